@@ -0,0 +1,296 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/net"
+)
+
+// configPath returns the path of the config file of crane, given by the
+// CRANE_CONFIG environment variable or ~/.crane/config.
+func configPath() string {
+	if path := os.Getenv("CRANE_CONFIG"); path != "" {
+		return path
+	}
+	return cmd.JoinWithUserDir(".crane", "config")
+}
+
+// readConfigSection reads a section of the config file, which has the format
+// of INI files:
+//
+//	# comment
+//	[aliases]
+//	st = instance-status --watch 5s
+//
+// A missing config file has empty sections.
+func readConfigSection(path, section string) (map[string]string, error) {
+	values := map[string]string{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var current string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("%s:%d: invalid section %q", path, n, line)
+			}
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value, got %q", path, n, line)
+		}
+		if current != section {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key %q in [%s]", path, n, key, section)
+		}
+		values[key] = strings.TrimSpace(line[i+1:])
+	}
+	return values, scanner.Err()
+}
+
+// splitCommandLine splits the command line in steps, separated by "&&", of
+// words, separated by spaces. Words may be quoted with single or double
+// quotes, and characters may be escaped with a backslash outside of single
+// quotes.
+func splitCommandLine(line string) ([][]string, error) {
+	var (
+		steps  [][]string
+		words  []string
+		word   []rune
+		inWord bool
+		quote  rune
+		escape bool
+	)
+	endWord := func() {
+		if inWord {
+			words = append(words, string(word))
+		}
+		word, inWord = nil, false
+	}
+	endStep := func() error {
+		endWord()
+		if len(words) == 0 {
+			return errors.New("empty command")
+		}
+		steps = append(steps, words)
+		words = nil
+		return nil
+	}
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case escape:
+			word, inWord, escape = append(word, r), true, false
+		case r == '\\' && quote != '\'':
+			escape = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word = append(word, r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			endWord()
+		case r == '&' && !inWord && i+1 < len(runes) && runes[i+1] == '&':
+			if err := endStep(); err != nil {
+				return nil, err
+			}
+			i++
+		default:
+			word, inWord = append(word, r), true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escape {
+		return nil, errors.New("unterminated escape")
+	}
+	if err := endStep(); err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// aliasCommand is a command defined in the aliases section of the config
+// file: either an alias of a command line, or a macro running many command
+// lines in sequence. Like plugins, aliases are registered as commands so
+// they're listed by "crane help", but they're run by commandLookup.
+type aliasCommand struct {
+	name   string
+	value  string
+	steps  [][]string
+	lookup *commandLookup
+}
+
+func (c *aliasCommand) isMacro() bool {
+	return len(c.steps) > 1
+}
+
+func (c *aliasCommand) Info() *cmd.Info {
+	if c.isMacro() {
+		return &cmd.Info{
+			Name:  c.name,
+			Usage: c.name,
+			Desc: fmt.Sprintf(`Macro for %s
+
+The commands are run in sequence, stopping on the first error. The macro is
+defined in the aliases section of the config file.`, c.value),
+		}
+	}
+	return &cmd.Info{
+		Name:  c.name,
+		Usage: c.name + " [args...]",
+		Desc: fmt.Sprintf(`Alias for %s
+
+The arguments are appended to the command. The alias is defined in the aliases
+section of the config file.`, c.value),
+	}
+}
+
+func (c *aliasCommand) Run(context *cmd.Context, client *cmd.Client) error {
+	return c.lookup.runAlias(context, c, context.Args, client.Verbosity, nil)
+}
+
+// registerAliases registers the aliases as commands of the manager. Built-in
+// commands take precedence over aliases, which take precedence over plugins.
+// The aliases are all validated first: when one of them is invalid, none is
+// registered.
+func registerAliases(l *commandLookup, aliases map[string]string) error {
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	commands := make([]*aliasCommand, 0, len(names))
+	for _, name := range names {
+		if !pluginNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid alias name %q, it must start with a letter and contain only lower case letters, numbers and dashes", name)
+		}
+		steps, err := splitCommandLine(aliases[name])
+		if err != nil {
+			return fmt.Errorf("invalid alias %q: %s", name, err)
+		}
+		commands = append(commands, &aliasCommand{name: name, value: aliases[name], steps: steps, lookup: l})
+	}
+	for _, c := range commands {
+		if _, ok := l.manager.Commands[c.name]; !ok {
+			l.manager.Register(c)
+		}
+	}
+	return nil
+}
+
+// runAlias runs the steps of the alias, stopping on the first error. seen are
+// the aliases being run, which the alias must not refer to.
+func (l *commandLookup) runAlias(context *cmd.Context, alias *aliasCommand, args []string, verbosity int, seen []string) error {
+	if contains(seen, alias.name) {
+		return fmt.Errorf("the alias %q refers to itself: %s", alias.name, strings.Join(append(seen, alias.name), " -> "))
+	}
+	seen = append(seen, alias.name)
+	if !alias.isMacro() {
+		step := append(append([]string{}, alias.steps[0]...), args...)
+		return l.run(context, step, verbosity, seen)
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("the macro %q takes no arguments", alias.name)
+	}
+	// The output of the steps would be out of order if some went to the
+	// pager.
+	context.RawOutput()
+	for i, step := range alias.steps {
+		if err := l.run(context, step, verbosity, seen); err != nil {
+			if err != cmd.ErrAbortCommand {
+				fmt.Fprintf(context.Stderr, "Error: %s\n", strings.TrimSuffix(err.Error(), "\n"))
+			}
+			return fmt.Errorf("macro %q stopped at step %d of %d: %s", alias.name, i+1, len(alias.steps), strings.Join(step, " "))
+		}
+	}
+	return nil
+}
+
+// resetFlag sets the flag back to its default value. Slice flags append the
+// values they're set to, so they're emptied instead.
+func resetFlag(f *gnuflag.Flag) {
+	switch v := f.Value.(type) {
+	case *cmd.StringSliceFlag:
+		*v = nil
+	case cmd.StringSliceFlagWrapper:
+		*v.Dst = nil
+	default:
+		f.Value.Set(f.DefValue)
+	}
+}
+
+// run runs the command line, whose first word is the name of an alias, a
+// plugin or a built-in command, like Manager.Run does.
+func (l *commandLookup) run(context *cmd.Context, args []string, verbosity int, seen []string) error {
+	name := args[0]
+	command, ok := l.manager.Commands[name]
+	if !ok {
+		return fmt.Errorf("%q is not a command", name)
+	}
+	ctx := cmd.Context{Args: args[1:], Stdout: context.Stdout, Stderr: context.Stderr, Stdin: context.Stdin}
+	switch c := command.(type) {
+	case *aliasCommand:
+		return l.runAlias(&ctx, c, ctx.Args, verbosity, seen)
+	case *pluginCommand:
+		return runPlugin(&ctx, c.name, c.path, verbosity)
+	}
+	if flagged, ok := command.(cmd.FlaggedCommand); ok {
+		fs := flagged.Flags()
+		// Flags keep the values of previous runs of the command.
+		fs.VisitAll(resetFlag)
+		if fs.Lookup("help") == nil {
+			fs.Bool("help", false, "Display help and exit")
+		}
+		if fs.Lookup("h") == nil {
+			fs.Bool("h", false, "Display help and exit")
+		}
+		fs.SetOutput(ctx.Stderr)
+		if err := fs.Parse(true, ctx.Args); err != nil {
+			return err
+		}
+		if fs.Lookup("help").Value.String() == "true" || fs.Lookup("h").Value.String() == "true" {
+			command, ctx.Args = l.manager.Commands["help"], []string{name}
+		} else {
+			ctx.Args = fs.Args()
+		}
+	}
+	info := command.Info()
+	if n := len(ctx.Args); n < info.MinArgs || (info.MaxArgs > 0 && n > info.MaxArgs) {
+		return fmt.Errorf("wrong number of arguments for %q, usage: %s", name, info.Usage)
+	}
+	client := cmd.NewClient(net.Dial5FullUnlimitedClient, &ctx, l.manager)
+	client.Verbosity = verbosity
+	return command.Run(&ctx, client)
+}
@@ -0,0 +1,282 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+type echoCommand struct {
+	fs       *gnuflag.FlagSet
+	upper    bool
+	prefixes cmd.StringSliceFlag
+}
+
+func (c *echoCommand) Info() *cmd.Info {
+	return &cmd.Info{Name: "echo", Usage: "echo [--upper] <words>...", Desc: "Echoes the words.", MinArgs: 1}
+}
+
+func (c *echoCommand) Run(context *cmd.Context, client *cmd.Client) error {
+	line := strings.Join(append(append([]string{}, c.prefixes...), context.Args...), " ")
+	if c.upper {
+		line = strings.ToUpper(line)
+	}
+	fmt.Fprintln(context.Stdout, line)
+	return nil
+}
+
+func (c *echoCommand) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("echo", gnuflag.ExitOnError)
+		c.fs.BoolVar(&c.upper, "upper", false, "Echo in upper case")
+		c.fs.Var(&c.prefixes, "prefix", "Word echoed before the words (may be repeated)")
+	}
+	return c.fs
+}
+
+type failCommand struct{}
+
+func (c *failCommand) Info() *cmd.Info {
+	return &cmd.Info{Name: "fail", Usage: "fail", Desc: "Fails."}
+}
+
+func (c *failCommand) Run(context *cmd.Context, client *cmd.Client) error {
+	return errors.New("something went wrong")
+}
+
+// aliasManager returns a manager with the echo and fail commands and the
+// aliases.
+func aliasManager(c *check.C, stdout, stderr *bytes.Buffer, aliases map[string]string) (*cmd.Manager, *commandLookup) {
+	lookup := &commandLookup{args: []string{}}
+	m := cmd.NewManager("crane", version, header, stdout, stderr, os.Stdin, lookup.lookup)
+	lookup.manager = m
+	m.Register(&echoCommand{})
+	m.Register(&failCommand{})
+	err := registerAliases(lookup, aliases)
+	c.Assert(err, check.IsNil)
+	return m, lookup
+}
+
+func (s *S) TestReadConfigSection(c *check.C) {
+	path := filepath.Join(c.MkDir(), "config")
+	err := ioutil.WriteFile(path, []byte(`# crane config
+[other]
+st = something else
+
+[aliases]
+st = instance-status --watch 5s
+; a macro
+check = api-check mysqlapi.yaml && doc-verify mysqlapi docs.md
+`), 0644)
+	c.Assert(err, check.IsNil)
+	aliases, err := readConfigSection(path, "aliases")
+	c.Assert(err, check.IsNil)
+	c.Assert(aliases, check.DeepEquals, map[string]string{
+		"st":    "instance-status --watch 5s",
+		"check": "api-check mysqlapi.yaml && doc-verify mysqlapi docs.md",
+	})
+	aliases, err = readConfigSection(filepath.Join(c.MkDir(), "config"), "aliases")
+	c.Assert(err, check.IsNil)
+	c.Assert(aliases, check.DeepEquals, map[string]string{})
+}
+
+func (s *S) TestReadConfigSectionInvalid(c *check.C) {
+	path := filepath.Join(c.MkDir(), "config")
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"[aliases\n", `.*config:1: invalid section "\[aliases"`},
+		{"[aliases]\nst\n", `.*config:2: expected key = value, got "st"`},
+		{"[aliases]\nst = a\nst = b\n", `.*config:3: duplicate key "st" in \[aliases\]`},
+	}
+	for _, t := range tests {
+		err := ioutil.WriteFile(path, []byte(t.config), 0644)
+		c.Assert(err, check.IsNil)
+		_, err = readConfigSection(path, "aliases")
+		c.Assert(err, check.ErrorMatches, t.err)
+	}
+}
+
+func (s *S) TestConfigPath(c *check.C) {
+	defer os.Unsetenv("CRANE_CONFIG")
+	os.Setenv("CRANE_CONFIG", "/etc/crane.conf")
+	c.Assert(configPath(), check.Equals, "/etc/crane.conf")
+	os.Unsetenv("CRANE_CONFIG")
+	c.Assert(configPath(), check.Equals, cmd.JoinWithUserDir(".crane", "config"))
+}
+
+func (s *S) TestSplitCommandLine(c *check.C) {
+	tests := []struct {
+		line  string
+		steps [][]string
+		err   string
+	}{
+		{"instance-status --watch 5s", [][]string{{"instance-status", "--watch", "5s"}}, ""},
+		{"  a\tb  ", [][]string{{"a", "b"}}, ""},
+		{`a "b c" 'd "e"' f\ g ""`, [][]string{{"a", "b c", `d "e"`, "f g", ""}}, ""},
+		{"a && b c&&d", [][]string{{"a"}, {"b", "c&&d"}}, ""},
+		{`a "&&" b`, [][]string{{"a", "&&", "b"}}, ""},
+		{"", nil, "empty command"},
+		{"a && ", nil, "empty command"},
+		{"&& a", nil, "empty command"},
+		{`a "b`, nil, "unterminated \" quote"},
+		{`a \`, nil, "unterminated escape"},
+	}
+	for _, t := range tests {
+		steps, err := splitCommandLine(t.line)
+		if t.err != "" {
+			c.Check(err, check.ErrorMatches, t.err, check.Commentf(t.line))
+			continue
+		}
+		c.Check(err, check.IsNil, check.Commentf(t.line))
+		c.Check(steps, check.DeepEquals, t.steps, check.Commentf(t.line))
+	}
+}
+
+func (s *S) TestRegisterAliases(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	m, _ := aliasManager(c, &stdout, &stderr, map[string]string{
+		"st":   "instance-status --watch 5s",
+		"echo": "fail",
+		"all":  "echo a && echo b",
+	})
+	c.Assert(m.Commands["echo"], check.FitsTypeOf, &echoCommand{})
+	c.Assert(m.Commands["st"].Info().Desc, check.Matches, "(?s)Alias for instance-status --watch 5s\n.*")
+	c.Assert(m.Commands["all"].Info().Desc, check.Matches, "(?s)Macro for echo a && echo b\n.*")
+	var help bytes.Buffer
+	context := cmd.Context{Stdout: &help}
+	err := m.Commands["help"].Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(help.String(), check.Matches, `(?s).*  all +Macro for echo a && echo b\n.*  st +Alias for instance-status --watch 5s\n.*`)
+}
+
+func (s *S) TestRegisterAliasesInvalid(c *check.C) {
+	lookup := &commandLookup{manager: cmd.NewManager("crane", version, header, ioutil.Discard, ioutil.Discard, os.Stdin, nil)}
+	err := registerAliases(lookup, map[string]string{"St": "instance-status"})
+	c.Assert(err, check.ErrorMatches, `invalid alias name "St", .*`)
+	err = registerAliases(lookup, map[string]string{"st": `instance-status "mysqlapi`})
+	c.Assert(err, check.ErrorMatches, `invalid alias "st": unterminated " quote`)
+	err = registerAliases(lookup, map[string]string{"a": "instance-list", "z": `instance-status "mysqlapi`})
+	c.Assert(err, check.ErrorMatches, `invalid alias "z": unterminated " quote`)
+	_, ok := lookup.manager.Commands["a"]
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *S) TestAliasLookup(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	m, _ := aliasManager(c, &stdout, &stderr, map[string]string{"shout": "echo --upper hello"})
+	m.Run([]string{"shout", "world"})
+	c.Assert(stderr.String(), check.Equals, "")
+	c.Assert(stdout.String(), check.Equals, "HELLO WORLD\n")
+}
+
+func (s *S) TestAliasRunFlagsAreReset(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	_, lookup := aliasManager(c, &stdout, &stderr, nil)
+	context := cmd.Context{Stdout: &stdout, Stderr: &stderr}
+	err := lookup.run(&context, []string{"echo", "--upper", "--prefix", "x", "--prefix", "y", "a"}, 0, nil)
+	c.Assert(err, check.IsNil)
+	err = lookup.run(&context, []string{"echo", "b"}, 0, nil)
+	c.Assert(err, check.IsNil)
+	err = lookup.run(&context, []string{"echo", "--prefix", "z", "c"}, 0, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "X Y A\nb\nz c\n")
+}
+
+func (s *S) TestAliasRunHelp(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	_, lookup := aliasManager(c, &stdout, &stderr, nil)
+	context := cmd.Context{Stdout: &stdout, Stderr: &stderr}
+	err := lookup.run(&context, []string{"echo", "-h"}, 0, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*Usage: crane echo \[--upper\] <words>\.\.\..*`)
+}
+
+func (s *S) TestAliasRunWrongArguments(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	_, lookup := aliasManager(c, &stdout, &stderr, nil)
+	context := cmd.Context{Stdout: &stdout, Stderr: &stderr}
+	err := lookup.run(&context, []string{"echo"}, 0, nil)
+	c.Assert(err, check.ErrorMatches, `wrong number of arguments for "echo", usage: echo \[--upper\] <words>\.\.\.`)
+	err = lookup.run(&context, []string{"ehco"}, 0, nil)
+	c.Assert(err, check.ErrorMatches, `"ehco" is not a command`)
+}
+
+func (s *S) TestMacroStopsOnFirstError(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	_, lookup := aliasManager(c, &stdout, &stderr, map[string]string{"all": "echo a && fail && echo c"})
+	context := cmd.Context{Args: []string{"all"}, Stdout: &stdout, Stderr: &stderr}
+	err := lookup.lookup(&context)
+	c.Assert(err, check.Equals, cmd.ErrAbortCommand)
+	c.Assert(stdout.String(), check.Equals, "a\n")
+	c.Assert(stderr.String(), check.Equals, `Error: something went wrong
+Error: macro "all" stopped at step 2 of 3: fail
+`)
+}
+
+func (s *S) TestMacroNested(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	_, lookup := aliasManager(c, &stdout, &stderr, map[string]string{
+		"shout": "echo --upper",
+		"all":   "shout a && echo b && shout c d",
+	})
+	context := cmd.Context{Args: []string{"all"}, Stdout: &stdout, Stderr: &stderr}
+	err := lookup.lookup(&context)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "A\nb\nC D\n")
+	c.Assert(stderr.String(), check.Equals, "")
+}
+
+func (s *S) TestMacroArguments(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	_, lookup := aliasManager(c, &stdout, &stderr, map[string]string{"all": "echo a && echo b"})
+	context := cmd.Context{Args: []string{"all", "c"}, Stdout: &stdout, Stderr: &stderr}
+	err := lookup.lookup(&context)
+	c.Assert(err, check.Equals, cmd.ErrAbortCommand)
+	c.Assert(stdout.String(), check.Equals, "")
+	c.Assert(stderr.String(), check.Equals, "Error: the macro \"all\" takes no arguments\n")
+}
+
+func (s *S) TestAliasLoop(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	_, lookup := aliasManager(c, &stdout, &stderr, map[string]string{"a": "b x", "b": "a y"})
+	context := cmd.Context{Args: []string{"a"}, Stdout: &stdout, Stderr: &stderr}
+	err := lookup.lookup(&context)
+	c.Assert(err, check.Equals, cmd.ErrAbortCommand)
+	c.Assert(stderr.String(), check.Equals, "Error: the alias \"a\" refers to itself: a -> b -> a\n")
+}
+
+func (s *S) TestAliasOfPlugin(c *check.C) {
+	dir := c.MkDir()
+	writePlugin(c, dir, "crane-deploy", pluginScript, 0755)
+	var stdout, stderr bytes.Buffer
+	m, lookup := aliasManager(c, &stdout, &stderr, map[string]string{"d": "deploy --force"})
+	registerPlugins(m, []string{dir})
+	lookup.args = []string{"-v", "2", "d", "myapp"}
+	context := cmd.Context{Args: []string{"d", "myapp"}, Stdout: &stdout, Stderr: &stderr}
+	err := lookup.lookup(&context)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s)args: --force myapp\nname: deploy\n.*verbosity: 2\n`)
+}
+
+func (s *S) TestBuildManagerLoadsAliases(c *check.C) {
+	path := filepath.Join(c.MkDir(), "config")
+	err := ioutil.WriteFile(path, []byte("[aliases]\nst = instance-status --watch 5s\ninstance-list = api-check\n"), 0644)
+	c.Assert(err, check.IsNil)
+	m := buildManager("crane", path, nil)
+	c.Assert(m.Commands["st"], check.FitsTypeOf, &aliasCommand{})
+	c.Assert(m.Commands["instance-list"], check.FitsTypeOf, &instanceList{})
+}
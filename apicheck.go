@@ -0,0 +1,381 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+const (
+	checkPassed  = "ok"
+	checkFailed  = "failed"
+	checkSkipped = "skipped"
+)
+
+// checkResult is the result of checking one step of the lifecycle of a
+// service instance against the contract of the services API.
+type checkResult struct {
+	name    string
+	result  string
+	details string
+}
+
+// apiChecker drives a full lifecycle of a service instance against a service
+// API, checking every response.
+type apiChecker struct {
+	api        *serviceAPI
+	instance   string
+	plan       string
+	team       string
+	appName    string
+	appHost    string
+	unitHost   string
+	expectVars []string
+
+	// statusTimeout is how long to wait for a new instance to be ready,
+	// checking its status every statusInterval.
+	statusTimeout  time.Duration
+	statusInterval time.Duration
+
+	results []checkResult
+}
+
+func (k *apiChecker) run() []checkResult {
+	k.step("list plans", k.checkPlans)
+	k.step("reject invalid credentials", k.checkAuthentication)
+	k.step("status of unknown instance", k.checkUnknownStatus)
+	if !k.step("create instance", k.checkCreate) {
+		k.skip("instance status", "bind app", "bind unit", "unbind unit", "unbind app", "remove instance", "remove instance again")
+		return k.results
+	}
+	k.step("instance status", k.checkStatus)
+	if k.step("bind app", k.checkBindApp) {
+		if k.step("bind unit", k.checkBindUnit) {
+			k.step("unbind unit", k.checkUnbindUnit)
+		} else {
+			k.skip("unbind unit")
+		}
+		k.step("unbind app", k.checkUnbindApp)
+	} else {
+		k.skip("bind unit", "unbind unit", "unbind app")
+	}
+	if k.step("remove instance", k.checkRemove) {
+		k.step("remove instance again", k.checkRemoveAgain)
+	} else {
+		k.skip("remove instance again")
+	}
+	return k.results
+}
+
+// step runs a check, recording its result. Checks return the details of the
+// response, and an error describing the contract violation, if any.
+func (k *apiChecker) step(name string, check func() (string, error)) bool {
+	details, err := check()
+	if err != nil {
+		k.results = append(k.results, checkResult{name: name, result: checkFailed, details: err.Error()})
+		return false
+	}
+	k.results = append(k.results, checkResult{name: name, result: checkPassed, details: details})
+	return true
+}
+
+func (k *apiChecker) skip(names ...string) {
+	for _, name := range names {
+		k.results = append(k.results, checkResult{name: name, result: checkSkipped})
+	}
+}
+
+func (k *apiChecker) checkPlans() (string, error) {
+	resp, err := k.api.plans()
+	if err := expectStatus(resp, err, http.StatusOK); err != nil {
+		return "", err
+	}
+	var plans []struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := json.Unmarshal(resp.body, &plans); err != nil {
+		return "", fmt.Errorf("the response must be a JSON list of plans: %s", err)
+	}
+	var names []string
+	for i, p := range plans {
+		if p.Name == "" {
+			return "", fmt.Errorf("the plan #%d has no name", i+1)
+		}
+		names = append(names, p.Name)
+	}
+	if k.plan == "" && len(names) > 0 {
+		k.plan = names[0]
+	}
+	if k.plan != "" && len(names) > 0 && !contains(names, k.plan) {
+		return "", fmt.Errorf("the plan %q is not in the list of plans", k.plan)
+	}
+	return fmt.Sprintf("%s, %d plan(s)", describe(resp), len(plans)), nil
+}
+
+func (k *apiChecker) checkAuthentication() (string, error) {
+	api := *k.api
+	api.password += "-invalid"
+	resp, err := api.plans()
+	return details(resp, expectStatus(resp, err, http.StatusUnauthorized))
+}
+
+func (k *apiChecker) checkUnknownStatus() (string, error) {
+	resp, err := k.api.instanceStatus(k.instance + "-unknown")
+	return details(resp, expectStatus(resp, err, http.StatusNotFound))
+}
+
+func (k *apiChecker) checkCreate() (string, error) {
+	resp, err := k.api.createInstance(k.instance, k.plan, k.team)
+	return details(resp, expectStatus(resp, err, http.StatusCreated))
+}
+
+// checkStatus waits for the instance to be ready. Pending instances return
+// 202, ready instances return 204.
+func (k *apiChecker) checkStatus() (string, error) {
+	deadline := time.Now().Add(k.statusTimeout)
+	for {
+		resp, err := k.api.instanceStatus(k.instance)
+		if err := expectStatus(resp, err, http.StatusNoContent, http.StatusAccepted); err != nil {
+			return "", err
+		}
+		if resp.status == http.StatusNoContent {
+			return describe(resp), nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("the instance is still pending after %s", k.statusTimeout)
+		}
+		time.Sleep(k.statusInterval)
+	}
+}
+
+func (k *apiChecker) checkBindApp() (string, error) {
+	resp, err := k.api.bindApp(k.instance, k.appName, k.appHost)
+	if err := expectStatus(resp, err, http.StatusCreated); err != nil {
+		return "", err
+	}
+	var envs map[string]string
+	if err := json.Unmarshal(resp.body, &envs); err != nil {
+		return "", fmt.Errorf("the response must be a JSON object with the environment variables of the app: %s", err)
+	}
+	if len(envs) == 0 {
+		return "", errors.New("the response does not include any environment variables")
+	}
+	var missing []string
+	for _, name := range k.expectVars {
+		if _, ok := envs[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing environment variables in the response: %s", strings.Join(missing, ", "))
+	}
+	var names []string
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("%s, variables: %s", describe(resp), strings.Join(names, ", ")), nil
+}
+
+func (k *apiChecker) checkBindUnit() (string, error) {
+	resp, err := k.api.bindUnit(k.instance, k.appHost, k.unitHost)
+	return details(resp, expectStatus(resp, err, http.StatusCreated, http.StatusOK))
+}
+
+func (k *apiChecker) checkUnbindUnit() (string, error) {
+	resp, err := k.api.unbindUnit(k.instance, k.appHost, k.unitHost)
+	return details(resp, expectStatus(resp, err, http.StatusOK))
+}
+
+func (k *apiChecker) checkUnbindApp() (string, error) {
+	resp, err := k.api.unbindApp(k.instance, k.appName, k.appHost)
+	return details(resp, expectStatus(resp, err, http.StatusOK))
+}
+
+func (k *apiChecker) checkRemove() (string, error) {
+	resp, err := k.api.removeInstance(k.instance)
+	return details(resp, expectStatus(resp, err, http.StatusOK))
+}
+
+// checkRemoveAgain checks that removing an instance is idempotent: removing it
+// again must succeed, or report that the instance does not exist.
+func (k *apiChecker) checkRemoveAgain() (string, error) {
+	resp, err := k.api.removeInstance(k.instance)
+	return details(resp, expectStatus(resp, err, http.StatusOK, http.StatusNotFound))
+}
+
+// expectStatus checks that the call succeeded with one of the given status
+// codes.
+func expectStatus(resp *apiResponse, err error, expected ...int) error {
+	if err != nil {
+		return err
+	}
+	for _, status := range expected {
+		if resp.status == status {
+			return nil
+		}
+	}
+	var codes []string
+	for _, status := range expected {
+		codes = append(codes, strconv.Itoa(status))
+	}
+	msg := fmt.Sprintf("expected status %s, got %d", strings.Join(codes, " or "), resp.status)
+	if body := strings.TrimSpace(string(resp.body)); body != "" {
+		if len(body) > 100 {
+			body = body[:100] + "..."
+		}
+		msg += ": " + body
+	}
+	return errors.New(msg)
+}
+
+func details(resp *apiResponse, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	return describe(resp), nil
+}
+
+func describe(resp *apiResponse) string {
+	return fmt.Sprintf("%d %s in %s", resp.status, http.StatusText(resp.status), resp.duration/time.Millisecond*time.Millisecond)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type apiCheck struct {
+	fs         *gnuflag.FlagSet
+	manifest   string
+	env        string
+	plan       string
+	team       string
+	instance   string
+	timeout    time.Duration
+	expectVars cmd.StringSliceFlag
+	strict     bool
+}
+
+func (c *apiCheck) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "api-check",
+		Usage: "api-check <endpoint> [-m/--manifest <manifest-file.yaml>] [-e/--env <environment>] [--plan <plan>] [--team <team>] [--instance <name>] [--expect-var <name>]... [--timeout <duration>] [--strict]",
+		Desc: `Checks that a service API conforms to the tsuru services API.
+
+A full lifecycle of a service instance is driven against the given endpoint,
+as tsuru would do it: the plans are listed, an instance is created, its status
+is checked, it's bound to a fake app and unit, unbound and removed. Every
+response is checked against the contract of the services API, like the status
+codes and the environment variables returned when binding an app. Removing the
+instance twice must not fail.
+
+The endpoint may be a URL or the name of an endpoint in the manifest, like
+"production". The credentials of the service are taken from the manifest, which
+defaults to "manifest.yaml".
+
+With the --strict flag, every request and response is also validated against
+the OpenAPI document of the services API (see "api-spec"), and any violation
+fails the check.
+
+A summary of the checks is displayed, and the command fails if any check
+fails.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *apiCheck) Run(context *cmd.Context, client *cmd.Client) error {
+	path := c.manifest
+	if path == "" {
+		path = "manifest.yaml"
+	}
+	m, err := loadManifest(path, c.env, true)
+	if err != nil {
+		return err
+	}
+	endpoint := resolveEndpoint(m, context.Args[0])
+	instance := c.instance
+	if instance == "" {
+		instance = "crane-check-" + strconv.FormatInt(time.Now().Unix(), 36)
+	}
+	team := c.team
+	if team == "" {
+		team = "crane"
+	}
+	timeout := c.timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	api := newServiceAPI(endpoint, m)
+	if c.strict {
+		api.validator = servicesAPIValidator
+	}
+	checker := apiChecker{
+		api:            api,
+		instance:       instance,
+		plan:           c.plan,
+		team:           team,
+		appName:        instance + "-app",
+		appHost:        instance + "-app.example.com",
+		unitHost:       "10.0.0.1",
+		expectVars:     c.expectVars,
+		statusTimeout:  timeout,
+		statusInterval: time.Second,
+	}
+	results := checker.run()
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"Check", "Result", "Details"}
+	var passed, failed, skipped int
+	for _, r := range results {
+		table.AddRow(cmd.Row{r.name, r.result, r.details})
+		switch r.result {
+		case checkPassed:
+			passed++
+		case checkFailed:
+			failed++
+		default:
+			skipped++
+		}
+	}
+	context.Stdout.Write(table.Bytes())
+	fmt.Fprintf(context.Stdout, "%d passed, %d failed, %d skipped.\n", passed, failed, skipped)
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+func (c *apiCheck) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("api-check", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.manifest, "manifest", "", "Manifest file with the credentials of the service (default: manifest.yaml)")
+		c.fs.StringVar(&c.manifest, "m", "", "Manifest file with the credentials of the service (default: manifest.yaml)")
+		c.fs.StringVar(&c.env, "env", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.StringVar(&c.env, "e", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.StringVar(&c.plan, "plan", "", "Plan of the instance (default: the first plan of the service)")
+		c.fs.StringVar(&c.team, "team", "", "Team of the instance (default: crane)")
+		c.fs.StringVar(&c.instance, "instance", "", "Name of the instance (default: a new crane-check-* name)")
+		c.fs.DurationVar(&c.timeout, "timeout", time.Minute, "How long to wait for the instance to be ready")
+		c.fs.Var(&c.expectVars, "expect-var", "Environment variable that must be returned when binding an app (may be repeated)")
+		c.fs.BoolVar(&c.strict, "strict", false, "Validate requests and responses against the OpenAPI document of the services API")
+	}
+	return c.fs
+}
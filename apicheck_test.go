@@ -0,0 +1,171 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func newTestChecker(fake *fakeServiceAPI) *apiChecker {
+	return &apiChecker{
+		api:            newServiceAPI(fake.server.URL, fake.manifest()),
+		instance:       "crane-check",
+		team:           "admin",
+		appName:        "crane-check-app",
+		appHost:        "crane-check-app.example.com",
+		unitHost:       "10.0.0.1",
+		statusTimeout:  10 * time.Millisecond,
+		statusInterval: time.Millisecond,
+	}
+}
+
+func resultsByName(results []checkResult) map[string]string {
+	m := map[string]string{}
+	for _, r := range results {
+		m[r.name] = r.result
+	}
+	return m
+}
+
+func (s *S) TestAPICheckerConformingAPI(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	checker := newTestChecker(fake)
+	checker.expectVars = []string{"MYSQL_HOST"}
+	results := checker.run()
+	c.Assert(results, check.HasLen, 11)
+	for _, r := range results {
+		c.Check(r.result, check.Equals, checkPassed, check.Commentf("%s: %s", r.name, r.details))
+	}
+	c.Assert(checker.plan, check.Equals, "small")
+	c.Assert(results[5].details, check.Matches, "201 Created in .*, variables: MYSQL_HOST, MYSQL_USER")
+	c.Assert(fake.instances, check.HasLen, 0)
+}
+
+func (s *S) TestAPICheckerWrongStatus(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	fake.overrides["DELETE /resources/{name}/bind"] = http.StatusInternalServerError
+	results := newTestChecker(fake).run()
+	c.Assert(resultsByName(results)["unbind unit"], check.Equals, checkFailed)
+	c.Assert(results[7].details, check.Equals, "expected status 200, got 500")
+	c.Assert(resultsByName(results)["remove instance again"], check.Equals, checkPassed)
+}
+
+func (s *S) TestAPICheckerMissingEnvs(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	checker := newTestChecker(fake)
+	checker.expectVars = []string{"MYSQL_HOST", "MYSQL_PASSWORD", "MYSQL_PORT"}
+	results := checker.run()
+	c.Assert(results[5].result, check.Equals, checkFailed)
+	c.Assert(results[5].details, check.Equals, "missing environment variables in the response: MYSQL_PASSWORD, MYSQL_PORT")
+	byName := resultsByName(results)
+	c.Assert(byName["bind unit"], check.Equals, checkSkipped)
+	c.Assert(byName["unbind app"], check.Equals, checkSkipped)
+	c.Assert(byName["remove instance"], check.Equals, checkPassed)
+	fake.envs = map[string]string{}
+	results = newTestChecker(fake).run()
+	c.Assert(results[5].details, check.Equals, "the response does not include any environment variables")
+}
+
+func (s *S) TestAPICheckerNonIdempotentRemove(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	fake.overrides["DELETE /resources/{name}"] = http.StatusOK
+	results := newTestChecker(fake).run()
+	c.Assert(resultsByName(results)["remove instance again"], check.Equals, checkPassed)
+	fake.overrides = map[string]int{}
+	checker := newTestChecker(fake)
+	checker.api.client.Transport = &removeTwiceTransport{}
+	results = checker.run()
+	c.Assert(results[10].result, check.Equals, checkFailed)
+	c.Assert(results[10].details, check.Equals, "expected status 200 or 404, got 500")
+}
+
+// removeTwiceTransport fails when an instance is removed again.
+type removeTwiceTransport struct {
+	removed bool
+}
+
+func (t *removeTwiceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "DELETE" && req.URL.Path == "/resources/crane-check" {
+		if t.removed {
+			return &http.Response{StatusCode: http.StatusInternalServerError, Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+		}
+		t.removed = true
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (s *S) TestAPICheckerCreateFailureSkipsLifecycle(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	fake.overrides["POST /resources"] = http.StatusInternalServerError
+	results := newTestChecker(fake).run()
+	c.Assert(results[3].result, check.Equals, checkFailed)
+	for _, r := range results[4:] {
+		c.Check(r.result, check.Equals, checkSkipped)
+	}
+}
+
+func (s *S) TestAPICheckerPendingInstance(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	fake.overrides["GET /resources/{name}/status"] = http.StatusAccepted
+	results := newTestChecker(fake).run()
+	c.Assert(results[4].result, check.Equals, checkFailed)
+	c.Assert(results[4].details, check.Equals, "the instance is still pending after 10ms")
+}
+
+func (s *S) TestAPICheckerAcceptsAnyCredentials(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	fake.overrides["GET /resources/plans"] = http.StatusOK
+	results := newTestChecker(fake).run()
+	c.Assert(results[1].name, check.Equals, "reject invalid credentials")
+	c.Assert(results[1].result, check.Equals, checkFailed)
+}
+
+func (s *S) TestAPICheckRun(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	path := filepath.Join(c.MkDir(), "manifest.yaml")
+	data := "id: mysqlapi\npassword: s3cr3t\nendpoint:\n  production: " + fake.server.URL + "\n"
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"production"}, Stdout: &stdout}
+	command := apiCheck{}
+	command.Flags().Parse(true, []string{"-m", path, "--instance", "mydb"})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s)\+-+\+.*\| Check +\| Result +\| Details +\|.*`+
+		`\| create instance +\| ok +\| 201 Created in .*11 passed, 0 failed, 0 skipped.\n$`)
+	c.Assert(fake.requests[3], check.Equals, "POST /resources")
+}
+
+func (s *S) TestAPICheckRunFailure(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	fake.overrides["DELETE /resources/{name}/bind-app"] = http.StatusNoContent
+	path := filepath.Join(c.MkDir(), "manifest.yaml")
+	err := ioutil.WriteFile(path, []byte("id: mysqlapi\npassword: s3cr3t\nendpoint:\n  production: mysqlapi.com\n"), 0600)
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{fake.server.URL}, Stdout: &stdout}
+	command := apiCheck{}
+	command.Flags().Parse(true, []string{"--manifest", path})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `1 check\(s\) failed`)
+	c.Assert(stdout.String(), check.Matches, `(?s).*\| unbind app +\| failed +\| expected status 200, got 204 +\|.*10 passed, 1 failed, 0 skipped.\n$`)
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+type serviceApply struct {
+	fs  *gnuflag.FlagSet
+	env string
+}
+
+func (c *serviceApply) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "apply",
+		Usage: "apply <manifest-file.yaml|plan-file.json> [-e/--env <environment>]",
+		Desc: `Creates or updates a service so it matches the given manifest file.
+
+The current definition of the service is fetched from the target and compared
+with the manifest. If the service does not exist, it is created. If it exists
+and differs from the manifest, it is updated. Running apply again with the same
+manifest does not change anything.
+
+When a plan file saved by the "plan" command is given, apply executes exactly
+the changes in the plan. It refuses to do so if the service changed in the
+target since the plan was made. Plan files never include the password of the
+service, so applying a plan keeps the current password, and plans creating the
+service are refused: apply the manifest to create it.
+
+When an environment is given, the overlay file of the environment is merged
+over the manifest: for "manifest.yml" and the environment "prod", the overlay
+file is "manifest.prod.yml". Values in the manifest may reference environment
+variables, like ${DB_PASSWORD}, and files, like ${file:secrets/password}.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *serviceApply) Run(context *cmd.Context, client *cmd.Client) error {
+	var (
+		p        *changePlan
+		password string
+		err      error
+	)
+	if filepath.Ext(context.Args[0]) == ".json" {
+		if c.env != "" {
+			return errors.New("the environment can't be changed when applying a plan file")
+		}
+		p, err = readPlan(context.Args[0])
+		if err == nil && p.Create {
+			// The service would be created without a password.
+			return fmt.Errorf("the plan creates the service %q, but plan files don't include its password: apply the manifest instead", p.Service)
+		}
+	} else {
+		var m *manifest
+		m, err = loadManifest(context.Args[0], c.env, true)
+		if err == nil {
+			password = m.Password
+			p, err = makePlan(client, m)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	p.write(context.Stdout)
+	if p.upToDate() {
+		return nil
+	}
+	err = p.execute(client, password)
+	if err != nil {
+		return err
+	}
+	if p.Create {
+		fmt.Fprintf(context.Stdout, "Service %q successfully created.\n", p.Service)
+	} else {
+		fmt.Fprintf(context.Stdout, "Service %q successfully updated.\n", p.Service)
+	}
+	return nil
+}
+
+func (c *serviceApply) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("apply", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.env, "env", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.StringVar(&c.env, "e", "", "Environment whose overlay file is merged over the manifest")
+	}
+	return c.fs
+}
@@ -0,0 +1,209 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestServiceApplyCreatesService(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Args:   []string{"testdata/manifest-full.yml"},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	err := (&serviceApply{}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Service "mysqlapi" will be created.
+Service "mysqlapi" successfully created.
+`
+	c.Assert(stdout.String(), check.Equals, expected)
+	c.Assert(target.services["mysqlapi"], check.DeepEquals, &service{
+		Name:       "mysqlapi",
+		Endpoint:   map[string]string{"production": "mysqlapi.com"},
+		OwnerTeams: []string{"admin"},
+	})
+	doc, err := ioutil.ReadFile("testdata/doc.txt")
+	c.Assert(err, check.IsNil)
+	c.Assert(target.docs["mysqlapi"], check.Equals, string(doc))
+}
+
+func (s *S) TestServiceApplyUpdatesService(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	target.services["mysqlapi"] = &service{
+		Name:     "mysqlapi",
+		Endpoint: map[string]string{"production": "old.mysqlapi.com"},
+	}
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Args:   []string{"testdata/manifest.yml"},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	err := (&serviceApply{}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `~ endpoint.production: old.mysqlapi.com => mysqlapi.com
+Service "mysqlapi" successfully updated.
+`
+	c.Assert(stdout.String(), check.Equals, expected)
+	c.Assert(target.services["mysqlapi"].Endpoint, check.DeepEquals, map[string]string{"production": "mysqlapi.com"})
+	c.Assert(target.requests[len(target.requests)-1], check.Equals, "PUT /1.0/services/mysqlapi")
+}
+
+func (s *S) TestServiceApplyUpToDate(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	target.services["mysqlapi"] = &service{
+		Name:     "mysqlapi",
+		Endpoint: map[string]string{"production": "mysqlapi.com"},
+	}
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Args:   []string{"testdata/manifest.yml"},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	err := (&serviceApply{}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Service \"mysqlapi\" is up to date.\n")
+	for _, r := range target.requests {
+		c.Assert(r, check.Matches, "GET .*")
+	}
+}
+
+func (s *S) TestServiceApplyIsIdempotent(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"testdata/manifest-full.yml"}, Stdout: &stdout}
+	err := (&serviceApply{}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	target.plans["mysqlapi"] = []plan{{Name: "small"}}
+	stdout.Reset()
+	err = (&serviceApply{}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Service \"mysqlapi\" is up to date.\n")
+}
+
+func (s *S) TestServiceApplyPlanFile(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	target.services["mysqlapi"] = &service{
+		Name:     "mysqlapi",
+		Endpoint: map[string]string{"production": "old.mysqlapi.com"},
+	}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	m, err := readManifest("testdata/manifest.yml")
+	c.Assert(err, check.IsNil)
+	p, err := makePlan(client, m)
+	c.Assert(err, check.IsNil)
+	planFile := filepath.Join(c.MkDir(), "plan.json")
+	err = writePlan(planFile, p)
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{planFile}, Stdout: &stdout}
+	err = (&serviceApply{}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(target.services["mysqlapi"].Endpoint, check.DeepEquals, map[string]string{"production": "mysqlapi.com"})
+}
+
+func (s *S) TestServiceApplyPlanFileDrifted(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	target.services["mysqlapi"] = &service{
+		Name:     "mysqlapi",
+		Endpoint: map[string]string{"production": "old.mysqlapi.com"},
+	}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	m, err := readManifest("testdata/manifest.yml")
+	c.Assert(err, check.IsNil)
+	p, err := makePlan(client, m)
+	c.Assert(err, check.IsNil)
+	planFile := filepath.Join(c.MkDir(), "plan.json")
+	err = writePlan(planFile, p)
+	c.Assert(err, check.IsNil)
+	target.services["mysqlapi"].Endpoint["production"] = "other.mysqlapi.com"
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{planFile}, Stdout: &stdout}
+	err = (&serviceApply{}).Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `the service "mysqlapi" has changed since the plan was made, please make a new plan`)
+	c.Assert(target.services["mysqlapi"].Endpoint, check.DeepEquals, map[string]string{"production": "other.mysqlapi.com"})
+}
+
+func (s *S) TestServiceApplyPlanFileCreate(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	m, err := readManifest("testdata/manifest-v2.yml")
+	c.Assert(err, check.IsNil)
+	p, err := makePlan(client, m)
+	c.Assert(err, check.IsNil)
+	c.Assert(p.Create, check.Equals, true)
+	planFile := filepath.Join(c.MkDir(), "plan.json")
+	err = writePlan(planFile, p)
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{planFile}, Stdout: &stdout}
+	err = (&serviceApply{}).Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `the plan creates the service "mysqlapi", but plan files don't include its password: apply the manifest instead`)
+	c.Assert(target.services, check.HasLen, 0)
+	for _, r := range target.requests {
+		c.Assert(r, check.Matches, "GET .*")
+	}
+}
+
+func (s *S) TestServiceApplyInvalidManifest(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Args:   []string{"testdata/unknown.yml"},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	err := (&serviceApply{}).Run(&context, client)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestServiceApplyWithEnvironment(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Args:   []string{"testdata/manifest-env.yml"},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	command := serviceApply{}
+	command.Flags().Parse(true, []string{"--env", "prod"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(target.services["mysqlapi"].Endpoint, check.DeepEquals, map[string]string{
+		"production": "https://mysqlapi.prod.example.com",
+	})
+	c.Assert(target.services["mysqlapi"].Description, check.Equals, "MySQL databases, $5 a month")
+}
+
+func (s *S) TestServiceApplyPlanWithEnvironment(c *check.C) {
+	context := cmd.Context{Args: []string{"plan.json"}}
+	command := serviceApply{}
+	command.Flags().Parse(true, []string{"-e", "prod"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "the environment can't be changed when applying a plan file")
+}
@@ -0,0 +1,374 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// benchSteps are the steps of each cycle of the benchmark, in order.
+var benchSteps = []string{"create", "bind", "unbind", "remove"}
+
+// benchmark runs concurrent cycles of the lifecycle of service instances
+// against a service API: each cycle creates an instance, binds it to an app,
+// unbinds it and removes it.
+type benchmark struct {
+	api         *serviceAPI
+	prefix      string
+	plan        string
+	team        string
+	concurrency int
+
+	// cycles is the number of cycles to run. When duration is set, cycles
+	// keep being started until it's over, up to cycles, if it's positive.
+	cycles   int
+	duration time.Duration
+
+	mu    sync.Mutex
+	steps map[string]*stepStats
+}
+
+// stepStats are the measurements of one step of the benchmark.
+type stepStats struct {
+	latencies []time.Duration
+	errors    int
+	failures  map[string]int
+}
+
+func (b *benchmark) run() *benchReport {
+	b.steps = map[string]*stepStats{}
+	for _, name := range benchSteps {
+		b.steps[name] = &stepStats{failures: map[string]int{}}
+	}
+	start := time.Now()
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		deadline := start.Add(b.duration)
+		for i := 0; b.cycles <= 0 || i < b.cycles; i++ {
+			if b.duration > 0 && time.Now().After(deadline) {
+				return
+			}
+			jobs <- i
+		}
+	}()
+	var (
+		wg     sync.WaitGroup
+		failed int
+		total  int
+	)
+	for i := 0; i < b.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				ok := b.cycle(fmt.Sprintf("%s-%d", b.prefix, n))
+				b.mu.Lock()
+				total++
+				if !ok {
+					failed++
+				}
+				b.mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return b.report(total, failed, time.Since(start))
+}
+
+// cycle runs one cycle of the benchmark, returning whether all of its steps
+// succeeded. The instance is removed even if binding or unbinding it fails.
+func (b *benchmark) cycle(instance string) bool {
+	appName := instance + "-app"
+	appHost := appName + ".example.com"
+	if !b.measure("create", http.StatusCreated, func() (*apiResponse, error) {
+		return b.api.createInstance(instance, b.plan, b.team)
+	}) {
+		return false
+	}
+	ok := b.measure("bind", http.StatusCreated, func() (*apiResponse, error) {
+		return b.api.bindApp(instance, appName, appHost)
+	})
+	if ok {
+		ok = b.measure("unbind", http.StatusOK, func() (*apiResponse, error) {
+			return b.api.unbindApp(instance, appName, appHost)
+		})
+	}
+	removed := b.measure("remove", http.StatusOK, func() (*apiResponse, error) {
+		return b.api.removeInstance(instance)
+	})
+	return ok && removed
+}
+
+func (b *benchmark) measure(step string, expected int, call func() (*apiResponse, error)) bool {
+	start := time.Now()
+	resp, err := call()
+	latency := time.Since(start)
+	if resp != nil {
+		latency = resp.duration
+	}
+	err = expectStatus(resp, err, expected)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := b.steps[step]
+	stats.latencies = append(stats.latencies, latency)
+	if err != nil {
+		stats.errors++
+		stats.failures[err.Error()]++
+	}
+	return err == nil
+}
+
+// benchReport is the result of a benchmark, as displayed with --json.
+type benchReport struct {
+	Cycles       int          `json:"cycles"`
+	FailedCycles int          `json:"failed_cycles"`
+	Concurrency  int          `json:"concurrency"`
+	Elapsed      float64      `json:"elapsed_seconds"`
+	Throughput   float64      `json:"cycles_per_second"`
+	Steps        []stepReport `json:"steps"`
+	elapsed      time.Duration
+}
+
+type stepReport struct {
+	Name      string         `json:"name"`
+	Requests  int            `json:"requests"`
+	Errors    int            `json:"errors"`
+	ErrorRate float64        `json:"error_rate"`
+	P50       float64        `json:"p50_ms"`
+	P90       float64        `json:"p90_ms"`
+	P99       float64        `json:"p99_ms"`
+	Max       float64        `json:"max_ms"`
+	Failures  map[string]int `json:"failures,omitempty"`
+}
+
+func (b *benchmark) report(total, failed int, elapsed time.Duration) *benchReport {
+	r := benchReport{
+		Cycles:       total,
+		FailedCycles: failed,
+		Concurrency:  b.concurrency,
+		Elapsed:      elapsed.Seconds(),
+		elapsed:      elapsed,
+	}
+	if elapsed > 0 {
+		r.Throughput = float64(total) / elapsed.Seconds()
+	}
+	for _, name := range benchSteps {
+		stats := b.steps[name]
+		latencies := durations(stats.latencies)
+		sort.Sort(latencies)
+		step := stepReport{
+			Name:     name,
+			Requests: len(latencies),
+			Errors:   stats.errors,
+			P50:      milliseconds(latencies.percentile(50)),
+			P90:      milliseconds(latencies.percentile(90)),
+			P99:      milliseconds(latencies.percentile(99)),
+			Max:      milliseconds(latencies.percentile(100)),
+		}
+		if len(latencies) > 0 {
+			step.ErrorRate = float64(stats.errors) / float64(len(latencies))
+		}
+		if len(stats.failures) > 0 {
+			step.Failures = stats.failures
+		}
+		r.Steps = append(r.Steps, step)
+	}
+	return &r
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// percentile returns the nearest-rank percentile of the sorted durations.
+func (d durations) percentile(p int) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	rank := (p*len(d) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return d[rank-1]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type apiBench struct {
+	fs          *gnuflag.FlagSet
+	manifest    string
+	env         string
+	plan        string
+	team        string
+	concurrency int
+	cycles      int
+	duration    time.Duration
+	json        bool
+	strict      bool
+}
+
+func (c *apiBench) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "api-bench",
+		Usage: "api-bench <endpoint> [-m/--manifest <manifest-file.yaml>] [-e/--env <environment>] [-c/--concurrency <n>] [-n/--cycles <n>] [-d/--duration <duration>] [--plan <plan>] [--team <team>] [--json] [--strict]",
+		Desc: `Benchmarks a service API under concurrent instance churn.
+
+Cycles of the lifecycle of a service instance are run concurrently against the
+given endpoint: each cycle creates an instance, binds it to an app, unbinds it
+and removes it. The service API is called directly, so no tsuru server is
+needed and the endpoint may be a local one.
+
+The endpoint may be a URL or the name of an endpoint in the manifest, like
+"production". The credentials of the service are taken from the manifest, which
+defaults to "manifest.yaml".
+
+By default, 100 cycles are run by 10 workers. With --duration, cycles keep
+being started until the duration is over, for soak testing; --cycles still
+limits the number of cycles, when given.
+
+With the --strict flag, every request and response is also validated against
+the OpenAPI document of the services API (see "api-spec"), and violations are
+counted as errors.
+
+The latency percentiles and the error rate of each step are displayed, along
+with the throughput in cycles per second. Use --json to get the report in JSON,
+for tracking trends.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *apiBench) Run(context *cmd.Context, client *cmd.Client) error {
+	path := c.manifest
+	if path == "" {
+		path = "manifest.yaml"
+	}
+	m, err := loadManifest(path, c.env, true)
+	if err != nil {
+		return err
+	}
+	endpoint := resolveEndpoint(m, context.Args[0])
+	concurrency := c.concurrency
+	if concurrency == 0 {
+		concurrency = 10
+	}
+	if concurrency < 0 {
+		return fmt.Errorf("invalid concurrency: %d", concurrency)
+	}
+	if c.cycles < 0 {
+		return fmt.Errorf("invalid number of cycles: %d", c.cycles)
+	}
+	if c.duration < 0 {
+		return fmt.Errorf("invalid duration: %s", c.duration)
+	}
+	cycles := c.cycles
+	if cycles == 0 && c.duration == 0 {
+		cycles = 100
+	}
+	team := c.team
+	if team == "" {
+		team = "crane"
+	}
+	api := newServiceAPI(endpoint, m)
+	if c.strict {
+		api.validator = servicesAPIValidator
+	}
+	b := benchmark{
+		api:         api,
+		prefix:      "crane-bench-" + strconv.FormatInt(time.Now().Unix(), 36),
+		plan:        c.plan,
+		team:        team,
+		concurrency: concurrency,
+		cycles:      cycles,
+		duration:    c.duration,
+	}
+	if b.plan == "" {
+		b.plan = firstPlan(b.api)
+	}
+	r := b.run()
+	if c.json {
+		return json.NewEncoder(context.Stdout).Encode(r)
+	}
+	fmt.Fprintf(context.Stdout, "Ran %d cycle(s) with %d worker(s) in %s (%.1f cycles/s), %d failed.\n",
+		r.Cycles, r.Concurrency, r.elapsed/time.Millisecond*time.Millisecond, r.Throughput, r.FailedCycles)
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"Step", "Requests", "Errors", "p50", "p90", "p99", "Max"}
+	for _, s := range r.Steps {
+		table.AddRow(cmd.Row{
+			s.Name,
+			strconv.Itoa(s.Requests),
+			fmt.Sprintf("%d (%.1f%%)", s.Errors, s.ErrorRate*100),
+			formatMilliseconds(s.P50),
+			formatMilliseconds(s.P90),
+			formatMilliseconds(s.P99),
+			formatMilliseconds(s.Max),
+		})
+	}
+	context.Stdout.Write(table.Bytes())
+	for _, s := range r.Steps {
+		var messages []string
+		for msg := range s.Failures {
+			messages = append(messages, msg)
+		}
+		sort.Strings(messages)
+		for _, msg := range messages {
+			fmt.Fprintf(context.Stdout, "%s: %s (%d time(s))\n", s.Name, msg, s.Failures[msg])
+		}
+	}
+	return nil
+}
+
+func formatMilliseconds(ms float64) string {
+	return fmt.Sprintf("%.1fms", ms)
+}
+
+// firstPlan returns the first plan of the service, or an empty string if the
+// plans can't be listed.
+func firstPlan(api *serviceAPI) string {
+	resp, err := api.plans()
+	if err != nil || resp.status != http.StatusOK {
+		return ""
+	}
+	var plans []plan
+	if json.Unmarshal(resp.body, &plans) != nil || len(plans) == 0 {
+		return ""
+	}
+	return plans[0].Name
+}
+
+func (c *apiBench) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("api-bench", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.manifest, "manifest", "", "Manifest file with the credentials of the service (default: manifest.yaml)")
+		c.fs.StringVar(&c.manifest, "m", "", "Manifest file with the credentials of the service (default: manifest.yaml)")
+		c.fs.StringVar(&c.env, "env", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.StringVar(&c.env, "e", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.IntVar(&c.concurrency, "concurrency", 10, "Number of cycles running at the same time")
+		c.fs.IntVar(&c.concurrency, "c", 10, "Number of cycles running at the same time")
+		c.fs.IntVar(&c.cycles, "cycles", 0, "Number of cycles to run (default: 100, unless --duration is set)")
+		c.fs.IntVar(&c.cycles, "n", 0, "Number of cycles to run (default: 100, unless --duration is set)")
+		c.fs.DurationVar(&c.duration, "duration", 0, "Keep starting cycles for this long")
+		c.fs.DurationVar(&c.duration, "d", 0, "Keep starting cycles for this long")
+		c.fs.StringVar(&c.plan, "plan", "", "Plan of the instances (default: the first plan of the service)")
+		c.fs.StringVar(&c.team, "team", "", "Team of the instances (default: crane)")
+		c.fs.BoolVar(&c.json, "json", false, "Display the report in JSON")
+		c.fs.BoolVar(&c.strict, "strict", false, "Validate requests and responses against the OpenAPI document of the services API")
+	}
+	return c.fs
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestBenchmarkRun(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	b := benchmark{
+		api:         newServiceAPI(fake.server.URL, fake.manifest()),
+		prefix:      "crane-bench",
+		plan:        "small",
+		team:        "admin",
+		concurrency: 4,
+		cycles:      20,
+	}
+	r := b.run()
+	c.Assert(r.Cycles, check.Equals, 20)
+	c.Assert(r.FailedCycles, check.Equals, 0)
+	c.Assert(r.Concurrency, check.Equals, 4)
+	c.Assert(r.Throughput > 0, check.Equals, true)
+	c.Assert(r.Steps, check.HasLen, 4)
+	for i, step := range r.Steps {
+		c.Check(step.Name, check.Equals, benchSteps[i])
+		c.Check(step.Requests, check.Equals, 20)
+		c.Check(step.Errors, check.Equals, 0)
+		c.Check(step.P50 <= step.P90 && step.P90 <= step.P99 && step.P99 <= step.Max, check.Equals, true)
+	}
+	c.Assert(fake.instances, check.HasLen, 0)
+	c.Assert(fake.requests, check.HasLen, 80)
+}
+
+func (s *S) TestBenchmarkStepErrors(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	fake.overrides["POST /resources/{name}/bind-app"] = http.StatusInternalServerError
+	b := benchmark{
+		api:         newServiceAPI(fake.server.URL, fake.manifest()),
+		prefix:      "crane-bench",
+		concurrency: 2,
+		cycles:      5,
+	}
+	r := b.run()
+	c.Assert(r.Cycles, check.Equals, 5)
+	c.Assert(r.FailedCycles, check.Equals, 5)
+	byName := map[string]stepReport{}
+	for _, step := range r.Steps {
+		byName[step.Name] = step
+	}
+	c.Assert(byName["create"].Errors, check.Equals, 0)
+	c.Assert(byName["bind"].Errors, check.Equals, 5)
+	c.Assert(byName["bind"].ErrorRate, check.Equals, 1.0)
+	c.Assert(byName["bind"].Failures, check.DeepEquals, map[string]int{"expected status 201, got 500": 5})
+	c.Assert(byName["unbind"].Requests, check.Equals, 0)
+	c.Assert(byName["remove"].Requests, check.Equals, 5)
+	c.Assert(fake.instances, check.HasLen, 0)
+}
+
+func (s *S) TestBenchmarkDuration(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	b := benchmark{
+		api:         newServiceAPI(fake.server.URL, fake.manifest()),
+		prefix:      "crane-bench",
+		concurrency: 2,
+		duration:    50 * time.Millisecond,
+	}
+	r := b.run()
+	c.Assert(r.Cycles > 0, check.Equals, true)
+	c.Assert(r.Elapsed >= 0.05, check.Equals, true)
+	c.Assert(r.FailedCycles, check.Equals, 0)
+}
+
+func (s *S) TestDurationsPercentile(c *check.C) {
+	var d durations
+	c.Assert(d.percentile(50), check.Equals, time.Duration(0))
+	for i := 1; i <= 100; i++ {
+		d = append(d, time.Duration(i)*time.Millisecond)
+	}
+	c.Assert(d.percentile(50), check.Equals, 50*time.Millisecond)
+	c.Assert(d.percentile(90), check.Equals, 90*time.Millisecond)
+	c.Assert(d.percentile(99), check.Equals, 99*time.Millisecond)
+	c.Assert(d.percentile(100), check.Equals, 100*time.Millisecond)
+	d = durations{time.Millisecond, 2 * time.Millisecond}
+	c.Assert(d.percentile(50), check.Equals, time.Millisecond)
+	c.Assert(d.percentile(99), check.Equals, 2*time.Millisecond)
+}
+
+func (s *S) TestAPIBenchRun(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	path := filepath.Join(c.MkDir(), "manifest.yaml")
+	data := "id: mysqlapi\npassword: s3cr3t\nendpoint:\n  production: " + fake.server.URL + "\n"
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"production"}, Stdout: &stdout}
+	command := apiBench{}
+	command.Flags().Parse(true, []string{"-m", path, "-n", "10", "-c", "2"})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `Ran 10 cycle\(s\) with 2 worker\(s\) in .* \(.* cycles/s\), 0 failed.\n`+
+		`(?s).*\| Step +\| Requests \| Errors +\| p50 .*\| create +\| 10 +\| 0 \(0.0%\) +\| .*ms \|.*`)
+	c.Assert(fake.requests[0], check.Equals, "GET /resources/plans")
+}
+
+func (s *S) TestAPIBenchRunJSON(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	fake.overrides["DELETE /resources/{name}"] = http.StatusServiceUnavailable
+	path := filepath.Join(c.MkDir(), "manifest.yaml")
+	err := ioutil.WriteFile(path, []byte("id: mysqlapi\npassword: s3cr3t\nendpoint:\n  production: mysqlapi.com\n"), 0600)
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{fake.server.URL}, Stdout: &stdout}
+	command := apiBench{}
+	command.Flags().Parse(true, []string{"--manifest", path, "--cycles", "3", "--json"})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	var r benchReport
+	err = json.Unmarshal(stdout.Bytes(), &r)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Cycles, check.Equals, 3)
+	c.Assert(r.FailedCycles, check.Equals, 3)
+	c.Assert(r.Concurrency, check.Equals, 10)
+	c.Assert(r.Steps[3].Name, check.Equals, "remove")
+	c.Assert(r.Steps[3].Errors, check.Equals, 3)
+	c.Assert(r.Steps[3].Failures, check.DeepEquals, map[string]int{"expected status 200, got 503": 3})
+}
+
+func (s *S) TestAPIBenchInvalidConcurrency(c *check.C) {
+	context := cmd.Context{Args: []string{"production"}}
+	command := apiBench{}
+	command.Flags().Parse(true, []string{"-m", "testdata/manifest.yml", "-c", "-1"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "invalid concurrency: -1")
+}
+
+func (s *S) TestAPIBenchInvalidCycles(c *check.C) {
+	context := cmd.Context{Args: []string{"production"}}
+	command := apiBench{}
+	command.Flags().Parse(true, []string{"-m", "testdata/manifest.yml", "-n", "-5"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "invalid number of cycles: -5")
+}
+
+func (s *S) TestAPIBenchInvalidDuration(c *check.C) {
+	context := cmd.Context{Args: []string{"production"}}
+	command := apiBench{}
+	command.Flags().Parse(true, []string{"-m", "testdata/manifest.yml", "-d", "-1s"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "invalid duration: -1s")
+}
@@ -0,0 +1,392 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/errors"
+)
+
+// catalogStateFile is the file, in the directory of an exported catalog, that
+// keeps the fingerprints of the sources of the pages, so exports only rewrite
+// the pages whose source changed.
+const catalogStateFile = ".crane-catalog.json"
+
+// catalogService is a service, as described in the catalog.
+type catalogService struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Teams       []string      `json:"teams,omitempty"`
+	Plans       []catalogPlan `json:"plans"`
+	Doc         string        `json:"doc,omitempty"`
+}
+
+type catalogPlan struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// fetchCatalog retrieves every service the user can read from the target,
+// sorted by name. The admin teams and the description of services the user
+// doesn't administrate are not available, and are left empty.
+func fetchCatalog(client *cmd.Client) ([]catalogService, error) {
+	var models []cmd.ServiceModel
+	if err := getJSON(client, "/services/instances", &models); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range models {
+		names = append(names, m.Service)
+	}
+	sort.Strings(names)
+	services := make([]catalogService, 0, len(names))
+	for _, name := range names {
+		// Service names become paths of pages.
+		if err := validateServiceID(name); err != nil {
+			return nil, fmt.Errorf("invalid service %q: %s", name, err)
+		}
+		s := catalogService{Name: name, Plans: []catalogPlan{}}
+		var def service
+		err := getJSON(client, "/services/"+name, &def)
+		if httpErr, ok := err.(*errors.HTTP); ok && httpErr.Code == http.StatusForbidden {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.Description = def.Description
+		s.Teams = sortedCopy(def.OwnerTeams)
+		plans, err := getServicePlans(client, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range plans {
+			s.Plans = append(s.Plans, catalogPlan{Name: p.Name, Description: p.Description})
+		}
+		s.Doc, err = getServiceDoc(client, name)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// catalogPage is a page of the catalog. The page is rendered from its source,
+// and only when the source changed since the last export.
+type catalogPage struct {
+	path   string
+	source interface{}
+	render func() ([]byte, error)
+}
+
+// fingerprint returns a hash of the source of the page in the given format.
+func (p *catalogPage) fingerprint(format string) string {
+	data, _ := json.Marshal(p.source)
+	return fmt.Sprintf("%x", sha256.Sum256(append([]byte(format+"\n"), data...)))
+}
+
+// catalogPages returns the pages of the catalog in the given format: an index
+// of the services and one page per service.
+func catalogPages(format string, services []catalogService) ([]catalogPage, error) {
+	// The index only describes the services, without their docs, so
+	// changing the doc of a service doesn't rewrite the index.
+	index := make([]catalogService, len(services))
+	for i, s := range services {
+		index[i] = s
+		index[i].Doc = ""
+	}
+	var pages []catalogPage
+	switch format {
+	case "html":
+		pages = append(pages, catalogPage{"index.html", index, func() ([]byte, error) {
+			return executeTemplate(catalogHTMLIndex, index)
+		}})
+		for i := range services {
+			s := services[i]
+			pages = append(pages, catalogPage{"services/" + s.Name + ".html", s, func() ([]byte, error) {
+				return executeTemplate(catalogHTMLService, s)
+			}})
+		}
+	case "markdown":
+		pages = append(pages, catalogPage{"README.md", index, func() ([]byte, error) {
+			return executeTemplate(catalogMarkdownIndex, index)
+		}})
+		for i := range services {
+			s := services[i]
+			pages = append(pages, catalogPage{"services/" + s.Name + ".md", s, func() ([]byte, error) {
+				return executeTemplate(catalogMarkdownService, s)
+			}})
+		}
+	case "json":
+		pages = append(pages, catalogPage{"catalog.json", index, func() ([]byte, error) {
+			return marshalCatalog(index)
+		}})
+		for i := range services {
+			s := services[i]
+			pages = append(pages, catalogPage{"services/" + s.Name + ".json", s, func() ([]byte, error) {
+				return marshalCatalog(s)
+			}})
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q, the available formats are: html, json, markdown", format)
+	}
+	return pages, nil
+}
+
+func marshalCatalog(v interface{}) ([]byte, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// executeTemplate renders a text or an HTML template.
+func executeTemplate(tmpl interface {
+	Execute(w io.Writer, data interface{}) error
+}, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// catalogResult counts the pages of an export.
+type catalogResult struct {
+	written, unchanged, removed []string
+}
+
+// exportCatalog writes the pages to dir, skipping the pages whose source
+// didn't change since the last export, unless force is true, and removing the
+// pages of services that no longer exist.
+func exportCatalog(dir, format string, pages []catalogPage, force bool) (*catalogResult, error) {
+	statePath := filepath.Join(dir, catalogStateFile)
+	previous := map[string]string{}
+	if data, err := ioutil.ReadFile(statePath); err == nil {
+		if err := json.Unmarshal(data, &previous); err != nil {
+			return nil, fmt.Errorf("invalid catalog state file %s: %s", statePath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	var result catalogResult
+	current := map[string]string{}
+	for _, p := range pages {
+		target := filepath.Join(dir, filepath.FromSlash(p.path))
+		fingerprint := p.fingerprint(format)
+		current[p.path] = fingerprint
+		if _, err := os.Stat(target); err == nil && !force && previous[p.path] == fingerprint {
+			result.unchanged = append(result.unchanged, p.path)
+			continue
+		}
+		content, err := p.render()
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s: %s", p.path, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(target, content, 0644); err != nil {
+			return nil, err
+		}
+		result.written = append(result.written, p.path)
+	}
+	var stale []string
+	for path := range previous {
+		// The state file is not trusted to point outside the directory.
+		if strings.Contains(path, "..") || filepath.IsAbs(filepath.FromSlash(path)) {
+			continue
+		}
+		if _, ok := current[path]; !ok {
+			stale = append(stale, path)
+		}
+	}
+	sort.Strings(stale)
+	for _, path := range stale {
+		err := os.Remove(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		result.removed = append(result.removed, path)
+	}
+	data, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(statePath, append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+type catalogExport struct {
+	fs     *gnuflag.FlagSet
+	format string
+	force  bool
+}
+
+func (c *catalogExport) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "catalog-export",
+		Usage: "catalog-export <directory> [--format html|json|markdown] [-f/--force]",
+		Desc: `Exports a catalog of every service you can read, with their plans, admin
+teams and documentation.
+
+The catalog is written to the directory, with an index of the services and one
+page per service:
+
+  html      a self-contained static site: index.html and services/<id>.html
+  markdown  README.md and services/<id>.md
+  json      a data bundle: catalog.json and services/<id>.json
+
+The export is incremental: the fingerprints of the sources of the pages are
+kept in the .crane-catalog.json file of the directory, and only the pages
+whose source changed are rewritten. Pages of services that no longer exist are
+removed. The --force flag rewrites every page.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *catalogExport) Run(context *cmd.Context, client *cmd.Client) error {
+	dir := context.Args[0]
+	format := c.format
+	if format == "" {
+		format = "html"
+	}
+	if _, err := catalogPages(format, nil); err != nil {
+		return err
+	}
+	services, err := fetchCatalog(client)
+	if err != nil {
+		return err
+	}
+	pages, err := catalogPages(format, services)
+	if err != nil {
+		return err
+	}
+	result, err := exportCatalog(dir, format, pages, c.force)
+	if err != nil {
+		return err
+	}
+	for _, path := range result.written {
+		fmt.Fprintf(context.Stdout, "  wrote %s\n", path)
+	}
+	for _, path := range result.removed {
+		fmt.Fprintf(context.Stdout, "  removed %s\n", path)
+	}
+	fmt.Fprintf(context.Stdout, "Catalog of %d services exported to %s: %d pages written, %d unchanged, %d removed.\n",
+		len(services), dir, len(result.written), len(result.unchanged), len(result.removed))
+	return nil
+}
+
+func (c *catalogExport) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("catalog-export", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.format, "format", "html", "Format of the catalog: html, json or markdown")
+		c.fs.BoolVar(&c.force, "force", false, "Rewrite every page, even if its source didn't change")
+		c.fs.BoolVar(&c.force, "f", false, "Rewrite every page, even if its source didn't change")
+	}
+	return c.fs
+}
+
+// markdownCell escapes the text for a cell of a Markdown table.
+func markdownCell(text string) string {
+	return strings.Replace(strings.Replace(text, "|", `\|`, -1), "\n", " ", -1)
+}
+
+const catalogStyle = `body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ccc; padding: .4em .6em; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; white-space: pre-wrap; }
+.teams { color: #666; }`
+
+var catalogHTMLIndex = htmltemplate.Must(htmltemplate.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Service catalog</title>
+<style>` + catalogStyle + `</style>
+</head>
+<body>
+<h1>Service catalog</h1>
+<table>
+<tr><th>Service</th><th>Description</th><th>Plans</th><th>Admin teams</th></tr>
+{{range .}}<tr><td><a href="services/{{.Name}}.html">{{.Name}}</a></td><td>{{.Description}}</td><td>{{range $i, $p := .Plans}}{{if $i}}, {{end}}{{$p.Name}}{{end}}</td><td class="teams">{{range $i, $t := .Teams}}{{if $i}}, {{end}}{{$t}}{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+var catalogHTMLService = htmltemplate.Must(htmltemplate.New("service").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}} - Service catalog</title>
+<style>` + catalogStyle + `</style>
+</head>
+<body>
+<p><a href="../index.html">Service catalog</a></p>
+<h1>{{.Name}}</h1>
+{{if .Description}}<p>{{.Description}}</p>
+{{end}}{{if .Teams}}<p class="teams">Administrated by {{range $i, $t := .Teams}}{{if $i}}, {{end}}{{$t}}{{end}}</p>
+{{end}}<h2>Plans</h2>
+{{if .Plans}}<table>
+<tr><th>Plan</th><th>Description</th></tr>
+{{range .Plans}}<tr><td>{{.Name}}</td><td>{{.Description}}</td></tr>
+{{end}}</table>
+{{else}}<p>The service has no plans.</p>
+{{end}}<h2>Documentation</h2>
+{{if .Doc}}<pre>{{.Doc}}</pre>
+{{else}}<p>The service has no documentation.</p>
+{{end}}</body>
+</html>
+`))
+
+var catalogMarkdownIndex = template.Must(template.New("index").Funcs(template.FuncMap{"cell": markdownCell}).Parse(`# Service catalog
+
+| Service | Description | Plans | Admin teams |
+|---------|-------------|-------|-------------|
+{{range .}}| [{{.Name}}](services/{{.Name}}.md) | {{cell .Description}} | {{range $i, $p := .Plans}}{{if $i}}, {{end}}{{cell $p.Name}}{{end}} | {{range $i, $t := .Teams}}{{if $i}}, {{end}}{{cell $t}}{{end}} |
+{{end}}`))
+
+var catalogMarkdownService = template.Must(template.New("service").Funcs(template.FuncMap{"cell": markdownCell}).Parse(`# {{.Name}}
+
+[Service catalog](../README.md)
+{{if .Description}}
+{{.Description}}
+{{end}}{{if .Teams}}
+Administrated by {{range $i, $t := .Teams}}{{if $i}}, {{end}}{{$t}}{{end}}.
+{{end}}
+## Plans
+{{if .Plans}}
+| Plan | Description |
+|------|-------------|
+{{range .Plans}}| {{cell .Name}} | {{cell .Description}} |
+{{end}}{{else}}
+The service has no plans.
+{{end}}
+## Documentation
+
+{{if .Doc}}{{.Doc}}{{else}}The service has no documentation.
+{{end}}`))
@@ -0,0 +1,196 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestFetchCatalog(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	e, stop := startEmulator(c, fake, &log)
+	defer stop()
+	e.docs["mysqlapi"] = "# mysqlapi\n"
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	services, err := fetchCatalog(client)
+	c.Assert(err, check.IsNil)
+	c.Assert(services, check.HasLen, 1)
+	c.Assert(services[0].Name, check.Equals, "mysqlapi")
+	c.Assert(services[0].Doc, check.Equals, "# mysqlapi\n")
+	c.Assert(services[0].Plans, check.Not(check.HasLen), 0)
+}
+
+func (s *S) TestCatalogPagesUnknownFormat(c *check.C) {
+	_, err := catalogPages("pdf", nil)
+	c.Assert(err, check.ErrorMatches, `unknown format "pdf", the available formats are: html, json, markdown`)
+}
+
+var catalogServices = []catalogService{
+	{
+		Name:        "mysqlapi",
+		Description: "MySQL <databases>",
+		Teams:       []string{"dba"},
+		Plans:       []catalogPlan{{Name: "small", Description: "Small | cheap"}},
+		Doc:         "Use MYSQL_HOST & MYSQL_PORT.\n",
+	},
+	{Name: "redisapi", Plans: []catalogPlan{}},
+}
+
+func renderCatalog(c *check.C, format string) map[string]string {
+	pages, err := catalogPages(format, catalogServices)
+	c.Assert(err, check.IsNil)
+	rendered := map[string]string{}
+	for _, p := range pages {
+		content, err := p.render()
+		c.Assert(err, check.IsNil)
+		rendered[p.path] = string(content)
+	}
+	return rendered
+}
+
+func (s *S) TestCatalogPagesHTML(c *check.C) {
+	pages := renderCatalog(c, "html")
+	c.Assert(pages, check.HasLen, 3)
+	c.Assert(pages["index.html"], check.Matches, `(?s).*<tr><td><a href="services/mysqlapi.html">mysqlapi</a></td><td>MySQL &lt;databases&gt;</td><td>small</td><td class="teams">dba</td></tr>.*`)
+	c.Assert(pages["services/mysqlapi.html"], check.Matches, `(?s).*<style>.*<h1>mysqlapi</h1>.*Administrated by dba.*<tr><td>small</td><td>Small | cheap</td></tr>.*<pre>Use MYSQL_HOST &amp; MYSQL_PORT.\n</pre>.*`)
+	c.Assert(pages["services/redisapi.html"], check.Matches, `(?s).*The service has no plans.*The service has no documentation.*`)
+}
+
+func (s *S) TestCatalogPagesMarkdown(c *check.C) {
+	pages := renderCatalog(c, "markdown")
+	c.Assert(pages, check.HasLen, 3)
+	c.Assert(pages["README.md"], check.Equals, `# Service catalog
+
+| Service | Description | Plans | Admin teams |
+|---------|-------------|-------|-------------|
+| [mysqlapi](services/mysqlapi.md) | MySQL <databases> | small | dba |
+| [redisapi](services/redisapi.md) |  |  |  |
+`)
+	c.Assert(pages["services/mysqlapi.md"], check.Equals, `# mysqlapi
+
+[Service catalog](../README.md)
+
+MySQL <databases>
+
+Administrated by dba.
+
+## Plans
+
+| Plan | Description |
+|------|-------------|
+| small | Small \| cheap |
+
+## Documentation
+
+Use MYSQL_HOST & MYSQL_PORT.
+`)
+}
+
+func (s *S) TestCatalogPagesJSON(c *check.C) {
+	pages := renderCatalog(c, "json")
+	c.Assert(pages, check.HasLen, 3)
+	var index []catalogService
+	err := json.Unmarshal([]byte(pages["catalog.json"]), &index)
+	c.Assert(err, check.IsNil)
+	c.Assert(index[0].Doc, check.Equals, "")
+	c.Assert(index[0].Plans, check.DeepEquals, catalogServices[0].Plans)
+	var service catalogService
+	err = json.Unmarshal([]byte(pages["services/mysqlapi.json"]), &service)
+	c.Assert(err, check.IsNil)
+	c.Assert(service, check.DeepEquals, catalogServices[0])
+}
+
+func (s *S) TestExportCatalogIncremental(c *check.C) {
+	dir := c.MkDir()
+	services := []catalogService{catalogServices[0], catalogServices[1]}
+	pages, err := catalogPages("html", services)
+	c.Assert(err, check.IsNil)
+	result, err := exportCatalog(dir, "html", pages, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.written, check.DeepEquals, []string{"index.html", "services/mysqlapi.html", "services/redisapi.html"})
+	result, err = exportCatalog(dir, "html", pages, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.written, check.IsNil)
+	c.Assert(result.unchanged, check.HasLen, 3)
+	services[0].Doc = "New docs.\n"
+	pages, err = catalogPages("html", services)
+	c.Assert(err, check.IsNil)
+	result, err = exportCatalog(dir, "html", pages, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.written, check.DeepEquals, []string{"services/mysqlapi.html"})
+	data, err := ioutil.ReadFile(filepath.Join(dir, "services", "mysqlapi.html"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Matches, "(?s).*<pre>New docs.\n</pre>.*")
+	err = os.Remove(filepath.Join(dir, "index.html"))
+	c.Assert(err, check.IsNil)
+	pages, err = catalogPages("html", services[:1])
+	c.Assert(err, check.IsNil)
+	result, err = exportCatalog(dir, "html", pages, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.written, check.DeepEquals, []string{"index.html"})
+	c.Assert(result.removed, check.DeepEquals, []string{"services/redisapi.html"})
+	_, err = os.Stat(filepath.Join(dir, "services", "redisapi.html"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	result, err = exportCatalog(dir, "html", pages, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.written, check.HasLen, 2)
+}
+
+func (s *S) TestExportCatalogIgnoresPathsOutsideTheDirectory(c *check.C) {
+	parent := c.MkDir()
+	dir := filepath.Join(parent, "catalog")
+	err := os.Mkdir(dir, 0755)
+	c.Assert(err, check.IsNil)
+	outside := filepath.Join(parent, "important.txt")
+	err = ioutil.WriteFile(outside, []byte("keep me"), 0644)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, catalogStateFile), []byte(`{"../important.txt": "x"}`), 0644)
+	c.Assert(err, check.IsNil)
+	result, err := exportCatalog(dir, "json", nil, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.removed, check.IsNil)
+	_, err = os.Stat(outside)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestCatalogExportRun(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	_, stop := startEmulator(c, fake, &log)
+	defer stop()
+	dir := c.MkDir()
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{dir}, Stdout: &stdout}
+	command := catalogExport{}
+	command.Flags().Parse(true, []string{"--format", "markdown"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "  wrote README.md\n  wrote services/mysqlapi.md\nCatalog of 1 services exported to "+dir+": 2 pages written, 0 unchanged, 0 removed.\n")
+	stdout.Reset()
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Catalog of 1 services exported to "+dir+": 0 pages written, 2 unchanged, 0 removed.\n")
+	_, err = os.Stat(filepath.Join(dir, catalogStateFile))
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestCatalogExportRunUnknownFormat(c *check.C) {
+	command := catalogExport{}
+	command.Flags().Parse(true, []string{"--format", "pdf"})
+	err := command.Run(&cmd.Context{Args: []string{c.MkDir()}}, nil)
+	c.Assert(err, check.ErrorMatches, `unknown format "pdf".*`)
+}
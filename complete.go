@@ -0,0 +1,375 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// completeCommandName is the name of the hidden command the completion
+// scripts run to complete the names of services, instances, teams and plans:
+//
+//	crane __complete <words...> <current-word>
+//
+// The words are the command line after the name of the program, and the
+// names matching the current word are written one per line.
+const completeCommandName = "__complete"
+
+// The kinds of names completed from the target.
+const (
+	completeServices  = "services"
+	completeInstances = "instances"
+	completeTeams     = "teams"
+	completePlans     = "plans"
+)
+
+// completionRemoteArgs are the kinds of names of the arguments of the
+// commands, by position. Arguments past the end are not completed.
+var completionRemoteArgs = map[string][]string{
+	"doc-get":          {completeServices},
+	"doc-sync":         {completeServices},
+	"doc-verify":       {completeServices},
+	"instance-add":     {completeServices},
+	"instance-bind":    {completeServices, completeInstances},
+	"instance-orphans": {completeServices},
+	"instance-remove":  {completeServices, completeInstances},
+	"instance-status":  {completeServices},
+	"instance-unbind":  {completeServices, completeInstances},
+}
+
+// completionRemoteFlags are the kinds of names of the values of the flags of
+// the commands, by the long name of the flag.
+var completionRemoteFlags = map[string]map[string]string{
+	"api-bench":     {"team": completeTeams},
+	"api-check":     {"team": completeTeams},
+	"doc-verify":    {"plan": completePlans, "team": completeTeams},
+	"instance-add":  {"plan": completePlans, "team": completeTeams},
+	"instance-list": {"plan": completePlans, "service": completeServices, "team": completeTeams},
+	"template":      {"team": completeTeams},
+}
+
+const (
+	// completionTimeout is the timeout of the requests to the target, which
+	// keep the shell waiting.
+	completionTimeout = 5 * time.Second
+
+	defaultCompletionTTL        = 5 * time.Minute
+	defaultCompletionOfflineTTL = time.Hour
+)
+
+// completionRequest is what a word of a command line is completed with: the
+// names of a kind, of the service for instances and plans, starting with the
+// prefix.
+type completionRequest struct {
+	kind    string
+	service string
+	prefix  string
+}
+
+// key returns the key of the names in the completion cache.
+func (r *completionRequest) key() string {
+	if r.kind == completeInstances || r.kind == completePlans {
+		return r.kind + "/" + r.service
+	}
+	return r.kind
+}
+
+// parseCompletionWords returns what the last word of the command line is
+// completed with. The kind of the request is empty when the word isn't the
+// name of something in the target.
+func parseCompletionWords(m *cmd.Manager, words []string) completionRequest {
+	var r completionRequest
+	if len(words) == 0 {
+		return r
+	}
+	r.prefix = words[len(words)-1]
+	words = words[:len(words)-1]
+	i := 0
+	for ; i < len(words) && strings.HasPrefix(words[i], "-"); i++ {
+		if words[i] == "-v" || words[i] == "--verbosity" {
+			i++
+		}
+	}
+	if i >= len(words) {
+		return r
+	}
+	name, args := words[i], words[i+1:]
+	// Aliases are completed like the command lines they stand for.
+	for n := 0; n < 10; n++ {
+		alias, ok := m.Commands[name].(*aliasCommand)
+		if !ok || alias.isMacro() {
+			break
+		}
+		args = append(append([]string{}, alias.steps[0][1:]...), args...)
+		name = alias.steps[0][0]
+	}
+	command, ok := m.Commands[name]
+	if !ok {
+		return r
+	}
+	flags := commandFlags(name, command)
+	values := map[string]string{}
+	var positional []string
+	var pending *completionFlag
+	for j := 0; j < len(args); j++ {
+		arg := args[j]
+		if arg == "--" {
+			positional = append(positional, args[j+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+		flagName := strings.TrimLeft(arg, "-")
+		value, inline := "", false
+		if k := strings.Index(flagName, "="); k >= 0 {
+			flagName, value, inline = flagName[:k], flagName[k+1:], true
+		}
+		f := findCompletionFlag(flags, flagName)
+		if f == nil || !f.value || inline {
+			if f != nil {
+				values[f.long] = value
+			}
+			continue
+		}
+		if j+1 == len(args) {
+			pending = f
+			break
+		}
+		j++
+		values[f.long] = args[j]
+	}
+	remoteArgs := completionRemoteArgs[name]
+	if service, ok := values["service"]; ok {
+		r.service = service
+	} else if len(remoteArgs) > 0 && remoteArgs[0] == completeServices && len(positional) > 0 {
+		r.service = positional[0]
+	}
+	switch {
+	case pending != nil:
+		r.kind = completionRemoteFlags[name][pending.long]
+	case strings.HasPrefix(r.prefix, "-"):
+	case len(positional) < len(remoteArgs):
+		r.kind = remoteArgs[len(positional)]
+	}
+	if (r.kind == completeInstances || r.kind == completePlans) && r.service == "" {
+		r.kind = ""
+	}
+	return r
+}
+
+func findCompletionFlag(flags []completionFlag, name string) *completionFlag {
+	for i := range flags {
+		if flags[i].long == name || flags[i].short == name {
+			return &flags[i]
+		}
+	}
+	return nil
+}
+
+// completionCacheEntry is a list of names in the completion cache, with the
+// time they were fetched.
+type completionCacheEntry struct {
+	Values []string  `json:"values"`
+	Time   time.Time `json:"time"`
+}
+
+// completionCache is the cache of the names fetched from a target, so the
+// target isn't asked for them every time a word is completed.
+type completionCache struct {
+	Target  string                          `json:"target"`
+	Entries map[string]completionCacheEntry `json:"entries"`
+}
+
+// completionCachePath returns the path of the completion cache of the target.
+func completionCachePath(target string) string {
+	sum := sha256.Sum256([]byte(target))
+	return cmd.JoinWithUserDir(".crane", "cache", "completion-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// readCompletionCache reads the completion cache of the target. Missing and
+// invalid caches are empty: they're filled again from the target.
+func readCompletionCache(path, target string) *completionCache {
+	cache := completionCache{Target: target}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		json.Unmarshal(data, &cache)
+	}
+	if cache.Target != target || cache.Entries == nil {
+		cache = completionCache{Target: target, Entries: map[string]completionCacheEntry{}}
+	}
+	return &cache
+}
+
+// write writes the cache to a temporary file renamed to the path, so shells
+// completing at the same time never read half of it.
+func (c *completionCache) write(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// values returns the names of the key. Names younger than the ttl are taken
+// from the cache, others are fetched again. When fetching fails, names younger
+// than the offline ttl are still taken from the cache. Fetching may return the
+// names of other keys too, which are cached with them.
+func (c *completionCache) values(key string, now time.Time, ttl, offlineTTL time.Duration, fetch func() (map[string][]string, error)) ([]string, bool, error) {
+	entry, ok := c.Entries[key]
+	if ok && now.Sub(entry.Time) < ttl {
+		return entry.Values, false, nil
+	}
+	fetched, err := fetch()
+	if err != nil {
+		if ok && now.Sub(entry.Time) < offlineTTL {
+			return entry.Values, false, nil
+		}
+		return nil, false, err
+	}
+	for k, v := range c.Entries {
+		if now.Sub(v.Time) >= offlineTTL {
+			delete(c.Entries, k)
+		}
+	}
+	for k, v := range fetched {
+		c.Entries[k] = completionCacheEntry{Values: v, Time: now}
+	}
+	return fetched[key], true, nil
+}
+
+// fetchCompletionValues fetches the names the request is completed with from
+// the target, by their keys in the cache. Listing the services lists the
+// names of their instances too.
+func fetchCompletionValues(client *cmd.Client, r completionRequest) (map[string][]string, error) {
+	switch r.kind {
+	case completeServices, completeInstances:
+		var list []serviceInstances
+		if err := getJSON(client, "/services/instances", &list); err != nil {
+			return nil, err
+		}
+		values := map[string][]string{completeServices: {}}
+		for _, s := range list {
+			values[completeServices] = append(values[completeServices], s.Service)
+			instances := sortedCopy(s.Instances)
+			if instances == nil {
+				instances = []string{}
+			}
+			values[completeInstances+"/"+s.Service] = instances
+		}
+		sort.Strings(values[completeServices])
+		return values, nil
+	case completeTeams:
+		teams, err := listTeams(client)
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for name := range teams {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return map[string][]string{r.key(): names}, nil
+	case completePlans:
+		plans, err := getServicePlans(client, r.service)
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, p := range plans {
+			names = append(names, p.Name)
+		}
+		sort.Strings(names)
+		return map[string][]string{r.key(): names}, nil
+	}
+	return nil, fmt.Errorf("unknown kind of names %q", r.kind)
+}
+
+// completionTTLs returns the ttl and the offline ttl of the completion cache,
+// set in the completion section of the config file:
+//
+//	[completion]
+//	ttl = 5m
+//	offline-ttl = 1h
+func completionTTLs() (time.Duration, time.Duration, error) {
+	config, err := readConfigSection(configPath(), "completion")
+	if err != nil {
+		return 0, 0, err
+	}
+	ttl, offlineTTL := defaultCompletionTTL, defaultCompletionOfflineTTL
+	for key, d := range map[string]*time.Duration{"ttl": &ttl, "offline-ttl": &offlineTTL} {
+		if value, ok := config[key]; ok {
+			if *d, err = time.ParseDuration(value); err != nil {
+				return 0, 0, fmt.Errorf("invalid %s in the completion section of the config file: %s", key, err)
+			}
+		}
+	}
+	return ttl, offlineTTL, nil
+}
+
+// runComplete runs the hidden __complete command, writing the names the last
+// of the words is completed with.
+func runComplete(m *cmd.Manager, context *cmd.Context, now time.Time) error {
+	context.RawOutput()
+	r := parseCompletionWords(m, context.Args)
+	if r.kind == "" {
+		return nil
+	}
+	target, err := cmd.GetTarget()
+	if err != nil {
+		return err
+	}
+	ttl, offlineTTL, err := completionTTLs()
+	if err != nil {
+		return err
+	}
+	path := completionCachePath(target)
+	cache := readCompletionCache(path, target)
+	client := cmd.NewClient(&http.Client{Timeout: completionTimeout}, context, m)
+	values, fetched, err := cache.values(r.key(), now, ttl, offlineTTL, func() (map[string][]string, error) {
+		return fetchCompletionValues(client, r)
+	})
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		if strings.HasPrefix(value, r.prefix) {
+			fmt.Fprintln(context.Stdout, value)
+		}
+	}
+	if fetched {
+		return cache.write(path)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestParseCompletionWords(c *check.C) {
+	m := buildManager("crane", "", nil)
+	err := registerAliases(&commandLookup{manager: m}, map[string]string{"rm": "instance-remove -y", "both": "rm && rm"})
+	c.Assert(err, check.IsNil)
+	tests := []struct {
+		words string
+		want  completionRequest
+	}{
+		{"instance-remove ''", completionRequest{kind: completeServices}},
+		{"instance-remove mysqlapi db", completionRequest{kind: completeInstances, service: "mysqlapi", prefix: "db"}},
+		{"-v 2 instance-bind mysqlapi db ''", completionRequest{service: "mysqlapi"}},
+		{"instance-remove -y my", completionRequest{kind: completeServices, prefix: "my"}},
+		{"instance-remove -", completionRequest{service: "", prefix: "-"}},
+		{"instance-add -p ''", completionRequest{}},
+		{"instance-add mysqlapi db -p s", completionRequest{kind: completePlans, service: "mysqlapi", prefix: "s"}},
+		{"instance-list --service mysqlapi --plan ''", completionRequest{kind: completePlans, service: "mysqlapi"}},
+		{"instance-list --service=mysqlapi -p ''", completionRequest{kind: completePlans, service: "mysqlapi"}},
+		{"instance-list -t ''", completionRequest{kind: completeTeams}},
+		{"instance-list --limit ''", completionRequest{}},
+		{"rm ''", completionRequest{kind: completeServices}},
+		{"rm mysqlapi ''", completionRequest{kind: completeInstances, service: "mysqlapi"}},
+		{"both ''", completionRequest{}},
+		{"instance-", completionRequest{prefix: "instance-"}},
+		{"unknown ''", completionRequest{}},
+	}
+	for _, t := range tests {
+		words := strings.Split(t.words, " ")
+		if words[len(words)-1] == "''" {
+			words[len(words)-1] = ""
+		}
+		c.Check(parseCompletionWords(m, words), check.Equals, t.want, check.Commentf(t.words))
+	}
+}
+
+func (s *S) TestCompletionCacheValues(c *check.C) {
+	cache := &completionCache{Target: "http://tsuru.example.com", Entries: map[string]completionCacheEntry{}}
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	var calls int
+	var fetchErr error
+	fetch := func() (map[string][]string, error) {
+		calls++
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return map[string][]string{"services": {"mysqlapi"}, "instances/mysqlapi": {"db"}}, nil
+	}
+	values, fetched, err := cache.values("services", now, 5*time.Minute, time.Hour, fetch)
+	c.Assert(err, check.IsNil)
+	c.Assert(values, check.DeepEquals, []string{"mysqlapi"})
+	c.Assert(fetched, check.Equals, true)
+	values, fetched, err = cache.values("instances/mysqlapi", now.Add(time.Minute), 5*time.Minute, time.Hour, fetch)
+	c.Assert(err, check.IsNil)
+	c.Assert(values, check.DeepEquals, []string{"db"})
+	c.Assert(fetched, check.Equals, false)
+	c.Assert(calls, check.Equals, 1)
+	fetchErr = errors.New("connection refused")
+	values, fetched, err = cache.values("services", now.Add(10*time.Minute), 5*time.Minute, time.Hour, fetch)
+	c.Assert(err, check.IsNil)
+	c.Assert(values, check.DeepEquals, []string{"mysqlapi"})
+	c.Assert(fetched, check.Equals, false)
+	c.Assert(calls, check.Equals, 2)
+	_, _, err = cache.values("services", now.Add(2*time.Hour), 5*time.Minute, time.Hour, fetch)
+	c.Assert(err, check.Equals, fetchErr)
+}
+
+func (s *S) TestCompletionCachePrunesOldEntries(c *check.C) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache := &completionCache{Entries: map[string]completionCacheEntry{
+		"plans/redisapi": {Values: []string{"small"}, Time: now.Add(-2 * time.Hour)},
+		"teams":          {Values: []string{"dba"}, Time: now.Add(-time.Minute)},
+	}}
+	_, _, err := cache.values("services", now, 5*time.Minute, time.Hour, func() (map[string][]string, error) {
+		return map[string][]string{"services": {}}, nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(cache.Entries, check.HasLen, 2)
+	_, ok := cache.Entries["plans/redisapi"]
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *S) TestReadCompletionCache(c *check.C) {
+	path := filepath.Join(c.MkDir(), "cache", "completion.json")
+	cache := readCompletionCache(path, "http://tsuru.example.com")
+	c.Assert(cache, check.DeepEquals, &completionCache{Target: "http://tsuru.example.com", Entries: map[string]completionCacheEntry{}})
+	cache.Entries["teams"] = completionCacheEntry{Values: []string{"dba"}, Time: time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)}
+	err := cache.write(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(readCompletionCache(path, "http://tsuru.example.com"), check.DeepEquals, cache)
+	c.Assert(readCompletionCache(path, "http://other.example.com").Entries, check.HasLen, 0)
+	err = ioutil.WriteFile(path, []byte("{not json"), 0644)
+	c.Assert(err, check.IsNil)
+	c.Assert(readCompletionCache(path, "http://tsuru.example.com").Entries, check.HasLen, 0)
+}
+
+func (s *S) TestCompletionCachePath(c *check.C) {
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", "/home/gopher")
+	path := completionCachePath("http://tsuru.example.com")
+	c.Assert(path, check.Matches, `/home/gopher/\.crane/cache/completion-[0-9a-f]{16}\.json`)
+	c.Assert(completionCachePath("http://other.example.com"), check.Not(check.Equals), path)
+}
+
+func (s *S) TestCompletionTTLs(c *check.C) {
+	path := filepath.Join(c.MkDir(), "config")
+	defer os.Unsetenv("CRANE_CONFIG")
+	os.Setenv("CRANE_CONFIG", path)
+	ttl, offlineTTL, err := completionTTLs()
+	c.Assert(err, check.IsNil)
+	c.Assert(ttl, check.Equals, 5*time.Minute)
+	c.Assert(offlineTTL, check.Equals, time.Hour)
+	err = ioutil.WriteFile(path, []byte("[completion]\nttl = 30s\noffline-ttl = 24h\n"), 0644)
+	c.Assert(err, check.IsNil)
+	ttl, offlineTTL, err = completionTTLs()
+	c.Assert(err, check.IsNil)
+	c.Assert(ttl, check.Equals, 30*time.Second)
+	c.Assert(offlineTTL, check.Equals, 24*time.Hour)
+	err = ioutil.WriteFile(path, []byte("[completion]\nttl = soon\n"), 0644)
+	c.Assert(err, check.IsNil)
+	_, _, err = completionTTLs()
+	c.Assert(err, check.ErrorMatches, `invalid ttl in the completion section of the config file: .*`)
+}
+
+// startCompletionTarget starts a tsuru server with services, teams and plans,
+// setting it as the target. It counts the requests it gets.
+func startCompletionTarget(requests *int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/1.0/services/instances":
+			w.Write([]byte(`[{"service": "redisapi", "instances": ["sessions"]}, {"service": "mysqlapi", "instances": ["db-users", "cache", "db-orders"]}]`))
+		case "/1.0/teams":
+			w.Write([]byte(`[{"Name": "users"}, {"Name": "dba"}]`))
+		case "/1.0/services/mysqlapi/plans":
+			w.Write([]byte(`[{"Name": "small"}, {"Name": "large"}]`))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	os.Setenv("TSURU_TARGET", server.URL)
+	return server
+}
+
+func runCompleteWords(m *cmd.Manager, now time.Time, words ...string) (string, error) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: words, Stdout: &stdout, Stderr: &stdout}
+	err := runComplete(m, &context, now)
+	return stdout.String(), err
+}
+
+func (s *S) TestRunComplete(c *check.C) {
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", c.MkDir())
+	var requests int
+	server := startCompletionTarget(&requests)
+	defer os.Setenv("TSURU_TARGET", "http://localhost:8080")
+	defer server.Close()
+	m := buildManager("crane", "", nil)
+	now := time.Now()
+	out, err := runCompleteWords(m, now, "instance-remove", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(out, check.Equals, "mysqlapi\nredisapi\n")
+	out, err = runCompleteWords(m, now, "instance-remove", "mysqlapi", "db")
+	c.Assert(err, check.IsNil)
+	c.Assert(out, check.Equals, "db-orders\ndb-users\n")
+	out, err = runCompleteWords(m, now, "instance-list", "-t", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(out, check.Equals, "dba\nusers\n")
+	out, err = runCompleteWords(m, now, "instance-add", "mysqlapi", "db", "--plan", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(out, check.Equals, "large\nsmall\n")
+	c.Assert(requests, check.Equals, 3)
+	_, err = os.Stat(completionCachePath(server.URL))
+	c.Assert(err, check.IsNil)
+	server.Close()
+	out, err = runCompleteWords(m, now.Add(10*time.Minute), "instance-remove", "r")
+	c.Assert(err, check.IsNil)
+	c.Assert(out, check.Equals, "redisapi\n")
+	_, err = runCompleteWords(m, now.Add(2*time.Hour), "instance-remove", "")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestRunCompleteNothingToComplete(c *check.C) {
+	var requests int
+	server := startCompletionTarget(&requests)
+	defer os.Setenv("TSURU_TARGET", "http://localhost:8080")
+	defer server.Close()
+	out, err := runCompleteWords(buildManager("crane", "", nil), time.Now(), "instance-list", "--limit", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(out, check.Equals, "")
+	c.Assert(requests, check.Equals, 0)
+}
+
+func (s *S) TestLookupComplete(c *check.C) {
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", c.MkDir())
+	var requests int
+	server := startCompletionTarget(&requests)
+	defer os.Setenv("TSURU_TARGET", "http://localhost:8080")
+	defer server.Close()
+	var stdout bytes.Buffer
+	lookup := &commandLookup{manager: buildManager("crane", "", nil), args: []string{}}
+	context := cmd.Context{Args: []string{"__complete", "doc-get", "m"}, Stdout: &stdout, Stderr: &stdout}
+	err := lookup.lookup(&context)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "mysqlapi\n")
+}
@@ -0,0 +1,575 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// completionShells are the shells completion scripts are generated for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// completionFlagValues are the values of the flags that take one of a few
+// values, by command and by the long name of the flag.
+var completionFlagValues = map[string]map[string][]string{
+	"catalog-export": {"format": {"html", "json", "markdown"}},
+	"init":           {"lang": scaffoldLanguages()},
+	"instance-list":  {"output": instanceFormats, "sort": instanceSortKeyNames()},
+	"manifest-lint":  {"format": {"text", "json", "sarif"}},
+}
+
+// completionTargetCommands are the commands whose arguments are the labels of
+// targets, completed from ~/.tsuru/targets when completing.
+var completionTargetCommands = []string{"target-set", "target-remove"}
+
+func scaffoldLanguages() []string {
+	var langs []string
+	for lang := range builtinScaffolds {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+func instanceSortKeyNames() []string {
+	var keys []string
+	for key := range instanceSortKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// completionFlag is a flag of a command. Long and short flags that set the
+// same value, like -o and --output, are a single flag.
+type completionFlag struct {
+	long   string
+	short  string
+	usage  string
+	value  bool
+	values []string
+	// remote reports whether the values of the flag are names completed
+	// from the target, by the __complete command.
+	remote bool
+}
+
+// names returns the names of the flag, with their dashes.
+func (f *completionFlag) names() []string {
+	var names []string
+	if f.short != "" {
+		names = append(names, "-"+f.short)
+	}
+	if f.long != "" {
+		names = append(names, "--"+f.long)
+	}
+	return names
+}
+
+// completionCommand is a command, as completed by the shells.
+type completionCommand struct {
+	name  string
+	desc  string
+	flags []completionFlag
+	// args are the values of the arguments of the command, when they're one
+	// of a few values.
+	args []string
+	// targets reports whether the arguments of the command are labels of
+	// targets.
+	targets bool
+	// remote reports whether the arguments of the command are completed by
+	// the __complete command.
+	remote bool
+}
+
+// sameFlagValue reports whether the flags set the same value.
+func sameFlagValue(a, b gnuflag.Value) bool {
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+// commandFlags returns the flags of the command, including -h/--help, sorted
+// by name.
+func commandFlags(name string, command cmd.Command) []completionFlag {
+	var flags []completionFlag
+	if flagged, ok := command.(cmd.FlaggedCommand); ok {
+		var all []*gnuflag.Flag
+		flagged.Flags().VisitAll(func(f *gnuflag.Flag) {
+			all = append(all, f)
+		})
+		paired := map[string]bool{}
+		for _, f := range all {
+			if paired[f.Name] {
+				continue
+			}
+			paired[f.Name] = true
+			flag := completionFlag{usage: f.Usage, value: true}
+			if b, ok := f.Value.(interface {
+				IsBoolFlag() bool
+			}); ok && b.IsBoolFlag() {
+				flag.value = false
+			}
+			if len(f.Name) == 1 {
+				flag.short = f.Name
+			} else {
+				flag.long = f.Name
+			}
+			for _, other := range all {
+				if paired[other.Name] || (len(other.Name) == 1) == (len(f.Name) == 1) || !sameFlagValue(other.Value, f.Value) {
+					continue
+				}
+				paired[other.Name] = true
+				if len(other.Name) == 1 {
+					flag.short = other.Name
+				} else {
+					flag.long = other.Name
+				}
+				break
+			}
+			flag.values = completionFlagValues[name][flag.long]
+			flag.remote = completionRemoteFlags[name][flag.long] != ""
+			flags = append(flags, flag)
+		}
+	}
+	if !hasCompletionFlag(flags, "help") {
+		flags = append(flags, completionFlag{long: "help", short: "h", usage: "Display help and exit"})
+	}
+	sort.Sort(completionFlagsByName(flags))
+	return flags
+}
+
+func hasCompletionFlag(flags []completionFlag, name string) bool {
+	for _, f := range flags {
+		if f.long == name || f.short == name {
+			return true
+		}
+	}
+	return false
+}
+
+type completionFlagsByName []completionFlag
+
+func (l completionFlagsByName) Len() int {
+	return len(l)
+}
+
+func (l completionFlagsByName) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l completionFlagsByName) Less(i, j int) bool {
+	return l[i].names()[len(l[i].names())-1] < l[j].names()[len(l[j].names())-1]
+}
+
+// completionCommands returns the commands of the manager, sorted by name.
+// Removed commands are not completed.
+func completionCommands(m *cmd.Manager) []completionCommand {
+	var names []string
+	for name, command := range m.Commands {
+		if _, ok := command.(*cmd.RemovedCommand); !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var commands []completionCommand
+	for _, name := range names {
+		command := m.Commands[name]
+		c := completionCommand{
+			name:    name,
+			desc:    firstLine(command.Info().Desc),
+			flags:   commandFlags(name, command),
+			targets: contains(completionTargetCommands, name),
+			remote:  len(completionRemoteArgs[name]) > 0,
+		}
+		// Aliases are completed like the command lines they stand for.
+		if alias, ok := command.(*aliasCommand); ok && !alias.isMacro() {
+			c.remote = true
+		}
+		switch name {
+		case "help":
+			c.args = names
+		case "completion":
+			c.args = completionShells
+		}
+		commands = append(commands, c)
+	}
+	return commands
+}
+
+func firstLine(s string) string {
+	if i := strings.Index(s, "\n"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSuffix(strings.TrimSpace(s), ".")
+}
+
+var nonIdentifierRegexp = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// completionFunc returns the prefix of the shell functions of the completion
+// of the program.
+func completionFunc(program string) string {
+	return "_" + nonIdentifierRegexp.ReplaceAllString(program, "_")
+}
+
+// singleQuote quotes the string for bash and zsh, with single quotes.
+func singleQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func writeBashCompletion(w io.Writer, program string, commands []completionCommand) error {
+	fn := completionFunc(program)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `# bash completion for %[1]s, generated by "%[1]s completion bash".
+#
+# Load it in the current shell with:
+#
+#     source <(%[1]s completion bash)
+
+%[2]s_targets() {
+    if [ -f "$HOME/.tsuru/targets" ]; then
+        cut -f1 "$HOME/.tsuru/targets"
+    fi
+}
+
+%[2]s_remote() {
+    %[1]s __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null
+}
+
+%[2]s() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local prev="${COMP_WORDS[COMP_CWORD-1]}"
+    local command="" i
+    for ((i = 1; i < COMP_CWORD; i++)); do
+        case "${COMP_WORDS[i]}" in
+        -v|--verbosity) ((i++)) ;;
+        -*) ;;
+        *) command="${COMP_WORDS[i]}"; break ;;
+        esac
+    done
+    COMPREPLY=()
+    if [ -z "$command" ]; then
+        case "$prev" in
+        -v|--verbosity)
+            COMPREPLY=( $(compgen -W "0 1 2" -- "$cur") )
+            return ;;
+        esac
+        if [[ "$cur" == -* ]]; then
+            COMPREPLY=( $(compgen -W "-h --help -v --verbosity --version" -- "$cur") )
+        else
+            COMPREPLY=( $(compgen -W "%[3]s" -- "$cur") )
+        fi
+        return
+    fi
+    case "$command" in
+`, program, fn, strings.Join(completionCommandNames(commands), " "))
+	for _, c := range commands {
+		fmt.Fprintf(&b, "    %s)\n", c.name)
+		var flagNames []string
+		var valueFlags bool
+		for _, f := range c.flags {
+			flagNames = append(flagNames, f.names()...)
+			valueFlags = valueFlags || f.value
+		}
+		if valueFlags {
+			b.WriteString("        case \"$prev\" in\n")
+			for _, f := range c.flags {
+				if !f.value {
+					continue
+				}
+				fmt.Fprintf(&b, "        %s)\n", strings.Join(f.names(), "|"))
+				if len(f.values) > 0 {
+					fmt.Fprintf(&b, "            COMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n", strings.Join(f.values, " "))
+				} else if f.remote {
+					fmt.Fprintf(&b, "            COMPREPLY=( $(compgen -W \"$(%s_remote)\" -- \"$cur\") )\n", fn)
+				}
+				b.WriteString("            return ;;\n")
+			}
+			b.WriteString("        esac\n")
+		}
+		b.WriteString("        if [[ \"$cur\" == -* ]]; then\n")
+		fmt.Fprintf(&b, "            COMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n", strings.Join(flagNames, " "))
+		switch {
+		case c.targets:
+			b.WriteString("        else\n")
+			fmt.Fprintf(&b, "            COMPREPLY=( $(compgen -W \"$(%s_targets)\" -- \"$cur\") )\n", fn)
+		case len(c.args) > 0:
+			b.WriteString("        else\n")
+			fmt.Fprintf(&b, "            COMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n", strings.Join(c.args, " "))
+		case c.remote:
+			b.WriteString("        else\n")
+			fmt.Fprintf(&b, "            COMPREPLY=( $(compgen -W \"$(%s_remote)\" -- \"$cur\") )\n", fn)
+		}
+		b.WriteString("        fi\n        ;;\n")
+	}
+	fmt.Fprintf(&b, `    esac
+}
+
+complete -F %s -o bashdefault -o default %s
+`, fn, program)
+	_, err := b.WriteTo(w)
+	return err
+}
+
+func completionCommandNames(commands []completionCommand) []string {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+	return names
+}
+
+// zshDescription escapes the description for the specs of _arguments.
+func zshDescription(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+func writeZshCompletion(w io.Writer, program string, commands []completionCommand) error {
+	fn := completionFunc(program)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `#compdef %[1]s
+
+# zsh completion for %[1]s, generated by "%[1]s completion zsh".
+#
+# Load it in the current shell with:
+#
+#     source <(%[1]s completion zsh)
+
+%[2]s_targets() {
+    local -a targets
+    if [[ -f $HOME/.tsuru/targets ]]; then
+        targets=(${(f)"$(cut -f1 $HOME/.tsuru/targets)"})
+    fi
+    compadd -a targets
+}
+
+%[2]s_remote() {
+    local -a values
+    values=(${(f)"$(%[1]s __complete "${(@)words[1,CURRENT]}" 2>/dev/null)"})
+    if (( $#values )); then
+        compadd -a values
+    else
+        _files
+    fi
+}
+
+%[2]s() {
+    local curcontext="$curcontext" state line
+    typeset -A opt_args
+    local -a commands
+    commands=(
+`, program, fn)
+	for _, c := range commands {
+		fmt.Fprintf(&b, "        %s\n", singleQuote(c.name+":"+c.desc))
+	}
+	fmt.Fprintf(&b, `    )
+    _arguments -C \
+        '(-v --verbosity)'{-v,--verbosity}'[Verbosity level]:level:(0 1 2)' \
+        '(- *)'{-h,--help}'[Display help and exit]' \
+        '(- *)--version[Print version and exit]' \
+        '1: :->command' \
+        '*:: :->args'
+    case $state in
+    command)
+        _describe -t commands %s commands
+        ;;
+    args)
+        case $line[1] in
+`, singleQuote(program+" command"))
+	for _, c := range commands {
+		fmt.Fprintf(&b, "        %s)\n            _arguments \\\n", c.name)
+		for _, f := range c.flags {
+			names := f.names()
+			spec := "[" + zshDescription(f.usage) + "]"
+			if f.value {
+				name := f.long
+				if name == "" {
+					name = f.short
+				}
+				if len(f.values) > 0 {
+					spec += ":" + name + ":(" + strings.Join(f.values, " ") + ")"
+				} else if f.remote {
+					spec += ":" + name + ":" + fn + "_remote"
+				} else {
+					spec += ":" + name + ":_files"
+				}
+			}
+			if len(names) > 1 {
+				// Both names are completed, excluding each other.
+				spec = singleQuote("("+strings.Join(names, " ")+")") + "{" + strings.Join(names, ",") + "}" + singleQuote(spec)
+			} else {
+				spec = singleQuote(names[0] + spec)
+			}
+			fmt.Fprintf(&b, "                %s \\\n", spec)
+		}
+		switch {
+		case c.targets:
+			fmt.Fprintf(&b, "                '*:target:%s_targets'\n", fn)
+		case len(c.args) > 0:
+			fmt.Fprintf(&b, "                '*:argument:(%s)'\n", strings.Join(c.args, " "))
+		case c.remote:
+			fmt.Fprintf(&b, "                '*:argument:%s_remote'\n", fn)
+		default:
+			b.WriteString("                '*:file:_files'\n")
+		}
+		b.WriteString("            ;;\n")
+	}
+	fmt.Fprintf(&b, `        esac
+        ;;
+    esac
+}
+
+if [ "$funcstack[1]" = "%[1]s" ]; then
+    %[1]s "$@"
+else
+    compdef %[1]s %[2]s
+fi
+`, fn, program)
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// fishQuote quotes the string for fish, with single quotes, in which fish
+// takes backslashes as escapes.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func writeFishCompletion(w io.Writer, program string, commands []completionCommand) error {
+	fn := "_" + completionFunc(program)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `# fish completion for %[1]s, generated by "%[1]s completion fish".
+#
+# Load it in the current shell with:
+#
+#     %[1]s completion fish | source
+
+function %[2]s_command
+    set -l words (commandline -opc)
+    set -e words[1]
+    while set -q words[1]
+        switch $words[1]
+            case -v --verbosity
+                set -e words[1]
+            case '-*'
+            case '*'
+                echo $words[1]
+                return 0
+        end
+        set -e words[1]
+    end
+    return 1
+end
+
+function %[2]s_using_command
+    set -l command (%[2]s_command)
+    and test "$command" = $argv[1]
+end
+
+function %[2]s_targets
+    test -f ~/.tsuru/targets
+    and cut -f1 ~/.tsuru/targets
+end
+
+function %[2]s_remote
+    set -l words (commandline -opc)
+    set -l current (commandline -ct)
+    %[1]s __complete $words[2..-1] "$current" 2>/dev/null
+end
+
+complete -c %[1]s -n 'not %[2]s_command' -f -s v -l verbosity -x -a '0 1 2' -d 'Verbosity level'
+complete -c %[1]s -n 'not %[2]s_command' -f -s h -l help -d 'Display help and exit'
+complete -c %[1]s -n 'not %[2]s_command' -f -l version -d 'Print version and exit'
+`, program, fn)
+	for _, c := range commands {
+		fmt.Fprintf(&b, "complete -c %s -n 'not %s_command' -f -a %s -d %s\n", program, fn, c.name, fishQuote(c.desc))
+	}
+	for _, c := range commands {
+		condition := fishQuote(fn + "_using_command " + c.name)
+		for _, f := range c.flags {
+			line := fmt.Sprintf("complete -c %s -n %s", program, condition)
+			if f.short != "" {
+				line += " -s " + f.short
+			}
+			if f.long != "" {
+				line += " -l " + f.long
+			}
+			if len(f.values) > 0 {
+				line += " -x -a " + fishQuote(strings.Join(f.values, " "))
+			} else if f.remote {
+				line += fmt.Sprintf(" -x -a '(%s_remote)'", fn)
+			} else if f.value {
+				line += " -r"
+			}
+			fmt.Fprintf(&b, "%s -d %s\n", line, fishQuote(f.usage))
+		}
+		switch {
+		case c.targets:
+			fmt.Fprintf(&b, "complete -c %s -n %s -x -a '(%s_targets)'\n", program, condition, fn)
+		case len(c.args) > 0:
+			fmt.Fprintf(&b, "complete -c %s -n %s -x -a %s\n", program, condition, fishQuote(strings.Join(c.args, " ")))
+		case c.remote:
+			// Files are still completed, for the arguments that are files.
+			fmt.Fprintf(&b, "complete -c %s -n %s -a '(%s_remote)'\n", program, condition, fn)
+		}
+	}
+	_, err := b.WriteTo(w)
+	return err
+}
+
+type completion struct {
+	manager *cmd.Manager
+	program string
+}
+
+func (c *completion) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "completion",
+		Usage: "completion bash|zsh|fish",
+		Desc: `Generates the completion script of crane for a shell: bash, zsh or fish.
+
+The scripts complete the commands, including plugins and aliases, their flags
+and the values of the flags that take one of a few values. The labels of the
+targets are read from ~/.tsuru/targets when completing, so they're always up to
+date. The names of services, instances, teams and plans are fetched from the
+target and cached in ~/.crane/cache for 5 minutes, or the ttl set in the
+completion section of the config file. Load the script in the current shell
+with:
+
+    source <(crane completion bash)
+    source <(crane completion zsh)
+    crane completion fish | source
+
+Generate the script again after installing plugins or defining aliases.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *completion) Run(context *cmd.Context, client *cmd.Client) error {
+	program := c.program
+	if program == "" {
+		program = "crane"
+	}
+	commands := completionCommands(c.manager)
+	// The pager would page the script.
+	context.RawOutput()
+	switch context.Args[0] {
+	case "bash":
+		return writeBashCompletion(context.Stdout, program, commands)
+	case "zsh":
+		return writeZshCompletion(context.Stdout, program, commands)
+	case "fish":
+		return writeFishCompletion(context.Stdout, program, commands)
+	}
+	return fmt.Errorf("unknown shell %q, must be bash, zsh or fish", context.Args[0])
+}
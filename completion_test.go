@@ -0,0 +1,161 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestCommandFlags(c *check.C) {
+	flags := commandFlags("instance-list", &instanceList{})
+	c.Assert(flags, check.HasLen, 11)
+	c.Assert(flags[0], check.DeepEquals, completionFlag{long: "app", short: "a", usage: "List only the instances bound to the app", value: true})
+	c.Assert(flags[1], check.DeepEquals, completionFlag{long: "help", short: "h", usage: "Display help and exit"})
+	c.Assert(flags[5], check.DeepEquals, completionFlag{long: "output", short: "o", usage: "Output format: table, json, yaml or csv", value: true, values: instanceFormats})
+	c.Assert(flags[7], check.DeepEquals, completionFlag{long: "reverse", usage: "Reverse the order of the instances"})
+	c.Assert(flags[9].values, check.DeepEquals, []string{"apps", "name", "plan", "service", "team"})
+}
+
+func (s *S) TestCommandFlagsConfirmation(c *check.C) {
+	flags := commandFlags("plugin-remove", &pluginRemove{})
+	var names []string
+	for _, f := range flags {
+		names = append(names, strings.Join(f.names(), " "))
+	}
+	c.Assert(names, check.DeepEquals, []string{"-y --assume-yes", "-h --help", "-l --lock"})
+}
+
+func (s *S) TestCommandFlagsNotFlagged(c *check.C) {
+	flags := commandFlags("instance-add", &failCommand{})
+	c.Assert(flags, check.DeepEquals, []completionFlag{{long: "help", short: "h", usage: "Display help and exit"}})
+}
+
+func (s *S) TestCompletionCommands(c *check.C) {
+	m := buildManager("crane", "", nil)
+	commands := completionCommands(m)
+	byName := map[string]completionCommand{}
+	for _, command := range commands {
+		byName[command.name] = command
+	}
+	_, ok := byName["create"]
+	c.Assert(ok, check.Equals, false)
+	c.Assert(byName["instance-list"].desc, check.Equals, "Lists the service instances you can read, one per line, with their plans, teams")
+	c.Assert(byName["target-set"].targets, check.Equals, true)
+	c.Assert(byName["instance-list"].targets, check.Equals, false)
+	c.Assert(byName["completion"].args, check.DeepEquals, []string{"bash", "zsh", "fish"})
+	c.Assert(byName["help"].args, check.DeepEquals, completionCommandNames(commands))
+	c.Assert(byName["catalog-export"].flags[1].values, check.DeepEquals, []string{"html", "json", "markdown"})
+}
+
+func (s *S) TestBashCompletion(c *check.C) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		c.Skip("bash is not installed")
+	}
+	var script bytes.Buffer
+	err = writeBashCompletion(&script, "crane", completionCommands(buildManager("crane", "", nil)))
+	c.Assert(err, check.IsNil)
+	home := c.MkDir()
+	err = os.Mkdir(filepath.Join(home, ".tsuru"), 0755)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(home, ".tsuru", "targets"), []byte("prod\thttps://tsuru.example.com\nstaging\thttps://staging.example.com\n"), 0644)
+	c.Assert(err, check.IsNil)
+	tests := []struct {
+		words string
+		reply string
+	}{
+		{"crane instance-s", "instance-status"},
+		{"crane -v 2 instance-l", "instance-list"},
+		{"crane instance-list -o ''", "table json yaml csv"},
+		{"crane instance-list --sort p", "plan"},
+		{"crane instance-list --re", "--reverse"},
+		{"crane instance-list --service ''", "__complete,instance-list,--service,"},
+		{"crane -v 2 instance-remove mysqlapi ''", "__complete,-v,2,instance-remove,mysqlapi,"},
+		{"crane instance-list --name ''", ""},
+		{"crane target-set ''", "prod staging"},
+		{"crane completion f", "fish"},
+		{"crane plugin-remove --a", "--assume-yes"},
+		{"crane --vers", "--version"},
+	}
+	for _, t := range tests {
+		program := script.String() + `
+HOME=` + singleQuote(home) + `
+crane() {
+    local IFS=,
+    echo "$*"
+}
+COMP_WORDS=(` + t.words + `)
+COMP_CWORD=$((${#COMP_WORDS[@]} - 1))
+_crane
+echo "${COMPREPLY[*]}"
+`
+		out, err := exec.Command(bash, "-c", program).CombinedOutput()
+		c.Check(err, check.IsNil, check.Commentf(t.words))
+		c.Check(strings.TrimSpace(string(out)), check.Equals, t.reply, check.Commentf(t.words))
+	}
+}
+
+func (s *S) TestZshCompletion(c *check.C) {
+	var script bytes.Buffer
+	err := writeZshCompletion(&script, "crane", completionCommands(buildManager("crane", "", nil)))
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.HasPrefix(script.String(), "#compdef crane\n"), check.Equals, true)
+	for _, line := range []string{
+		`        'instance-remove:Removes an instance of the service. Instances bound to apps can'\''t be'`,
+		`                '(-o --output)'{-o,--output}'[Output format: table, json, yaml or csv]:output:(table json yaml csv)' \`,
+		`                '--reverse[Reverse the order of the instances]' \`,
+		`                '*:target:_crane_targets'`,
+		`                '(-p --plan)'{-p,--plan}'[Plan of the instance]:plan:_crane_remote' \`,
+		`                '*:argument:_crane_remote'`,
+		`        targets=(${(f)"$(cut -f1 $HOME/.tsuru/targets)"})`,
+		`    compdef _crane crane`,
+	} {
+		c.Check(strings.Contains(script.String(), line+"\n"), check.Equals, true, check.Commentf(line))
+	}
+}
+
+func (s *S) TestFishCompletion(c *check.C) {
+	var script bytes.Buffer
+	err := writeFishCompletion(&script, "crane", completionCommands(buildManager("crane", "", nil)))
+	c.Assert(err, check.IsNil)
+	for _, line := range []string{
+		`complete -c crane -n 'not __crane_command' -f -a instance-list -d 'Lists the service instances you can read, one per line, with their plans, teams'`,
+		`complete -c crane -n 'not __crane_command' -f -a instance-remove -d 'Removes an instance of the service. Instances bound to apps can\'t be'`,
+		`complete -c crane -n '__crane_using_command instance-list' -s o -l output -x -a 'table json yaml csv' -d 'Output format: table, json, yaml or csv'`,
+		`complete -c crane -n '__crane_using_command instance-list' -l reverse -d 'Reverse the order of the instances'`,
+		`complete -c crane -n '__crane_using_command instance-list' -s s -l service -x -a '(__crane_remote)' -d 'List only the instances of the service'`,
+		`complete -c crane -n '__crane_using_command instance-remove' -a '(__crane_remote)'`,
+		`complete -c crane -n '__crane_using_command target-set' -x -a '(__crane_targets)'`,
+		`complete -c crane -n '__crane_using_command completion' -x -a 'bash zsh fish'`,
+	} {
+		c.Check(strings.Contains(script.String(), line+"\n"), check.Equals, true, check.Commentf(line))
+	}
+}
+
+func (s *S) TestCompletionRun(c *check.C) {
+	m := buildManager("tsuru-crane", "", nil)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"bash"}, Stdout: &stdout}
+	command := completion{manager: m, program: "tsuru-crane"}
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s)# bash completion for tsuru-crane, .*\ncomplete -F _tsuru_crane -o bashdefault -o default tsuru-crane\n`)
+	context.Args = []string{"tcsh"}
+	err = command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `unknown shell "tcsh", must be bash, zsh or fish`)
+}
+
+func (s *S) TestSingleQuote(c *check.C) {
+	c.Assert(singleQuote("can't"), check.Equals, `'can'\''t'`)
+	c.Assert(fishQuote(`can't \n`), check.Equals, `'can\'t \\n'`)
+}
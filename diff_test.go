@@ -0,0 +1,66 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestUnifiedDiffEqual(c *check.C) {
+	c.Assert(unifiedDiff("a", "b", "one\ntwo\n", "one\ntwo\n"), check.Equals, "")
+	c.Assert(unifiedDiff("a", "b", "one\ntwo", "one\ntwo\n"), check.Equals, "")
+	c.Assert(unifiedDiff("a", "b", "", ""), check.Equals, "")
+}
+
+func (s *S) TestUnifiedDiff(c *check.C) {
+	from := "mysqlapi\n\nVariables:\n\n  MYSQL_HOST\n  MYSQL_PORT\n  MYSQL_USER\n"
+	to := "mysqlapi\n\nVariables:\n\n  MYSQL_HOST\n  MYSQL_USER\n  MYSQL_PASSWORD\n"
+	c.Assert(unifiedDiff("mysqlapi (tsuru)", "README.md", from, to), check.Equals, `--- mysqlapi (tsuru)
++++ README.md
+@@ -3,5 +3,5 @@
+ Variables:
+ 
+   MYSQL_HOST
+-  MYSQL_PORT
+   MYSQL_USER
++  MYSQL_PASSWORD
+`)
+}
+
+func (s *S) TestUnifiedDiffHunks(c *check.C) {
+	var lines []string
+	for _, l := range "abcdefghijklmnopqrst" {
+		lines = append(lines, string(l))
+	}
+	from := strings.Join(lines, "\n") + "\n"
+	lines[1] = "B"
+	lines[17] = "R"
+	to := strings.Join(lines, "\n") + "\n"
+	c.Assert(unifiedDiff("a", "b", from, to), check.Equals, `--- a
++++ b
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -15,6 +15,6 @@
+ o
+ p
+ q
+-r
++R
+ s
+ t
+`)
+}
+
+func (s *S) TestUnifiedDiffEmptySides(c *check.C) {
+	c.Assert(unifiedDiff("a", "b", "", "one\ntwo\n"), check.Equals, "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+one\n+two\n")
+	c.Assert(unifiedDiff("a", "b", "one\n", ""), check.Equals, "--- a\n+++ b\n@@ -1 +0,0 @@\n-one\n")
+}
@@ -37,13 +37,37 @@ The currently available commands are (grouped by subject):
 	team-user-remove  removes a user from a team
 
 	template          generates a new manifest file, so you can just fill information for your service
+	init              generates a new service API project
 	create            creates a new service from a manifest file
 	update            updates a service using a manifest file
+	apply             creates or updates a service so it matches a manifest file
+	plan              displays (and saves) the changes apply would make
+	manifest-lint     checks a manifest file for problems
+	api-check         checks that a service API conforms to the tsuru services API
+	api-bench         benchmarks a service API under concurrent instance churn
+	api-emulate       starts a local tsuru stand-in for testing a service API
+	api-proxy         logs and records the traffic of a service API
+	api-replay        sends the requests recorded by api-proxy again
+	api-spec          displays the OpenAPI document of the services API
+	instance-add      creates an instance of a service
+	instance-remove   removes an instance of a service
+	instance-bind     binds an instance of a service to an app
+	instance-unbind   unbinds an instance of a service from an app
+	instance-list     lists service instances, with filters
+	instance-status   displays the status of the instances of a service
+	instance-orphans  lists the unbound instances of a service
+	plugin-install    installs a plugin, pinning its checksum
+	plugin-list       lists the installed plugins
+	plugin-remove     removes a plugin
+	completion        generates the shell completion scripts
 	remove            removes a service
 	list              list all services that the user is administrator of
 
 	doc-add           updates service's documentation
 	doc-get           gets current docs of the service
+	doc-verify        checks the docs of the service against its bind response
+	doc-sync          syncs the docs of the service with a file
+	catalog-export    exports a catalog of the services you can read
 
 Use "crane help <command>" for more information about a command.
 
@@ -202,17 +226,34 @@ A team can never have 0 users. If you are the last member of a team, you can't
 remove yourself from it.
 
 
-Create an empty manifest file
+Create a manifest file
 
 Usage:
 
-	% crane template
+	% crane template [-o/--output <manifest-file.yaml>] [-n/--non-interactive] [--id <id>] [--endpoint <name>=<url>]... [--team <team>]...
 
-Template will create a file named "manifest.yaml" with the following content:
+Template will ask for the id of the service, its endpoints, the teams that own
+it and the credentials used by tsuru to authenticate in the service API,
+validating each answer, and create a file named "manifest.yaml" with the
+following content:
 
-	id: servicename
-	endpoint:
-	  production: production-endpoint.com
+	version: 2
+	id: mysqlapi
+	username: mysqlapi
+	password: ${MYSQLAPI_PASSWORD}
+	teams:
+	- admin
+	endpoints:
+	  production: https://mysqlapi.com
+
+Answers may also be given with flags. In non-interactive mode, which is useful
+for scripts, nothing is asked and the values come only from flags:
+
+	% crane template -n --id mysqlapi --endpoint production=https://mysqlapi.com --team admin
+
+By default, the password is a reference to an environment variable, so it's not
+stored in the manifest. Existing files are never overwritten, unless the
+-f/--force flag is given.
 
 Change it at will to configure your service. Id is the id of your service, it
 must be unique. You must provide a production endpoint that will be invoked by
@@ -255,6 +296,436 @@ possible to edit an endpoint, or add new endpoints. You need to be an
 administrator of the team to perform an update.
 
 
+Apply a manifest file
+
+Usage:
+
+	% crane apply <manifest-file.yaml>
+
+Apply will fetch the current definition of the service from the tsuru server
+and compare it with the manifest file. If the service does not exist, it will
+be created; if it differs from the manifest, it will be updated. Here is an
+example of usage:
+
+	% crane apply /home/gopher/projects/mysqlapi/manifest.yaml
+	~ endpoint.production: mysqlapi.com => https://mysqlapi.com:7777
+	Service "mysqlapi" successfully updated.
+	% crane apply /home/gopher/projects/mysqlapi/manifest.yaml
+	Service "mysqlapi" is up to date.
+
+Applying the same manifest many times is safe, so apply can be run on every
+change of the manifest.
+
+The manifest file is versioned. The current version of the format describes
+the credentials used by tsuru to call the service API, the endpoints of the
+service (production, staging, or one per pool), its administrator teams, a
+description, a doc file (relative to the manifest file) and the plans the
+service API is expected to offer:
+
+	version: 2
+	id: mysqlapi
+	description: MySQL databases for tsuru apps
+	username: mysqlapi
+	password: s3cr3t
+	teams:
+	  - admin
+	doc: doc.txt
+	endpoints:
+	  production: https://mysqlapi.com:7777
+	  staging: https://staging.mysqlapi.com:7777
+	plans:
+	  - name: small
+	    description: 1GB of storage
+
+Manifests without a version, like the ones generated by older versions of
+crane, are upgraded automatically: "endpoint" becomes "endpoints", "team" is
+added to "teams" and "plans" may be a list of names. Errors in the manifest
+are reported with their line and column.
+
+Plans are defined by the service API, so crane only reports differences in
+plans, it never changes them.
+
+Values in the manifest may reference environment variables and files, so
+secrets don't need to be stored in the manifest: "${DB_PASSWORD}" is replaced
+by the value of the environment variable DB_PASSWORD, "${file:secrets/pass}"
+by the contents of the file (relative to the manifest file) and "$$" by "$".
+
+When the same service runs in many tsuru installations, the differences
+between them may be written in overlay files, which are merged over the
+manifest when the environment is given with -e/--env:
+
+	% cat manifest.prod.yaml
+	password: ${PROD_PASSWORD}
+	endpoints:
+	  production: https://mysqlapi.prod.example.com
+	  staging: null
+	% crane apply manifest.yaml --env prod
+
+Mappings in the overlay file are merged with the ones in the manifest, null
+values remove fields and other values replace the ones in the manifest. The
+plan and manifest-lint commands also accept the -e/--env flag.
+
+
+Review changes before applying them
+
+Usage:
+
+	% crane plan <manifest-file.yaml> [-o/--output <plan-file.json>]
+
+Plan will display the changes that "crane apply" would make in the service:
+differences in endpoints, teams, documentation and plans. When an output file
+is given, the plan is saved to it:
+
+	% crane plan manifest.yaml -o plan.json
+	~ endpoint.production: mysqlapi.com => https://mysqlapi.com:7777
+	+ team: admin
+	Plan saved to plan.json.
+	% crane apply plan.json
+
+Applying a plan file executes exactly the changes in the plan. If the service
+changed in the tsuru server after the plan was made, apply will refuse to
+execute it, and a new plan must be made. Plan files don't include the password
+of the service, so plans creating the service are refused too: the manifest
+must be applied instead.
+
+
+Check a manifest file for problems
+
+Usage:
+
+	% crane manifest-lint <manifest-file.yaml> [--policy <policy-file.yaml>] [--format text|json|sarif]
+
+manifest-lint checks a manifest file without talking to the tsuru server.
+Besides checking that the manifest is valid, it checks that endpoints use
+HTTPS, that the id is a valid service name, that the password is not stored in
+the manifest and that the doc file exists:
+
+	% crane manifest-lint manifest.yaml
+	manifest.yaml:5:1: error: the password is stored in plaintext in the manifest [plaintext-password]
+	Error: 1 error(s) found in the manifest
+
+Teams may disable built-in rules and add their own rules in a policy file.
+Each rule checks a field of the manifest ("id", "endpoints", "plans.name",
+...), requiring it to be defined or its values to match (or not match) a
+regular expression:
+
+	disable:
+	  - doc-file
+	rules:
+	  - id: company-domain
+	    description: Endpoints must be in the company domain.
+	    severity: warning
+	    field: endpoints
+	    match: '^https://[a-z0-9.-]+\.example\.com(:\d+)?/?$'
+
+The fields rules may check are id, description, username, password, doc,
+teams, endpoints, endpoints.<name>, plans, plans.name and plans.description.
+Policies with rules for other fields are rejected, with the position of the
+rule in the policy file.
+
+Findings may be displayed in JSON or SARIF, for annotating pull requests in CI
+systems. The command fails if any of the findings is an error.
+
+
+Check a service API
+
+Usage:
+
+	% crane api-check <endpoint> [-m/--manifest <manifest-file.yaml>] [--plan <plan>] [--expect-var <name>]...
+
+api-check checks that a service API conforms to the tsuru services API, before
+registering it in tsuru. It drives a full lifecycle of a service instance
+against the endpoint, like tsuru would do: the plans are listed, an instance is
+created, its status is checked, it's bound to a fake app and unit, unbound and
+removed. The credentials are taken from the manifest file:
+
+	% crane api-check production --expect-var MYSQL_HOST
+	+----------------------------+--------+-------------------------------------------------+
+	| Check                      | Result | Details                                         |
+	+----------------------------+--------+-------------------------------------------------+
+	| list plans                 | ok     | 200 OK in 12ms, 2 plan(s)                       |
+	| reject invalid credentials | ok     | 401 Unauthorized in 3ms                         |
+	| ...                        |        |                                                 |
+	| bind app                   | failed | missing environment variables in the response:  |
+	|                            |        | MYSQL_HOST                                      |
+	| ...                        |        |                                                 |
+	| remove instance again      | failed | expected status 200 or 404, got 500             |
+	+----------------------------+--------+-------------------------------------------------+
+	9 passed, 2 failed, 0 skipped.
+
+The endpoint may be a URL or the name of an endpoint in the manifest. Every
+contract violation is reported, like wrong status codes, bind responses without
+environment variables and removals that fail when repeated.
+
+
+Benchmark a service API
+
+Usage:
+
+	% crane api-bench <endpoint> [-m/--manifest <manifest-file.yaml>] [-c/--concurrency <n>] [-n/--cycles <n>] [-d/--duration <duration>] [--json]
+
+api-bench runs concurrent cycles of instance churn against a service API: each
+cycle creates an instance, binds it to an app, unbinds it and removes it. The
+service API is called directly, so it works against a local endpoint, without a
+tsuru server:
+
+	% crane api-bench http://localhost:8888 -c 10 -n 200
+	Ran 200 cycle(s) with 10 worker(s) in 4.12s (48.5 cycles/s), 1 failed.
+	+--------+----------+------------+--------+---------+---------+---------+
+	| Step   | Requests | Errors     | p50    | p90     | p99     | Max     |
+	+--------+----------+------------+--------+---------+---------+---------+
+	| create | 200      | 1 (0.5%)   | 81.2ms | 143.9ms | 301.4ms | 322.0ms |
+	| bind   | 199      | 0 (0.0%)   | 12.5ms | 20.1ms  | 33.7ms  | 35.2ms  |
+	| unbind | 199      | 0 (0.0%)   | 9.8ms  | 15.3ms  | 24.0ms  | 26.1ms  |
+	| remove | 199      | 0 (0.0%)   | 40.3ms | 72.6ms  | 98.8ms  | 102.5ms |
+	+--------+----------+------------+--------+---------+---------+---------+
+	create: expected status 201, got 500 (1 time(s))
+
+With --duration, cycles keep being started until the duration is over, for soak
+testing. Use --json to get the report in JSON, for tracking trends across
+releases.
+
+
+Emulate tsuru for a service
+
+Usage:
+
+	% crane api-emulate <manifest-file.yaml> [-e/--env <environment>] [--endpoint <name>] [--app <app>]... [-- <command> [args...]]
+
+api-emulate starts a local stand-in for the tsuru API, with the service from
+the manifest registered and a set of fake apps, so a service API can be tested
+end-to-end without a tsuru installation. The emulated service calls the real
+service API and every call is logged:
+
+	% crane api-emulate manifest.yaml --app myapp -- sh
+	Emulating tsuru at http://127.0.0.1:51234, with the service "mysqlapi" and the apps: myapp.
+	$ crane instance-add mysqlapi mydb -p small
+	POST /resources: 201 Created in 35ms
+	Service instance "mydb" successfully created.
+
+The command runs with the TSURU_TARGET and TSURU_TOKEN environment variables
+pointing to the emulator. When no command is given, the user's shell is
+started. The emulator is not authenticated, so --listen only takes loopback
+addresses, like 127.0.0.1:8080, and listens on 127.0.0.1 when only the port is
+given.
+
+
+Manage service instances
+
+Usage:
+
+	% crane instance-add <service> <instance> [-p/--plan <plan>] [-t/--team <team>]
+	% crane instance-bind <service> <instance> -a/--app <app>
+	% crane instance-unbind <service> <instance> -a/--app <app>
+	% crane instance-remove <service> <instance> [-y/--assume-yes]
+
+These commands create, bind, unbind and remove instances of a service, for
+testing it against the tsuru stand-in started by api-emulate. instance-bind
+displays the environment variables the service API set in the app.
+
+
+List service instances
+
+Usage:
+
+	% crane instance-list [-s/--service <service>] [-t/--team <team>] [-p/--plan <plan>] [-a/--app <app>] [-n/--name <pattern>] [--sort service|name|plan|team|apps] [--reverse] [--limit <n>] [--offset <n>] [-o/--output table|json|yaml|csv]
+
+instance-list lists the service instances you can read, one per line, with
+their plans, teams and bound apps. The instances may be filtered by service, by
+team (the owner of the instance or a team with access to it), by plan, by bound
+app and by name, with a glob pattern:
+
+	% crane instance-list -s mysqlapi -n "db-*" -a web
+	+----------+----------+-------+-------+----------+
+	| Service  | Instance | Plan  | Team  | Apps     |
+	+----------+----------+-------+-------+----------+
+	| mysqlapi | db-users | small | users | api, web |
+	+----------+----------+-------+-------+----------+
+
+Instances are sorted by service and name, or by the field given with --sort.
+Use --limit and --offset to list a page of the instances. The json, yaml and
+csv output formats feed the inventory into other tools.
+
+
+Display the status of service instances
+
+Usage:
+
+	% crane instance-status <service> [-w/--workers <n>] [--timeout <duration>] [--watch <interval>]
+
+instance-status retrieves the status of every instance of the service
+concurrently, with a bounded number of workers (10 by default), and displays
+them in a table, unhealthy instances first, with the time each status took:
+
+	% crane instance-status mysqlapi
+	Instances of "mysqlapi" at 15:04:05:
+	+----------+---------+---------+------+
+	| Instance | Health  | Status  | Time |
+	+----------+---------+---------+------+
+	| orders   | down    | down    | 31ms |
+	| cache    | unknown | pending | 12ms |
+	| users    | healthy | up      | 9ms  |
+	+----------+---------+---------+------+
+	1 healthy, 1 down, 1 unknown.
+
+Instances whose status is pending, or can't be retrieved within --timeout, are
+unknown. The command fails if any instance is not healthy. With --watch, like
+"--watch 10s", the statuses are refreshed at every interval, in place when the
+output is a terminal, until the command is interrupted. The health is colored
+only when the output is a terminal.
+
+
+Find orphaned service instances
+
+Usage:
+
+	% crane instance-orphans <service> [--idle <duration>] [--remove] [-y/--assume-yes]
+
+instance-orphans lists the instances of the service that no app is bound to,
+and the instances whose owning team no longer exists, along with the last bind
+or unbind event of each, taken from the event history of tsuru:
+
+	% crane instance-orphans mysqlapi
+	+----------+-------+------+------+----------------------------------------+-------------------------+
+	| Instance | Plan  | Team | Apps | Last bind                              | Reason                  |
+	+----------+-------+------+------+----------------------------------------+-------------------------+
+	| idle     | small | dba  |      | unbound from myapp at 2017-09-01 10:30 | unbound                 |
+	| lost     | small | gone |      | -                                      | unbound, team not found |
+	+----------+-------+------+------+----------------------------------------+-------------------------+
+	2 orphaned instances of "mysqlapi", out of 40 instances.
+
+With --idle, like "--idle 720h", unbound instances are only listed when nothing
+was bound to, or unbound from, them within the duration. Teams you can't read
+are reported as not found.
+
+With --remove, the unbound orphaned instances are removed, after confirmation.
+Instances still bound to apps are never removed, and neither are instances
+whose team is not found, as it may be a team you can't read. --idle and
+--remove fail when the bind history is not available, and with --idle,
+instances whose bind history can't be read completely are not removed.
+
+
+Record the traffic of a service API
+
+Usage:
+
+	% crane api-proxy --upstream <endpoint> [-l/--listen <address>] [-o/--output <session-file>]
+	% crane api-replay <session-file> <endpoint> [-m/--manifest <manifest-file.yaml>]
+
+api-proxy starts a reverse proxy to a service API, logging every request tsuru
+sends to the service, along with the response. Point the endpoint of the
+service in tsuru to the proxy to see what tsuru actually sends. The secret in
+the basic authentication is always redacted:
+
+	% crane api-proxy --upstream http://localhost:8000 --listen :8888
+	Proxying http://localhost:8000 at [::]:8888, recording the session to session-20171018-150405.jsonl.
+	POST /resources/mydb/bind-app: 201 Created in 12.4ms
+	  Authorization: Basic mysqlapi:REDACTED
+	  > app-host=myapp.example.com&app-name=myapp
+	  < {"MYSQL_HOST":"10.0.0.2"}
+
+The exchanges are recorded to a session file, one JSON object per line.
+api-replay sends the recorded requests again, in order, to a service API, like
+a new build of the service, comparing the status of the responses with the
+recorded ones. The credentials are taken from the manifest file. Exchanges
+recorded while a fault was injected (see below) are skipped, as their responses
+were made up or altered by the proxy.
+
+
+Inject faults in a service API
+
+Usage:
+
+	% crane api-proxy --upstream <endpoint> --faults <rules-file.yaml> [--control <address>]
+
+The proxy started by api-proxy may inject faults in the exchanges between tsuru
+and the service API, for checking that the service and tsuru degrade
+gracefully. The rules are defined in a YAML file:
+
+	rules:
+	  - name: flaky-binds
+	    route: bind-app
+	    probability: 0.3
+	    status: 503
+	  - name: slow-creates
+	    route: POST /resources
+	    latency: 2s
+	  - route: remove
+	    drop: true
+	  - route: plans
+	    malformed-json: true
+
+A rule applies to a route, given by its method and path, like
+"POST /resources/{name}/bind-app", or by its name: plans, create, status,
+bind-app, unbind-app, bind-unit, unbind-unit or remove. It fires with the given
+probability, which defaults to 1, and may add latency, respond with an error
+status instead of calling the service API, drop the connection or make the
+response invalid JSON.
+
+With --control, a small control API is started in the given address, for
+changing the rules at runtime:
+
+	% curl -X POST http://localhost:8889/faults/flaky-binds/disable
+	% curl -X PUT --data-binary @faults.yaml http://localhost:8889/faults
+	% curl -X DELETE http://localhost:8889/faults
+
+GET /faults lists the rules, PUT /faults replaces them with the ones in the
+body, DELETE /faults removes all of them, and POST /faults/<name>/enable and
+/faults/<name>/disable switch a rule on and off. The control API is not
+authenticated, so it only listens on loopback addresses, like 127.0.0.1:8889,
+and on 127.0.0.1 when only the port is given, like :8889.
+
+
+Start a new service API project
+
+Usage:
+
+	% crane init <service-id> [-l/--lang go|python] [-o/--output <directory>] [-f/--force]
+
+init generates a new service API project, in a directory named after the
+service. The project includes a skeleton of the service API implementing every
+route of the tsuru services API, a manifest file, a documentation file and a
+test suite that checks the service API with api-check:
+
+	% crane init --lang go mysqlapi
+	Service API project for "mysqlapi" created in mysqlapi:
+
+	  README.md
+	  doc.md
+	  main.go
+	  main_test.go
+	  manifest.yaml
+
+The templates are built into crane, for Go and Python. Files in
+~/.crane/templates/<language> override the built-in templates with the same
+path, and new languages may be added by creating their directories. Templates
+use the syntax of Go's text/template package, with the fields .ID, .EnvPrefix
+(like MYSQLAPI) and .PasswordVar (like MYSQLAPI_PASSWORD).
+
+
+Validate a service API against the services API spec
+
+Usage:
+
+	% crane api-spec [-o/--output <file>]
+
+api-spec displays the OpenAPI document of the services API, the API that
+service providers implement and tsuru calls. It describes every route, the
+form fields tsuru sends and the status codes and JSON bodies of the responses,
+and may be used to generate clients, servers or documentation.
+
+api-check, api-bench, api-replay, api-emulate and api-proxy validate every
+request and response against the document when the --strict flag is given,
+reporting precisely how an exchange doesn't conform to it:
+
+	% crane api-check http://localhost:8888 --strict
+	...
+	| bind app | failed | POST /resources/{name}/bind-app doesn't conform to the services API: response: $.MYSQL_PORT: expected string, got integer |
+
+api-proxy doesn't change the exchanges in strict mode, it logs the violations,
+prefixed by "!", and records them in the session.
+
+
 Remove a service
 
 Usage:
@@ -305,8 +776,252 @@ Retrieve service's documentation
 
 Usage:
 
-	% crane doc-get <service-id>
+	% crane doc-get <service-id> [--raw]
+
+doc-get will retrieve the current documentation of the service. Documentation
+written in Markdown is rendered for the terminal, with colors: headers, lists,
+code blocks, tables and the inline formatting of text. Long documentation is
+displayed through the pager.
+
+When the output is not a terminal, or when the --raw flag is given, the
+documentation is displayed as it is.
+
+
+Verify service's documentation
+
+Usage:
+
+	% crane doc-verify <service-id> <doc-file.txt> [--endpoint <endpoint>] [-m/--manifest <manifest-file.yaml>] [--prefix <prefix>]
+
+doc-verify checks that the environment variables documented for the service
+are the ones its service API returns when binding an app. The names are taken
+from the documentation file, like MYSQL_HOST in the example above. A test
+instance is created and bound to an app, and the variables in the response are
+compared with the documented ones:
+
+	% crane doc-verify mysqlapi doc.txt --endpoint production
+	+---------------------+------------+----------+---------+
+	| Variable            | Documented | Returned | Result  |
+	+---------------------+------------+----------+---------+
+	| MYSQL_DATABASE_NAME | yes        | yes      | ok      |
+	| MYSQL_HOST          | yes        | yes      | ok      |
+	| MYSQL_PASSWORD      | yes        | yes      | ok      |
+	| MYSQL_PORT          | yes        | no       | missing |
+	| MYSQL_USER          | yes        | yes      | ok      |
+	+---------------------+------------+----------+---------+
+	5 documented, 4 returned: 1 missing, 0 undocumented.
+	Error: the documentation of "mysqlapi" doesn't match the bind response
+
+With --endpoint, the service API is called directly, with the credentials in
+the manifest. Otherwise, the instance is bound through the tsuru target, which
+is meant to be the tsuru stand-in started by api-emulate, and the app is given
+with --app:
+
+	% crane api-emulate manifest.yaml -- crane doc-verify mysqlapi doc.txt --app myapp
+
+Binding through a target that is not the emulator creates an instance and
+restarts a real app, so it's refused unless --allow-target is given. The test
+instance is removed afterwards.
+
+
+Sync service's documentation with a file
+
+Usage:
+
+	% crane doc-sync <service-id> <doc-file> [-s/--section <name>] [--check] [-y/--assume-yes]
+
+doc-sync keeps the documentation of the service in sync with a file in the
+repository of the service, like its README. The documentation is the whole
+file, or a section of a Markdown file delimited by HTML comments, which are not
+rendered:
+
+	<!-- crane:begin tsuru-doc -->
+	mysqlapi
+
+	This service is used for mysql connections.
+	<!-- crane:end tsuru-doc -->
+
+The documentation in the target is compared with the file, and the differences
+are displayed as a unified diff before uploading it:
+
+	% crane doc-sync mysqlapi README.md --section tsuru-doc
+	--- mysqlapi (target)
+	+++ README.md (section tsuru-doc)
+	@@ -1,3 +1,3 @@
+	 mysqlapi
+
+	-This service is used for mysql.
+	+This service is used for mysql connections.
+	Are you sure you want to update the documentation of "mysqlapi"? (y/n) y
+	Documentation of "mysqlapi" successfully updated.
+
+With --check, nothing is uploaded, and the command fails when the documentation
+has drifted from the file, which is useful in CI.
+
+
+Export a catalog of the services
+
+Usage:
+
+	% crane catalog-export <directory> [--format html|json|markdown] [-f/--force]
+
+catalog-export walks every service you can read, and exports a catalog with
+their plans, admin teams and documentation to the directory. The catalog has an
+index of the services and a page per service, in one of the formats:
+
+	html      a self-contained static site: index.html and services/<id>.html
+	markdown  README.md and services/<id>.md
+	json      a data bundle: catalog.json and services/<id>.json
+
+The export is incremental: only the pages whose source changed since the last
+export are rewritten, and the pages of removed services are deleted. The
+fingerprints of the sources are kept in the .crane-catalog.json file of the
+directory. Use --force to rewrite every page:
+
+	% crane catalog-export catalog
+	  wrote services/mysqlapi.html
+	Catalog of 12 services exported to catalog: 1 pages written, 12 unchanged, 0 removed.
+
+Extend crane with plugins
+
+crane runs plugins: executables named crane-<name>, found in the ~/.crane/plugins
+directory or in the directories of PATH, in this order. A plugin is run as the
+command <name>, with the arguments given to it:
+
+	% crane deploy-docs --force mysqlapi
+
+runs crane-deploy-docs --force mysqlapi. Built-in commands take precedence over
+plugins with the same name, and plugins are listed by crane help next to the
+built-in commands.
+
+The target and the token of crane are passed to plugins through the
+TSURU_TARGET and TSURU_TOKEN environment variables, the verbosity given to crane
+with -v through CRANE_VERBOSITY, and the name of the plugin through
+CRANE_PLUGIN_NAME. Plugins may be interactive: their input and output are the
+ones of crane.
+
+
+Install a plugin
+
+Usage:
+
+	% crane plugin-install [<name> [<url-or-path>]] [--sha256 <checksum>] [-l/--lock <file>]
+
+plugin-install installs a plugin in ~/.crane/plugins, from a URL or from a
+local file, so installing works offline. The plugin is either an executable or
+a tarball, optionally gzipped, with the crane-<name> executable:
+
+	% crane plugin-install deploy-docs ./crane-deploy-docs-1.2.tar.gz
+	Plugin "deploy-docs" installed from /home/gopher/crane-deploy-docs-1.2.tar.gz (sha256 5f2b...).
+
+Each version of a plugin is kept in a directory named after its checksum, in
+~/.crane/plugins/versions, and the SHA-256 checksum of what was installed is
+pinned in the lock file, ~/.crane/plugins/plugins.lock:
+
+	{
+	  "plugins": {
+	    "deploy-docs": {
+	      "source": "../../crane-deploy-docs-1.2.tar.gz",
+	      "sha256": "5f2b..."
+	    }
+	  }
+	}
+
+Installing the plugin again from the same source fails if its checksum changed.
+Installing it from another source, like a new release, pins the new checksum.
+Use --sha256 to check the checksum of a plugin before it's pinned.
+Local sources are pinned relative to the directory of the lock file, so a lock
+file kept along with the plugins in a repository works wherever it's checked
+out.
+
+Without the source, the plugin is installed from the source pinned in the lock
+file, and without the name, every plugin pinned in the lock file is installed.
+Share a lock file with --lock, so every member of a team runs the same plugins:
+
+	% crane plugin-install --lock plugins.lock
+
+
+List the plugins
+
+Usage:
+
+	% crane plugin-list [-l/--lock <file>]
+
+plugin-list lists the plugins pinned in the lock file, with their sources,
+checksums and whether they're installed, and the other plugins found on PATH.
+
+
+Remove a plugin
+
+Usage:
+
+	% crane plugin-remove <name> [-l/--lock <file>] [-y/--assume-yes]
+
+plugin-remove removes a plugin installed by plugin-install, and its pin in the
+lock file. Plugins found on PATH are not removed.
+
+
+Aliases and macros
+
+Aliases of long command lines are defined in the aliases section of the config
+file of crane, ~/.crane/config, or the file given by the CRANE_CONFIG
+environment variable:
+
+	# ~/.crane/config
+	[aliases]
+	st = instance-status --watch 5s
+	publish = manifest-lint manifest.yaml && apply manifest.yaml && doc-sync mysqlapi docs.md -y
+
+An alias is run like a command, with the arguments appended to the aliased
+command line:
+
+	% crane st mysqlapi
+
+runs crane instance-status --watch 5s mysqlapi. Aliases whose command lines are
+separated by "&&" are macros, which run the command lines in sequence and stop
+on the first error. Macros take no arguments. Words may be quoted with single
+or double quotes.
+
+Aliases may refer to other aliases and to plugins. Built-in commands take
+precedence over aliases with the same name, and aliases take precedence over
+plugins. Aliases are listed by crane help, next to the built-in commands.
+
+
+Shell completion
+
+Usage:
+
+	% crane completion bash|zsh|fish
+
+completion generates the completion script of crane for the shell, which
+completes the commands, their flags and the values of flags that take a fixed
+set of values, like the output formats of instance-list. The commands
+target-set and target-remove complete the labels of the targets, read from
+~/.tsuru/targets. To enable the completion, add to ~/.bashrc:
+
+	eval "$(crane completion bash)"
+
+or to ~/.zshrc:
+
+	eval "$(crane completion zsh)"
+
+or write the script for fish to its completions directory:
+
+	% crane completion fish > ~/.config/fish/completions/crane.fish
+
+Aliases and plugins are completed like the built-in commands.
+
+The names of services, instances, teams and plans, like the arguments of
+instance-remove and the values of the --plan and --team flags of instance-add,
+are fetched from the target. They're cached in ~/.crane/cache, by target, so
+the target isn't asked for them every time a word is completed. Cached names
+are fetched again after 5 minutes, and are still completed for an hour when the
+target can't be reached. Both durations are set in the completion section of
+the config file:
 
-doc-get will retrieve the current documentation of the service.
+	# ~/.crane/config
+	[completion]
+	ttl = 10m
+	offline-ttl = 24h
 */
 package main
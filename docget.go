@@ -0,0 +1,205 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	mdHeader     = regexp.MustCompile(`^(#{1,6})\s+(.*?)(\s+#+)?\s*$`)
+	mdSetext     = regexp.MustCompile(`^(=+|-+)\s*$`)
+	mdListItem   = regexp.MustCompile(`^(\s*)([-*+]|\d+[.)])\s+(.*)$`)
+	mdFence      = regexp.MustCompile("^\\s*(```+|~~~+)")
+	mdRule       = regexp.MustCompile(`^\s*([-*_])(\s*([-*_])){2,}\s*$`)
+	mdTableSep   = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+	mdInlineCode = regexp.MustCompile("`([^`]+)`")
+	mdBold       = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	mdEmphasis   = regexp.MustCompile(`\*([^*\s][^*]*)\*`)
+	mdLink       = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+)
+
+// renderMarkdown renders a Markdown document for displaying in a terminal,
+// with colors. Headers, lists, code blocks, tables, rules and the inline
+// formatting of text are rendered, other constructs are kept as they are.
+func renderMarkdown(doc string) string {
+	lines := strings.Split(strings.TrimRight(strings.Replace(doc, "\r\n", "\n", -1), "\n"), "\n")
+	var buf bytes.Buffer
+	// Indented code blocks can't interrupt paragraphs, nor lists.
+	code := true
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		indented := strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t")
+		if strings.TrimSpace(line) == "" {
+			code = true
+		} else if !indented || mdListItem.MatchString(line) {
+			code = false
+		}
+		switch {
+		case mdFence.MatchString(line):
+			fence := mdFence.FindStringSubmatch(line)[1]
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				fmt.Fprintf(&buf, "    %s\n", cmd.Colorfy(lines[i], "green", "", ""))
+			}
+		case code && indented:
+			fmt.Fprintf(&buf, "%s\n", cmd.Colorfy(line, "green", "", ""))
+		case mdHeader.MatchString(line):
+			m := mdHeader.FindStringSubmatch(line)
+			buf.WriteString(renderHeader(len(m[1]), m[2]))
+		case strings.TrimSpace(line) != "" && i+1 < len(lines) && mdSetext.MatchString(lines[i+1]) && !mdListItem.MatchString(line):
+			level := 1
+			if lines[i+1][0] == '-' {
+				level = 2
+			}
+			buf.WriteString(renderHeader(level, strings.TrimSpace(line)))
+			i++
+		case mdRule.MatchString(line):
+			fmt.Fprintf(&buf, "%s\n", strings.Repeat("-", 40))
+		case strings.Contains(line, "|") && i+1 < len(lines) && mdTableSep.MatchString(lines[i+1]) && strings.Contains(lines[i+1], "|"):
+			table := cmd.NewTable()
+			table.Headers = renderTableRow(line)
+			for i += 2; i < len(lines) && strings.Contains(lines[i], "|"); i++ {
+				table.AddRow(renderTableRow(lines[i]))
+			}
+			i--
+			buf.Write(table.Bytes())
+		case mdListItem.MatchString(line):
+			m := mdListItem.FindStringSubmatch(line)
+			bullet := m[2]
+			if !strings.ContainsAny(bullet[len(bullet)-1:], ".)") {
+				bullet = "•"
+			}
+			fmt.Fprintf(&buf, "%s  %s %s\n", m[1], cmd.Colorfy(bullet, "yellow", "", "bold"), renderInline(m[3]))
+		default:
+			fmt.Fprintf(&buf, "%s\n", renderInline(line))
+		}
+	}
+	return buf.String()
+}
+
+func renderHeader(level int, text string) string {
+	color := "cyan"
+	if level == 1 {
+		color = "blue"
+	}
+	return cmd.Colorfy(renderInline(text), color, "", "bold") + "\n"
+}
+
+// renderTableRow splits a row of a Markdown table in cells, rendering them.
+func renderTableRow(line string) cmd.Row {
+	line = strings.TrimSpace(line)
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+	var row cmd.Row
+	for _, cell := range strings.Split(line, "|") {
+		row = append(row, renderInline(strings.TrimSpace(cell)))
+	}
+	return row
+}
+
+// renderInline renders the inline formatting of a line: code spans, links,
+// bold and emphasized text. Code spans are kept verbatim.
+func renderInline(text string) string {
+	var buf bytes.Buffer
+	for {
+		loc := mdInlineCode.FindStringSubmatchIndex(text)
+		if loc == nil {
+			buf.WriteString(renderInlineText(text))
+			return buf.String()
+		}
+		buf.WriteString(renderInlineText(text[:loc[0]]))
+		buf.WriteString(cmd.Colorfy(text[loc[2]:loc[3]], "green", "", ""))
+		text = text[loc[1]:]
+	}
+}
+
+func renderInlineText(text string) string {
+	text = mdLink.ReplaceAllStringFunc(text, func(s string) string {
+		m := mdLink.FindStringSubmatch(s)
+		if m[1] == m[2] {
+			return cmd.Colorfy(m[2], "blue", "", "")
+		}
+		return m[1] + " (" + cmd.Colorfy(m[2], "blue", "", "") + ")"
+	})
+	text = mdBold.ReplaceAllStringFunc(text, func(s string) string {
+		return cmd.Colorfy(mdBold.FindStringSubmatch(s)[1], "", "", "bold")
+	})
+	return mdEmphasis.ReplaceAllStringFunc(text, func(s string) string {
+		return cmd.Colorfy(mdEmphasis.FindStringSubmatch(s)[1], "yellow", "", "")
+	})
+}
+
+// isTerminal reports whether the output is a terminal. Commands write to a
+// pager when the standard output is a terminal, so outputs that aren't files
+// are checked through the standard output.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(interface {
+		Fd() uintptr
+	})
+	if !ok {
+		f = os.Stdout
+	}
+	return terminal.IsTerminal(int(f.Fd()))
+}
+
+type docGet struct {
+	fs  *gnuflag.FlagSet
+	raw bool
+
+	// terminal reports whether the output is a terminal. It checks the
+	// standard output when not set.
+	terminal func(io.Writer) bool
+}
+
+func (c *docGet) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "doc-get",
+		Usage: "doc-get <service-id> [--raw]",
+		Desc: `Displays the documentation of a service.
+
+Documentation written in Markdown is rendered for the terminal, with colors:
+headers, lists, code blocks, tables and the inline formatting of text. Long
+documentation is displayed through the pager, like the output of other
+commands.
+
+When the output is not a terminal, like when it's redirected to a file, or when
+the --raw flag is given, the documentation is displayed as it is.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *docGet) Run(context *cmd.Context, client *cmd.Client) error {
+	doc, err := getServiceDoc(client, context.Args[0])
+	if err != nil {
+		return err
+	}
+	tty := c.terminal
+	if tty == nil {
+		tty = isTerminal
+	}
+	if c.raw || !tty(context.Stdout) {
+		_, err = io.WriteString(context.Stdout, doc)
+		return err
+	}
+	_, err = io.WriteString(context.Stdout, renderMarkdown(doc))
+	return err
+}
+
+func (c *docGet) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("doc-get", gnuflag.ExitOnError)
+		c.fs.BoolVar(&c.raw, "raw", false, "Display the documentation as it is, without rendering it")
+	}
+	return c.fs
+}
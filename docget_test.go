@@ -0,0 +1,119 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+const markdownDoc = "# mysqlapi\n" +
+	"\n" +
+	"MySQL databases for **tsuru** apps, see [the guide](https://example.com/guide).\n" +
+	"\n" +
+	"Variables\n" +
+	"---------\n" +
+	"\n" +
+	"| Name | Description |\n" +
+	"|------|-------------|\n" +
+	"| `MYSQL_HOST` | address of the *server* |\n" +
+	"| MYSQL_PORT | port |\n" +
+	"\n" +
+	"## Usage\n" +
+	"\n" +
+	"- connect with the variables\n" +
+	"  - nested item\n" +
+	"1. first\n" +
+	"\n" +
+	"```go\n" +
+	"db, err := sql.Open(\"mysql\", dsn)\n" +
+	"```\n" +
+	"\n" +
+	"    indented code\n" +
+	"***\n"
+
+func (s *S) TestRenderMarkdown(c *check.C) {
+	rendered := renderMarkdown(markdownDoc)
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"Name", "Description"}
+	table.AddRow(cmd.Row{cmd.Colorfy("MYSQL_HOST", "green", "", ""), "address of the " + cmd.Colorfy("server", "yellow", "", "")})
+	table.AddRow(cmd.Row{"MYSQL_PORT", "port"})
+	expected := cmd.Colorfy("mysqlapi", "blue", "", "bold") + "\n" +
+		"\n" +
+		"MySQL databases for " + cmd.Colorfy("tsuru", "", "", "bold") + " apps, see the guide (" + cmd.Colorfy("https://example.com/guide", "blue", "", "") + ").\n" +
+		"\n" +
+		cmd.Colorfy("Variables", "cyan", "", "bold") + "\n" +
+		"\n" +
+		string(table.Bytes()) +
+		"\n" +
+		cmd.Colorfy("Usage", "cyan", "", "bold") + "\n" +
+		"\n" +
+		"  " + cmd.Colorfy("•", "yellow", "", "bold") + " connect with the variables\n" +
+		"    " + cmd.Colorfy("•", "yellow", "", "bold") + " nested item\n" +
+		"  " + cmd.Colorfy("1.", "yellow", "", "bold") + " first\n" +
+		"\n" +
+		"    " + cmd.Colorfy(`db, err := sql.Open("mysql", dsn)`, "green", "", "") + "\n" +
+		"\n" +
+		cmd.Colorfy("    indented code", "green", "", "") + "\n" +
+		strings.Repeat("-", 40) + "\n"
+	c.Assert(rendered, check.Equals, expected)
+}
+
+func (s *S) TestRenderMarkdownIndentedLinesInParagraphs(c *check.C) {
+	doc := "Once bound, you will be able to use:\n\n\t\t- MYSQL_HOST: host of MySQL server\n\t\t- MYSQL_PORT: port\nPlain *text* with MYSQL_HOST_NAME and 2 * 3.\n"
+	bullet := cmd.Colorfy("•", "yellow", "", "bold")
+	c.Assert(renderMarkdown(doc), check.Equals, "Once bound, you will be able to use:\n\n"+
+		"\t\t  "+bullet+" MYSQL_HOST: host of MySQL server\n"+
+		"\t\t  "+bullet+" MYSQL_PORT: port\n"+
+		"Plain "+cmd.Colorfy("text", "yellow", "", "")+" with MYSQL_HOST_NAME and 2 * 3.\n")
+}
+
+func docGetClient() *cmd.Client {
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: "# mysqlapi\n\nUse `MYSQL_HOST`.\n", Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && req.URL.Path == "/1.0/services/mysqlapi/doc"
+		},
+	}
+	return cmd.NewClient(&http.Client{Transport: trans}, nil, manager)
+}
+
+func (s *S) TestDocGetRun(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	command := docGet{terminal: func(io.Writer) bool { return true }}
+	err := command.Run(&context, docGetClient())
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, cmd.Colorfy("mysqlapi", "blue", "", "bold")+"\n\nUse "+cmd.Colorfy("MYSQL_HOST", "green", "", "")+".\n")
+}
+
+func (s *S) TestDocGetRunRaw(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	command := docGet{terminal: func(io.Writer) bool { return true }}
+	command.Flags().Parse(true, []string{"--raw"})
+	err := command.Run(&context, docGetClient())
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "# mysqlapi\n\nUse `MYSQL_HOST`.\n")
+}
+
+func (s *S) TestDocGetRunNotTerminal(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	command := docGet{terminal: func(io.Writer) bool { return false }}
+	err := command.Run(&context, docGetClient())
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "# mysqlapi\n\nUse `MYSQL_HOST`.\n")
+}
+
+func (s *S) TestIsTerminal(c *check.C) {
+	c.Assert(isTerminal(&bytes.Buffer{}), check.Equals, isTerminal(nil))
+}
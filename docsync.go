@@ -0,0 +1,117 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// docSection extracts the named section from a Markdown file. The section is
+// delimited by HTML comments, which are not rendered:
+//
+//	<!-- crane:begin tsuru-doc -->
+//	...
+//	<!-- crane:end tsuru-doc -->
+func docSection(content, name string) (string, error) {
+	begin := "<!-- crane:begin " + name + " -->"
+	end := "<!-- crane:end " + name + " -->"
+	i := strings.Index(content, begin)
+	if i < 0 {
+		return "", fmt.Errorf("the section %q was not found, mark it with %s and %s", name, begin, end)
+	}
+	content = content[i+len(begin):]
+	j := strings.Index(content, end)
+	if j < 0 {
+		return "", fmt.Errorf("the section %q is not closed, mark its end with %s", name, end)
+	}
+	return strings.Trim(content[:j], "\n") + "\n", nil
+}
+
+type docSync struct {
+	cmd.ConfirmationCommand
+	fs      *gnuflag.FlagSet
+	section string
+	check   bool
+}
+
+func (c *docSync) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "doc-sync",
+		Usage: "doc-sync <service-id> <doc-file> [-s/--section <name>] [--check] [-y/--assume-yes]",
+		Desc: `Syncs the documentation of a service with a file, like the README of its
+repository.
+
+The documentation is the whole file, or a section of a Markdown file, given by
+its name with --section and delimited by HTML comments:
+
+  <!-- crane:begin tsuru-doc -->
+  ...
+  <!-- crane:end tsuru-doc -->
+
+The documentation is compared with the one in the target, and the differences
+are displayed as a unified diff. The documentation is then uploaded, after
+confirmation.
+
+With --check, nothing is uploaded and the command fails if the documentation
+in the target differs from the file, for checking in CI that the docs haven't
+drifted.`,
+		MinArgs: 2,
+		MaxArgs: 2,
+	}
+}
+
+func (c *docSync) Run(context *cmd.Context, client *cmd.Client) error {
+	id, path := context.Args[0], context.Args[1]
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	doc := string(data)
+	source := path
+	if c.section != "" {
+		doc, err = docSection(doc, c.section)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		source = fmt.Sprintf("%s (section %s)", path, c.section)
+	}
+	current, err := getServiceDoc(client, id)
+	if err != nil {
+		return err
+	}
+	diff := unifiedDiff(id+" (target)", source, current, doc)
+	if diff == "" {
+		fmt.Fprintf(context.Stdout, "The documentation of %q is up to date.\n", id)
+		return nil
+	}
+	fmt.Fprint(context.Stdout, diff)
+	if c.check {
+		return fmt.Errorf("the documentation of %q differs from %s", id, source)
+	}
+	if !c.Confirm(context, fmt.Sprintf("Are you sure you want to update the documentation of %q?", id)) {
+		return nil
+	}
+	err = updateServiceDoc(client, id, doc)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Documentation of %q successfully updated.\n", id)
+	return nil
+}
+
+func (c *docSync) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = c.ConfirmationCommand.Flags()
+		c.fs.StringVar(&c.section, "section", "", "Name of the section of the Markdown file with the documentation")
+		c.fs.StringVar(&c.section, "s", "", "Name of the section of the Markdown file with the documentation")
+		c.fs.BoolVar(&c.check, "check", false, "Fail if the documentation differs, without uploading it")
+	}
+	return c.fs
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+const docSyncReadme = `# mysqlapi
+
+Some notes for the maintainers.
+
+<!-- crane:begin tsuru-doc -->
+
+mysqlapi
+
+Binding sets MYSQL_HOST and MYSQL_USER.
+
+<!-- crane:end tsuru-doc -->
+
+More notes.
+`
+
+func (s *S) TestDocSection(c *check.C) {
+	doc, err := docSection(docSyncReadme, "tsuru-doc")
+	c.Assert(err, check.IsNil)
+	c.Assert(doc, check.Equals, "mysqlapi\n\nBinding sets MYSQL_HOST and MYSQL_USER.\n")
+	_, err = docSection(docSyncReadme, "other")
+	c.Assert(err, check.ErrorMatches, `the section "other" was not found, mark it with <!-- crane:begin other --> and <!-- crane:end other -->`)
+	_, err = docSection("<!-- crane:begin doc -->\nmysqlapi\n", "doc")
+	c.Assert(err, check.ErrorMatches, `the section "doc" is not closed, mark its end with <!-- crane:end doc -->`)
+}
+
+// startDocSyncEmulator starts an emulator with the given doc for mysqlapi,
+// returning a README with the section to sync.
+func startDocSyncEmulator(c *check.C, doc string) (*emulator, string, func()) {
+	fake := newFakeServiceAPI()
+	e, stop := startEmulator(c, fake, &bytes.Buffer{})
+	e.docs["mysqlapi"] = doc
+	path := filepath.Join(c.MkDir(), "README.md")
+	err := ioutil.WriteFile(path, []byte(docSyncReadme), 0600)
+	c.Assert(err, check.IsNil)
+	return e, path, func() {
+		stop()
+		fake.stop()
+	}
+}
+
+func (s *S) TestDocSyncRun(c *check.C) {
+	e, path, stop := startDocSyncEmulator(c, "mysqlapi\n\nBinding sets MYSQL_HOST.\n")
+	defer stop()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi", path}, Stdout: &stdout, Stdin: strings.NewReader("y\n")}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	command := docSync{}
+	command.Flags().Parse(true, []string{"-s", "tsuru-doc"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `--- mysqlapi (target)
++++ `+path+` (section tsuru-doc)
+@@ -1,3 +1,3 @@
+ mysqlapi
+ 
+-Binding sets MYSQL_HOST.
++Binding sets MYSQL_HOST and MYSQL_USER.
+Are you sure you want to update the documentation of "mysqlapi"? (y/n) Documentation of "mysqlapi" successfully updated.
+`)
+	c.Assert(e.docs["mysqlapi"], check.Equals, "mysqlapi\n\nBinding sets MYSQL_HOST and MYSQL_USER.\n")
+	stdout.Reset()
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "The documentation of \"mysqlapi\" is up to date.\n")
+}
+
+func (s *S) TestDocSyncRunAborted(c *check.C) {
+	e, path, stop := startDocSyncEmulator(c, "old docs\n")
+	defer stop()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi", path}, Stdout: &stdout, Stdin: strings.NewReader("n\n")}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	err := (&docSync{}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s)--- mysqlapi \(target\)\n\+\+\+ .*README.md\n.*\+More notes.\n.*\(y/n\) Abort.\n$`)
+	c.Assert(e.docs["mysqlapi"], check.Equals, "old docs\n")
+}
+
+func (s *S) TestDocSyncRunCheck(c *check.C) {
+	e, path, stop := startDocSyncEmulator(c, "old docs\n")
+	defer stop()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi", path}, Stdout: &stdout}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	command := docSync{}
+	command.Flags().Parse(true, []string{"--section", "tsuru-doc", "--check", "-y"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `the documentation of "mysqlapi" differs from .*README.md \(section tsuru-doc\)`)
+	c.Assert(stdout.String(), check.Matches, `(?s)--- mysqlapi \(target\)\n.*-old docs\n.*`)
+	c.Assert(e.docs["mysqlapi"], check.Equals, "old docs\n")
+	e.docs["mysqlapi"] = "mysqlapi\n\nBinding sets MYSQL_HOST and MYSQL_USER.\n"
+	stdout.Reset()
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "The documentation of \"mysqlapi\" is up to date.\n")
+}
+
+func (s *S) TestDocSyncRunMissingSection(c *check.C) {
+	_, path, stop := startDocSyncEmulator(c, "")
+	defer stop()
+	command := docSync{section: "docs"}
+	err := command.Run(&cmd.Context{Args: []string{"mysqlapi", path}}, nil)
+	c.Assert(err, check.ErrorMatches, `.*README.md: the section "docs" was not found, .*`)
+}
+
+func (s *S) TestDocSyncRunUnknownService(c *check.C) {
+	_, path, stop := startDocSyncEmulator(c, "")
+	defer stop()
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	err := (&docSync{}).Run(&cmd.Context{Args: []string{"redisapi", path}}, client)
+	c.Assert(err, check.ErrorMatches, "service \"redisapi\" not found\n")
+}
@@ -0,0 +1,309 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// envVarPattern matches the names of environment variables in the
+// documentation of a service: upper case names with underscores, like
+// MYSQL_HOST, or names referenced like $HOST and ${HOST}.
+var envVarPattern = regexp.MustCompile(`\$\{?([A-Z][A-Z0-9_]*)|\b([A-Z][A-Z0-9]*(?:_[A-Z0-9]+)+)\b`)
+
+// documentedVars returns the names of the environment variables mentioned in
+// the documentation, sorted. When prefix is not empty, only the names starting
+// with it are returned.
+func documentedVars(doc, prefix string) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, m := range envVarPattern.FindAllStringSubmatch(doc, -1) {
+		name := m[1] + m[2]
+		if seen[name] || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// varResult compares a variable in the documentation with the response of a
+// bind.
+type varResult struct {
+	name       string
+	documented bool
+	returned   bool
+}
+
+func (r varResult) String() string {
+	switch {
+	case !r.returned:
+		return "missing"
+	case !r.documented:
+		return "undocumented"
+	}
+	return "ok"
+}
+
+// compareVars compares the documented variables with the ones returned when
+// binding an app, sorted by name.
+func compareVars(documented []string, returned map[string]string) []varResult {
+	results := map[string]*varResult{}
+	for _, name := range documented {
+		results[name] = &varResult{name: name, documented: true}
+	}
+	for name := range returned {
+		if r, ok := results[name]; ok {
+			r.returned = true
+		} else {
+			results[name] = &varResult{name: name, returned: true}
+		}
+	}
+	var names []string
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]varResult, len(names))
+	for i, name := range names {
+		list[i] = *results[name]
+	}
+	return list
+}
+
+// bindEndpoint binds a new instance to a fake app calling the service API
+// directly, returning the environment variables in the response. The instance
+// is unbound and removed afterwards.
+func bindEndpoint(api *serviceAPI, instance, plan, team, app string) (map[string]string, error) {
+	host := app + ".example.com"
+	resp, err := api.createInstance(instance, plan, team)
+	if err := expectStatus(resp, err, http.StatusCreated); err != nil {
+		return nil, fmt.Errorf("failed to create the instance: %s", err)
+	}
+	defer api.removeInstance(instance)
+	resp, err = api.bindApp(instance, app, host)
+	if err := expectStatus(resp, err, http.StatusCreated); err != nil {
+		return nil, fmt.Errorf("failed to bind the instance: %s", err)
+	}
+	defer api.unbindApp(instance, app, host)
+	var envs map[string]string
+	if err := json.Unmarshal(resp.body, &envs); err != nil {
+		return nil, fmt.Errorf("the bind response must be a JSON object with the environment variables of the app: %s", err)
+	}
+	return envs, nil
+}
+
+// isEmulatorTarget reports whether the tsuru target is the emulator started by
+// api-emulate.
+func isEmulatorTarget(client *cmd.Client) bool {
+	resp, err := doRequest(client, "GET", "/teams", nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.Header.Get(emulatorHeader) != ""
+}
+
+// bindTarget binds a new instance of the service to the app through the tsuru
+// target, like the emulator started by api-emulate, returning the environment
+// variables set in the app. The instance is unbound and removed afterwards.
+func bindTarget(client *cmd.Client, service, instance, plan, team, app string) (map[string]string, error) {
+	path := "/services/" + service + "/instances"
+	resp, err := doRequest(client, "POST", path, url.Values{"name": {instance}, "plan": {plan}, "owner": {team}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the instance: %s", err)
+	}
+	resp.Body.Close()
+	path += "/" + instance
+	defer func() {
+		if resp, err := doRequest(client, "DELETE", path, nil); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	resp, err = doRequest(client, "PUT", path+"/"+app, url.Values{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind the instance: %s", err)
+	}
+	defer func() {
+		if resp, err := doRequest(client, "DELETE", path+"/"+app, url.Values{}); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	defer resp.Body.Close()
+	var envs map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&envs); err != nil {
+		return nil, fmt.Errorf("invalid environment variables returned by the bind: %s", err)
+	}
+	return envs, nil
+}
+
+type docVerify struct {
+	fs       *gnuflag.FlagSet
+	manifest string
+	env      string
+	endpoint string
+	app      string
+	plan     string
+	team     string
+	prefix   string
+	strict   bool
+	// allowTarget allows binding through a tsuru target that isn't the
+	// emulator, which creates the instance and binds a real app.
+	allowTarget bool
+}
+
+func (c *docVerify) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "doc-verify",
+		Usage: "doc-verify <service> <doc-file> [--endpoint <endpoint>] [-m/--manifest <manifest-file.yaml>] [-e/--env <environment>] [-a/--app <app>] [--allow-target] [--plan <plan>] [--team <team>] [--prefix <prefix>] [--strict]",
+		Desc: `Checks that the documentation of a service matches the environment variables
+its service API returns when binding an app.
+
+The names of the environment variables are taken from the documentation file:
+upper case names with underscores, like MYSQL_HOST, and names referenced like
+$HOST or ${HOST}. With --prefix, only the names starting with the prefix are
+considered.
+
+A test instance is then created and bound to an app, and the variables in the
+response of the bind are compared with the documented ones. The instance is
+unbound and removed afterwards.
+
+With --endpoint, the service API is called directly. The endpoint may be a URL
+or the name of an endpoint in the manifest, like "production", and the
+credentials of the service are taken from the manifest, which defaults to
+"manifest.yaml". The --strict flag validates the exchanges against the OpenAPI
+document of the services API (see "api-spec"). The app is only a name sent to
+the service API, which defaults to "myapp".
+
+Without --endpoint, the instance is created and bound through the tsuru target,
+which is meant to be the tsuru stand-in started by "api-emulate", and --app is
+required. Other targets are refused, as the bind would create an instance and
+restart a real app, unless --allow-target is given.
+
+The command fails if any documented variable is missing from the response, or
+if any returned variable is not documented.`,
+		MinArgs: 2,
+		MaxArgs: 2,
+	}
+}
+
+func (c *docVerify) Run(context *cmd.Context, client *cmd.Client) error {
+	service := context.Args[0]
+	data, err := ioutil.ReadFile(context.Args[1])
+	if err != nil {
+		return err
+	}
+	documented := documentedVars(string(data), c.prefix)
+	if len(documented) == 0 {
+		return fmt.Errorf("no environment variables found in %s", context.Args[1])
+	}
+	instance := "crane-verify-" + strconv.FormatInt(time.Now().Unix(), 36)
+	team := c.team
+	if team == "" {
+		team = "crane"
+	}
+	var returned map[string]string
+	if c.endpoint != "" {
+		app := c.app
+		if app == "" {
+			app = "myapp"
+		}
+		path := c.manifest
+		if path == "" {
+			path = "manifest.yaml"
+		}
+		m, err := loadManifest(path, c.env, true)
+		if err != nil {
+			return err
+		}
+		if m.ID != service {
+			return fmt.Errorf("the manifest %s describes the service %q, not %q", path, m.ID, service)
+		}
+		api := newServiceAPI(resolveEndpoint(m, c.endpoint), m)
+		if c.strict {
+			api.validator = servicesAPIValidator
+		}
+		plan := c.plan
+		if plan == "" {
+			plan = firstPlan(api)
+		}
+		returned, err = bindEndpoint(api, instance, plan, team, app)
+		if err != nil {
+			return err
+		}
+	} else {
+		if c.strict {
+			return errors.New("the --strict flag requires --endpoint, use the --strict flag of api-emulate instead")
+		}
+		if c.app == "" {
+			return errors.New("the app bound to the test instance is required without --endpoint, use the --app flag")
+		}
+		if !c.allowTarget && !isEmulatorTarget(client) {
+			return errors.New("the tsuru target is not the emulator of api-emulate, binding through it would create an instance and restart the app: use --allow-target to bind anyway")
+		}
+		returned, err = bindTarget(client, service, instance, c.plan, team, c.app)
+		if err != nil {
+			return err
+		}
+	}
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"Variable", "Documented", "Returned", "Result"}
+	var missing, undocumented int
+	for _, r := range compareVars(documented, returned) {
+		table.AddRow(cmd.Row{r.name, yesNo(r.documented), yesNo(r.returned), r.String()})
+		if !r.returned {
+			missing++
+		} else if !r.documented {
+			undocumented++
+		}
+	}
+	context.Stdout.Write(table.Bytes())
+	fmt.Fprintf(context.Stdout, "%d documented, %d returned: %d missing, %d undocumented.\n", len(documented), len(returned), missing, undocumented)
+	if missing+undocumented > 0 {
+		return fmt.Errorf("the documentation of %q doesn't match the bind response", service)
+	}
+	return nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func (c *docVerify) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("doc-verify", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.endpoint, "endpoint", "", "Endpoint of the service API to bind directly (default: bind through the tsuru target)")
+		c.fs.StringVar(&c.manifest, "manifest", "", "Manifest file with the credentials of the service (default: manifest.yaml)")
+		c.fs.StringVar(&c.manifest, "m", "", "Manifest file with the credentials of the service (default: manifest.yaml)")
+		c.fs.StringVar(&c.env, "env", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.StringVar(&c.env, "e", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.StringVar(&c.app, "app", "", "App bound to the test instance (required without --endpoint)")
+		c.fs.StringVar(&c.app, "a", "", "App bound to the test instance (required without --endpoint)")
+		c.fs.BoolVar(&c.allowTarget, "allow-target", false, "Bind through a tsuru target that is not the emulator of api-emulate")
+		c.fs.StringVar(&c.plan, "plan", "", "Plan of the test instance (default: the first plan of the service)")
+		c.fs.StringVar(&c.team, "team", "", "Team of the test instance (default: crane)")
+		c.fs.StringVar(&c.prefix, "prefix", "", "Only consider the documented variables starting with the prefix")
+		c.fs.BoolVar(&c.strict, "strict", false, "Validate requests and responses against the OpenAPI document of the services API")
+	}
+	return c.fs
+}
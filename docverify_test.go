@@ -0,0 +1,173 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestDocumentedVars(c *check.C) {
+	doc := `MySQL service
+
+Binding an instance sets MYSQL_HOST and MYSQL_PORT in the app:
+
+  MYSQL_HOST: address of the database
+  MYSQL_USER: user, see also ${MYSQL_PASSWORD}
+
+Use $DATABASE in the connection string. Not variables: MySQL, SQL, Mysql_host.
+`
+	c.Assert(documentedVars(doc, ""), check.DeepEquals, []string{"DATABASE", "MYSQL_HOST", "MYSQL_PASSWORD", "MYSQL_PORT", "MYSQL_USER"})
+	c.Assert(documentedVars(doc, "MYSQL_"), check.DeepEquals, []string{"MYSQL_HOST", "MYSQL_PASSWORD", "MYSQL_PORT", "MYSQL_USER"})
+	c.Assert(documentedVars("No variables here.", ""), check.IsNil)
+}
+
+func (s *S) TestCompareVars(c *check.C) {
+	results := compareVars([]string{"MYSQL_HOST", "MYSQL_PORT"}, map[string]string{"MYSQL_HOST": "10.0.0.2", "MYSQL_USER": "root"})
+	c.Assert(results, check.DeepEquals, []varResult{
+		{name: "MYSQL_HOST", documented: true, returned: true},
+		{name: "MYSQL_PORT", documented: true},
+		{name: "MYSQL_USER", returned: true},
+	})
+	c.Assert(results[0].String(), check.Equals, "ok")
+	c.Assert(results[1].String(), check.Equals, "missing")
+	c.Assert(results[2].String(), check.Equals, "undocumented")
+}
+
+func writeDocVerifyFiles(c *check.C, fake *fakeServiceAPI, doc string) (string, string) {
+	dir := c.MkDir()
+	manifest := filepath.Join(dir, "manifest.yaml")
+	err := ioutil.WriteFile(manifest, []byte("id: mysqlapi\npassword: s3cr3t\nendpoint:\n  production: "+fake.server.URL+"\n"), 0600)
+	c.Assert(err, check.IsNil)
+	docFile := filepath.Join(dir, "doc.md")
+	err = ioutil.WriteFile(docFile, []byte(doc), 0600)
+	c.Assert(err, check.IsNil)
+	return manifest, docFile
+}
+
+func (s *S) TestDocVerifyRunEndpoint(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	manifest, doc := writeDocVerifyFiles(c, fake, "Sets MYSQL_HOST and MYSQL_USER in the app.\n")
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi", doc}, Stdout: &stdout}
+	command := docVerify{}
+	command.Flags().Parse(true, []string{"--endpoint", "production", "-m", manifest, "--strict"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*\| MYSQL_HOST +\| yes +\| yes +\| ok +\|.*\| MYSQL_USER +\| yes +\| yes +\| ok +\|.*2 documented, 2 returned: 0 missing, 0 undocumented.\n$`)
+	c.Assert(strings.Join(fake.requests, "\n"), check.Matches, `GET /resources/plans
+POST /resources
+POST /resources/crane-verify-\w+/bind-app
+DELETE /resources/crane-verify-\w+/bind-app
+DELETE /resources/crane-verify-\w+`)
+	c.Assert(fake.instances, check.HasLen, 0)
+}
+
+func (s *S) TestDocVerifyRunEndpointMismatch(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	manifest, doc := writeDocVerifyFiles(c, fake, "Sets MYSQL_HOST and MYSQL_PORT in the app.\n")
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi", doc}, Stdout: &stdout}
+	command := docVerify{}
+	command.Flags().Parse(true, []string{"--endpoint", fake.server.URL, "-m", manifest})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `the documentation of "mysqlapi" doesn't match the bind response`)
+	c.Assert(stdout.String(), check.Matches, `(?s).*\| MYSQL_PORT +\| yes +\| no +\| missing +\|.*\| MYSQL_USER +\| no +\| yes +\| undocumented +\|.*2 documented, 2 returned: 1 missing, 1 undocumented.\n$`)
+}
+
+func (s *S) TestDocVerifyRunEndpointBindFailure(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	fake.overrides["POST /resources/{name}/bind-app"] = http.StatusInternalServerError
+	manifest, doc := writeDocVerifyFiles(c, fake, "Sets MYSQL_HOST in the app.\n")
+	context := cmd.Context{Args: []string{"mysqlapi", doc}, Stdout: ioutil.Discard}
+	command := docVerify{}
+	command.Flags().Parse(true, []string{"--endpoint", "production", "-m", manifest})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "failed to bind the instance: expected status 201, got 500")
+	c.Assert(fake.instances, check.HasLen, 0)
+}
+
+func (s *S) TestDocVerifyRunWrongService(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	manifest, doc := writeDocVerifyFiles(c, fake, "Sets MYSQL_HOST in the app.\n")
+	context := cmd.Context{Args: []string{"redisapi", doc}, Stdout: ioutil.Discard}
+	command := docVerify{}
+	command.Flags().Parse(true, []string{"--endpoint", "production", "-m", manifest})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `the manifest .*manifest.yaml describes the service "mysqlapi", not "redisapi"`)
+}
+
+func (s *S) TestDocVerifyRunNoVariables(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	_, doc := writeDocVerifyFiles(c, fake, "Nothing to see here.\n")
+	err := (&docVerify{}).Run(&cmd.Context{Args: []string{"mysqlapi", doc}}, nil)
+	c.Assert(err, check.ErrorMatches, "no environment variables found in .*doc.md")
+}
+
+func (s *S) TestDocVerifyRunEmulator(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	e, stop := startEmulator(c, fake, &log)
+	defer stop()
+	_, doc := writeDocVerifyFiles(c, fake, "Sets MYSQL_HOST in the app.\n")
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi", doc}, Stdout: &stdout}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	err := (&docVerify{app: "myapp"}).Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `the documentation of "mysqlapi" doesn't match the bind response`)
+	c.Assert(stdout.String(), check.Matches, `(?s).*\| MYSQL_USER +\| no +\| yes +\| undocumented +\|.*1 documented, 2 returned: 0 missing, 1 undocumented.\n$`)
+	c.Assert(e.instances, check.HasLen, 0)
+	c.Assert(fake.instances, check.HasLen, 0)
+	c.Assert(log.String(), check.Matches, `(?s).*DELETE /resources/crane-verify-\w+: 200 OK.*`)
+	err = (&docVerify{strict: true}).Run(&context, client)
+	c.Assert(err, check.ErrorMatches, "the --strict flag requires --endpoint, use the --strict flag of api-emulate instead")
+}
+
+func (s *S) TestDocVerifyRunTargetRequiresApp(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	_, stop := startEmulator(c, fake, &log)
+	defer stop()
+	_, doc := writeDocVerifyFiles(c, fake, "Sets MYSQL_HOST in the app.\n")
+	context := cmd.Context{Args: []string{"mysqlapi", doc}, Stdout: ioutil.Discard}
+	err := (&docVerify{}).Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.ErrorMatches, "the app bound to the test instance is required without --endpoint, use the --app flag")
+}
+
+func (s *S) TestDocVerifyRunRefusesRealTarget(c *check.C) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+	os.Setenv("TSURU_TARGET", server.URL)
+	defer os.Setenv("TSURU_TARGET", "http://localhost:8080")
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	_, doc := writeDocVerifyFiles(c, fake, "Sets MYSQL_HOST in the app.\n")
+	context := cmd.Context{Args: []string{"mysqlapi", doc}, Stdout: ioutil.Discard}
+	err := (&docVerify{app: "web"}).Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.ErrorMatches, "the tsuru target is not the emulator of api-emulate, .*: use --allow-target to bind anyway")
+	c.Assert(requests, check.DeepEquals, []string{"GET /1.0/teams"})
+	err = (&docVerify{app: "web", allowTarget: true}).Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.NotNil)
+	c.Assert(requests[1], check.Equals, "POST /1.0/services/mysqlapi/instances")
+}
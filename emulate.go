@@ -0,0 +1,664 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// emulatedApp is an app of the emulator. Apps are never deployed, they only
+// exist to be bound to service instances.
+type emulatedApp struct {
+	Name  string            `json:"name"`
+	IP    string            `json:"ip"`
+	Units []string          `json:"units"`
+	Env   map[string]string `json:"env"`
+}
+
+// emulatedInstance is a service instance created in the emulator.
+type emulatedInstance struct {
+	Name        string
+	ServiceName string
+	PlanName    string
+	TeamOwner   string
+	Apps        []string
+}
+
+// emulatorHeader is the header set in the responses of the emulator, which
+// tells it apart from real tsuru targets.
+const emulatorHeader = "X-Crane-Emulator"
+
+// emulator is a fake tsuru server. It keeps services, service instances and
+// apps in memory, and calls the service APIs like tsuru does when instances
+// are created, bound, unbound and removed.
+type emulator struct {
+	// endpoint is the name of the endpoint of the services that is called,
+	// like "production".
+	endpoint string
+
+	// log receives a line for every call to a service API.
+	log io.Writer
+
+	// validator, when set, validates the calls to the service APIs, which
+	// fail when they don't conform to the services API.
+	validator *specValidator
+
+	mu        sync.Mutex
+	services  map[string]*service
+	passwords map[string]string
+	docs      map[string]string
+	instances map[string]*emulatedInstance
+	apps      map[string]*emulatedApp
+	events    []tsuruEvent
+
+	// busy are the names of the instances being created, removed, bound or
+	// unbound, whose service API is called without the lock held.
+	busy map[string]bool
+}
+
+func newEmulator(log io.Writer) *emulator {
+	return &emulator{
+		endpoint:  "production",
+		log:       log,
+		services:  map[string]*service{},
+		passwords: map[string]string{},
+		docs:      map[string]string{},
+		instances: map[string]*emulatedInstance{},
+		apps:      map[string]*emulatedApp{},
+		busy:      map[string]bool{},
+	}
+}
+
+// addService registers the service described by the manifest.
+func (e *emulator) addService(m *manifest) error {
+	state, err := manifestState(m)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.services[m.ID] = &service{
+		Name:        m.ID,
+		Username:    m.Username,
+		Description: m.Description,
+		Endpoint:    state.Endpoint,
+		OwnerTeams:  state.Teams,
+	}
+	e.passwords[m.ID] = m.Password
+	e.docs[m.ID] = state.Doc
+	return nil
+}
+
+// addApp creates a fake app, with one unit.
+func (e *emulator) addApp(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	n := len(e.apps) + 1
+	e.apps[name] = &emulatedApp{
+		Name:  name,
+		IP:    name + ".example.com",
+		Units: []string{fmt.Sprintf("10.0.%d.1", n)},
+		Env:   map[string]string{},
+	}
+}
+
+// serviceAPI returns the client of the API of the given service. It must be
+// called with the lock held.
+func (e *emulator) serviceAPI(s *service) *serviceAPI {
+	m := manifest{ID: s.Name, Username: s.Username, Password: e.passwords[s.Name]}
+	api := newServiceAPI(s.Endpoint[e.endpoint], &m)
+	api.validator = e.validator
+	return api
+}
+
+// call calls the service API, logging the call. Responses with status codes
+// other than the expected ones are returned as errors. It must be called with
+// the lock held, which is released while the service API is called, so a slow
+// service API doesn't hold the other requests.
+func (e *emulator) call(route string, f func() (*apiResponse, error), expected ...int) (*apiResponse, error) {
+	e.mu.Unlock()
+	resp, err := f()
+	e.mu.Lock()
+	if serr, ok := err.(*specError); ok {
+		fmt.Fprintf(e.log, "%s: %d %s in %s\n", route, resp.status, http.StatusText(resp.status), resp.duration/time.Millisecond*time.Millisecond)
+		for _, p := range serr.problems {
+			fmt.Fprintf(e.log, "  ! %s\n", p)
+		}
+		return nil, err
+	}
+	if err != nil {
+		fmt.Fprintf(e.log, "%s: %s\n", route, err)
+		return nil, fmt.Errorf("failed to call the service API: %s", err)
+	}
+	fmt.Fprintf(e.log, "%s: %d %s in %s\n", route, resp.status, http.StatusText(resp.status), resp.duration/time.Millisecond*time.Millisecond)
+	if err := expectStatus(resp, nil, expected...); err != nil {
+		return nil, fmt.Errorf("the service API returned an error: %s", err)
+	}
+	return resp, nil
+}
+
+func (e *emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	w.Header().Set(emulatorHeader, "true")
+	parseForm(r)
+	path := strings.TrimPrefix(r.URL.Path, "/1.0")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	var (
+		status int
+		result interface{}
+		err    error
+	)
+	switch {
+	case r.Method == "GET" && path == "/apps":
+		result = e.listApps()
+	case r.Method == "GET" && path == "/services/instances":
+		result = e.listInstances()
+	case r.Method == "GET" && path == "/teams":
+		result = e.listTeams()
+	case r.Method == "GET" && path == "/events":
+		result = e.listEvents(r.URL.Query())
+	case r.Method == "POST" && path == "/services":
+		status, err = e.saveService(r.FormValue("id"), r, true)
+	case len(parts) < 2 || parts[0] != "services":
+		status, err = http.StatusNotFound, fmt.Errorf("route %s %s not found", r.Method, r.URL.Path)
+	default:
+		s, ok := e.services[parts[1]]
+		if !ok {
+			status, err = http.StatusNotFound, fmt.Errorf("service %q not found", parts[1])
+			break
+		}
+		status, result, err = e.serveService(s, parts[2:], r)
+	}
+	if err != nil {
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if s, ok := result.(string); ok {
+		w.Write([]byte(s))
+		return
+	}
+	if result != nil {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+	}
+	if result != nil {
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func (e *emulator) serveService(s *service, parts []string, r *http.Request) (int, interface{}, error) {
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		return 0, s, nil
+	case len(parts) == 0 && r.Method == "PUT":
+		status, err := e.saveService(s.Name, r, false)
+		return status, nil, err
+	case len(parts) == 1 && parts[0] == "doc" && r.Method == "GET":
+		return 0, e.docs[s.Name], nil
+	case len(parts) == 1 && parts[0] == "doc" && r.Method == "PUT":
+		e.docs[s.Name] = r.FormValue("doc")
+		return 0, nil, nil
+	case len(parts) == 1 && parts[0] == "plans" && r.Method == "GET":
+		return e.plans(s)
+	case len(parts) == 1 && parts[0] == "instances" && r.Method == "POST":
+		return e.createInstance(s, r.FormValue("name"), r.FormValue("plan"), r.FormValue("owner"))
+	}
+	if len(parts) < 2 || parts[0] != "instances" {
+		return http.StatusNotFound, nil, fmt.Errorf("route %s %s not found", r.Method, r.URL.Path)
+	}
+	instance, ok := e.instances[parts[1]]
+	if !ok || instance.ServiceName != s.Name {
+		return http.StatusNotFound, nil, fmt.Errorf("service instance %q not found", parts[1])
+	}
+	switch {
+	case len(parts) == 2 && r.Method == "GET":
+		return 0, instance, nil
+	case len(parts) == 2 && r.Method == "DELETE":
+		return e.removeInstance(s, instance)
+	case len(parts) == 3 && parts[2] == "status" && r.Method == "GET":
+		return e.instanceStatus(s, instance)
+	}
+	if len(parts) != 3 {
+		return http.StatusNotFound, nil, fmt.Errorf("route %s %s not found", r.Method, r.URL.Path)
+	}
+	app, ok := e.apps[parts[2]]
+	if !ok {
+		return http.StatusNotFound, nil, fmt.Errorf("app %q not found", parts[2])
+	}
+	switch r.Method {
+	case "PUT":
+		return e.bind(s, instance, app)
+	case "DELETE":
+		return e.unbind(s, instance, app)
+	}
+	return http.StatusMethodNotAllowed, nil, fmt.Errorf("method %s not allowed", r.Method)
+}
+
+func (e *emulator) saveService(id string, r *http.Request, create bool) (int, error) {
+	if _, ok := e.services[id]; ok && create {
+		return http.StatusConflict, fmt.Errorf("service %q already exists", id)
+	}
+	s := service{
+		Name:        id,
+		Username:    r.FormValue("username"),
+		Description: r.FormValue("description"),
+		Endpoint:    map[string]string{},
+		OwnerTeams:  r.Form["team"],
+	}
+	for key, values := range r.Form {
+		if key == "endpoint" {
+			s.Endpoint["production"] = values[0]
+		} else if strings.HasPrefix(key, "endpoint.") {
+			s.Endpoint[strings.TrimPrefix(key, "endpoint.")] = values[0]
+		}
+	}
+	e.services[id] = &s
+	if password := r.FormValue("password"); password != "" || create {
+		e.passwords[id] = password
+	}
+	if create {
+		return http.StatusCreated, nil
+	}
+	return 0, nil
+}
+
+func (e *emulator) plans(s *service) (int, interface{}, error) {
+	resp, err := e.call("GET /resources/plans", e.serviceAPI(s).plans, http.StatusOK)
+	if err != nil {
+		return 0, nil, err
+	}
+	var plans []plan
+	if err := json.Unmarshal(resp.body, &plans); err != nil {
+		return 0, nil, fmt.Errorf("invalid plans returned by the service API: %s", err)
+	}
+	return 0, plans, nil
+}
+
+// reserve marks the instance as busy while its service API is called,
+// failing when it's already busy. The returned function releases it.
+func (e *emulator) reserve(name string) (func(), error) {
+	if e.busy[name] {
+		return nil, fmt.Errorf("the service instance %q is busy, try again later", name)
+	}
+	e.busy[name] = true
+	return func() { delete(e.busy, name) }, nil
+}
+
+func (e *emulator) createInstance(s *service, name, plan, team string) (int, interface{}, error) {
+	if name == "" {
+		return http.StatusBadRequest, nil, errors.New("the name of the instance is required")
+	}
+	if _, ok := e.instances[name]; ok {
+		return http.StatusConflict, nil, fmt.Errorf("service instance %q already exists", name)
+	}
+	release, err := e.reserve(name)
+	if err != nil {
+		return http.StatusConflict, nil, err
+	}
+	defer release()
+	api := e.serviceAPI(s)
+	_, err = e.call("POST /resources", func() (*apiResponse, error) {
+		return api.createInstance(name, plan, team)
+	}, http.StatusCreated)
+	if err != nil {
+		return 0, nil, err
+	}
+	e.instances[name] = &emulatedInstance{Name: name, ServiceName: s.Name, PlanName: plan, TeamOwner: team}
+	return http.StatusCreated, nil, nil
+}
+
+func (e *emulator) removeInstance(s *service, instance *emulatedInstance) (int, interface{}, error) {
+	if len(instance.Apps) > 0 {
+		return http.StatusBadRequest, nil, fmt.Errorf("the service instance %q is bound to the apps: %s", instance.Name, strings.Join(instance.Apps, ", "))
+	}
+	release, err := e.reserve(instance.Name)
+	if err != nil {
+		return http.StatusConflict, nil, err
+	}
+	defer release()
+	api := e.serviceAPI(s)
+	_, err = e.call("DELETE /resources/"+instance.Name, func() (*apiResponse, error) {
+		return api.removeInstance(instance.Name)
+	}, http.StatusOK)
+	if err != nil {
+		return 0, nil, err
+	}
+	delete(e.instances, instance.Name)
+	return 0, nil, nil
+}
+
+func (e *emulator) instanceStatus(s *service, instance *emulatedInstance) (int, interface{}, error) {
+	api := e.serviceAPI(s)
+	resp, err := e.call("GET /resources/"+instance.Name+"/status", func() (*apiResponse, error) {
+		return api.instanceStatus(instance.Name)
+	}, http.StatusNoContent, http.StatusAccepted, http.StatusInternalServerError)
+	if err != nil {
+		return 0, nil, err
+	}
+	status := "down"
+	switch resp.status {
+	case http.StatusNoContent:
+		status = "up"
+	case http.StatusAccepted:
+		status = "pending"
+	}
+	return 0, fmt.Sprintf("Service instance %q is %s\n", instance.Name, status), nil
+}
+
+// bind binds the instance to the app and its units, returning the
+// environment variables set in the app.
+func (e *emulator) bind(s *service, instance *emulatedInstance, app *emulatedApp) (int, interface{}, error) {
+	if contains(instance.Apps, app.Name) {
+		return http.StatusConflict, nil, fmt.Errorf("the app %q is already bound to the service instance %q", app.Name, instance.Name)
+	}
+	release, err := e.reserve(instance.Name)
+	if err != nil {
+		return http.StatusConflict, nil, err
+	}
+	defer release()
+	api := e.serviceAPI(s)
+	route := "/resources/" + instance.Name
+	resp, err := e.call("POST "+route+"/bind-app", func() (*apiResponse, error) {
+		return api.bindApp(instance.Name, app.Name, app.IP)
+	}, http.StatusCreated)
+	if err != nil {
+		return 0, nil, err
+	}
+	var envs map[string]string
+	if err := json.Unmarshal(resp.body, &envs); err != nil {
+		return 0, nil, fmt.Errorf("invalid environment variables returned by the service API: %s", err)
+	}
+	for _, unit := range app.Units {
+		_, err = e.call("POST "+route+"/bind", func() (*apiResponse, error) {
+			return api.bindUnit(instance.Name, app.IP, unit)
+		}, http.StatusCreated, http.StatusOK)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	for name, value := range envs {
+		app.Env[name] = value
+	}
+	instance.Apps = append(instance.Apps, app.Name)
+	sort.Strings(instance.Apps)
+	e.addBindEvent(eventKindBind, s, instance, app)
+	return 0, envs, nil
+}
+
+func (e *emulator) unbind(s *service, instance *emulatedInstance, app *emulatedApp) (int, interface{}, error) {
+	if !contains(instance.Apps, app.Name) {
+		return http.StatusBadRequest, nil, fmt.Errorf("the app %q is not bound to the service instance %q", app.Name, instance.Name)
+	}
+	release, err := e.reserve(instance.Name)
+	if err != nil {
+		return http.StatusConflict, nil, err
+	}
+	defer release()
+	api := e.serviceAPI(s)
+	route := "/resources/" + instance.Name
+	for _, unit := range app.Units {
+		_, err = e.call("DELETE "+route+"/bind", func() (*apiResponse, error) {
+			return api.unbindUnit(instance.Name, app.IP, unit)
+		}, http.StatusOK)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	_, err = e.call("DELETE "+route+"/bind-app", func() (*apiResponse, error) {
+		return api.unbindApp(instance.Name, app.Name, app.IP)
+	}, http.StatusOK)
+	if err != nil {
+		return 0, nil, err
+	}
+	apps := instance.Apps[:0]
+	for _, name := range instance.Apps {
+		if name != app.Name {
+			apps = append(apps, name)
+		}
+	}
+	instance.Apps = apps
+	e.addBindEvent(eventKindUnbind, s, instance, app)
+	return 0, nil, nil
+}
+
+// addBindEvent records an event of the app being bound to, or unbound from,
+// the instance, like tsuru does.
+func (e *emulator) addBindEvent(kind string, s *service, instance *emulatedInstance, app *emulatedApp) {
+	e.events = append(e.events, tsuruEvent{
+		StartTime:    time.Now(),
+		Kind:         eventKind{Name: kind},
+		Target:       eventTarget{Type: "app", Value: app.Name},
+		ExtraTargets: []eventExtraTarget{{Target: serviceInstanceTarget(s.Name, instance.Name)}},
+	})
+}
+
+// maxEventsLimit is the most events tsuru returns at a time.
+const maxEventsLimit = 100
+
+// listEvents returns the events matching the query, most recent first. Like
+// tsuru, the events are filtered by the kindname, target.type and
+// target.value parameters, the targets matching extra targets too, and paged
+// by the skip and limit parameters.
+func (e *emulator) listEvents(query url.Values) []tsuruEvent {
+	kinds := query["kindname"]
+	target := eventTarget{Type: query.Get("target.type"), Value: query.Get("target.value")}
+	skip, _ := strconv.Atoi(query.Get("skip"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 || limit > maxEventsLimit {
+		limit = maxEventsLimit
+	}
+	events := []tsuruEvent{}
+	for i := len(e.events) - 1; i >= 0 && len(events) < limit; i-- {
+		if len(kinds) > 0 && !contains(kinds, e.events[i].Kind.Name) || !e.events[i].matches(target) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		events = append(events, e.events[i])
+	}
+	return events
+}
+
+// listTeams returns the teams of the emulator: the teams that own the
+// services.
+func (e *emulator) listTeams() []map[string]string {
+	seen := map[string]bool{}
+	var names []string
+	for _, s := range e.services {
+		for _, team := range s.OwnerTeams {
+			if !seen[team] {
+				seen[team] = true
+				names = append(names, team)
+			}
+		}
+	}
+	sort.Strings(names)
+	teams := []map[string]string{}
+	for _, name := range names {
+		teams = append(teams, map[string]string{"name": name})
+	}
+	return teams
+}
+
+func (e *emulator) listApps() []emulatedApp {
+	var names []string
+	for name := range e.apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	apps := []emulatedApp{}
+	for _, name := range names {
+		apps = append(apps, *e.apps[name])
+	}
+	return apps
+}
+
+func (e *emulator) listInstances() []cmd.ServiceModel {
+	instances := map[string][]string{}
+	for name, instance := range e.instances {
+		instances[instance.ServiceName] = append(instances[instance.ServiceName], name)
+	}
+	var names []string
+	for name := range e.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	models := []cmd.ServiceModel{}
+	for _, name := range names {
+		sort.Strings(instances[name])
+		models = append(models, cmd.ServiceModel{Service: name, Instances: instances[name]})
+	}
+	return models
+}
+
+// parseForm parses the form in the body of the request, including DELETE
+// requests, which are ignored by http.Request.ParseForm but used by tsuru.
+func parseForm(r *http.Request) {
+	if r.Method != "DELETE" {
+		r.ParseForm()
+		return
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	r.Form, _ = url.ParseQuery(string(data))
+}
+
+type apiEmulate struct {
+	fs       *gnuflag.FlagSet
+	env      string
+	endpoint string
+	listen   string
+	apps     cmd.StringSliceFlag
+	strict   bool
+}
+
+func (c *apiEmulate) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "api-emulate",
+		Usage: "api-emulate <manifest-file.yaml> [-e/--env <environment>] [--endpoint <name>] [--app <name>]... [--listen <address>] [--strict] [-- <command> [args...]]",
+		Desc: `Runs a local tsuru stand-in, for testing a service API end to end.
+
+The emulator is a fake tsuru server with the service described in the manifest
+and some fake apps. When service instances are created, bound, unbound and
+removed in the emulator, it calls the service API like tsuru would do, logging
+every call.
+
+The given command runs with the emulator as its tsuru target, and the emulator
+stops when the command finishes. Without a command, a shell is started. Inside
+it, crane commands talk to the emulator:
+
+  % crane api-emulate manifest.yaml --app myapp
+  $ crane instance-add mysqlapi mydb
+  $ crane instance-bind mysqlapi mydb --app myapp
+  $ crane instance-unbind mysqlapi mydb --app myapp
+  $ crane instance-remove mysqlapi mydb -y
+  $ exit
+
+The emulator calls the production endpoint of the service, unless another
+endpoint is given. With the --strict flag, the calls are validated against the
+OpenAPI document of the services API (see "api-spec"): the violations are
+logged, and the operation fails in the emulator.
+
+The emulator listens on a random local port by default. It's not
+authenticated, so --listen only takes loopback addresses, like
+"127.0.0.1:8080", and listens on 127.0.0.1 when only the port is given.`,
+		MinArgs: 1,
+	}
+}
+
+func (c *apiEmulate) Run(context *cmd.Context, client *cmd.Client) error {
+	m, err := loadManifest(context.Args[0], c.env, true)
+	if err != nil {
+		return err
+	}
+	e := newEmulator(context.Stderr)
+	if c.strict {
+		e.validator = servicesAPIValidator
+	}
+	if c.endpoint != "" {
+		if _, ok := m.Endpoints[c.endpoint]; !ok {
+			return fmt.Errorf("the endpoint %q is not defined in the manifest", c.endpoint)
+		}
+		e.endpoint = c.endpoint
+	}
+	err = e.addService(m)
+	if err != nil {
+		return err
+	}
+	apps := c.apps
+	if len(apps) == 0 {
+		apps = []string{"myapp"}
+	}
+	for _, app := range apps {
+		e.addApp(app)
+	}
+	listen := "127.0.0.1:0"
+	if c.listen != "" {
+		// The emulator calls the service API with its credentials for
+		// anyone who can reach it.
+		if listen, err = loopbackAddress("emulator", c.listen); err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	go http.Serve(listener, e)
+	target := "http://" + listener.Addr().String()
+	fmt.Fprintf(context.Stdout, "Emulating tsuru at %s, with the service %q and the apps: %s.\n", target, m.ID, strings.Join(apps, ", "))
+	args := context.Args[1:]
+	if len(args) == 0 {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		args = []string{shell}
+	}
+	command := exec.Command(args[0], args[1:]...)
+	command.Stdin = context.Stdin
+	command.Stdout = context.Stdout
+	command.Stderr = context.Stderr
+	command.Env = append(os.Environ(), "TSURU_TARGET="+target, "TSURU_TOKEN=crane-emulator")
+	return command.Run()
+}
+
+func (c *apiEmulate) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("api-emulate", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.env, "env", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.StringVar(&c.env, "e", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.StringVar(&c.endpoint, "endpoint", "", "Endpoint of the service called by the emulator (default: production)")
+		c.fs.StringVar(&c.listen, "listen", "", "Loopback address the emulator listens on (default: a random local port)")
+		c.fs.Var(&c.apps, "app", "Name of a fake app (may be repeated, default: myapp)")
+		c.fs.BoolVar(&c.strict, "strict", false, "Validate the calls to the service API against the OpenAPI document of the services API")
+	}
+	return c.fs
+}
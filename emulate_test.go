@@ -0,0 +1,270 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+// startEmulator runs an emulator with the service of the fake service API
+// and the app "myapp", making it the target.
+func startEmulator(c *check.C, fake *fakeServiceAPI, log *bytes.Buffer) (*emulator, func()) {
+	e := newEmulator(log)
+	err := e.addService(fake.manifest())
+	c.Assert(err, check.IsNil)
+	e.addApp("myapp")
+	server := httptest.NewServer(e)
+	os.Setenv("TSURU_TARGET", server.URL)
+	return e, func() {
+		server.Close()
+		os.Setenv("TSURU_TARGET", "http://localhost:8080")
+	}
+}
+
+func (s *S) TestEmulatorInstanceLifecycle(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	e, stop := startEmulator(c, fake, &log)
+	defer stop()
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	context := cmd.Context{Args: []string{"mysqlapi", "mydb"}, Stdout: ioutil.Discard}
+	add := instanceAdd{}
+	add.Flags().Parse(true, []string{"-p", "small"})
+	err := add.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(fake.instances["mydb"], check.NotNil)
+	var stdout bytes.Buffer
+	context.Stdout = &stdout
+	bind := instanceBind{app: "myapp"}
+	err = bind.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, "(?s).*MYSQL_HOST=10.0.0.2\n  MYSQL_USER=root\n")
+	c.Assert(e.apps["myapp"].Env, check.DeepEquals, fake.envs)
+	c.Assert(fake.instances["mydb"], check.DeepEquals, map[string]bool{"myapp.example.com": true, "10.0.1.1": true})
+	context.Stdin = strings.NewReader("y\n")
+	err = (&instanceRemove{}).Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `the service instance "mydb" is bound to the apps: myapp`+"\n")
+	err = (&instanceUnbind{app: "myapp"}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(fake.instances["mydb"], check.HasLen, 0)
+	context.Stdin = strings.NewReader("y\n")
+	err = (&instanceRemove{}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(fake.instances, check.HasLen, 0)
+	c.Assert(e.instances, check.HasLen, 0)
+	c.Assert(log.String(), check.Matches, `POST /resources: 201 Created in .*
+POST /resources/mydb/bind-app: 201 Created in .*
+POST /resources/mydb/bind: 201 Created in .*
+DELETE /resources/mydb/bind: 200 OK in .*
+DELETE /resources/mydb/bind-app: 200 OK in .*
+DELETE /resources/mydb: 200 OK in .*
+`)
+}
+
+func (s *S) TestEmulatorServiceAPIError(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	fake.overrides["POST /resources"] = http.StatusInternalServerError
+	var log bytes.Buffer
+	e, stop := startEmulator(c, fake, &log)
+	defer stop()
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	context := cmd.Context{Args: []string{"mysqlapi", "mydb"}, Stdout: ioutil.Discard}
+	err := (&instanceAdd{}).Run(&context, client)
+	c.Assert(err, check.ErrorMatches, "the service API returned an error: expected status 201, got 500\n")
+	c.Assert(e.instances, check.HasLen, 0)
+}
+
+func (s *S) TestEmulatorUnknownRoutes(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	_, stop := startEmulator(c, fake, &log)
+	defer stop()
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	context := cmd.Context{Args: []string{"postgresapi", "mydb"}, Stdout: ioutil.Discard}
+	err := (&instanceAdd{}).Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `service "postgresapi" not found`+"\n")
+	context.Args = []string{"mysqlapi", "mydb"}
+	err = (&instanceBind{app: "myapp"}).Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `service instance "mydb" not found`+"\n")
+}
+
+func (s *S) TestEmulatorServesServices(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	_, stop := startEmulator(c, fake, &log)
+	defer stop()
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	state, err := fetchServiceState(client, "mysqlapi")
+	c.Assert(err, check.IsNil)
+	c.Assert(state.Endpoint, check.DeepEquals, map[string]string{"production": fake.server.URL})
+	c.Assert(state.Plans, check.DeepEquals, []string{"big", "small"})
+	var apps []emulatedApp
+	err = getJSON(client, "/apps", &apps)
+	c.Assert(err, check.IsNil)
+	c.Assert(apps, check.DeepEquals, []emulatedApp{
+		{Name: "myapp", IP: "myapp.example.com", Units: []string{"10.0.1.1"}, Env: map[string]string{}},
+	})
+}
+
+func (s *S) TestAPIEmulateRun(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	path := filepath.Join(c.MkDir(), "manifest.yaml")
+	data := "id: mysqlapi\npassword: s3cr3t\nendpoint:\n  production: " + fake.server.URL + "\n"
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	c.Assert(err, check.IsNil)
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Args:   []string{path, "sh", "-c", `echo "$TSURU_TARGET $TSURU_TOKEN"`},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	command := apiEmulate{}
+	command.Flags().Parse(true, []string{"--app", "web", "--app", "worker"})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	lines := strings.SplitN(stdout.String(), "\n", 2)
+	c.Assert(lines[0], check.Matches, `Emulating tsuru at http://127.0.0.1:\d+, with the service "mysqlapi" and the apps: web, worker.`)
+	c.Assert(lines[1], check.Matches, `http://127.0.0.1:\d+ crane-emulator\n`)
+}
+
+func (s *S) TestAPIEmulateCommandFailure(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	path := filepath.Join(c.MkDir(), "manifest.yaml")
+	data := "id: mysqlapi\nendpoint:\n  production: " + fake.server.URL + "\n"
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	c.Assert(err, check.IsNil)
+	context := cmd.Context{Args: []string{path, "false"}, Stdout: ioutil.Discard, Stderr: ioutil.Discard}
+	err = (&apiEmulate{}).Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "exit status 1")
+}
+
+func (s *S) TestAPIEmulateUnknownEndpoint(c *check.C) {
+	context := cmd.Context{Args: []string{"testdata/manifest.yml"}}
+	command := apiEmulate{}
+	command.Flags().Parse(true, []string{"--endpoint", "staging"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `the endpoint "staging" is not defined in the manifest`)
+}
+
+func (s *S) TestAPIEmulateListenNotLoopback(c *check.C) {
+	context := cmd.Context{Args: []string{"testdata/manifest.yml", "touch", filepath.Join(c.MkDir(), "ran")}}
+	command := apiEmulate{}
+	command.Flags().Parse(true, []string{"--listen", "0.0.0.0:8080"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `the emulator must listen on a loopback address, like 127.0.0.1:8080, not "0.0.0.0:8080"`)
+	_, err = os.Stat(context.Args[2])
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestEmulatorServesDuringServiceAPICalls(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/bind-app") {
+			<-release
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer slow.Close()
+	m := fake.manifest()
+	m.Endpoints["production"] = slow.URL
+	e := newEmulator(ioutil.Discard)
+	err := e.addService(m)
+	c.Assert(err, check.IsNil)
+	e.addApp("myapp")
+	e.instances["mydb"] = &emulatedInstance{Name: "mydb", ServiceName: "mysqlapi"}
+	fake.instances["mydb"] = map[string]bool{}
+	server := httptest.NewServer(e)
+	defer server.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+	bind := func() int {
+		req, err := http.NewRequest("PUT", server.URL+"/1.0/services/mysqlapi/instances/mydb/myapp", nil)
+		c.Assert(err, check.IsNil)
+		resp, err := client.Do(req)
+		c.Assert(err, check.IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	done := make(chan int)
+	go func() {
+		done <- bind()
+	}()
+	for busy := false; !busy; time.Sleep(time.Millisecond) {
+		e.mu.Lock()
+		busy = e.busy["mydb"]
+		e.mu.Unlock()
+	}
+	resp, err := client.Get(server.URL + "/1.0/services/instances")
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(bind(), check.Equals, http.StatusConflict)
+	close(release)
+	c.Assert(<-done, check.Equals, http.StatusOK)
+	c.Assert(e.instances["mydb"].Apps, check.DeepEquals, []string{"myapp"})
+	c.Assert(e.busy, check.HasLen, 0)
+}
+
+func (s *S) TestEmulatorListInstances(c *check.C) {
+	e := newEmulator(ioutil.Discard)
+	e.services["mysqlapi"] = &service{Name: "mysqlapi"}
+	e.services["redisapi"] = &service{Name: "redisapi"}
+	e.instances["mydb"] = &emulatedInstance{Name: "mydb", ServiceName: "mysqlapi"}
+	e.instances["db"] = &emulatedInstance{Name: "db", ServiceName: "mysqlapi"}
+	data, err := json.Marshal(e.listInstances())
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, `[{"Service":"mysqlapi","Instances":["db","mydb"]},{"Service":"redisapi","Instances":null}]`)
+}
+
+func (s *S) TestEmulatorBindEventsAndTeams(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	e, stop := startEmulator(c, fake, &log)
+	defer stop()
+	e.services["mysqlapi"].OwnerTeams = []string{"dba", "admin"}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	context := cmd.Context{Args: []string{"mysqlapi", "mydb"}, Stdout: ioutil.Discard}
+	err := (&instanceAdd{}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	err = (&instanceBind{app: "myapp"}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	err = (&instanceUnbind{app: "myapp"}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(e.listEvents(url.Values{}), check.HasLen, 2)
+	c.Assert(e.listEvents(url.Values{"target.value": {"mysqlapi/mydb"}, "skip": {"1"}}), check.HasLen, 1)
+	c.Assert(e.listEvents(url.Values{"target.value": {"mysqlapi/other"}}), check.HasLen, 0)
+	c.Assert(e.listEvents(url.Values{"limit": {"1"}})[0].Kind.Name, check.Equals, eventKindUnbind)
+	events := e.listEvents(url.Values{"kindname": {eventKindBind}})
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Target, check.Equals, eventTarget{Type: "app", Value: "myapp"})
+	c.Assert(events[0].ExtraTargets, check.DeepEquals, []eventExtraTarget{{Target: eventTarget{Type: "service-instance", Value: "mysqlapi/mydb"}}})
+	binds, incomplete, err := lastBindEvents(client, "mysqlapi", []string{"mydb"})
+	c.Assert(err, check.IsNil)
+	c.Assert(binds["mydb"].Kind.Name, check.Equals, eventKindUnbind)
+	c.Assert(incomplete, check.HasLen, 0)
+	teams, err := listTeams(client)
+	c.Assert(err, check.IsNil)
+	c.Assert(teams, check.DeepEquals, map[string]bool{"admin": true, "dba": true})
+}
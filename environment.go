@@ -0,0 +1,179 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// overlayPath returns the path of the overlay file of the given manifest for
+// an environment: the overlay of "manifest.yml" for the environment "prod" is
+// "manifest.prod.yml", in the same directory.
+func overlayPath(path, env string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + env + ext
+}
+
+// mergeValues merges the overlay value over the base value. Mappings are
+// merged recursively, and any other value in the overlay replaces the base
+// value. A null value in an overlay mapping removes the key.
+func mergeValues(base, overlay interface{}) interface{} {
+	baseMap, ok := base.(map[interface{}]interface{})
+	if !ok {
+		return overlay
+	}
+	overlayMap, ok := overlay.(map[interface{}]interface{})
+	if !ok {
+		return overlay
+	}
+	result := make(map[interface{}]interface{}, len(baseMap)+len(overlayMap))
+	for key, value := range baseMap {
+		result[key] = value
+	}
+	for key, value := range overlayMap {
+		if value == nil {
+			delete(result, key)
+		} else {
+			result[key] = mergeValues(result[key], value)
+		}
+	}
+	return result
+}
+
+// mergePositions merges the positions of the fields in an overlay over the
+// positions of the fields in the base manifest. Fields replaced by the overlay
+// lose the positions of their children in the base manifest.
+func mergePositions(base, overlay map[string]yamlPosition) map[string]yamlPosition {
+	result := make(map[string]yamlPosition, len(base)+len(overlay))
+	for path, pos := range base {
+		result[path] = pos
+	}
+	for path := range overlay {
+		for basePath := range base {
+			if strings.HasPrefix(basePath, path+".") {
+				if _, ok := overlay[basePath]; !ok {
+					delete(result, basePath)
+				}
+			}
+		}
+	}
+	for path, pos := range overlay {
+		result[path] = pos
+	}
+	return result
+}
+
+// referenceRegexp matches references in manifest values: "${NAME}" is
+// replaced by the value of the environment variable NAME, "${file:path}" by
+// the contents of the file and "$$" by a single "$".
+var referenceRegexp = regexp.MustCompile(`\$\$|\$\{([^}]*)\}`)
+
+// isReference reports whether the value is made only of a reference, like
+// "${DB_PASSWORD}".
+func isReference(value string) bool {
+	loc := referenceRegexp.FindStringIndex(value)
+	return loc != nil && loc[0] == 0 && loc[1] == len(value) && value != "$$"
+}
+
+// hasReference reports whether the value includes a reference, and thus is
+// only known when the manifest is interpolated.
+func hasReference(value string) bool {
+	for _, match := range referenceRegexp.FindAllString(value, -1) {
+		if match != "$$" {
+			return true
+		}
+	}
+	return false
+}
+
+// interpolate resolves the references in every string of the manifest.
+// Files are read relative to the given directory.
+func (d *manifestDecoder) interpolate(root map[interface{}]interface{}, dir string) (map[interface{}]interface{}, error) {
+	value, err := d.interpolateValue(root, "", dir)
+	if err != nil {
+		return nil, err
+	}
+	return value.(map[interface{}]interface{}), nil
+}
+
+func (d *manifestDecoder) interpolateValue(value interface{}, path, dir string) (interface{}, error) {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch v := value.(type) {
+	case string:
+		return d.interpolateString(v, path, dir)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if result[i], err = d.interpolateValue(item, join(strconv.Itoa(i)), dir); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	case map[interface{}]interface{}:
+		keys := make([]string, 0, len(v))
+		byName := make(map[string]interface{}, len(v))
+		for key := range v {
+			keys = append(keys, fmt.Sprint(key))
+			byName[fmt.Sprint(key)] = key
+		}
+		sort.Strings(keys)
+		result := make(map[interface{}]interface{}, len(v))
+		for _, name := range keys {
+			key := byName[name]
+			interpolated, err := d.interpolateValue(v[key], join(name), dir)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = interpolated
+		}
+		return result, nil
+	}
+	return value, nil
+}
+
+func (d *manifestDecoder) interpolateString(value, path, dir string) (string, error) {
+	var err error
+	result := referenceRegexp.ReplaceAllStringFunc(value, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		if err != nil {
+			return ""
+		}
+		name := match[2 : len(match)-1]
+		if strings.HasPrefix(name, "file:") {
+			file := strings.TrimPrefix(name, "file:")
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+			data, readErr := ioutil.ReadFile(file)
+			if readErr != nil {
+				err = d.errorf(path, "failed to read %q: %s", strings.TrimPrefix(name, "file:"), readErr)
+				return ""
+			}
+			return strings.TrimRight(string(data), "\r\n")
+		}
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			err = d.errorf(path, "the environment variable %q is not defined", name)
+			return ""
+		}
+		return envValue
+	})
+	return result, err
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestOverlayPath(c *check.C) {
+	c.Assert(overlayPath("manifest.yml", "prod"), check.Equals, "manifest.prod.yml")
+	c.Assert(overlayPath("services/mysql/manifest.yaml", "qa"), check.Equals, "services/mysql/manifest.qa.yaml")
+	c.Assert(overlayPath("manifest", "prod"), check.Equals, "manifest.prod")
+}
+
+func (s *S) TestMergeValues(c *check.C) {
+	base := map[interface{}]interface{}{
+		"id":    "mysqlapi",
+		"teams": []interface{}{"admin", "ops"},
+		"endpoints": map[interface{}]interface{}{
+			"production": "mysqlapi.com",
+			"staging":    "staging.mysqlapi.com",
+		},
+	}
+	overlay := map[interface{}]interface{}{
+		"teams": []interface{}{"prod"},
+		"endpoints": map[interface{}]interface{}{
+			"production": "prod.mysqlapi.com",
+			"staging":    nil,
+		},
+	}
+	c.Assert(mergeValues(base, overlay), check.DeepEquals, map[interface{}]interface{}{
+		"id":        "mysqlapi",
+		"teams":     []interface{}{"prod"},
+		"endpoints": map[interface{}]interface{}{"production": "prod.mysqlapi.com"},
+	})
+	c.Assert(base["endpoints"], check.HasLen, 2)
+}
+
+func (s *S) TestMergePositions(c *check.C) {
+	base := map[string]yamlPosition{
+		"teams":            {file: "manifest.yml", line: 1, column: 1},
+		"teams.0":          {file: "manifest.yml", line: 2, column: 3},
+		"teams.1":          {file: "manifest.yml", line: 3, column: 3},
+		"endpoints":        {file: "manifest.yml", line: 4, column: 1},
+		"endpoints.dev":    {file: "manifest.yml", line: 5, column: 3},
+		"endpoints.domain": {file: "manifest.yml", line: 6, column: 3},
+	}
+	overlay := map[string]yamlPosition{
+		"teams":         {file: "manifest.prod.yml", line: 1, column: 1},
+		"teams.0":       {file: "manifest.prod.yml", line: 2, column: 3},
+		"endpoints":     {file: "manifest.prod.yml", line: 3, column: 1},
+		"endpoints.dev": {file: "manifest.prod.yml", line: 4, column: 3},
+	}
+	c.Assert(mergePositions(base, overlay), check.DeepEquals, map[string]yamlPosition{
+		"teams":         {file: "manifest.prod.yml", line: 1, column: 1},
+		"teams.0":       {file: "manifest.prod.yml", line: 2, column: 3},
+		"endpoints":     {file: "manifest.prod.yml", line: 3, column: 1},
+		"endpoints.dev": {file: "manifest.prod.yml", line: 4, column: 3},
+	})
+}
+
+func (s *S) TestReferences(c *check.C) {
+	var tests = []struct {
+		value        string
+		isReference  bool
+		hasReference bool
+	}{
+		{"s3cr3t", false, false},
+		{"${DB_PASSWORD}", true, true},
+		{"${file:secrets/password}", true, true},
+		{"https://${HOST}/api", false, true},
+		{"$$", false, false},
+		{"$${NOT_A_REFERENCE}", false, false},
+		{"${A}${B}", false, true},
+	}
+	for _, t := range tests {
+		c.Check(isReference(t.value), check.Equals, t.isReference, check.Commentf(t.value))
+		c.Check(hasReference(t.value), check.Equals, t.hasReference, check.Commentf(t.value))
+	}
+}
+
+func (s *S) TestLoadManifestInterpolatesEnvironmentVariables(c *check.C) {
+	os.Setenv("MYSQLAPI_PASSWORD", "from-env")
+	defer os.Unsetenv("MYSQLAPI_PASSWORD")
+	m, err := loadManifest("testdata/manifest-env.yml", "", true)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Password, check.Equals, "from-env")
+	c.Assert(m.Description, check.Equals, "MySQL databases, $5 a month")
+	c.Assert(m.Endpoints, check.DeepEquals, map[string]string{
+		"production": "https://mysqlapi.com",
+		"staging":    "https://staging.mysqlapi.com",
+	})
+}
+
+func (s *S) TestLoadManifestUndefinedEnvironmentVariable(c *check.C) {
+	os.Unsetenv("MYSQLAPI_PASSWORD")
+	_, err := loadManifest("testdata/manifest-env.yml", "", true)
+	c.Assert(err, check.ErrorMatches, `invalid manifest: testdata/manifest-env.yml:4:1: the environment variable "MYSQLAPI_PASSWORD" is not defined`)
+}
+
+func (s *S) TestLoadManifestWithoutInterpolation(c *check.C) {
+	os.Unsetenv("MYSQLAPI_PASSWORD")
+	m, err := loadManifest("testdata/manifest-env.yml", "", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Password, check.Equals, "${MYSQLAPI_PASSWORD}")
+	c.Assert(m.Description, check.Equals, "MySQL databases, $$5 a month")
+}
+
+func (s *S) TestLoadManifestWithOverlay(c *check.C) {
+	m, err := loadManifest("testdata/manifest-env.yml", "prod", true)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.ID, check.Equals, "mysqlapi")
+	c.Assert(m.Password, check.Equals, "s3cr3t")
+	c.Assert(m.Endpoints, check.DeepEquals, map[string]string{"production": "https://mysqlapi.prod.example.com"})
+	c.Assert(m.position("id"), check.Equals, yamlPosition{file: "testdata/manifest-env.yml", line: 2, column: 1})
+	c.Assert(m.position("endpoints.production"), check.Equals, yamlPosition{file: "testdata/manifest-env.prod.yml", line: 3, column: 3})
+}
+
+func (s *S) TestLoadManifestOverlayNotFound(c *check.C) {
+	_, err := loadManifest("testdata/manifest-env.yml", "qa", true)
+	c.Assert(err, check.ErrorMatches, `overlay file for the environment "qa" not found: testdata/manifest-env.qa.yml`)
+}
+
+func (s *S) TestLoadManifestFileReferenceNotFound(c *check.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "manifest.yml")
+	data := "id: mysqlapi\npassword: ${file:missing.txt}\nendpoint:\n  production: mysqlapi.com\n"
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	c.Assert(err, check.IsNil)
+	_, err = loadManifest(path, "", true)
+	c.Assert(err, check.ErrorMatches, `invalid manifest: .*/manifest.yml:2:1: failed to read "missing.txt": .*`)
+}
@@ -0,0 +1,260 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v1"
+)
+
+// faultRoutes are the names of the routes of the services API, which may be
+// used instead of the method and path in fault rules.
+var faultRoutes = map[string]string{
+	"plans":       "GET /resources/plans",
+	"create":      "POST /resources",
+	"status":      "GET /resources/{name}/status",
+	"bind-app":    "POST /resources/{name}/bind-app",
+	"unbind-app":  "DELETE /resources/{name}/bind-app",
+	"bind-unit":   "POST /resources/{name}/bind",
+	"unbind-unit": "DELETE /resources/{name}/bind",
+	"remove":      "DELETE /resources/{name}",
+}
+
+// faultRules holds the rules for injecting faults in the exchanges between
+// tsuru and a service API, as defined in a YAML file.
+//
+// Each rule applies to a route, like "POST /resources/{name}/bind-app" or its
+// name, "bind-app", with a probability, which defaults to 1. A rule may delay
+// the request, respond with an error status instead of calling the service
+// API, drop the connection, or make the response invalid JSON.
+type faultRules struct {
+	Rules []*faultRule `yaml:"rules" json:"rules"`
+}
+
+type faultRule struct {
+	Name          string   `yaml:"name" json:"name"`
+	Route         string   `yaml:"route" json:"route"`
+	Probability   *float64 `yaml:"probability" json:"probability,omitempty"`
+	Latency       string   `yaml:"latency" json:"latency,omitempty"`
+	Status        int      `yaml:"status" json:"status,omitempty"`
+	Drop          bool     `yaml:"drop" json:"drop,omitempty"`
+	MalformedJSON bool     `yaml:"malformed-json" json:"malformed-json,omitempty"`
+	Disabled      bool     `yaml:"disabled" json:"disabled"`
+
+	method  string
+	path    []string
+	latency time.Duration
+}
+
+func readFaultRules(path string) ([]*faultRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseFaultRules(data)
+}
+
+// parseFaultRules parses and validates fault rules, in YAML or JSON.
+func parseFaultRules(data []byte) ([]*faultRule, error) {
+	var rules faultRules
+	err := yaml.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fault rules: %s", err)
+	}
+	names := map[string]bool{}
+	for i, r := range rules.Rules {
+		if r == nil {
+			return nil, fmt.Errorf("invalid fault rule #%d: the rule is empty", i+1)
+		}
+		if err := r.prepare(i); err != nil {
+			return nil, fmt.Errorf("invalid fault rule #%d: %s", i+1, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("invalid fault rule #%d: duplicate name %q", i+1, r.Name)
+		}
+		names[r.Name] = true
+	}
+	return rules.Rules, nil
+}
+
+// prepare validates the rule, which is the i-th rule of its file.
+func (r *faultRule) prepare(i int) error {
+	if r.Name == "" {
+		r.Name = fmt.Sprintf("rule-%d", i+1)
+	}
+	route := r.Route
+	if named, ok := faultRoutes[route]; ok {
+		route = named
+	}
+	if route == "" {
+		return errors.New("the route is required")
+	}
+	r.method = "*"
+	if parts := strings.SplitN(route, " ", 2); len(parts) == 2 {
+		r.method, route = strings.ToUpper(parts[0]), strings.TrimSpace(parts[1])
+	}
+	if !strings.HasPrefix(route, "/") {
+		return fmt.Errorf("invalid route %q", r.Route)
+	}
+	r.path = strings.Split(strings.Trim(route, "/"), "/")
+	if r.Probability != nil && (*r.Probability < 0 || *r.Probability > 1) {
+		return fmt.Errorf("the probability must be between 0 and 1, got %v", *r.Probability)
+	}
+	if r.Latency != "" {
+		latency, err := time.ParseDuration(r.Latency)
+		if err != nil {
+			return fmt.Errorf("invalid latency %q", r.Latency)
+		}
+		r.latency = latency
+	}
+	if r.Status != 0 && (r.Status < 400 || r.Status > 599) {
+		return fmt.Errorf("the status must be between 400 and 599, got %d", r.Status)
+	}
+	var effects int
+	for _, set := range []bool{r.Status != 0, r.Drop, r.MalformedJSON} {
+		if set {
+			effects++
+		}
+	}
+	if effects > 1 {
+		return errors.New("only one of status, drop or malformed-json may be set")
+	}
+	if effects == 0 && r.latency == 0 {
+		return errors.New("one of latency, status, drop or malformed-json is required")
+	}
+	return nil
+}
+
+// matches checks whether the rule applies to requests with the given method
+// and path. The segments of the route in braces match any segment.
+func (r *faultRule) matches(method, path string) bool {
+	if r.method != "*" && r.method != method {
+		return false
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) != len(r.path) {
+		return false
+	}
+	for i, s := range r.path {
+		if !strings.HasPrefix(s, "{") && s != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// faultSet is the set of fault rules of a proxy, which may be changed at
+// runtime through its control API.
+type faultSet struct {
+	mu     sync.Mutex
+	rules  []*faultRule
+	random func() float64
+}
+
+func newFaultSet(rules []*faultRule) *faultSet {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return &faultSet{rules: rules, random: random.Float64}
+}
+
+// pick returns the first enabled rule that matches the request and fires,
+// according to its probability, or nil.
+func (s *faultSet) pick(method, path string) *faultRule {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.rules {
+		if r.Disabled || !r.matches(method, path) {
+			continue
+		}
+		if r.Probability == nil || s.random() < *r.Probability {
+			rule := *r
+			return &rule
+		}
+	}
+	return nil
+}
+
+func (s *faultSet) set(rules []*faultRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = rules
+}
+
+func (s *faultSet) enable(name string, enabled bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.rules {
+		if r.Name == name {
+			r.Disabled = !enabled
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP implements the control API of the fault rules:
+//
+//	GET    /faults                 lists the rules
+//	PUT    /faults                 replaces the rules with the ones in the body
+//	DELETE /faults                 removes all the rules
+//	POST   /faults/<name>/enable   enables a rule
+//	POST   /faults/<name>/disable  disables a rule
+func (s *faultSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "faults" {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+	case len(parts) == 1 && r.Method == "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rules, err := parseFaultRules(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.set(rules)
+	case len(parts) == 1 && r.Method == "DELETE":
+		s.set(nil)
+	case len(parts) == 3 && r.Method == "POST" && (parts[2] == "enable" || parts[2] == "disable"):
+		if !s.enable(parts[1], parts[2] == "enable") {
+			http.Error(w, fmt.Sprintf("fault rule %q not found", parts[1]), http.StatusNotFound)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rules := faultRules{Rules: s.rules}
+	if rules.Rules == nil {
+		rules.Rules = []*faultRule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// malformJSON returns an invalid JSON document made from the given one, by
+// cutting it in half.
+func malformJSON(data []byte) []byte {
+	return append(data[:len(data)/2:len(data)/2], '{')
+}
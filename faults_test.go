@@ -0,0 +1,238 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestParseFaultRules(c *check.C) {
+	data := `rules:
+  - name: flaky-binds
+    route: bind-app
+    probability: 0.3
+    status: 503
+  - route: post /resources
+    latency: 2s
+  - route: /resources/{name}
+    drop: true
+`
+	rules, err := parseFaultRules([]byte(data))
+	c.Assert(err, check.IsNil)
+	c.Assert(rules, check.HasLen, 3)
+	c.Assert(rules[0].Name, check.Equals, "flaky-binds")
+	c.Assert(*rules[0].Probability, check.Equals, 0.3)
+	c.Assert(rules[0].method, check.Equals, "POST")
+	c.Assert(rules[0].path, check.DeepEquals, []string{"resources", "{name}", "bind-app"})
+	c.Assert(rules[1].Name, check.Equals, "rule-2")
+	c.Assert(rules[1].method, check.Equals, "POST")
+	c.Assert(rules[1].latency, check.Equals, 2*time.Second)
+	c.Assert(rules[2].method, check.Equals, "*")
+}
+
+func (s *S) TestParseFaultRulesJSON(c *check.C) {
+	rules, err := parseFaultRules([]byte(`{"rules": [{"route": "remove", "status": 500}]}`))
+	c.Assert(err, check.IsNil)
+	c.Assert(rules, check.HasLen, 1)
+	c.Assert(rules[0].Status, check.Equals, 500)
+}
+
+func (s *S) TestParseFaultRulesInvalid(c *check.C) {
+	tests := []struct {
+		rules string
+		err   string
+	}{
+		{"rules: [{status: 500}]", "invalid fault rule #1: the route is required"},
+		{"rules: [{route: resources, status: 500}]", `invalid fault rule #1: invalid route "resources"`},
+		{"rules: [{route: create}]", "invalid fault rule #1: one of latency, status, drop or malformed-json is required"},
+		{"rules: [{route: create, status: 200}]", "invalid fault rule #1: the status must be between 400 and 599, got 200"},
+		{"rules: [{route: create, status: 500, drop: true}]", "invalid fault rule #1: only one of status, drop or malformed-json may be set"},
+		{"rules: [{route: create, latency: soon}]", `invalid fault rule #1: invalid latency "soon"`},
+		{"rules: [{route: create, drop: true, probability: 2}]", "invalid fault rule #1: the probability must be between 0 and 1, got 2"},
+		{"rules: [{route: create, drop: true}, {name: rule-1, route: remove, drop: true}]", `invalid fault rule #2: duplicate name "rule-1"`},
+		{"rules: [", "invalid fault rules: .*"},
+	}
+	for _, t := range tests {
+		_, err := parseFaultRules([]byte(t.rules))
+		c.Check(err, check.ErrorMatches, t.err, check.Commentf(t.rules))
+	}
+}
+
+func (s *S) TestFaultRuleMatches(c *check.C) {
+	rules, err := parseFaultRules([]byte("rules: [{route: bind-app, drop: true}, {route: /resources/plans, drop: true}]"))
+	c.Assert(err, check.IsNil)
+	c.Assert(rules[0].matches("POST", "/resources/mydb/bind-app"), check.Equals, true)
+	c.Assert(rules[0].matches("DELETE", "/resources/mydb/bind-app"), check.Equals, false)
+	c.Assert(rules[0].matches("POST", "/resources/mydb/bind"), check.Equals, false)
+	c.Assert(rules[0].matches("POST", "/resources/mydb"), check.Equals, false)
+	c.Assert(rules[1].matches("GET", "/resources/plans"), check.Equals, true)
+	c.Assert(rules[1].matches("GET", "/resources/mydb"), check.Equals, false)
+}
+
+func (s *S) TestFaultSetPick(c *check.C) {
+	rules, err := parseFaultRules([]byte(`rules:
+  - {name: flaky, route: bind-app, probability: 0.3, status: 503}
+  - {name: slow, route: bind-app, latency: 10ms}
+`))
+	c.Assert(err, check.IsNil)
+	faults := newFaultSet(rules)
+	faults.random = func() float64 { return 0.2 }
+	c.Assert(faults.pick("POST", "/resources/mydb/bind-app").Name, check.Equals, "flaky")
+	faults.random = func() float64 { return 0.5 }
+	c.Assert(faults.pick("POST", "/resources/mydb/bind-app").Name, check.Equals, "slow")
+	c.Assert(faults.pick("POST", "/resources"), check.IsNil)
+	c.Assert(faults.enable("slow", false), check.Equals, true)
+	c.Assert(faults.pick("POST", "/resources/mydb/bind-app"), check.IsNil)
+	c.Assert(faults.enable("unknown", false), check.Equals, false)
+	var nilSet *faultSet
+	c.Assert(nilSet.pick("POST", "/resources"), check.IsNil)
+}
+
+func (s *S) TestFaultSetProbability(c *check.C) {
+	rules, err := parseFaultRules([]byte("rules: [{route: bind-app, probability: 0.3, status: 503}]"))
+	c.Assert(err, check.IsNil)
+	faults := newFaultSet(rules)
+	var fired int
+	for i := 0; i < 1000; i++ {
+		if faults.pick("POST", "/resources/mydb/bind-app") != nil {
+			fired++
+		}
+	}
+	c.Assert(fired > 200 && fired < 400, check.Equals, true, check.Commentf("fired %d times", fired))
+}
+
+// startFaultyProxy starts a proxy to the fake service API with the given fault
+// rules, returning a client of the service API through the proxy.
+func startFaultyProxy(c *check.C, fake *fakeServiceAPI, rules string, log *bytes.Buffer) (*serviceAPI, func()) {
+	parsed, err := parseFaultRules([]byte(rules))
+	c.Assert(err, check.IsNil)
+	proxy := newServiceProxy(fake.server.URL, log, nil)
+	proxy.faults = newFaultSet(parsed)
+	server := httptest.NewServer(proxy)
+	return newServiceAPI(server.URL, fake.manifest()), server.Close
+}
+
+func (s *S) TestServiceProxyInjectsStatus(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	api, stop := startFaultyProxy(c, fake, "rules: [{name: broken-create, route: create, status: 503}]", &log)
+	defer stop()
+	resp, err := api.createInstance("mydb", "small", "admin")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.status, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(string(resp.body), check.Equals, `fault "broken-create" injected by crane`+"\n")
+	c.Assert(fake.requests, check.HasLen, 0)
+	c.Assert(log.String(), check.Matches, `POST /resources: 503 Service Unavailable in .*ms \(fault "broken-create"\)\n(?s).*`)
+}
+
+func (s *S) TestServiceProxyInjectsLatency(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	api, stop := startFaultyProxy(c, fake, "rules: [{route: plans, latency: 50ms}]", &log)
+	defer stop()
+	resp, err := api.plans()
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.status, check.Equals, http.StatusOK)
+	c.Assert(resp.duration >= 50*time.Millisecond, check.Equals, true)
+	c.Assert(fake.requests, check.DeepEquals, []string{"GET /resources/plans"})
+}
+
+func (s *S) TestServiceProxyDropsConnection(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	api, stop := startFaultyProxy(c, fake, "rules: [{route: remove, drop: true}]", &log)
+	defer stop()
+	_, err := api.removeInstance("mydb")
+	c.Assert(err, check.NotNil)
+	c.Assert(fake.requests, check.HasLen, 0)
+	c.Assert(log.String(), check.Matches, `DELETE /resources/mydb: failed after .*ms: connection dropped \(fault "rule-1"\)\n(?s).*`)
+}
+
+func (s *S) TestServiceProxyMalformsJSON(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	api, stop := startFaultyProxy(c, fake, "rules: [{route: bind-app, malformed-json: true}]", &log)
+	defer stop()
+	_, err := api.createInstance("mydb", "small", "admin")
+	c.Assert(err, check.IsNil)
+	resp, err := api.bindApp("mydb", "myapp", "myapp.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.status, check.Equals, http.StatusCreated)
+	var envs map[string]string
+	c.Assert(json.Unmarshal(resp.body, &envs), check.NotNil)
+	c.Assert(fake.instances["mydb"]["myapp.example.com"], check.Equals, true)
+}
+
+func (s *S) TestMalformJSON(c *check.C) {
+	data := []byte(`{"MYSQL_HOST":"10.0.0.2"}`)
+	c.Assert(string(malformJSON(data)), check.Equals, `{"MYSQL_HOST{`)
+	c.Assert(string(data), check.Equals, `{"MYSQL_HOST":"10.0.0.2"}`)
+	c.Assert(string(malformJSON(nil)), check.Equals, "{")
+}
+
+func (s *S) TestFaultControlAPI(c *check.C) {
+	faults := newFaultSet(nil)
+	server := httptest.NewServer(faults)
+	defer server.Close()
+	do := func(method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, check.IsNil)
+		return resp.StatusCode, string(data)
+	}
+	status, body := do("GET", "/faults", "")
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(body, check.Equals, `{"rules":[]}`+"\n")
+	status, body = do("PUT", "/faults", "rules: [{name: flaky, route: bind-app, status: 500}]")
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(body, check.Equals, `{"rules":[{"name":"flaky","route":"bind-app","status":500,"disabled":false}]}`+"\n")
+	c.Assert(faults.pick("POST", "/resources/mydb/bind-app"), check.NotNil)
+	status, body = do("POST", "/faults/flaky/disable", "")
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(body, check.Matches, `(?s).*"disabled":true.*`)
+	c.Assert(faults.pick("POST", "/resources/mydb/bind-app"), check.IsNil)
+	status, _ = do("POST", "/faults/flaky/enable", "")
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(faults.pick("POST", "/resources/mydb/bind-app"), check.NotNil)
+	status, body = do("POST", "/faults/unknown/enable", "")
+	c.Assert(status, check.Equals, http.StatusNotFound)
+	c.Assert(body, check.Equals, `fault rule "unknown" not found`+"\n")
+	status, body = do("PUT", "/faults", "rules: [{route: bind-app}]")
+	c.Assert(status, check.Equals, http.StatusBadRequest)
+	c.Assert(body, check.Equals, "invalid fault rule #1: one of latency, status, drop or malformed-json is required\n")
+	status, body = do("DELETE", "/faults", "")
+	c.Assert(status, check.Equals, http.StatusOK)
+	c.Assert(body, check.Equals, `{"rules":[]}`+"\n")
+	status, _ = do("GET", "/other", "")
+	c.Assert(status, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestReadFaultRules(c *check.C) {
+	path := filepath.Join(c.MkDir(), "faults.yaml")
+	err := ioutil.WriteFile(path, []byte("rules:\n  - route: create\n    status: 500\n"), 0600)
+	c.Assert(err, check.IsNil)
+	rules, err := readFaultRules(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(rules, check.HasLen, 1)
+	_, err = readFaultRules(filepath.Join(c.MkDir(), "not-found.yaml"))
+	c.Assert(err, check.NotNil)
+}
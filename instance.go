@@ -0,0 +1,202 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+var errAppRequired = errors.New("the app is required, use -a/--app to define it")
+
+// doRequest sends a request to the target, with the given form values.
+func doRequest(client *cmd.Client, method, path string, values url.Values) (*http.Response, error) {
+	u, err := cmd.GetURL(path)
+	if err != nil {
+		return nil, err
+	}
+	var request *http.Request
+	if values == nil {
+		request, err = http.NewRequest(method, u, nil)
+	} else {
+		request, err = http.NewRequest(method, u, strings.NewReader(values.Encode()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if values != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return client.Do(request)
+}
+
+type instanceAdd struct {
+	fs   *gnuflag.FlagSet
+	plan string
+	team string
+}
+
+func (c *instanceAdd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "instance-add",
+		Usage: "instance-add <service> <instance> [-p/--plan <plan>] [-t/--team <team>]",
+		Desc: `Creates a new instance of the service.
+
+This command is meant for testing services, like in the tsuru stand-in started
+by "api-emulate".`,
+		MinArgs: 2,
+		MaxArgs: 2,
+	}
+}
+
+func (c *instanceAdd) Run(context *cmd.Context, client *cmd.Client) error {
+	values := url.Values{"name": {context.Args[1]}, "plan": {c.plan}, "owner": {c.team}}
+	resp, err := doRequest(client, "POST", "/services/"+context.Args[0]+"/instances", values)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(context.Stdout, "Service instance %q successfully created.\n", context.Args[1])
+	return nil
+}
+
+func (c *instanceAdd) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("instance-add", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.plan, "plan", "", "Plan of the instance")
+		c.fs.StringVar(&c.plan, "p", "", "Plan of the instance")
+		c.fs.StringVar(&c.team, "team", "", "Team that owns the instance")
+		c.fs.StringVar(&c.team, "t", "", "Team that owns the instance")
+	}
+	return c.fs
+}
+
+type instanceRemove struct {
+	cmd.ConfirmationCommand
+}
+
+func (c *instanceRemove) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "instance-remove",
+		Usage: "instance-remove <service> <instance> [-y/--assume-yes]",
+		Desc: `Removes an instance of the service. Instances bound to apps can't be
+removed.`,
+		MinArgs: 2,
+		MaxArgs: 2,
+	}
+}
+
+func (c *instanceRemove) Run(context *cmd.Context, client *cmd.Client) error {
+	question := fmt.Sprintf("Are you sure you want to remove the service instance %q?", context.Args[1])
+	if !c.Confirm(context, question) {
+		return nil
+	}
+	resp, err := doRequest(client, "DELETE", "/services/"+context.Args[0]+"/instances/"+context.Args[1], nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(context.Stdout, "Service instance %q successfully removed.\n", context.Args[1])
+	return nil
+}
+
+type instanceBind struct {
+	fs  *gnuflag.FlagSet
+	app string
+}
+
+func (c *instanceBind) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "instance-bind",
+		Usage: "instance-bind <service> <instance> -a/--app <app>",
+		Desc: `Binds an instance of the service to an app, displaying the environment
+variables set in the app.`,
+		MinArgs: 2,
+		MaxArgs: 2,
+	}
+}
+
+func (c *instanceBind) Run(context *cmd.Context, client *cmd.Client) error {
+	if c.app == "" {
+		return errAppRequired
+	}
+	resp, err := doRequest(client, "PUT", "/services/"+context.Args[0]+"/instances/"+context.Args[1]+"/"+c.app, url.Values{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var envs map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&envs)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Service instance %q successfully bound to the app %q.\n", context.Args[1], c.app)
+	if len(envs) > 0 {
+		fmt.Fprintln(context.Stdout, "\nEnvironment variables set in the app:")
+		var names []string
+		for name := range envs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(context.Stdout, "  %s=%s\n", name, envs[name])
+		}
+	}
+	return nil
+}
+
+func (c *instanceBind) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("instance-bind", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.app, "app", "", "App to bind the instance to")
+		c.fs.StringVar(&c.app, "a", "", "App to bind the instance to")
+	}
+	return c.fs
+}
+
+type instanceUnbind struct {
+	fs  *gnuflag.FlagSet
+	app string
+}
+
+func (c *instanceUnbind) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "instance-unbind",
+		Usage:   "instance-unbind <service> <instance> -a/--app <app>",
+		Desc:    "Unbinds an instance of the service from an app.",
+		MinArgs: 2,
+		MaxArgs: 2,
+	}
+}
+
+func (c *instanceUnbind) Run(context *cmd.Context, client *cmd.Client) error {
+	if c.app == "" {
+		return errAppRequired
+	}
+	resp, err := doRequest(client, "DELETE", "/services/"+context.Args[0]+"/instances/"+context.Args[1]+"/"+c.app, url.Values{})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	fmt.Fprintf(context.Stdout, "Service instance %q successfully unbound from the app %q.\n", context.Args[1], c.app)
+	return nil
+}
+
+func (c *instanceUnbind) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("instance-unbind", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.app, "app", "", "App to unbind the instance from")
+		c.fs.StringVar(&c.app, "a", "", "App to unbind the instance from")
+	}
+	return c.fs
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestInstanceAdd(c *check.C) {
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusCreated},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "POST" && req.URL.Path == "/1.0/services/mysqlapi/instances" &&
+				req.FormValue("name") == "mydb" && req.FormValue("plan") == "small" && req.FormValue("owner") == "admin"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi", "mydb"}, Stdout: &stdout}
+	command := instanceAdd{}
+	command.Flags().Parse(true, []string{"-p", "small", "-t", "admin"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Service instance \"mydb\" successfully created.\n")
+}
+
+func (s *S) TestInstanceAddFailure(c *check.C) {
+	trans := &cmdtest.Transport{Message: "service instance \"mydb\" already exists", Status: http.StatusConflict}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, manager)
+	context := cmd.Context{Args: []string{"mysqlapi", "mydb"}}
+	err := (&instanceAdd{}).Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `service instance "mydb" already exists`)
+}
+
+func (s *S) TestInstanceRemove(c *check.C) {
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "DELETE" && req.URL.Path == "/1.0/services/mysqlapi/instances/mydb"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi", "mydb"}, Stdout: &stdout, Stdin: strings.NewReader("y\n")}
+	err := (&instanceRemove{}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Are you sure you want to remove the service instance "mydb"? (y/n) Service instance "mydb" successfully removed.`+"\n")
+}
+
+func (s *S) TestInstanceRemoveAborted(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi", "mydb"}, Stdout: &stdout, Stdin: strings.NewReader("n\n")}
+	err := (&instanceRemove{}).Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Are you sure you want to remove the service instance "mydb"? (y/n) Abort.`+"\n")
+}
+
+func (s *S) TestInstanceBind(c *check.C) {
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Message: `{"MYSQL_USER":"root","MYSQL_HOST":"10.0.0.2"}`, Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "PUT" && req.URL.Path == "/1.0/services/mysqlapi/instances/mydb/myapp"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi", "mydb"}, Stdout: &stdout}
+	command := instanceBind{}
+	command.Flags().Parse(true, []string{"-a", "myapp"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `Service instance "mydb" successfully bound to the app "myapp".
+
+Environment variables set in the app:
+  MYSQL_HOST=10.0.0.2
+  MYSQL_USER=root
+`
+	c.Assert(stdout.String(), check.Equals, expected)
+}
+
+func (s *S) TestInstanceBindRequiresApp(c *check.C) {
+	context := cmd.Context{Args: []string{"mysqlapi", "mydb"}}
+	err := (&instanceBind{}).Run(&context, nil)
+	c.Assert(err, check.Equals, errAppRequired)
+}
+
+func (s *S) TestInstanceUnbind(c *check.C) {
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{Status: http.StatusOK},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "DELETE" && req.URL.Path == "/1.0/services/mysqlapi/instances/mydb/myapp"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, manager)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi", "mydb"}, Stdout: &stdout}
+	command := instanceUnbind{}
+	command.Flags().Parse(true, []string{"--app", "myapp"})
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Service instance \"mydb\" successfully unbound from the app \"myapp\".\n")
+}
+
+func (s *S) TestInstanceUnbindRequiresApp(c *check.C) {
+	context := cmd.Context{Args: []string{"mysqlapi", "mydb"}}
+	err := (&instanceUnbind{}).Run(&context, nil)
+	c.Assert(err, check.Equals, errAppRequired)
+}
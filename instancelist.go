@@ -0,0 +1,338 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/yaml.v1"
+)
+
+// serviceInstance is a service instance, as returned by tsuru.
+type serviceInstance struct {
+	Name        string
+	ServiceName string
+	PlanName    string
+	TeamOwner   string
+	Teams       []string
+	Apps        []string
+	Description string
+}
+
+// serviceInstances is an item of the list of service instances returned by
+// tsuru: the names of the instances of a service and, in recent versions of
+// tsuru, their details.
+type serviceInstances struct {
+	Service          string            `json:"service"`
+	Instances        []string          `json:"instances"`
+	ServiceInstances []serviceInstance `json:"service_instances"`
+}
+
+// instanceInfo is a service instance in the inventory of instance-list.
+type instanceInfo struct {
+	Service     string   `json:"service" yaml:"service"`
+	Name        string   `json:"name" yaml:"name"`
+	Plan        string   `json:"plan,omitempty" yaml:"plan,omitempty"`
+	Team        string   `json:"team,omitempty" yaml:"team,omitempty"`
+	Teams       []string `json:"teams,omitempty" yaml:"teams,omitempty"`
+	Apps        []string `json:"apps" yaml:"apps"`
+	Description string   `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+func newInstanceInfo(service string, si serviceInstance) instanceInfo {
+	apps := sortedCopy(si.Apps)
+	if apps == nil {
+		apps = []string{}
+	}
+	return instanceInfo{
+		Service:     service,
+		Name:        si.Name,
+		Plan:        si.PlanName,
+		Team:        si.TeamOwner,
+		Teams:       sortedCopy(si.Teams),
+		Apps:        apps,
+		Description: si.Description,
+	}
+}
+
+// fetchInstances retrieves every service instance the user can read from the
+// target. Targets that only list the names of the instances are asked for the
+// details of each instance, and only for the instances of the given service
+// when service is not empty.
+func fetchInstances(client *cmd.Client, service string) ([]instanceInfo, error) {
+	var list []serviceInstances
+	if err := getJSON(client, "/services/instances", &list); err != nil {
+		return nil, err
+	}
+	var instances []instanceInfo
+	for _, s := range list {
+		if service != "" && s.Service != service {
+			continue
+		}
+		if len(s.ServiceInstances) == len(s.Instances) {
+			for _, si := range s.ServiceInstances {
+				instances = append(instances, newInstanceInfo(s.Service, si))
+			}
+			continue
+		}
+		for _, name := range s.Instances {
+			var si serviceInstance
+			if err := getJSON(client, "/services/"+s.Service+"/instances/"+name, &si); err != nil {
+				return nil, fmt.Errorf("failed to get the instance %q of %q: %s", name, s.Service, err)
+			}
+			si.Name = name
+			instances = append(instances, newInstanceInfo(s.Service, si))
+		}
+	}
+	return instances, nil
+}
+
+// instanceFilter selects service instances. Empty fields match any instance.
+type instanceFilter struct {
+	service string
+	team    string
+	plan    string
+	app     string
+	name    string
+}
+
+func (f *instanceFilter) validate() error {
+	if _, err := path.Match(f.name, ""); err != nil {
+		return fmt.Errorf("invalid name pattern %q: %s", f.name, err)
+	}
+	return nil
+}
+
+// match reports whether the instance is selected. The team matches the owner
+// of the instance and the teams with access to it, and the name is a glob
+// pattern, like "db-*".
+func (f *instanceFilter) match(i instanceInfo) bool {
+	if f.service != "" && i.Service != f.service {
+		return false
+	}
+	if f.team != "" && i.Team != f.team && !contains(i.Teams, f.team) {
+		return false
+	}
+	if f.plan != "" && i.Plan != f.plan {
+		return false
+	}
+	if f.app != "" && !contains(i.Apps, f.app) {
+		return false
+	}
+	if f.name != "" {
+		if ok, _ := path.Match(f.name, i.Name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// instanceSortKeys are the fields instances may be sorted by.
+var instanceSortKeys = map[string]func(a, b instanceInfo) int{
+	"service": func(a, b instanceInfo) int { return strings.Compare(a.Service, b.Service) },
+	"name":    func(a, b instanceInfo) int { return strings.Compare(a.Name, b.Name) },
+	"plan":    func(a, b instanceInfo) int { return strings.Compare(a.Plan, b.Plan) },
+	"team":    func(a, b instanceInfo) int { return strings.Compare(a.Team, b.Team) },
+	"apps":    func(a, b instanceInfo) int { return len(a.Apps) - len(b.Apps) },
+}
+
+// instancesByKey sorts instances by a key, then by service and name.
+type instancesByKey struct {
+	instances []instanceInfo
+	compare   func(a, b instanceInfo) int
+	reverse   bool
+}
+
+func (s instancesByKey) Len() int {
+	return len(s.instances)
+}
+
+func (s instancesByKey) Swap(i, j int) {
+	s.instances[i], s.instances[j] = s.instances[j], s.instances[i]
+}
+
+func (s instancesByKey) Less(i, j int) bool {
+	a, b := s.instances[i], s.instances[j]
+	if c := s.compare(a, b); c != 0 {
+		return (c < 0) != s.reverse
+	}
+	if a.Service != b.Service {
+		return a.Service < b.Service
+	}
+	return a.Name < b.Name
+}
+
+// sortInstances sorts the instances by the given key, which must be one of
+// instanceSortKeys.
+func sortInstances(instances []instanceInfo, key string, reverse bool) {
+	sort.Sort(instancesByKey{instances: instances, compare: instanceSortKeys[key], reverse: reverse})
+}
+
+// instanceFormats are the output formats of instance-list.
+var instanceFormats = []string{"table", "json", "yaml", "csv"}
+
+// writeInstances writes the instances in the given format, one of
+// instanceFormats.
+func writeInstances(w io.Writer, format string, instances []instanceInfo) error {
+	switch format {
+	case "table":
+		table := cmd.NewTable()
+		table.Headers = cmd.Row{"Service", "Instance", "Plan", "Team", "Apps"}
+		for _, i := range instances {
+			table.AddRow(cmd.Row{i.Service, i.Name, i.Plan, i.Team, strings.Join(i.Apps, ", ")})
+		}
+		_, err := w.Write(table.Bytes())
+		return err
+	case "json":
+		if instances == nil {
+			instances = []instanceInfo{}
+		}
+		return json.NewEncoder(w).Encode(instances)
+	case "yaml":
+		if len(instances) == 0 {
+			_, err := io.WriteString(w, "[]\n")
+			return err
+		}
+		data, err := yaml.Marshal(instances)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"service", "name", "plan", "team", "teams", "apps", "description"})
+		for _, i := range instances {
+			cw.Write([]string{i.Service, i.Name, i.Plan, i.Team, strings.Join(i.Teams, ","), strings.Join(i.Apps, ","), i.Description})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("invalid output format %q", format)
+}
+
+type instanceList struct {
+	fs      *gnuflag.FlagSet
+	filter  instanceFilter
+	sort    string
+	reverse bool
+	limit   int
+	offset  int
+	output  string
+}
+
+func (c *instanceList) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "instance-list",
+		Usage: "instance-list [-s/--service <service>] [-t/--team <team>] [-p/--plan <plan>] [-a/--app <app>] [-n/--name <pattern>] [--sort service|name|plan|team|apps] [--reverse] [--limit <n>] [--offset <n>] [-o/--output table|json|yaml|csv]",
+		Desc: `Lists the service instances you can read, one per line, with their plans, teams
+and bound apps.
+
+Instances may be filtered by service, by team (the owner of the instance or a
+team with access to it), by plan, by bound app and by name, with a glob pattern
+like "db-*". Filters are combined, so only the instances matching all of them
+are listed.
+
+Instances are sorted by service and name, or by the field given with --sort,
+and the order is reversed with --reverse. With --limit, only a page of the
+instances is listed, starting after --offset instances.
+
+The output is a table by default. The json, yaml and csv formats are meant to
+be consumed by other tools.`,
+		MinArgs: 0,
+		MaxArgs: 0,
+	}
+}
+
+func (c *instanceList) Run(context *cmd.Context, client *cmd.Client) error {
+	if err := c.filter.validate(); err != nil {
+		return err
+	}
+	if c.limit < 0 || c.offset < 0 {
+		return errors.New("the limit and the offset must not be negative")
+	}
+	key := c.sort
+	if key == "" {
+		key = "service"
+	}
+	if _, ok := instanceSortKeys[key]; !ok {
+		return fmt.Errorf("invalid sort key %q, must be service, name, plan, team or apps", key)
+	}
+	output := c.output
+	if output == "" {
+		output = "table"
+	}
+	if !contains(instanceFormats, output) {
+		return fmt.Errorf("invalid output format %q, must be table, json, yaml or csv", output)
+	}
+	all, err := fetchInstances(client, c.filter.service)
+	if err != nil {
+		return err
+	}
+	var instances []instanceInfo
+	for _, i := range all {
+		if c.filter.match(i) {
+			instances = append(instances, i)
+		}
+	}
+	sortInstances(instances, key, c.reverse)
+	total := len(instances)
+	start := c.offset
+	if start > total {
+		start = total
+	}
+	end := total
+	if c.limit > 0 && start+c.limit < total {
+		end = start + c.limit
+	}
+	if output == "table" && total > 0 && start == total {
+		fmt.Fprintf(context.Stdout, "No instances at offset %d, out of %d instances.\n", c.offset, total)
+		return nil
+	}
+	instances = instances[start:end]
+	if err := writeInstances(context.Stdout, output, instances); err != nil {
+		return err
+	}
+	if output == "table" && end-start < total {
+		fmt.Fprintf(context.Stdout, "Showing %d-%d of %d instances.", start+1, end, total)
+		if end < total {
+			fmt.Fprintf(context.Stdout, " Use --offset %d for more.", end)
+		}
+		fmt.Fprintln(context.Stdout)
+	}
+	return nil
+}
+
+func (c *instanceList) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("instance-list", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.filter.service, "service", "", "List only the instances of the service")
+		c.fs.StringVar(&c.filter.service, "s", "", "List only the instances of the service")
+		c.fs.StringVar(&c.filter.team, "team", "", "List only the instances the team owns or has access to")
+		c.fs.StringVar(&c.filter.team, "t", "", "List only the instances the team owns or has access to")
+		c.fs.StringVar(&c.filter.plan, "plan", "", "List only the instances of the plan")
+		c.fs.StringVar(&c.filter.plan, "p", "", "List only the instances of the plan")
+		c.fs.StringVar(&c.filter.app, "app", "", "List only the instances bound to the app")
+		c.fs.StringVar(&c.filter.app, "a", "", "List only the instances bound to the app")
+		c.fs.StringVar(&c.filter.name, "name", "", "List only the instances whose names match the glob pattern")
+		c.fs.StringVar(&c.filter.name, "n", "", "List only the instances whose names match the glob pattern")
+		c.fs.StringVar(&c.sort, "sort", "service", "Field the instances are sorted by: service, name, plan, team or apps")
+		c.fs.BoolVar(&c.reverse, "reverse", false, "Reverse the order of the instances")
+		c.fs.IntVar(&c.limit, "limit", 0, "Maximum number of instances listed (default: no limit)")
+		c.fs.IntVar(&c.offset, "offset", 0, "Number of instances skipped before listing")
+		c.fs.StringVar(&c.output, "output", "table", "Output format: table, json, yaml or csv")
+		c.fs.StringVar(&c.output, "o", "table", "Output format: table, json, yaml or csv")
+	}
+	return c.fs
+}
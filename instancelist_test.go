@@ -0,0 +1,205 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+const instancesJSON = `[
+  {"service": "mysqlapi", "instances": ["db-users", "db-orders", "cache"], "service_instances": [
+    {"Name": "db-users", "PlanName": "small", "TeamOwner": "users", "Teams": ["users", "dba"], "Apps": ["web", "api"]},
+    {"Name": "db-orders", "PlanName": "large", "TeamOwner": "orders", "Teams": ["orders"], "Apps": ["checkout"], "Description": "orders, archived"},
+    {"Name": "cache", "PlanName": "small", "TeamOwner": "dba", "Apps": []}
+  ]},
+  {"service": "redisapi", "instances": ["sessions"], "service_instances": [
+    {"Name": "sessions", "PlanName": "small", "TeamOwner": "users", "Apps": ["web"]}
+  ]}
+]`
+
+// startInstancesTarget starts a tsuru server that lists the instances of
+// instancesJSON, setting it as the target.
+func startInstancesTarget() func() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/1.0/services/instances" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(instancesJSON))
+	}))
+	os.Setenv("TSURU_TARGET", server.URL)
+	return func() {
+		server.Close()
+		os.Setenv("TSURU_TARGET", "http://localhost:8080")
+	}
+}
+
+func runInstanceList(c *check.C, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	command := instanceList{}
+	command.Flags().Parse(true, args)
+	err := command.Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	return stdout.String(), err
+}
+
+func (s *S) TestFetchInstances(c *check.C) {
+	defer startInstancesTarget()()
+	instances, err := fetchInstances(cmd.NewClient(http.DefaultClient, nil, manager), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(instances, check.HasLen, 4)
+	c.Assert(instances[0], check.DeepEquals, instanceInfo{
+		Service: "mysqlapi",
+		Name:    "db-users",
+		Plan:    "small",
+		Team:    "users",
+		Teams:   []string{"dba", "users"},
+		Apps:    []string{"api", "web"},
+	})
+	c.Assert(instances[2].Apps, check.DeepEquals, []string{})
+	instances, err = fetchInstances(cmd.NewClient(http.DefaultClient, nil, manager), "redisapi")
+	c.Assert(err, check.IsNil)
+	c.Assert(instances, check.HasLen, 1)
+	c.Assert(instances[0].Name, check.Equals, "sessions")
+}
+
+func (s *S) TestFetchInstancesWithoutDetails(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	e, stop := startEmulator(c, fake, &log)
+	defer stop()
+	e.instances["mydb"] = &emulatedInstance{Name: "mydb", ServiceName: "mysqlapi", PlanName: "small", TeamOwner: "dba", Apps: []string{"myapp"}}
+	instances, err := fetchInstances(cmd.NewClient(http.DefaultClient, nil, manager), "")
+	c.Assert(err, check.IsNil)
+	c.Assert(instances, check.DeepEquals, []instanceInfo{
+		{Service: "mysqlapi", Name: "mydb", Plan: "small", Team: "dba", Apps: []string{"myapp"}},
+	})
+}
+
+func (s *S) TestInstanceFilter(c *check.C) {
+	instance := instanceInfo{Service: "mysqlapi", Name: "db-users", Plan: "small", Team: "users", Teams: []string{"dba"}, Apps: []string{"web"}}
+	var tests = []struct {
+		filter   instanceFilter
+		expected bool
+	}{
+		{instanceFilter{}, true},
+		{instanceFilter{service: "mysqlapi", team: "users", plan: "small", app: "web", name: "db-*"}, true},
+		{instanceFilter{team: "dba"}, true},
+		{instanceFilter{service: "redisapi"}, false},
+		{instanceFilter{team: "orders"}, false},
+		{instanceFilter{plan: "large"}, false},
+		{instanceFilter{app: "api"}, false},
+		{instanceFilter{name: "cache*"}, false},
+	}
+	for _, t := range tests {
+		c.Check(t.filter.match(instance), check.Equals, t.expected, check.Commentf("%#v", t.filter))
+	}
+	c.Assert((&instanceFilter{name: "[db"}).validate(), check.ErrorMatches, `invalid name pattern "\[db": .*`)
+}
+
+func (s *S) TestSortInstances(c *check.C) {
+	instances := []instanceInfo{
+		{Service: "redisapi", Name: "sessions", Plan: "small", Apps: []string{"web"}},
+		{Service: "mysqlapi", Name: "db-users", Plan: "small", Apps: []string{"web", "api"}},
+		{Service: "mysqlapi", Name: "cache", Plan: "large"},
+	}
+	names := func() []string {
+		var names []string
+		for _, i := range instances {
+			names = append(names, i.Name)
+		}
+		return names
+	}
+	sortInstances(instances, "service", false)
+	c.Assert(names(), check.DeepEquals, []string{"cache", "db-users", "sessions"})
+	sortInstances(instances, "plan", false)
+	c.Assert(names(), check.DeepEquals, []string{"cache", "db-users", "sessions"})
+	sortInstances(instances, "apps", true)
+	c.Assert(names(), check.DeepEquals, []string{"db-users", "sessions", "cache"})
+	sortInstances(instances, "name", true)
+	c.Assert(names(), check.DeepEquals, []string{"sessions", "db-users", "cache"})
+}
+
+func (s *S) TestInstanceListRun(c *check.C) {
+	defer startInstancesTarget()()
+	stdout, err := runInstanceList(c)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, `+----------+-----------+-------+--------+----------+
+| Service  | Instance  | Plan  | Team   | Apps     |
++----------+-----------+-------+--------+----------+
+| mysqlapi | cache     | small | dba    |          |
+| mysqlapi | db-orders | large | orders | checkout |
+| mysqlapi | db-users  | small | users  | api, web |
+| redisapi | sessions  | small | users  | web      |
++----------+-----------+-------+--------+----------+
+`)
+}
+
+func (s *S) TestInstanceListRunFilters(c *check.C) {
+	defer startInstancesTarget()()
+	stdout, err := runInstanceList(c, "-t", "users", "-a", "web", "--sort", "service", "--reverse", "-o", "csv")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, "service,name,plan,team,teams,apps,description\n"+
+		"redisapi,sessions,small,users,,web,\n"+
+		"mysqlapi,db-users,small,users,\"dba,users\",\"api,web\",\n")
+	stdout, err = runInstanceList(c, "-s", "mysqlapi", "-n", "db-*", "-p", "large", "-o", "json")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, `[{"service":"mysqlapi","name":"db-orders","plan":"large","team":"orders","teams":["orders"],"apps":["checkout"],"description":"orders, archived"}]`+"\n")
+	stdout, err = runInstanceList(c, "-s", "postgresapi", "-o", "json")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, "[]\n")
+}
+
+func (s *S) TestInstanceListRunYAML(c *check.C) {
+	defer startInstancesTarget()()
+	stdout, err := runInstanceList(c, "-s", "redisapi", "-o", "yaml")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, `- service: redisapi
+  name: sessions
+  plan: small
+  team: users
+  apps:
+  - web
+`)
+	stdout, err = runInstanceList(c, "-s", "postgresapi", "-o", "yaml")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, "[]\n")
+}
+
+func (s *S) TestInstanceListRunPagination(c *check.C) {
+	defer startInstancesTarget()()
+	stdout, err := runInstanceList(c, "--limit", "2", "--sort", "name")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Matches, `(?s).*\| cache .*\| db-orders .*Showing 1-2 of 4 instances. Use --offset 2 for more.\n$`)
+	c.Assert(stdout, check.Not(check.Matches), `(?s).*db-users.*`)
+	stdout, err = runInstanceList(c, "--limit", "2", "--offset", "3", "--sort", "name")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Matches, `(?s).*\| sessions .*Showing 4-4 of 4 instances.\n$`)
+	stdout, err = runInstanceList(c, "--offset", "4")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, "No instances at offset 4, out of 4 instances.\n")
+	stdout, err = runInstanceList(c, "--offset", "10", "-o", "json")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, "[]\n")
+}
+
+func (s *S) TestInstanceListRunInvalidFlags(c *check.C) {
+	_, err := runInstanceList(c, "--sort", "size")
+	c.Assert(err, check.ErrorMatches, `invalid sort key "size", must be service, name, plan, team or apps`)
+	_, err = runInstanceList(c, "-o", "xml")
+	c.Assert(err, check.ErrorMatches, `invalid output format "xml", must be table, json, yaml or csv`)
+	_, err = runInstanceList(c, "--limit", "-1")
+	c.Assert(err, check.ErrorMatches, "the limit and the offset must not be negative")
+	_, err = runInstanceList(c, "-n", "[db")
+	c.Assert(err, check.ErrorMatches, `invalid name pattern .*`)
+}
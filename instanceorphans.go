@@ -0,0 +1,314 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// The kinds of the events of tsuru about binding apps to service instances.
+const (
+	eventKindBind   = "app.update.bind"
+	eventKindUnbind = "app.update.unbind"
+)
+
+// eventTarget is the target of an event of tsuru, like an app or a service
+// instance.
+type eventTarget struct {
+	Type  string
+	Value string
+}
+
+type eventKind struct {
+	Name string
+}
+
+type eventExtraTarget struct {
+	Target eventTarget
+}
+
+// tsuruEvent is an event of tsuru. Only the fields crane uses are decoded.
+type tsuruEvent struct {
+	StartTime    time.Time
+	Kind         eventKind
+	Target       eventTarget
+	ExtraTargets []eventExtraTarget
+}
+
+// serviceInstanceTarget returns the target of the events of a service
+// instance.
+func serviceInstanceTarget(service, instance string) eventTarget {
+	return eventTarget{Type: "service-instance", Value: service + "/" + instance}
+}
+
+// matches reports whether the target or one of the extra targets of the event
+// is like the given target. Empty fields of the target match anything.
+func (e *tsuruEvent) matches(target eventTarget) bool {
+	like := func(t eventTarget) bool {
+		return (target.Type == "" || t.Type == target.Type) && (target.Value == "" || t.Value == target.Value)
+	}
+	if like(e.Target) {
+		return true
+	}
+	for _, t := range e.ExtraTargets {
+		if like(t.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// bindEventsPageSize is the number of events asked to tsuru at a time,
+	// the most it returns.
+	bindEventsPageSize = 100
+
+	// bindEventsMaxPages bounds the pages of events read for an instance,
+	// in case the target doesn't page them.
+	bindEventsMaxPages = 20
+)
+
+// lastBindEvent returns the most recent bind or unbind event of the instance,
+// or nil when there is none, reading every page of the events that target the
+// instance. It also returns whether the history of the instance was read
+// completely.
+func lastBindEvent(client *cmd.Client, service, instance string) (*tsuruEvent, bool, error) {
+	target := serviceInstanceTarget(service, instance)
+	var last *tsuruEvent
+	for page := 0; page < bindEventsMaxPages; page++ {
+		query := url.Values{
+			"kindname":     {eventKindBind, eventKindUnbind},
+			"target.type":  {target.Type},
+			"target.value": {target.Value},
+			"skip":         {strconv.Itoa(page * bindEventsPageSize)},
+			"limit":        {strconv.Itoa(bindEventsPageSize)},
+		}
+		var events []tsuruEvent
+		err := getJSON(client, "/events?"+query.Encode(), &events)
+		// tsuru answers with an empty body when there are no events.
+		if err != nil && err != io.EOF {
+			return nil, false, err
+		}
+		for i, e := range events {
+			if e.Kind.Name != eventKindBind && e.Kind.Name != eventKindUnbind || !e.matches(target) {
+				continue
+			}
+			if last == nil || e.StartTime.After(last.StartTime) {
+				last = &events[i]
+			}
+		}
+		if len(events) < bindEventsPageSize {
+			return last, true, nil
+		}
+	}
+	return last, false, nil
+}
+
+// lastBindEvents returns the most recent bind or unbind event of each of the
+// instances of the service that have one, by the name of the instance, and
+// the instances whose history couldn't be read completely.
+func lastBindEvents(client *cmd.Client, service string, instances []string) (map[string]tsuruEvent, map[string]bool, error) {
+	last := map[string]tsuruEvent{}
+	incomplete := map[string]bool{}
+	for _, name := range instances {
+		e, complete, err := lastBindEvent(client, service, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if e != nil {
+			last[name] = *e
+		}
+		if !complete {
+			incomplete[name] = true
+		}
+	}
+	return last, incomplete, nil
+}
+
+// listTeams returns the names of the teams the user can read.
+func listTeams(client *cmd.Client) (map[string]bool, error) {
+	var teams []struct{ Name string }
+	err := getJSON(client, "/teams", &teams)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, t := range teams {
+		names[t.Name] = true
+	}
+	return names, nil
+}
+
+// orphanInstance is a service instance no app needs anymore.
+type orphanInstance struct {
+	instanceInfo
+	lastBind *tsuruEvent
+	reasons  []string
+}
+
+// lastBindString describes the last bind activity of the instance.
+func (o *orphanInstance) lastBindString() string {
+	if o.lastBind == nil {
+		return "-"
+	}
+	action := "bound to"
+	if o.lastBind.Kind.Name == eventKindUnbind {
+		action = "unbound from"
+	}
+	return fmt.Sprintf("%s %s at %s", action, o.lastBind.Target.Value, o.lastBind.StartTime.Local().Format("2006-01-02 15:04"))
+}
+
+// findOrphans returns the instances that aren't bound to any app, or whose
+// owning team no longer exists. When idle is positive, unbound instances are
+// only returned when there was no bind activity on them within idle before
+// now.
+func findOrphans(instances []instanceInfo, teams map[string]bool, binds map[string]tsuruEvent, idle time.Duration, now time.Time) []orphanInstance {
+	var orphans []orphanInstance
+	for _, i := range instances {
+		o := orphanInstance{instanceInfo: i}
+		if e, ok := binds[i.Name]; ok {
+			o.lastBind = &e
+		}
+		if len(i.Apps) == 0 && (idle <= 0 || o.lastBind == nil || now.Sub(o.lastBind.StartTime) >= idle) {
+			o.reasons = append(o.reasons, "unbound")
+		}
+		if i.Team != "" && !teams[i.Team] {
+			o.reasons = append(o.reasons, "team not found")
+		}
+		if len(o.reasons) > 0 {
+			orphans = append(orphans, o)
+		}
+	}
+	return orphans
+}
+
+type instanceOrphans struct {
+	cmd.ConfirmationCommand
+	fs     *gnuflag.FlagSet
+	idle   time.Duration
+	remove bool
+}
+
+func (c *instanceOrphans) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "instance-orphans",
+		Usage: "instance-orphans <service> [--idle <duration>] [--remove] [-y/--assume-yes]",
+		Desc: `Lists the orphaned instances of a service: the instances no app is bound to,
+and the instances whose owning team no longer exists.
+
+Instances are joined with their bound apps and with the last bind or unbind
+event of each, taken from the event history of tsuru. With --idle, like
+"--idle 720h", unbound instances are only listed when nothing was bound to, or
+unbound from, them within the duration. Teams you can't read are reported as
+not found.
+
+With --remove, the unbound orphaned instances are removed, after confirmation.
+Instances still bound to apps are never removed, and neither are instances
+whose team is not found, as it may be a team you can't read. --idle and
+--remove fail when the bind history is not available, and with --idle,
+instances whose bind history can't be read completely are not removed.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *instanceOrphans) Run(context *cmd.Context, client *cmd.Client) error {
+	service := context.Args[0]
+	if c.idle < 0 {
+		return errors.New("the idle duration must be positive")
+	}
+	instances, err := fetchInstances(client, service)
+	if err != nil {
+		return err
+	}
+	teams, err := listTeams(client)
+	if err != nil {
+		return fmt.Errorf("failed to list the teams: %s", err)
+	}
+	names := make([]string, len(instances))
+	for i := range instances {
+		names[i] = instances[i].Name
+	}
+	binds, incomplete, err := lastBindEvents(client, service, names)
+	if err != nil {
+		// Without the history, every unbound instance would look idle.
+		if c.idle > 0 || c.remove {
+			return fmt.Errorf("the bind history is not available: %s", strings.TrimSpace(err.Error()))
+		}
+		fmt.Fprintf(context.Stdout, "The bind history is not available: %s\n", strings.TrimSpace(err.Error()))
+		binds, incomplete = nil, nil
+	}
+	sortInstances(instances, "name", false)
+	orphans := findOrphans(instances, teams, binds, c.idle, time.Now())
+	if len(orphans) == 0 {
+		fmt.Fprintf(context.Stdout, "No orphaned instances of %q, out of %d instances.\n", service, len(instances))
+		return nil
+	}
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"Instance", "Plan", "Team", "Apps", "Last bind", "Reason"}
+	var removable, unsure []string
+	for _, o := range orphans {
+		table.AddRow(cmd.Row{o.Name, o.Plan, o.Team, strings.Join(o.Apps, ", "), o.lastBindString(), strings.Join(o.reasons, ", ")})
+		// Teams not found may only be teams the user can't read.
+		if !contains(o.reasons, "unbound") || contains(o.reasons, "team not found") {
+			continue
+		}
+		// The events missing from an incomplete history may be recent.
+		if c.idle > 0 && incomplete[o.Name] {
+			unsure = append(unsure, o.Name)
+			continue
+		}
+		removable = append(removable, o.Name)
+	}
+	context.Stdout.Write(table.Bytes())
+	fmt.Fprintf(context.Stdout, "%d orphaned instances of %q, out of %d instances.\n", len(orphans), service, len(instances))
+	if !c.remove {
+		return nil
+	}
+	if len(unsure) > 0 {
+		fmt.Fprintf(context.Stdout, "Not removing %s: their bind history is incomplete.\n", strings.Join(unsure, ", "))
+	}
+	if len(removable) == 0 {
+		fmt.Fprintln(context.Stdout, "No instances to remove, all the orphaned instances are bound to apps, owned by teams not found or with an incomplete bind history.")
+		return nil
+	}
+	question := fmt.Sprintf("Are you sure you want to remove the %d unbound orphaned instances of %q?", len(removable), service)
+	if !c.Confirm(context, question) {
+		return nil
+	}
+	var failed int
+	for _, name := range removable {
+		resp, err := doRequest(client, "DELETE", "/services/"+service+"/instances/"+name, nil)
+		if err != nil {
+			fmt.Fprintf(context.Stdout, "Failed to remove the service instance %q: %s\n", name, strings.TrimSpace(err.Error()))
+			failed++
+			continue
+		}
+		resp.Body.Close()
+		fmt.Fprintf(context.Stdout, "Service instance %q successfully removed.\n", name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to remove %d of %d instances", failed, len(removable))
+	}
+	return nil
+}
+
+func (c *instanceOrphans) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = c.ConfirmationCommand.Flags()
+		c.fs.DurationVar(&c.idle, "idle", 0, "Only list unbound instances without bind activity within the duration")
+		c.fs.BoolVar(&c.remove, "remove", false, "Remove the unbound orphaned instances, after confirmation")
+	}
+	return c.fs
+}
@@ -0,0 +1,305 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestFindOrphans(c *check.C) {
+	now := time.Date(2017, 10, 18, 15, 0, 0, 0, time.UTC)
+	instances := []instanceInfo{
+		{Service: "mysqlapi", Name: "bound", Team: "dba", Apps: []string{"web"}},
+		{Service: "mysqlapi", Name: "unbound", Team: "dba", Apps: []string{}},
+		{Service: "mysqlapi", Name: "recent", Team: "dba", Apps: []string{}},
+		{Service: "mysqlapi", Name: "abandoned", Team: "gone", Apps: []string{"web"}},
+		{Service: "mysqlapi", Name: "lost", Team: "gone", Apps: []string{}},
+	}
+	teams := map[string]bool{"dba": true}
+	binds := map[string]tsuruEvent{
+		"unbound": {StartTime: now.Add(-60 * 24 * time.Hour), Kind: eventKind{Name: eventKindUnbind}, Target: eventTarget{Type: "app", Value: "web"}},
+		"recent":  {StartTime: now.Add(-time.Hour), Kind: eventKind{Name: eventKindUnbind}, Target: eventTarget{Type: "app", Value: "web"}},
+	}
+	reasons := func(orphans []orphanInstance) map[string]string {
+		result := map[string]string{}
+		for _, o := range orphans {
+			result[o.Name] = strings.Join(o.reasons, ", ")
+		}
+		return result
+	}
+	orphans := findOrphans(instances, teams, binds, 0, now)
+	c.Assert(reasons(orphans), check.DeepEquals, map[string]string{
+		"unbound":   "unbound",
+		"recent":    "unbound",
+		"abandoned": "team not found",
+		"lost":      "unbound, team not found",
+	})
+	c.Assert(orphans[0].lastBind, check.NotNil)
+	c.Assert(orphans[0].lastBindString(), check.Matches, `unbound from web at 2017-\d\d-\d\d \d\d:\d\d`)
+	c.Assert(orphans[2].lastBindString(), check.Equals, "-")
+	orphans = findOrphans(instances, teams, binds, 30*24*time.Hour, now)
+	c.Assert(reasons(orphans), check.DeepEquals, map[string]string{
+		"unbound":   "unbound",
+		"abandoned": "team not found",
+		"lost":      "unbound, team not found",
+	})
+}
+
+// startOrphansEmulator starts an emulator with the instances "mydb", bound to
+// myapp, "idle", unbound from myapp, "spare", never bound, and "lost", owned
+// by a team that doesn't exist.
+func startOrphansEmulator(c *check.C, fake *fakeServiceAPI) (*emulator, func()) {
+	var log bytes.Buffer
+	e, stop := startEmulator(c, fake, &log)
+	e.services["mysqlapi"].OwnerTeams = []string{"dba"}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	for _, name := range []string{"mydb", "idle", "spare", "lost"} {
+		team := "dba"
+		if name == "lost" {
+			team = "gone"
+		}
+		add := instanceAdd{team: team}
+		err := add.Run(&cmd.Context{Args: []string{"mysqlapi", name}, Stdout: &log}, client)
+		c.Assert(err, check.IsNil)
+	}
+	for _, name := range []string{"mydb", "idle"} {
+		err := (&instanceBind{app: "myapp"}).Run(&cmd.Context{Args: []string{"mysqlapi", name}, Stdout: &log}, client)
+		c.Assert(err, check.IsNil)
+	}
+	err := (&instanceUnbind{app: "myapp"}).Run(&cmd.Context{Args: []string{"mysqlapi", "idle"}, Stdout: &log}, client)
+	c.Assert(err, check.IsNil)
+	return e, stop
+}
+
+func (s *S) TestInstanceOrphansRun(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	_, stop := startOrphansEmulator(c, fake)
+	defer stop()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	err := (&instanceOrphans{}).Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s)\+-+.*
+\| Instance \| Plan \| Team \| Apps \| Last bind +\| Reason +\|
+.*\| idle +\| +\| dba +\| +\| unbound from myapp at \d{4}-\d\d-\d\d \d\d:\d\d \| unbound +\|
+\| lost +\| +\| gone \| +\| - +\| unbound, team not found \|
+\| spare +\| +\| dba +\| +\| - +\| unbound +\|
+.*3 orphaned instances of "mysqlapi", out of 4 instances.\n$`)
+}
+
+func (s *S) TestInstanceOrphansRunIdle(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	_, stop := startOrphansEmulator(c, fake)
+	defer stop()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	command := instanceOrphans{}
+	command.Flags().Parse(true, []string{"--idle", "720h"})
+	err := command.Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Not(check.Matches), `(?s).*\| idle .*`)
+	c.Assert(stdout.String(), check.Matches, `(?s).*2 orphaned instances of "mysqlapi", out of 4 instances.\n$`)
+}
+
+func (s *S) TestInstanceOrphansRunRemove(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	e, stop := startOrphansEmulator(c, fake)
+	defer stop()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout, Stdin: strings.NewReader("y\n")}
+	command := instanceOrphans{}
+	command.Flags().Parse(true, []string{"--remove"})
+	err := command.Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*Are you sure you want to remove the 2 unbound orphaned instances of "mysqlapi"\? \(y/n\) `+
+		`Service instance "idle" successfully removed.
+Service instance "spare" successfully removed.
+$`)
+	c.Assert(e.instances, check.HasLen, 2)
+	c.Assert(e.instances["mydb"], check.NotNil)
+	c.Assert(e.instances["lost"], check.NotNil)
+	stdout.Reset()
+	err = command.Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*1 orphaned instances of "mysqlapi", out of 2 instances.
+No instances to remove, all the orphaned instances are bound to apps, owned by teams not found or with an incomplete bind history.\n$`)
+}
+
+func (s *S) TestInstanceOrphansRunRemoveAborted(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	e, stop := startOrphansEmulator(c, fake)
+	defer stop()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout, Stdin: strings.NewReader("n\n")}
+	command := instanceOrphans{}
+	command.Flags().Parse(true, []string{"--remove"})
+	err := command.Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*\(y/n\) Abort.\n$`)
+	c.Assert(e.instances, check.HasLen, 4)
+}
+
+func (s *S) TestInstanceOrphansRunRemoveFailure(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	_, stop := startOrphansEmulator(c, fake)
+	defer stop()
+	fake.overrides["DELETE /resources/{name}"] = http.StatusInternalServerError
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	command := instanceOrphans{}
+	command.Flags().Parse(true, []string{"--remove", "-y"})
+	err := command.Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.ErrorMatches, "failed to remove 2 of 2 instances")
+	c.Assert(stdout.String(), check.Matches, `(?s).*Failed to remove the service instance "idle": .*`)
+}
+
+// startNoHistoryTarget starts a tsuru server with the instances "spare",
+// never bound, and "mydb", bound to myapp, whose event history fails.
+func startNoHistoryTarget() (*[]string, func()) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/1.0/services/instances":
+			w.Write([]byte(`[{"service": "mysqlapi", "instances": ["spare", "mydb"], "service_instances": [
+				{"Name": "spare", "TeamOwner": "dba"}, {"Name": "mydb", "TeamOwner": "dba", "Apps": ["myapp"]}]}]`))
+		case "/1.0/teams":
+			w.Write([]byte(`[{"Name": "dba"}]`))
+		default:
+			http.Error(w, "event history unavailable", http.StatusInternalServerError)
+		}
+	}))
+	os.Setenv("TSURU_TARGET", server.URL)
+	return &requests, func() {
+		server.Close()
+		os.Setenv("TSURU_TARGET", "http://localhost:8080")
+	}
+}
+
+func (s *S) TestInstanceOrphansRunNoHistory(c *check.C) {
+	_, stop := startNoHistoryTarget()
+	defer stop()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	err := (&instanceOrphans{}).Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s)The bind history is not available: event history unavailable
+.*1 orphaned instances of "mysqlapi", out of 2 instances.\n$`)
+}
+
+func (s *S) TestInstanceOrphansRunNoHistoryIdleOrRemove(c *check.C) {
+	requests, stop := startNoHistoryTarget()
+	defer stop()
+	for _, args := range [][]string{{"--idle", "720h"}, {"--remove", "-y"}} {
+		command := instanceOrphans{}
+		command.Flags().Parse(true, args)
+		context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: ioutil.Discard}
+		err := command.Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+		c.Check(err, check.ErrorMatches, "the bind history is not available: event history unavailable", check.Commentf("%v", args))
+	}
+	for _, r := range *requests {
+		c.Assert(strings.HasPrefix(r, "DELETE"), check.Equals, false)
+	}
+}
+
+// startPagedHistoryTarget starts a tsuru server with the unbound instances
+// "idle", unbound from myapp on its second page of events, "spare", never
+// bound, and "stuck", whose events are never paged.
+func startPagedHistoryTarget(now time.Time) (*[]string, func()) {
+	var requests []string
+	event := func(kind string, at time.Time, instance string) string {
+		return fmt.Sprintf(`{"StartTime": %q, "Kind": {"Name": %q}, "Target": {"Type": "app", "Value": "myapp"}, `+
+			`"ExtraTargets": [{"Target": {"Type": "service-instance", "Value": "mysqlapi/%s"}}]}`, at.Format(time.RFC3339), kind, instance)
+	}
+	page := func(instance string) string {
+		events := make([]string, bindEventsPageSize)
+		for i := range events {
+			events[i] = event(eventKindBind, now.Add(-90*24*time.Hour), instance)
+		}
+		return "[" + strings.Join(events, ", ") + "]"
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/1.0/services/instances":
+			w.Write([]byte(`[{"service": "mysqlapi", "instances": ["idle", "spare", "stuck"], "service_instances": [
+				{"Name": "idle", "TeamOwner": "dba"}, {"Name": "spare", "TeamOwner": "dba"}, {"Name": "stuck", "TeamOwner": "dba"}]}]`))
+		case "/1.0/teams":
+			w.Write([]byte(`[{"Name": "dba"}]`))
+		case "/1.0/events":
+			if r.FormValue("target.type") != "service-instance" || r.FormValue("limit") != strconv.Itoa(bindEventsPageSize) {
+				http.Error(w, "unfiltered events", http.StatusBadRequest)
+				return
+			}
+			switch r.FormValue("target.value") + " " + r.FormValue("skip") {
+			case "mysqlapi/idle 0":
+				w.Write([]byte(page("idle")))
+			case "mysqlapi/idle 100":
+				w.Write([]byte("[" + event(eventKindUnbind, now.Add(-24*time.Hour), "idle") + "]"))
+			case "mysqlapi/stuck " + r.FormValue("skip"):
+				w.Write([]byte(page("stuck")))
+			}
+		case "/1.0/services/mysqlapi/instances/spare":
+			w.Write([]byte("removed"))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	os.Setenv("TSURU_TARGET", server.URL)
+	return &requests, func() {
+		server.Close()
+		os.Setenv("TSURU_TARGET", "http://localhost:8080")
+	}
+}
+
+func (s *S) TestLastBindEventsPages(c *check.C) {
+	now := time.Now()
+	_, stop := startPagedHistoryTarget(now)
+	defer stop()
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	binds, incomplete, err := lastBindEvents(client, "mysqlapi", []string{"idle", "spare", "stuck"})
+	c.Assert(err, check.IsNil)
+	c.Assert(binds, check.HasLen, 2)
+	c.Assert(binds["idle"].Kind.Name, check.Equals, eventKindUnbind)
+	c.Assert(binds["stuck"].Kind.Name, check.Equals, eventKindBind)
+	c.Assert(incomplete, check.DeepEquals, map[string]bool{"stuck": true})
+}
+
+func (s *S) TestInstanceOrphansRunIdleRemoveIncompleteHistory(c *check.C) {
+	requests, stop := startPagedHistoryTarget(time.Now())
+	defer stop()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	command := instanceOrphans{}
+	command.Flags().Parse(true, []string{"--idle", "720h", "--remove", "-y"})
+	err := command.Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*2 orphaned instances of "mysqlapi", out of 3 instances.
+Not removing stuck: their bind history is incomplete.
+Service instance "spare" successfully removed.\n$`)
+	var deleted []string
+	for _, r := range *requests {
+		if strings.HasPrefix(r, "DELETE") {
+			deleted = append(deleted, r)
+		}
+	}
+	c.Assert(deleted, check.DeepEquals, []string{"DELETE /1.0/services/mysqlapi/instances/spare"})
+}
@@ -0,0 +1,308 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// The health of a service instance, as reported by instance-status.
+const (
+	healthHealthy = "healthy"
+	healthDown    = "down"
+	healthUnknown = "unknown"
+)
+
+// instanceHealth is the status of a service instance.
+type instanceHealth struct {
+	name     string
+	health   string
+	detail   string
+	duration time.Duration
+}
+
+// parseInstanceStatus parses the status returned by tsuru, like `Service
+// instance "mydb" is up`, returning the health of the instance and the status
+// reported by the service API.
+func parseInstanceStatus(body string) (string, string) {
+	body = strings.TrimSpace(body)
+	status := body
+	if i := strings.Index(body, `" is `); i >= 0 {
+		status = body[i+len(`" is `):]
+	}
+	switch {
+	case status == "up":
+		return healthHealthy, status
+	case strings.HasPrefix(status, "down"):
+		return healthDown, status
+	}
+	return healthUnknown, status
+}
+
+// clientWithTimeout returns a copy of the client whose requests give up after
+// the timeout. The client itself is returned when the timeout is not positive.
+func clientWithTimeout(client *cmd.Client, timeout time.Duration) *cmd.Client {
+	if timeout <= 0 {
+		return client
+	}
+	httpClient := *client.HTTPClient
+	httpClient.Timeout = timeout
+	probe := *client
+	probe.HTTPClient = &httpClient
+	return &probe
+}
+
+// getInstanceStatus retrieves the status of the instance from the target,
+// giving up after the timeout.
+func getInstanceStatus(client *cmd.Client, service, name string, timeout time.Duration) (string, error) {
+	u, err := cmd.GetURL("/services/" + service + "/instances/" + name + "/status")
+	if err != nil {
+		return "", err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := clientWithTimeout(client, timeout).Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// fetchInstanceStatus retrieves the health of the instance. Instances whose
+// status can't be retrieved have an unknown health.
+func fetchInstanceStatus(client *cmd.Client, service, name string, timeout time.Duration) instanceHealth {
+	start := time.Now()
+	h := instanceHealth{name: name, health: healthUnknown}
+	body, err := getInstanceStatus(client, service, name, timeout)
+	if err != nil {
+		h.detail = strings.TrimSpace(err.Error())
+	} else {
+		h.health, h.detail = parseInstanceStatus(body)
+	}
+	h.duration = time.Since(start)
+	return h
+}
+
+// checkInstances retrieves the status of the instances concurrently, with at
+// most the given number of workers. The results are in the order of the
+// instances.
+func checkInstances(client *cmd.Client, service string, names []string, workers int, timeout time.Duration) []instanceHealth {
+	results := make([]instanceHealth, len(names))
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range names {
+			jobs <- i
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(names); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				results[n] = fetchInstanceStatus(client, service, names[n], timeout)
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// serviceInstanceNames returns the names of the instances of the service,
+// sorted.
+func serviceInstanceNames(client *cmd.Client, service string) ([]string, error) {
+	var list []serviceInstances
+	if err := getJSON(client, "/services/instances", &list); err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		if s.Service == service {
+			return sortedCopy(s.Instances), nil
+		}
+	}
+	return nil, fmt.Errorf("service %q not found", service)
+}
+
+// healthRank orders the instances in the dashboard, unhealthy ones first.
+var healthRank = map[string]int{healthDown: 0, healthUnknown: 1, healthHealthy: 2}
+
+type byHealth []instanceHealth
+
+func (l byHealth) Len() int {
+	return len(l)
+}
+
+func (l byHealth) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l byHealth) Less(i, j int) bool {
+	return healthRank[l[i].health] < healthRank[l[j].health]
+}
+
+// writeInstanceHealth writes the dashboard of the instances: a table with the
+// unhealthy instances first, and a summary. The health of the instances is
+// colored when color is true.
+func writeInstanceHealth(w io.Writer, service string, results []instanceHealth, at time.Time, color bool) (healthy, down, unknown int) {
+	sorted := make(byHealth, len(results))
+	copy(sorted, results)
+	sort.Stable(sorted)
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"Instance", "Health", "Status", "Time"}
+	for _, r := range sorted {
+		var fg, effect string
+		switch r.health {
+		case healthHealthy:
+			healthy++
+			fg = "green"
+		case healthDown:
+			down++
+			fg, effect = "red", "bold"
+		default:
+			unknown++
+			fg = "yellow"
+		}
+		health := r.health
+		if color {
+			health = cmd.Colorfy(health, fg, "", effect)
+		}
+		table.AddRow(cmd.Row{r.name, health, r.detail, (r.duration / time.Millisecond * time.Millisecond).String()})
+	}
+	fmt.Fprintf(w, "Instances of %q at %s:\n", service, at.Format("15:04:05"))
+	w.Write(table.Bytes())
+	fmt.Fprintf(w, "%d healthy, %d down, %d unknown.\n", healthy, down, unknown)
+	return healthy, down, unknown
+}
+
+// clearScreen moves the cursor to the top of the terminal and clears it.
+const clearScreen = "\033[H\033[2J"
+
+type instanceStatus struct {
+	fs      *gnuflag.FlagSet
+	workers int
+	timeout time.Duration
+	watch   time.Duration
+
+	// stop is notified when watching must stop. It's notified by SIGINT and
+	// SIGTERM when not set.
+	stop chan os.Signal
+
+	// terminal reports whether the output is a terminal. It checks the
+	// standard output when not set.
+	terminal func(io.Writer) bool
+}
+
+func (c *instanceStatus) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "instance-status",
+		Usage: "instance-status <service> [-w/--workers <n>] [--timeout <duration>] [--watch <interval>]",
+		Desc: `Displays the status of every instance of a service.
+
+The statuses are retrieved concurrently, by a bounded number of workers, and
+displayed in a table, with the unhealthy instances first and the time taken by
+each status. Instances are healthy when their service API reports them as up,
+down when it reports them as down, and unknown when their status is pending or
+can't be retrieved in time.
+
+With --watch, the statuses are retrieved again at every interval, like
+"--watch 10s", refreshing the table in place when the output is a terminal,
+until interrupted. The health is colored only when the output is a terminal.
+
+The command fails if any instance is not healthy, in watch mode when the last
+refresh had unhealthy instances.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *instanceStatus) Run(context *cmd.Context, client *cmd.Client) error {
+	service := context.Args[0]
+	workers := c.workers
+	if workers <= 0 {
+		workers = 10
+	}
+	if c.watch < 0 {
+		return errors.New("the watch interval must be positive")
+	}
+	names, err := serviceInstanceNames(client, service)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		fmt.Fprintf(context.Stdout, "The service %q has no instances.\n", service)
+		return nil
+	}
+	if c.watch > 0 {
+		// The pager would hold the refreshes until the command ends.
+		context.RawOutput()
+	}
+	tty := c.terminal
+	if tty == nil {
+		tty = isTerminal
+	}
+	color := tty(context.Stdout)
+	refresh := c.watch > 0 && color
+	stop := c.stop
+	if stop == nil && c.watch > 0 {
+		stop = make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(stop)
+	}
+	for {
+		results := checkInstances(client, service, names, workers, c.timeout)
+		if refresh {
+			io.WriteString(context.Stdout, clearScreen)
+		}
+		_, down, unknown := writeInstanceHealth(context.Stdout, service, results, time.Now(), color)
+		err = nil
+		if down+unknown > 0 {
+			err = fmt.Errorf("%d of %d instances of %q are not healthy", down+unknown, len(results), service)
+		}
+		if c.watch == 0 {
+			return err
+		}
+		select {
+		case <-stop:
+			return err
+		case <-time.After(c.watch):
+		}
+		if !refresh {
+			fmt.Fprintln(context.Stdout)
+		}
+	}
+}
+
+func (c *instanceStatus) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("instance-status", gnuflag.ExitOnError)
+		c.fs.IntVar(&c.workers, "workers", 10, "Number of statuses retrieved concurrently")
+		c.fs.IntVar(&c.workers, "w", 10, "Number of statuses retrieved concurrently")
+		c.fs.DurationVar(&c.timeout, "timeout", 10*time.Second, "Maximum time to retrieve the status of an instance")
+		c.fs.DurationVar(&c.watch, "watch", 0, "Retrieve the statuses again at every interval, until interrupted")
+	}
+	return c.fs
+}
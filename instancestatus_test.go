@@ -0,0 +1,254 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+// statusTarget is a tsuru server that reports the given statuses of the
+// instances of mysqlapi, keeping track of the concurrent requests.
+type statusTarget struct {
+	server   *httptest.Server
+	statuses map[string]string
+	delay    time.Duration
+
+	mu      sync.Mutex
+	active  int
+	maxSeen int
+	calls   int
+}
+
+func startStatusTarget(statuses map[string]string) *statusTarget {
+	t := &statusTarget{statuses: statuses}
+	t.server = httptest.NewServer(t)
+	os.Setenv("TSURU_TARGET", t.server.URL)
+	return t
+}
+
+func (t *statusTarget) stop() {
+	t.server.Close()
+	os.Setenv("TSURU_TARGET", "http://localhost:8080")
+}
+
+func (t *statusTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/1.0/services/instances" {
+		var names []string
+		t.mu.Lock()
+		for name := range t.statuses {
+			names = append(names, fmt.Sprintf("%q", name))
+		}
+		t.mu.Unlock()
+		fmt.Fprintf(w, `[{"service": "redisapi", "instances": ["cache"]}, {"service": "mysqlapi", "instances": [%s]}]`, strings.Join(names, ", "))
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	name := parts[len(parts)-2]
+	t.mu.Lock()
+	status := t.statuses[name]
+	t.calls++
+	t.active++
+	if t.active > t.maxSeen {
+		t.maxSeen = t.active
+	}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.active--
+		t.mu.Unlock()
+	}()
+	time.Sleep(t.delay)
+	if status == "slow" {
+		time.Sleep(300 * time.Millisecond)
+	}
+	if status == "error" {
+		http.Error(w, "failed to get the status", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Service instance %q is %s\n", name, status)
+}
+
+func (t *statusTarget) setStatus(name, status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.statuses[name] = status
+}
+
+func (s *S) TestParseInstanceStatus(c *check.C) {
+	var tests = []struct {
+		body   string
+		health string
+		status string
+	}{
+		{`Service instance "mydb" is up`, healthHealthy, "up"},
+		{"Service instance \"mydb\" is down\n", healthDown, "down"},
+		{`Service instance "mydb" is down: connection refused`, healthDown, "down: connection refused"},
+		{`Service instance "mydb" is pending`, healthUnknown, "pending"},
+		{"something else", healthUnknown, "something else"},
+	}
+	for _, t := range tests {
+		health, status := parseInstanceStatus(t.body)
+		c.Check(health, check.Equals, t.health)
+		c.Check(status, check.Equals, t.status)
+	}
+}
+
+func (s *S) TestCheckInstancesBoundsTheWorkers(c *check.C) {
+	statuses := map[string]string{}
+	var names []string
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("db%02d", i)
+		statuses[name] = "up"
+		names = append(names, name)
+	}
+	target := startStatusTarget(statuses)
+	defer target.stop()
+	target.delay = 20 * time.Millisecond
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	// Commands list the instances before checking them, which initializes
+	// the filesystem of the tsuru client lazily, and not concurrently.
+	cmd.ReadToken()
+	results := checkInstances(client, "mysqlapi", names, 3, time.Second)
+	c.Assert(results, check.HasLen, 12)
+	for i, r := range results {
+		c.Check(r.name, check.Equals, names[i])
+		c.Check(r.health, check.Equals, healthHealthy)
+		c.Check(r.duration >= 20*time.Millisecond, check.Equals, true)
+	}
+	c.Assert(target.calls, check.Equals, 12)
+	c.Assert(target.maxSeen, check.Equals, 3)
+}
+
+func (s *S) TestFetchInstanceStatusTimeout(c *check.C) {
+	target := startStatusTarget(map[string]string{"mydb": "slow"})
+	defer target.stop()
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	h := fetchInstanceStatus(client, "mysqlapi", "mydb", 50*time.Millisecond)
+	c.Assert(h.health, check.Equals, healthUnknown)
+	c.Assert(h.detail, check.Not(check.Equals), "")
+	c.Assert(h.duration < 300*time.Millisecond, check.Equals, true)
+	c.Assert(client.HTTPClient.Timeout, check.Equals, time.Duration(0))
+}
+
+func (s *S) TestInstanceStatusRun(c *check.C) {
+	target := startStatusTarget(map[string]string{"users": "up", "orders": "down", "cache": "pending", "sessions": "error"})
+	defer target.stop()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	command := instanceStatus{terminal: func(io.Writer) bool { return true }}
+	command.Flags().Parse(true, []string{"-w", "2"})
+	err := command.Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.ErrorMatches, `3 of 4 instances of "mysqlapi" are not healthy`)
+	out := stdout.String()
+	c.Assert(out, check.Matches, `(?s)Instances of "mysqlapi" at \d\d:\d\d:\d\d:
+.*\| Instance +\| Health +\| Status +\| Time +\|
+.*\| orders +\| `+strings.Replace(cmd.Colorfy("down", "red", "", "bold"), "[", `\[`, -1)+` +\| down +\| \d+m?s +\|
+.*\| cache +\| .*unknown.* +\| pending +\| \d+m?s +\|
+.*\| sessions +\| .*unknown.* +\| failed to get the status +\| \d+m?s +\|
+.*\| users +\| .*healthy.* +\| up +\| \d+m?s +\|
+.*1 healthy, 1 down, 2 unknown.\n$`)
+	c.Assert(out, check.Not(check.Matches), "(?s).*"+strings.Replace(clearScreen, "[", `\[`, -1)+".*")
+}
+
+func (s *S) TestInstanceStatusRunNotTerminal(c *check.C) {
+	target := startStatusTarget(map[string]string{"users": "up", "orders": "down"})
+	defer target.stop()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	command := instanceStatus{terminal: func(io.Writer) bool { return false }}
+	err := command.Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.ErrorMatches, `1 of 2 instances of "mysqlapi" are not healthy`)
+	c.Assert(stdout.String(), check.Matches, `(?s).*\| orders +\| down +\| down +\| .*\| users +\| healthy +\| up +\| .*`)
+	c.Assert(strings.Contains(stdout.String(), "\033["), check.Equals, false)
+}
+
+func (s *S) TestInstanceStatusRunHealthy(c *check.C) {
+	target := startStatusTarget(map[string]string{"users": "up"})
+	defer target.stop()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	err := (&instanceStatus{}).Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*1 healthy, 0 down, 0 unknown.\n$`)
+}
+
+func (s *S) TestInstanceStatusRunWatch(c *check.C) {
+	target := startStatusTarget(map[string]string{"users": "up"})
+	defer target.stop()
+	stop := make(chan os.Signal, 1)
+	var stdout bytes.Buffer
+	var mu sync.Mutex
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: lockedWriter{&mu, &stdout}}
+	command := instanceStatus{stop: stop, terminal: func(io.Writer) bool { return true }}
+	command.Flags().Parse(true, []string{"--watch", "10ms"})
+	done := make(chan error)
+	go func() {
+		done <- command.Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	}()
+	for {
+		mu.Lock()
+		n := strings.Count(stdout.String(), clearScreen)
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	target.setStatus("users", "down")
+	time.Sleep(50 * time.Millisecond)
+	stop <- os.Interrupt
+	err := <-done
+	c.Assert(err, check.ErrorMatches, `1 of 1 instances of "mysqlapi" are not healthy`)
+	c.Assert(strings.HasPrefix(stdout.String(), clearScreen), check.Equals, true)
+}
+
+func (s *S) TestInstanceStatusRunUnknownService(c *check.C) {
+	target := startStatusTarget(map[string]string{"users": "up"})
+	defer target.stop()
+	context := cmd.Context{Args: []string{"postgresapi"}, Stdout: &bytes.Buffer{}}
+	err := (&instanceStatus{}).Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.ErrorMatches, `service "postgresapi" not found`)
+}
+
+// lockedWriter serializes the writes to a writer shared with a test.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+func (s *S) TestInstanceStatusRunEmulator(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	var log bytes.Buffer
+	e, stop := startEmulator(c, fake, &log)
+	defer stop()
+	e.instances["mydb"] = &emulatedInstance{Name: "mydb", ServiceName: "mysqlapi"}
+	fake.instances["mydb"] = map[string]bool{}
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	err := (&instanceStatus{}).Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*\| mydb .*\| up .*1 healthy, 0 down, 0 unknown.\n$`)
+	fake.overrides["GET /resources/{name}/status"] = http.StatusInternalServerError
+	err = (&instanceStatus{}).Run(&context, cmd.NewClient(http.DefaultClient, nil, manager))
+	c.Assert(err, check.ErrorMatches, `1 of 1 instances of "mysqlapi" are not healthy`)
+}
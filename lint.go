@@ -0,0 +1,589 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/yaml.v1"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// lintFinding is a problem found in a manifest file.
+type lintFinding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+}
+
+func (f lintFinding) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s [%s]", f.File, f.Line, f.Column, f.Severity, f.Message, f.Rule)
+}
+
+// lintRule is a check run against a valid manifest.
+type lintRule struct {
+	ID          string
+	Description string
+	Severity    string
+	check       func(m *manifest) []lintProblem
+}
+
+// lintProblem is a problem reported by a rule, at the field identified by
+// path.
+type lintProblem struct {
+	path    string
+	message string
+}
+
+var serviceNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9-]{0,39}$`)
+
+// builtinLintRules are the rules checked in every manifest, unless disabled
+// by the policy.
+var builtinLintRules = []lintRule{
+	{
+		ID:          "https-endpoints",
+		Description: "Endpoints must use HTTPS.",
+		Severity:    severityError,
+		check: func(m *manifest) []lintProblem {
+			var problems []lintProblem
+			for _, name := range sortedKeys(m.Endpoints) {
+				endpoint := m.Endpoints[name]
+				if !strings.HasPrefix(endpoint, "https://") && !strings.HasPrefix(endpoint, "${") {
+					problems = append(problems, lintProblem{
+						path:    "endpoints." + name,
+						message: fmt.Sprintf("the endpoint %q does not use HTTPS", name),
+					})
+				}
+			}
+			return problems
+		},
+	},
+	{
+		ID:          "service-id",
+		Description: "The service id must be a valid service name.",
+		Severity:    severityError,
+		check: func(m *manifest) []lintProblem {
+			if serviceNameRegexp.MatchString(m.ID) || hasReference(m.ID) {
+				return nil
+			}
+			return []lintProblem{{
+				path:    "id",
+				message: fmt.Sprintf("the id %q does not match %s", m.ID, serviceNameRegexp),
+			}}
+		},
+	},
+	{
+		ID:          "plaintext-password",
+		Description: "The password must not be stored in the manifest, only a reference to it.",
+		Severity:    severityError,
+		check: func(m *manifest) []lintProblem {
+			if m.Password == "" || isReference(m.Password) {
+				return nil
+			}
+			return []lintProblem{{path: "password", message: "the password is stored in plaintext in the manifest"}}
+		},
+	},
+	{
+		ID:          "doc-file",
+		Description: "The doc file must exist.",
+		Severity:    severityError,
+		check: func(m *manifest) []lintProblem {
+			if m.Doc == "" || hasReference(m.Doc) {
+				return nil
+			}
+			if _, err := os.Stat(m.path(m.Doc)); err != nil {
+				return []lintProblem{{path: "doc", message: fmt.Sprintf("the doc file %q does not exist", m.Doc)}}
+			}
+			return nil
+		},
+	},
+}
+
+// lintPolicy holds the rules defined by a team in a YAML file, and the
+// built-in rules it disables.
+//
+// Each rule checks the values of a field of the manifest, like "id",
+// "endpoints", "endpoints.staging" or "plans.name". A rule may require the
+// field to be defined, or every value to match (or not match) a regular
+// expression.
+type lintPolicy struct {
+	Disable []string         `yaml:"disable"`
+	Rules   []lintPolicyRule `yaml:"rules"`
+
+	// path and positions locate the rules in the policy file, when the
+	// policy was read from a file.
+	path      string
+	positions map[string]yamlPosition
+}
+
+type lintPolicyRule struct {
+	ID          string `yaml:"id"`
+	Description string `yaml:"description"`
+	Severity    string `yaml:"severity"`
+	Field       string `yaml:"field"`
+	Required    bool   `yaml:"required"`
+	Match       string `yaml:"match"`
+	NotMatch    string `yaml:"not-match"`
+	Message     string `yaml:"message"`
+}
+
+func readLintPolicy(path string) (*lintPolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy lintPolicy
+	err = yaml.Unmarshal(data, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file: %s", err)
+	}
+	policy.path = path
+	policy.positions = yamlPositions(data)
+	return &policy, nil
+}
+
+// lintRuleError is an error in the given key of a rule of a policy.
+type lintRuleError struct {
+	key     string
+	message string
+}
+
+func (e *lintRuleError) Error() string {
+	return e.message
+}
+
+func ruleErrorf(key, format string, args ...interface{}) error {
+	return &lintRuleError{key: key, message: fmt.Sprintf(format, args...)}
+}
+
+// rules returns the built-in rules not disabled by the policy, followed by
+// the rules defined by the policy.
+func (p *lintPolicy) rules() ([]lintRule, error) {
+	disabled := map[string]bool{}
+	for _, id := range p.Disable {
+		disabled[id] = true
+	}
+	var rules []lintRule
+	for _, rule := range builtinLintRules {
+		if !disabled[rule.ID] {
+			rules = append(rules, rule)
+		}
+	}
+	for i, r := range p.Rules {
+		rule, err := r.lintRule()
+		if err != nil {
+			if p.path == "" {
+				return nil, fmt.Errorf("invalid policy rule #%d: %s", i+1, err)
+			}
+			pos := lookupPosition(p.positions, fmt.Sprintf("rules.%d.%s", i, err.(*lintRuleError).key))
+			return nil, fmt.Errorf("invalid policy: %s:%d:%d: rule #%d: %s", p.path, pos.line, pos.column, i+1, err)
+		}
+		if !disabled[rule.ID] {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func (r *lintPolicyRule) lintRule() (lintRule, error) {
+	if r.ID == "" {
+		return lintRule{}, ruleErrorf("id", "the id is required")
+	}
+	if r.Field == "" {
+		return lintRule{}, ruleErrorf("field", "the field is required")
+	}
+	field := strings.TrimSuffix(r.Field, ".*")
+	if !isLintField(field) {
+		return lintRule{}, ruleErrorf("field", "unknown field %q, must be %s or endpoints.<name>", r.Field, strings.Join(lintFields, ", "))
+	}
+	if !r.Required && r.Match == "" && r.NotMatch == "" {
+		return lintRule{}, ruleErrorf("", "one of required, match or not-match is required")
+	}
+	severity := r.Severity
+	if severity == "" {
+		severity = severityError
+	}
+	if severity != severityError && severity != severityWarning {
+		return lintRule{}, ruleErrorf("severity", "invalid severity %q", severity)
+	}
+	var match, notMatch *regexp.Regexp
+	var err error
+	if r.Match != "" {
+		if match, err = regexp.Compile(r.Match); err != nil {
+			return lintRule{}, ruleErrorf("match", "%s", err)
+		}
+	}
+	if r.NotMatch != "" {
+		if notMatch, err = regexp.Compile(r.NotMatch); err != nil {
+			return lintRule{}, ruleErrorf("not-match", "%s", err)
+		}
+	}
+	message := func(v manifestValue, format string, args ...interface{}) string {
+		if r.Message != "" {
+			return r.Message
+		}
+		return fmt.Sprintf("%s: ", v.path) + fmt.Sprintf(format, args...)
+	}
+	return lintRule{
+		ID:          r.ID,
+		Description: r.Description,
+		Severity:    severity,
+		check: func(m *manifest) []lintProblem {
+			values := m.values(field)
+			if len(values) == 0 {
+				if r.Required {
+					return []lintProblem{{path: field, message: message(manifestValue{path: field}, "the field is required")}}
+				}
+				return nil
+			}
+			var problems []lintProblem
+			for _, v := range values {
+				if hasReference(v.value) {
+					continue
+				}
+				if match != nil && !match.MatchString(v.value) {
+					problems = append(problems, lintProblem{path: v.path, message: message(v, "%q does not match %s", v.value, match)})
+				}
+				if notMatch != nil && notMatch.MatchString(v.value) {
+					problems = append(problems, lintProblem{path: v.path, message: message(v, "%q must not match %s", v.value, notMatch)})
+				}
+			}
+			return problems
+		},
+	}, nil
+}
+
+// lintFields are the fields of the manifest checked by the rules of policies,
+// besides the endpoints, like "endpoints.staging".
+var lintFields = []string{"id", "description", "username", "password", "doc", "teams", "endpoints", "plans", "plans.name", "plans.description"}
+
+// isLintField reports whether the rules of policies can check the field.
+func isLintField(field string) bool {
+	return contains(lintFields, field) || strings.HasPrefix(field, "endpoints.") && field != "endpoints."
+}
+
+// manifestValue is the value of a field in a manifest, identified by its
+// path.
+type manifestValue struct {
+	path  string
+	value string
+}
+
+// values returns the values of the given field of the manifest. Lists and
+// mappings return one value per item, like "endpoints", which returns the
+// value of every endpoint, and "plans.name", which returns the name of every
+// plan. Empty values are not returned.
+func (m *manifest) values(field string) []manifestValue {
+	var values []manifestValue
+	add := func(path, value string) {
+		if value != "" {
+			values = append(values, manifestValue{path: path, value: value})
+		}
+	}
+	switch {
+	case field == "id":
+		add("id", m.ID)
+	case field == "description":
+		add("description", m.Description)
+	case field == "username":
+		add("username", m.Username)
+	case field == "password":
+		add("password", m.Password)
+	case field == "doc":
+		add("doc", m.Doc)
+	case field == "teams":
+		for i, team := range m.Teams {
+			add(fmt.Sprintf("teams.%d", i), team)
+		}
+	case field == "endpoints":
+		for _, name := range sortedKeys(m.Endpoints) {
+			add("endpoints."+name, m.Endpoints[name])
+		}
+	case strings.HasPrefix(field, "endpoints."):
+		add(field, m.Endpoints[strings.TrimPrefix(field, "endpoints.")])
+	case field == "plans" || field == "plans.name":
+		for i, p := range m.Plans {
+			add(fmt.Sprintf("plans.%d.name", i), p.Name)
+		}
+	case field == "plans.description":
+		for i, p := range m.Plans {
+			add(fmt.Sprintf("plans.%d.description", i), p.Description)
+		}
+	}
+	return values
+}
+
+// lintManifest checks the manifest file, merged with the overlay file of the
+// given environment, against the given rules. Errors that make the manifest
+// invalid are reported as findings of the "manifest" rule.
+//
+// References to environment variables and files are not resolved, as they
+// may not be available where the manifest is checked. Values that include
+// references are skipped by rules that check their contents.
+func lintManifest(path, env string, rules []lintRule) ([]lintFinding, error) {
+	m, err := loadManifest(path, env, false)
+	if err != nil {
+		if manifestErr, ok := err.(*manifestError); ok {
+			return []lintFinding{{
+				Rule:     "manifest",
+				Severity: severityError,
+				Message:  manifestErr.Message,
+				File:     manifestErr.Path,
+				Line:     manifestErr.Line,
+				Column:   manifestErr.Column,
+			}}, nil
+		}
+		return nil, err
+	}
+	var findings []lintFinding
+	for _, rule := range rules {
+		for _, problem := range rule.check(m) {
+			pos := m.position(problem.path)
+			file := pos.file
+			if file == "" {
+				file = path
+			}
+			findings = append(findings, lintFinding{
+				Rule:     rule.ID,
+				Severity: rule.Severity,
+				Message:  problem.message,
+				File:     file,
+				Line:     pos.line,
+				Column:   pos.column,
+			})
+		}
+	}
+	sort.Stable(findingsByPosition(findings))
+	return findings, nil
+}
+
+type findingsByPosition []lintFinding
+
+func (f findingsByPosition) Len() int {
+	return len(f)
+}
+
+func (f findingsByPosition) Less(i, j int) bool {
+	if f[i].Line == f[j].Line {
+		return f[i].Column < f[j].Column
+	}
+	return f[i].Line < f[j].Line
+}
+
+func (f findingsByPosition) Swap(i, j int) {
+	f[i], f[j] = f[j], f[i]
+}
+
+type manifestLint struct {
+	fs     *gnuflag.FlagSet
+	policy string
+	format string
+	env    string
+}
+
+func (c *manifestLint) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "manifest-lint",
+		Usage: "manifest-lint <manifest-file.yaml> [--policy <policy-file.yaml>] [--format text|json|sarif] [-e/--env <environment>]",
+		Desc: `Checks a manifest file for problems, without talking to the tsuru server.
+
+Besides checking that the manifest is valid, the following rules are checked:
+
+  - https-endpoints: endpoints must use HTTPS
+  - service-id: the service id must be a valid service name
+  - plaintext-password: the password must not be stored in the manifest (use a
+    reference like ${DB_PASSWORD} instead)
+  - doc-file: the doc file must exist
+
+Teams may disable built-in rules and add their own rules in a policy file:
+
+  disable:
+    - plaintext-password
+  rules:
+    - id: company-domain
+      description: Endpoints must be in the company domain.
+      severity: warning
+      field: endpoints
+      match: '^https://[a-z0-9.-]+\.example\.com(:\d+)?/?$'
+    - id: description
+      field: description
+      required: true
+
+When an environment is given, the overlay file of the environment is merged
+over the manifest before checking it. References to environment variables and
+files are not resolved, and values that include them are not checked.
+
+The findings are displayed as text, JSON or SARIF, and the command fails if
+any finding is an error.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *manifestLint) Run(context *cmd.Context, client *cmd.Client) error {
+	policy := &lintPolicy{}
+	if c.policy != "" {
+		var err error
+		policy, err = readLintPolicy(c.policy)
+		if err != nil {
+			return err
+		}
+	}
+	rules, err := policy.rules()
+	if err != nil {
+		return err
+	}
+	findings, err := lintManifest(context.Args[0], c.env, rules)
+	if err != nil {
+		return err
+	}
+	switch c.format {
+	case "", "text":
+		for _, f := range findings {
+			fmt.Fprintln(context.Stdout, f)
+		}
+	case "json":
+		if findings == nil {
+			findings = []lintFinding{}
+		}
+		err = json.NewEncoder(context.Stdout).Encode(findings)
+	case "sarif":
+		err = writeSARIF(context.Stdout, rules, findings)
+	default:
+		return fmt.Errorf("invalid format %q, must be text, json or sarif", c.format)
+	}
+	if err != nil {
+		return err
+	}
+	var errorCount int
+	for _, f := range findings {
+		if f.Severity == severityError {
+			errorCount++
+		}
+	}
+	if errorCount > 0 {
+		return fmt.Errorf("%d error(s) found in the manifest", errorCount)
+	}
+	return nil
+}
+
+func (c *manifestLint) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("manifest-lint", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.policy, "policy", "", "Policy file with custom rules")
+		c.fs.StringVar(&c.format, "format", "text", "Format of the findings: text, json or sarif")
+		c.fs.StringVar(&c.env, "env", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.StringVar(&c.env, "e", "", "Environment whose overlay file is merged over the manifest")
+	}
+	return c.fs
+}
+
+// writeSARIF writes the findings in the SARIF 2.1.0 format, understood by
+// many CI systems.
+func writeSARIF(w io.Writer, rules []lintRule, findings []lintFinding) error {
+	type message struct {
+		Text string `json:"text"`
+	}
+	type sarifRule struct {
+		ID               string  `json:"id"`
+		ShortDescription message `json:"shortDescription"`
+	}
+	type region struct {
+		StartLine   int `json:"startLine"`
+		StartColumn int `json:"startColumn"`
+	}
+	type artifactLocation struct {
+		URI string `json:"uri"`
+	}
+	type physicalLocation struct {
+		ArtifactLocation artifactLocation `json:"artifactLocation"`
+		Region           region           `json:"region"`
+	}
+	type location struct {
+		PhysicalLocation physicalLocation `json:"physicalLocation"`
+	}
+	type result struct {
+		RuleID    string     `json:"ruleId"`
+		Level     string     `json:"level"`
+		Message   message    `json:"message"`
+		Locations []location `json:"locations"`
+	}
+	type driver struct {
+		Name           string      `json:"name"`
+		Version        string      `json:"version"`
+		InformationURI string      `json:"informationUri"`
+		Rules          []sarifRule `json:"rules"`
+	}
+	type tool struct {
+		Driver driver `json:"driver"`
+	}
+	type run struct {
+		Tool    tool     `json:"tool"`
+		Results []result `json:"results"`
+	}
+	type log struct {
+		Schema  string `json:"$schema"`
+		Version string `json:"version"`
+		Runs    []run  `json:"runs"`
+	}
+	r := run{
+		Tool: tool{Driver: driver{
+			Name:           "crane",
+			Version:        version,
+			InformationURI: "https://github.com/tsuru/crane",
+			Rules:          []sarifRule{{ID: "manifest", ShortDescription: message{"The manifest must be valid."}}},
+		}},
+		Results: []result{},
+	}
+	for _, rule := range rules {
+		r.Tool.Driver.Rules = append(r.Tool.Driver.Rules, sarifRule{ID: rule.ID, ShortDescription: message{rule.Description}})
+	}
+	for _, f := range findings {
+		r.Results = append(r.Results, result{
+			RuleID:  f.Rule,
+			Level:   f.Severity,
+			Message: message{f.Message},
+			Locations: []location{{PhysicalLocation: physicalLocation{
+				ArtifactLocation: artifactLocation{URI: f.File},
+				Region:           region{StartLine: f.Line, StartColumn: f.Column},
+			}}},
+		})
+	}
+	data, err := json.MarshalIndent(log{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []run{r},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,290 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestLintManifestBuiltinRules(c *check.C) {
+	findings, err := lintManifest("testdata/manifest-lint.yml", "", builtinLintRules)
+	c.Assert(err, check.IsNil)
+	c.Assert(findings, check.DeepEquals, []lintFinding{
+		{
+			Rule:     "service-id",
+			Severity: "error",
+			Message:  `the id "MySQL" does not match ^[a-z][a-z0-9-]{0,39}$`,
+			File:     "testdata/manifest-lint.yml",
+			Line:     2,
+			Column:   1,
+		},
+		{
+			Rule:     "plaintext-password",
+			Severity: "error",
+			Message:  "the password is stored in plaintext in the manifest",
+			File:     "testdata/manifest-lint.yml",
+			Line:     3,
+			Column:   1,
+		},
+		{
+			Rule:     "doc-file",
+			Severity: "error",
+			Message:  `the doc file "missing.txt" does not exist`,
+			File:     "testdata/manifest-lint.yml",
+			Line:     4,
+			Column:   1,
+		},
+		{
+			Rule:     "https-endpoints",
+			Severity: "error",
+			Message:  `the endpoint "staging" does not use HTTPS`,
+			File:     "testdata/manifest-lint.yml",
+			Line:     7,
+			Column:   3,
+		},
+	})
+}
+
+func (s *S) TestLintManifestValid(c *check.C) {
+	findings, err := lintManifest("testdata/manifest-v2.yml", "", builtinLintRules[:2])
+	c.Assert(err, check.IsNil)
+	c.Assert(findings, check.HasLen, 0)
+}
+
+func (s *S) TestLintManifestInvalidManifest(c *check.C) {
+	findings, err := lintManifest("testdata/doc.txt", "", builtinLintRules)
+	c.Assert(err, check.IsNil)
+	c.Assert(findings, check.DeepEquals, []lintFinding{{
+		Rule:     "manifest",
+		Severity: "error",
+		Message:  "mapping values are not allowed in this context",
+		File:     "testdata/doc.txt",
+		Line:     5,
+		Column:   1,
+	}})
+}
+
+func (s *S) TestLintManifestFileNotFound(c *check.C) {
+	_, err := lintManifest("testdata/unknown.yml", "", builtinLintRules)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestLintPolicyRules(c *check.C) {
+	policy, err := readLintPolicy("testdata/policy.yml")
+	c.Assert(err, check.IsNil)
+	rules, err := policy.rules()
+	c.Assert(err, check.IsNil)
+	var ids []string
+	for _, rule := range rules {
+		ids = append(ids, rule.ID)
+	}
+	c.Assert(ids, check.DeepEquals, []string{"https-endpoints", "service-id", "doc-file", "company-domain", "plan-description"})
+	findings, err := lintManifest("testdata/manifest-v2.yml", "", rules[3:])
+	c.Assert(err, check.IsNil)
+	c.Assert(findings, check.HasLen, 3)
+	c.Assert(findings[0].String(), check.Equals, `testdata/manifest-v2.yml:11:3: warning: endpoints.production: "https://mysqlapi.com" does not match ^https://[a-z0-9.-]+\.example\.com$ [company-domain]`)
+	c.Assert(findings[1].Line, check.Equals, 12)
+	c.Assert(findings[2].Line, check.Equals, 13)
+}
+
+func (s *S) TestLintPolicyRuleRequired(c *check.C) {
+	rule, err := (&lintPolicyRule{ID: "desc", Field: "plans.description", Required: true, Message: "plans must be described"}).lintRule()
+	c.Assert(err, check.IsNil)
+	findings, err := lintManifest("testdata/manifest.yml", "", []lintRule{rule})
+	c.Assert(err, check.IsNil)
+	c.Assert(findings, check.DeepEquals, []lintFinding{{
+		Rule:     "desc",
+		Severity: "error",
+		Message:  "plans must be described",
+		File:     "testdata/manifest.yml",
+		Line:     1,
+		Column:   1,
+	}})
+}
+
+func (s *S) TestLintPolicyRuleNotMatch(c *check.C) {
+	rule, err := (&lintPolicyRule{ID: "no-staging", Field: "endpoints.*", NotMatch: "staging"}).lintRule()
+	c.Assert(err, check.IsNil)
+	findings, err := lintManifest("testdata/manifest-v2.yml", "", []lintRule{rule})
+	c.Assert(err, check.IsNil)
+	c.Assert(findings, check.HasLen, 1)
+	c.Assert(findings[0].Message, check.Equals, `endpoints.staging: "https://staging.mysqlapi.com" must not match staging`)
+}
+
+func (s *S) TestLintPolicyInvalidRules(c *check.C) {
+	tests := []struct {
+		rule lintPolicyRule
+		err  string
+	}{
+		{lintPolicyRule{Field: "id", Required: true}, "the id is required"},
+		{lintPolicyRule{ID: "x", Required: true}, "the field is required"},
+		{lintPolicyRule{ID: "x", Field: "id"}, "one of required, match or not-match is required"},
+		{lintPolicyRule{ID: "x", Field: "id", Required: true, Severity: "fatal"}, `invalid severity "fatal"`},
+		{lintPolicyRule{ID: "x", Field: "id", Match: "("}, "error parsing regexp: .*"},
+		{lintPolicyRule{ID: "x", Field: "plan.name", Required: true}, `unknown field "plan.name", must be id, description, username, password, doc, teams, endpoints, plans, plans.name, plans.description or endpoints.<name>`},
+		{lintPolicyRule{ID: "x", Field: "endpoints.", Required: true}, `unknown field "endpoints.", .*`},
+	}
+	for _, t := range tests {
+		_, err := t.rule.lintRule()
+		c.Check(err, check.ErrorMatches, t.err)
+	}
+	policy := lintPolicy{Rules: []lintPolicyRule{{ID: "x"}}}
+	_, err := policy.rules()
+	c.Assert(err, check.ErrorMatches, "invalid policy rule #1: the field is required")
+	for _, field := range []string{"id", "teams.*", "endpoints.staging", "plans.description"} {
+		_, err = (&lintPolicyRule{ID: "x", Field: field, Required: true}).lintRule()
+		c.Check(err, check.IsNil, check.Commentf(field))
+	}
+}
+
+func (s *S) TestReadLintPolicyUnknownField(c *check.C) {
+	path := filepath.Join(c.MkDir(), "policy.yml")
+	data := "rules:\n  - id: plans\n    field: plans\n    required: true\n  - id: owners\n    required: true\n    field: owner\n"
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	c.Assert(err, check.IsNil)
+	policy, err := readLintPolicy(path)
+	c.Assert(err, check.IsNil)
+	_, err = policy.rules()
+	c.Assert(err, check.ErrorMatches, `invalid policy: .*/policy.yml:7:5: rule #2: unknown field "owner", .*`)
+	err = ioutil.WriteFile(path, []byte("rules:\n  - id: plans\n    field: plans\n"), 0644)
+	c.Assert(err, check.IsNil)
+	policy, err = readLintPolicy(path)
+	c.Assert(err, check.IsNil)
+	_, err = policy.rules()
+	c.Assert(err, check.ErrorMatches, `invalid policy: .*/policy.yml:2:3: rule #1: one of required, match or not-match is required`)
+}
+
+func (s *S) TestManifestLintRun(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"testdata/manifest-lint.yml"}, Stdout: &stdout}
+	command := manifestLint{}
+	command.Flags().Parse(true, []string{"--policy", "testdata/policy.yml"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `4 error\(s\) found in the manifest`)
+	expected := `testdata/manifest-lint.yml:1:1: error: plans must be described [plan-description]
+testdata/manifest-lint.yml:2:1: error: the id "MySQL" does not match ^[a-z][a-z0-9-]{0,39}$ [service-id]
+testdata/manifest-lint.yml:4:1: error: the doc file "missing.txt" does not exist [doc-file]
+testdata/manifest-lint.yml:7:3: error: the endpoint "staging" does not use HTTPS [https-endpoints]
+testdata/manifest-lint.yml:7:3: warning: endpoints.staging: "http://staging.mysqlapi.com" does not match ^https://[a-z0-9.-]+\.example\.com$ [company-domain]
+`
+	c.Assert(stdout.String(), check.Equals, expected)
+}
+
+func (s *S) TestManifestLintRunWarningsOnly(c *check.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "manifest.yml")
+	err := ioutil.WriteFile(path, []byte("id: mysqlapi\nendpoint:\n  production: https://mysqlapi.com\n"), 0600)
+	c.Assert(err, check.IsNil)
+	policy := filepath.Join(dir, "policy.yml")
+	err = ioutil.WriteFile(policy, []byte("rules:\n  - id: domain\n    severity: warning\n    field: endpoints\n    match: example\n"), 0600)
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{path}, Stdout: &stdout}
+	command := manifestLint{}
+	command.Flags().Parse(true, []string{"--policy", policy})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, path+`:3:3: warning: endpoints.production: "https://mysqlapi.com" does not match example [domain]`+"\n")
+}
+
+func (s *S) TestManifestLintRunJSON(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"testdata/manifest-v2.yml"}, Stdout: &stdout}
+	command := manifestLint{}
+	command.Flags().Parse(true, []string{"--format", "json"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `1 error\(s\) found in the manifest`)
+	var findings []lintFinding
+	err = json.Unmarshal(stdout.Bytes(), &findings)
+	c.Assert(err, check.IsNil)
+	c.Assert(findings, check.DeepEquals, []lintFinding{{
+		Rule:     "plaintext-password",
+		Severity: "error",
+		Message:  "the password is stored in plaintext in the manifest",
+		File:     "testdata/manifest-v2.yml",
+		Line:     5,
+		Column:   1,
+	}})
+}
+
+func (s *S) TestManifestLintRunSARIF(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"testdata/manifest-v2.yml"}, Stdout: &stdout}
+	command := manifestLint{}
+	command.Flags().Parse(true, []string{"--format", "sarif"})
+	command.Run(&context, nil)
+	var log struct {
+		Version string
+		Runs    []struct {
+			Tool struct {
+				Driver struct {
+					Name  string
+					Rules []struct{ ID string }
+				}
+			}
+			Results []struct {
+				RuleID    string
+				Level     string
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct{ URI string }
+						Region           struct{ StartLine, StartColumn int }
+					}
+				}
+			}
+		}
+	}
+	err := json.Unmarshal(stdout.Bytes(), &log)
+	c.Assert(err, check.IsNil)
+	c.Assert(log.Version, check.Equals, "2.1.0")
+	c.Assert(log.Runs, check.HasLen, 1)
+	c.Assert(log.Runs[0].Tool.Driver.Name, check.Equals, "crane")
+	c.Assert(log.Runs[0].Tool.Driver.Rules, check.HasLen, 5)
+	c.Assert(log.Runs[0].Results, check.HasLen, 1)
+	result := log.Runs[0].Results[0]
+	c.Assert(result.RuleID, check.Equals, "plaintext-password")
+	c.Assert(result.Level, check.Equals, "error")
+	c.Assert(result.Locations[0].PhysicalLocation.ArtifactLocation.URI, check.Equals, "testdata/manifest-v2.yml")
+	c.Assert(result.Locations[0].PhysicalLocation.Region.StartLine, check.Equals, 5)
+}
+
+func (s *S) TestManifestLintRunInvalidFormat(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"testdata/manifest-v2.yml"}, Stdout: &stdout}
+	command := manifestLint{}
+	command.Flags().Parse(true, []string{"--format", "xml"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `invalid format "xml", must be text, json or sarif`)
+}
+
+func (s *S) TestLintManifestWithOverlay(c *check.C) {
+	findings, err := lintManifest("testdata/manifest-env.yml", "prod", builtinLintRules)
+	c.Assert(err, check.IsNil)
+	c.Assert(findings, check.HasLen, 0)
+	rule, err := (&lintPolicyRule{ID: "domain", Field: "endpoints", NotMatch: `example\.com`}).lintRule()
+	c.Assert(err, check.IsNil)
+	findings, err = lintManifest("testdata/manifest-env.yml", "prod", []lintRule{rule})
+	c.Assert(err, check.IsNil)
+	c.Assert(findings, check.HasLen, 1)
+	c.Assert(findings[0].File, check.Equals, "testdata/manifest-env.prod.yml")
+	c.Assert(findings[0].Line, check.Equals, 3)
+}
+
+func (s *S) TestLintManifestSkipsReferences(c *check.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "manifest.yml")
+	data := "id: ${SERVICE}\npassword: ${DB_PASSWORD}\ndoc: ${file:doc-path}\nendpoint:\n  production: ${ENDPOINT}\n"
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	c.Assert(err, check.IsNil)
+	findings, err := lintManifest(path, "", builtinLintRules)
+	c.Assert(err, check.IsNil)
+	c.Assert(findings, check.HasLen, 0)
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/tsuru/tsuru/cmd"
@@ -15,21 +16,60 @@ const (
 	header  = "Supported-Crane"
 )
 
-func buildManager(name string) *cmd.Manager {
-	m := cmd.BuildBaseManager(name, version, header, nil)
+// buildManager builds the manager of the commands of crane, with the aliases
+// defined in the config file and the plugins found in the directories. An
+// empty config path defines no aliases.
+func buildManager(name, config string, pluginDirs []string) *cmd.Manager {
+	lookup := &commandLookup{}
+	m := cmd.BuildBaseManager(name, version, header, lookup.lookup)
+	lookup.manager = m
+	m.Register(&serviceApply{})
+	m.Register(&servicePlan{})
+	m.Register(&manifestLint{})
+	m.Register(&serviceTemplate{})
+	m.Register(&serviceInit{})
+	m.Register(&apiCheck{})
+	m.Register(&apiBench{})
+	m.Register(&apiEmulate{})
+	m.Register(&apiProxy{})
+	m.Register(&apiReplay{})
+	m.Register(&apiSpec{})
+	m.Register(&docVerify{})
+	m.Register(&docSync{})
+	m.Register(&docGet{})
+	m.Register(&catalogExport{})
+	m.Register(&instanceAdd{})
+	m.Register(&instanceRemove{})
+	m.Register(&instanceBind{})
+	m.Register(&instanceUnbind{})
+	m.Register(&instanceList{})
+	m.Register(&instanceStatus{})
+	m.Register(&instanceOrphans{})
+	m.Register(&pluginInstall{})
+	m.Register(&pluginList{})
+	m.Register(&pluginRemove{})
+	m.Register(&completion{manager: m, program: name})
 	m.RegisterRemoved("create", "You should use `tsuru service-create` instead.")
 	m.RegisterRemoved("remove", "You should use `tsuru service-destroy` instead.")
 	m.RegisterRemoved("list", "You should use `tsuru service-list` instead.")
 	m.RegisterRemoved("update", "You should use `tsuru service-update` instead.")
-	m.RegisterRemoved("doc-get", "You should use `tsuru service-doc-get` instead.")
-	m.RegisterRemoved("doc-add", "You should use `tsuru service-doc-add` instead.")
-	m.RegisterRemoved("template", "You should use `tsuru service-template` instead.")
+	m.RegisterRemoved("doc-add", "You should use `crane doc-sync` or `tsuru service-doc-add` instead.")
+	if config != "" {
+		aliases, err := readConfigSection(config, "aliases")
+		if err == nil {
+			err = registerAliases(lookup, aliases)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: the aliases were not loaded: %s\n", err)
+		}
+	}
+	registerPlugins(m, pluginDirs)
 	return m
 }
 
 func main() {
 	name := cmd.ExtractProgramName(os.Args[0])
-	manager := buildManager(name)
+	manager := buildManager(name, configPath(), pluginDirs())
 	args := os.Args[1:]
 	manager.Run(args)
 }
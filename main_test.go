@@ -11,7 +11,7 @@ import (
 
 func (s *S) TestCommandsFromBaseManagerAreRegistered(c *check.C) {
 	baseManager := cmd.BuildBaseManager("tsuru", version, header, nil)
-	manager := buildManager("tsuru")
+	manager := buildManager("tsuru", "", nil)
 	for name, instance := range baseManager.Commands {
 		command, ok := manager.Commands[name]
 		c.Assert(ok, check.Equals, true)
@@ -20,50 +20,218 @@ func (s *S) TestCommandsFromBaseManagerAreRegistered(c *check.C) {
 }
 
 func (s *S) TestCreateIsRegistered(c *check.C) {
-	manager := buildManager("tsuru")
+	manager := buildManager("tsuru", "", nil)
 	target, ok := manager.Commands["create"]
 	c.Assert(ok, check.Equals, true)
 	c.Assert(target, check.FitsTypeOf, &cmd.RemovedCommand{})
 }
 
 func (s *S) TestRemoveIsRegistered(c *check.C) {
-	manager := buildManager("tsuru")
+	manager := buildManager("tsuru", "", nil)
 	remove, ok := manager.Commands["remove"]
 	c.Assert(ok, check.Equals, true)
 	c.Assert(remove, check.FitsTypeOf, &cmd.RemovedCommand{})
 }
 
 func (s *S) TestListIsRegistered(c *check.C) {
-	manager := buildManager("tsuru")
+	manager := buildManager("tsuru", "", nil)
 	remove, ok := manager.Commands["list"]
 	c.Assert(ok, check.Equals, true)
 	c.Assert(remove, check.FitsTypeOf, &cmd.RemovedCommand{})
 }
 
 func (s *S) TestUpdateIsRegistered(c *check.C) {
-	manager := buildManager("tsuru")
+	manager := buildManager("tsuru", "", nil)
 	update, ok := manager.Commands["update"]
 	c.Assert(ok, check.Equals, true)
 	c.Assert(update, check.FitsTypeOf, &cmd.RemovedCommand{})
 }
 
 func (s *S) TestDocGetIsRegistered(c *check.C) {
-	manager := buildManager("tsuru")
-	update, ok := manager.Commands["doc-get"]
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["doc-get"]
 	c.Assert(ok, check.Equals, true)
-	c.Assert(update, check.FitsTypeOf, &cmd.RemovedCommand{})
+	c.Assert(command, check.FitsTypeOf, &docGet{})
 }
 
 func (s *S) TestDocAddIsRegistered(c *check.C) {
-	manager := buildManager("tsuru")
+	manager := buildManager("tsuru", "", nil)
 	update, ok := manager.Commands["doc-add"]
 	c.Assert(ok, check.Equals, true)
 	c.Assert(update, check.FitsTypeOf, &cmd.RemovedCommand{})
 }
 
 func (s *S) TestTemplateIsRegistered(c *check.C) {
-	manager := buildManager("tsuru")
+	manager := buildManager("tsuru", "", nil)
 	update, ok := manager.Commands["template"]
 	c.Assert(ok, check.Equals, true)
-	c.Assert(update, check.FitsTypeOf, &cmd.RemovedCommand{})
+	c.Assert(update, check.FitsTypeOf, &serviceTemplate{})
+}
+
+func (s *S) TestInitIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["init"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &serviceInit{})
+}
+
+func (s *S) TestApplyIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	apply, ok := manager.Commands["apply"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(apply, check.FitsTypeOf, &serviceApply{})
+}
+
+func (s *S) TestPlanIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	plan, ok := manager.Commands["plan"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(plan, check.FitsTypeOf, &servicePlan{})
+}
+
+func (s *S) TestManifestLintIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	lint, ok := manager.Commands["manifest-lint"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(lint, check.FitsTypeOf, &manifestLint{})
+}
+
+func (s *S) TestAPICheckIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["api-check"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &apiCheck{})
+}
+
+func (s *S) TestAPIBenchIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["api-bench"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &apiBench{})
+}
+
+func (s *S) TestAPIEmulateIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["api-emulate"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &apiEmulate{})
+}
+
+func (s *S) TestAPIProxyIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["api-proxy"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &apiProxy{})
+}
+
+func (s *S) TestAPIReplayIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["api-replay"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &apiReplay{})
+}
+
+func (s *S) TestDocVerifyIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["doc-verify"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &docVerify{})
+}
+
+func (s *S) TestDocSyncIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["doc-sync"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &docSync{})
+}
+
+func (s *S) TestAPISpecIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["api-spec"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &apiSpec{})
+}
+
+func (s *S) TestInstanceAddIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["instance-add"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &instanceAdd{})
+}
+
+func (s *S) TestInstanceRemoveIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["instance-remove"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &instanceRemove{})
+}
+
+func (s *S) TestInstanceBindIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["instance-bind"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &instanceBind{})
+}
+
+func (s *S) TestInstanceUnbindIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["instance-unbind"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &instanceUnbind{})
+}
+
+func (s *S) TestCatalogExportIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["catalog-export"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &catalogExport{})
+}
+
+func (s *S) TestInstanceListIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["instance-list"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &instanceList{})
+}
+
+func (s *S) TestInstanceStatusIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["instance-status"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &instanceStatus{})
+}
+
+func (s *S) TestInstanceOrphansIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["instance-orphans"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &instanceOrphans{})
+}
+
+func (s *S) TestPluginInstallIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["plugin-install"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &pluginInstall{})
+}
+
+func (s *S) TestPluginListIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["plugin-list"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &pluginList{})
+}
+
+func (s *S) TestPluginRemoveIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["plugin-remove"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &pluginRemove{})
+}
+
+func (s *S) TestCompletionIsRegistered(c *check.C) {
+	manager := buildManager("tsuru", "", nil)
+	command, ok := manager.Commands["completion"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &completion{})
 }
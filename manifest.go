@@ -0,0 +1,494 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v1"
+)
+
+// manifestVersion is the current version of the manifest format. Manifests
+// without a version are in the first format, which is upgraded when parsed.
+const manifestVersion = 2
+
+// manifest is the description of a service, as written by the service
+// provider in a YAML file.
+type manifest struct {
+	Version     int               `yaml:"version"`
+	ID          string            `yaml:"id"`
+	Description string            `yaml:"description,omitempty"`
+	Username    string            `yaml:"username,omitempty"`
+	Password    string            `yaml:"password,omitempty"`
+	Teams       []string          `yaml:"teams,omitempty"`
+	Doc         string            `yaml:"doc,omitempty"`
+	Endpoints   map[string]string `yaml:"endpoints"`
+	Plans       []manifestPlan    `yaml:"plans,omitempty"`
+
+	// dir is the directory of the manifest file, used to resolve relative
+	// paths.
+	dir string
+
+	// positions are the positions of the fields in the manifest file,
+	// indexed by their path in the current format, like "endpoints.staging".
+	positions map[string]yamlPosition
+}
+
+// manifestPlan is the metadata of a plan offered by the service.
+type manifestPlan struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description,omitempty"`
+}
+
+// manifestError is an error in a manifest file, with its position in the
+// file. Line and Column start at 1.
+type manifestError struct {
+	Path    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *manifestError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("invalid manifest: line %d, column %d: %s", e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("invalid manifest: %s:%d:%d: %s", e.Path, e.Line, e.Column, e.Message)
+}
+
+func readManifest(path string) (*manifest, error) {
+	return loadManifest(path, "", true)
+}
+
+// loadManifest reads the manifest file in the given path. When env is not
+// empty, the overlay file for the environment is merged over the manifest
+// (see overlayPath). References to environment variables and files in the
+// values are resolved only when interpolate is true.
+func loadManifest(path, env string, interpolate bool) (*manifest, error) {
+	root, positions, err := readManifestFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if env != "" {
+		overlay, overlayPositions, err := readManifestFile(overlayPath(path, env))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("overlay file for the environment %q not found: %s", env, overlayPath(path, env))
+			}
+			return nil, err
+		}
+		root = mergeValues(root, overlay).(map[interface{}]interface{})
+		positions = mergePositions(positions, overlayPositions)
+	}
+	d := manifestDecoder{positions: positions}
+	if interpolate {
+		root, err = d.interpolate(root, filepath.Dir(path))
+	}
+	var m *manifest
+	if err == nil {
+		m, err = d.decode(root)
+	}
+	if err != nil {
+		if manifestErr, ok := err.(*manifestError); ok && manifestErr.Path == "" {
+			manifestErr.Path = path
+		}
+		return nil, err
+	}
+	m.dir = filepath.Dir(path)
+	return m, nil
+}
+
+// readManifestFile reads the YAML document in the given path, returning its
+// root mapping and the positions of its fields in the file.
+func readManifestFile(path string) (map[interface{}]interface{}, map[string]yamlPosition, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, positions, err := parseManifestYAML(data)
+	if err != nil {
+		err.(*manifestError).Path = path
+		return nil, nil, err
+	}
+	for key, pos := range positions {
+		pos.file = path
+		positions[key] = pos
+	}
+	return root, positions, nil
+}
+
+// parseManifest parses and validates a manifest, upgrading it to the current
+// format if needed. Errors are returned as *manifestError.
+func parseManifest(data []byte) (*manifest, error) {
+	root, positions, err := parseManifestYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	d := manifestDecoder{positions: positions}
+	return d.decode(root)
+}
+
+func parseManifestYAML(data []byte) (map[interface{}]interface{}, map[string]yamlPosition, error) {
+	d := manifestDecoder{positions: yamlPositions(data)}
+	var raw interface{}
+	err := yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, nil, d.syntaxError(data, err)
+	}
+	root, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, d.errorf("", "the manifest must be a mapping")
+	}
+	return root, d.positions, nil
+}
+
+var manifestFields = map[int][]string{
+	1: {"id", "username", "password", "team", "teams", "doc", "endpoint", "plans"},
+	2: {"version", "id", "description", "username", "password", "teams", "doc", "endpoints", "plans"},
+}
+
+type manifestDecoder struct {
+	positions map[string]yamlPosition
+}
+
+func (d *manifestDecoder) decode(root map[interface{}]interface{}) (*manifest, error) {
+	m := manifest{Version: 1}
+	if _, ok := root["version"]; ok {
+		version, err := d.int(root, "version")
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := manifestFields[version]; !ok {
+			return nil, d.errorf("version", "unsupported manifest version %d", version)
+		}
+		m.Version = version
+	}
+	var keys []string
+	for key := range root {
+		keys = append(keys, fmt.Sprint(key))
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !d.known(m.Version, key) {
+			return nil, d.errorf(key, "unknown field %q", key)
+		}
+	}
+	var err error
+	fields := []struct {
+		dst *string
+		key string
+	}{
+		{&m.ID, "id"},
+		{&m.Description, "description"},
+		{&m.Username, "username"},
+		{&m.Password, "password"},
+		{&m.Doc, "doc"},
+	}
+	for _, f := range fields {
+		if *f.dst, err = d.string(root, "", f.key); err != nil {
+			return nil, err
+		}
+	}
+	if m.Teams, err = d.strings(root, "teams"); err != nil {
+		return nil, err
+	}
+	endpointsKey := "endpoints"
+	if m.Version == 1 {
+		endpointsKey = "endpoint"
+		var team string
+		if team, err = d.string(root, "", "team"); err != nil {
+			return nil, err
+		}
+		if team != "" {
+			m.Teams = append(m.Teams, team)
+		}
+	}
+	if m.Endpoints, err = d.stringMap(root, endpointsKey); err != nil {
+		return nil, err
+	}
+	if m.Plans, err = d.plans(root, m.Version); err != nil {
+		return nil, err
+	}
+	if m.ID == "" {
+		return nil, d.errorf("id", "the service id is required")
+	}
+	if m.Endpoints["production"] == "" {
+		return nil, d.errorf(endpointsKey, "the production endpoint is required")
+	}
+	m.positions = d.positions
+	if m.Version == 1 {
+		m.positions = make(map[string]yamlPosition, len(d.positions))
+		for path, pos := range d.positions {
+			if path == "endpoint" || strings.HasPrefix(path, "endpoint.") {
+				path = "endpoints" + strings.TrimPrefix(path, "endpoint")
+			}
+			m.positions[path] = pos
+		}
+	}
+	m.Version = manifestVersion
+	return &m, nil
+}
+
+func (d *manifestDecoder) known(version int, key string) bool {
+	for _, field := range manifestFields[version] {
+		if field == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *manifestDecoder) int(root map[interface{}]interface{}, key string) (int, error) {
+	value, ok := root[key].(int)
+	if !ok {
+		return 0, d.errorf(key, "%s must be an integer", key)
+	}
+	return value, nil
+}
+
+func (d *manifestDecoder) string(parent map[interface{}]interface{}, prefix, key string) (string, error) {
+	value, ok := parent[key]
+	if !ok || value == nil {
+		return "", nil
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int, int64, float64, bool:
+		return fmt.Sprint(v), nil
+	}
+	return "", d.errorf(prefix+key, "%s must be a string", prefix+key)
+}
+
+func (d *manifestDecoder) strings(root map[interface{}]interface{}, key string) ([]string, error) {
+	value, ok := root[key]
+	if !ok || value == nil {
+		return nil, nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, d.errorf(key, "%s must be a list of strings", key)
+	}
+	result := make([]string, len(items))
+	for i, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			path := key + "." + strconv.Itoa(i)
+			return nil, d.errorf(path, "%s must be a string", path)
+		}
+		result[i] = s
+	}
+	return result, nil
+}
+
+func (d *manifestDecoder) stringMap(root map[interface{}]interface{}, key string) (map[string]string, error) {
+	value, ok := root[key]
+	if !ok || value == nil {
+		return nil, nil
+	}
+	items, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, d.errorf(key, "%s must be a mapping", key)
+	}
+	result := make(map[string]string, len(items))
+	for name := range items {
+		s, err := d.string(items, key+".", fmt.Sprint(name))
+		if err != nil {
+			return nil, err
+		}
+		result[fmt.Sprint(name)] = s
+	}
+	return result, nil
+}
+
+// plans decodes the plans of the manifest. In the first format, plans are a
+// list of names; in the current one, a list of mappings.
+func (d *manifestDecoder) plans(root map[interface{}]interface{}, version int) ([]manifestPlan, error) {
+	if version == 1 {
+		names, err := d.strings(root, "plans")
+		if err != nil {
+			return nil, err
+		}
+		var plans []manifestPlan
+		for _, name := range names {
+			plans = append(plans, manifestPlan{Name: name})
+		}
+		return plans, nil
+	}
+	value, ok := root["plans"]
+	if !ok || value == nil {
+		return nil, nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, d.errorf("plans", "plans must be a list")
+	}
+	plans := make([]manifestPlan, len(items))
+	for i, item := range items {
+		prefix := "plans." + strconv.Itoa(i)
+		fields, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, d.errorf(prefix, "%s must be a mapping", prefix)
+		}
+		for key := range fields {
+			if key != "name" && key != "description" {
+				return nil, d.errorf(prefix+"."+fmt.Sprint(key), "unknown field %q", fmt.Sprint(key))
+			}
+		}
+		var err error
+		if plans[i].Name, err = d.string(fields, prefix+".", "name"); err != nil {
+			return nil, err
+		}
+		if plans[i].Description, err = d.string(fields, prefix+".", "description"); err != nil {
+			return nil, err
+		}
+		if plans[i].Name == "" {
+			return nil, d.errorf(prefix, "the name of the plan is required")
+		}
+	}
+	return plans, nil
+}
+
+func (d *manifestDecoder) errorf(path string, format string, args ...interface{}) error {
+	pos := lookupPosition(d.positions, path)
+	return &manifestError{Path: pos.file, Line: pos.line, Column: pos.column, Message: fmt.Sprintf(format, args...)}
+}
+
+// lookupPosition returns the position of the given path, falling back to the
+// closest parent that has a known position.
+func lookupPosition(positions map[string]yamlPosition, path string) yamlPosition {
+	for path != "" {
+		if pos, ok := positions[path]; ok {
+			return pos
+		}
+		i := strings.LastIndex(path, ".")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return yamlPosition{line: 1, column: 1}
+}
+
+var yamlErrorRegexp = regexp.MustCompile(`^YAML error: line (\d+): (.*)$`)
+
+// syntaxError converts an error from the YAML parser, which only includes a
+// zero-based line number, into a *manifestError. The column is the first
+// non-blank column of the line.
+func (d *manifestDecoder) syntaxError(data []byte, err error) error {
+	parts := yamlErrorRegexp.FindStringSubmatch(err.Error())
+	if parts == nil {
+		return &manifestError{Line: 1, Column: 1, Message: strings.TrimPrefix(err.Error(), "YAML error: ")}
+	}
+	line, _ := strconv.Atoi(parts[1])
+	line++
+	column := 1
+	lines := strings.Split(string(data), "\n")
+	if line <= len(lines) {
+		column += len(lines[line-1]) - len(strings.TrimLeft(lines[line-1], " \t"))
+	}
+	return &manifestError{Line: line, Column: column, Message: parts[2]}
+}
+
+// yamlPosition is the position of a field in a YAML file. file is empty
+// when the document wasn't read from a file.
+type yamlPosition struct {
+	file         string
+	line, column int
+}
+
+// yamlPositions scans a YAML document written in block style, returning the
+// position of every mapping key and sequence item, indexed by path. Paths are
+// dot-separated keys and indexes, like "plans.0.name". Flow collections are
+// not scanned.
+func yamlPositions(data []byte) map[string]yamlPosition {
+	type entry struct {
+		indent int
+		path   string
+		item   bool
+	}
+	var stack []entry
+	counts := map[string]int{}
+	positions := map[string]yamlPosition{}
+	join := func(parent, key string) string {
+		if parent == "" {
+			return key
+		}
+		return parent + "." + key
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		content := strings.TrimLeft(line, " ")
+		indent := len(line) - len(content)
+		if content == "" || content[0] == '#' || strings.HasPrefix(content, "---") {
+			continue
+		}
+		for content != "" {
+			item := content == "-" || strings.HasPrefix(content, "- ")
+			for len(stack) > 0 {
+				top := stack[len(stack)-1]
+				if top.indent < indent || (top.indent == indent && item && !top.item) {
+					break
+				}
+				stack = stack[:len(stack)-1]
+			}
+			var parent string
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1].path
+			}
+			pos := yamlPosition{line: n + 1, column: indent + 1}
+			if item {
+				path := join(parent, strconv.Itoa(counts[parent]))
+				counts[parent]++
+				positions[path] = pos
+				stack = append(stack, entry{indent: indent, path: path, item: true})
+				rest := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+				indent += len(content) - len(rest)
+				content = rest
+				continue
+			}
+			i := strings.Index(content, ":")
+			if i < 0 || (i+1 < len(content) && content[i+1] != ' ') {
+				break
+			}
+			key := strings.Trim(content[:i], `"'`)
+			path := join(parent, key)
+			positions[path] = pos
+			stack = append(stack, entry{indent: indent, path: path})
+			break
+		}
+	}
+	return positions
+}
+
+// path resolves the given path relative to the directory of the manifest.
+func (m *manifest) path(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(m.dir, p)
+}
+
+// position returns the position of the field identified by the given path in
+// the manifest file.
+func (m *manifest) position(path string) yamlPosition {
+	return lookupPosition(m.positions, path)
+}
+
+// planNames returns the sorted names of the plans in the manifest.
+func (m *manifest) planNames() []string {
+	var names []string
+	for _, p := range m.Plans {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,187 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "gopkg.in/check.v1"
+
+func (s *S) TestReadManifest(c *check.C) {
+	m, err := readManifest("testdata/manifest.yml")
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Version, check.Equals, manifestVersion)
+	c.Assert(m.ID, check.Equals, "mysqlapi")
+	c.Assert(m.Endpoints, check.DeepEquals, map[string]string{"production": "mysqlapi.com"})
+	c.Assert(m.dir, check.Equals, "testdata")
+}
+
+func (s *S) TestReadManifestV2(c *check.C) {
+	m, err := readManifest("testdata/manifest-v2.yml")
+	c.Assert(err, check.IsNil)
+	c.Assert(m.position("plans.1.description"), check.Equals, yamlPosition{file: "testdata/manifest-v2.yml", line: 18, column: 5})
+	m.dir = ""
+	m.positions = nil
+	c.Assert(m, check.DeepEquals, &manifest{
+		Version:     2,
+		ID:          "mysqlapi",
+		Description: "MySQL databases for tsuru apps",
+		Username:    "mysqlapi",
+		Password:    "s3cr3t",
+		Teams:       []string{"admin", "ops"},
+		Doc:         "doc.txt",
+		Endpoints: map[string]string{
+			"production":    "https://mysqlapi.com",
+			"staging":       "https://staging.mysqlapi.com",
+			"pool-internal": "https://internal.mysqlapi.com",
+		},
+		Plans: []manifestPlan{
+			{Name: "small", Description: "1GB of storage"},
+			{Name: "big", Description: "100GB of storage"},
+		},
+	})
+}
+
+func (s *S) TestReadManifestFileNotFound(c *check.C) {
+	_, err := readManifest("testdata/unknown.yml")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestReadManifestErrorIncludesPath(c *check.C) {
+	_, err := readManifest("testdata/doc.txt")
+	c.Assert(err, check.ErrorMatches, "invalid manifest: testdata/doc.txt:5:1: mapping values are not allowed in this context")
+}
+
+func (s *S) TestParseManifestUpgradesV1(c *check.C) {
+	data := `id: mysqlapi
+username: mysql
+team: admin
+endpoint:
+  production: mysqlapi.com
+  staging: staging.mysqlapi.com
+plans:
+  - small
+  - big
+`
+	m, err := parseManifest([]byte(data))
+	c.Assert(err, check.IsNil)
+	c.Assert(m.position("endpoints.staging"), check.Equals, yamlPosition{line: 6, column: 3})
+	m.positions = nil
+	c.Assert(m, check.DeepEquals, &manifest{
+		Version:   2,
+		ID:        "mysqlapi",
+		Username:  "mysql",
+		Teams:     []string{"admin"},
+		Endpoints: map[string]string{"production": "mysqlapi.com", "staging": "staging.mysqlapi.com"},
+		Plans:     []manifestPlan{{Name: "small"}, {Name: "big"}},
+	})
+}
+
+func (s *S) TestParseManifestWithoutID(c *check.C) {
+	_, err := parseManifest([]byte("endpoint:\n  production: mysqlapi.com\n"))
+	c.Assert(err, check.ErrorMatches, "invalid manifest: line 1, column 1: the service id is required")
+}
+
+func (s *S) TestParseManifestWithoutProductionEndpoint(c *check.C) {
+	_, err := parseManifest([]byte("id: mysqlapi\nendpoint:\n  staging: mysqlapi.com\n"))
+	c.Assert(err, check.ErrorMatches, "invalid manifest: line 2, column 1: the production endpoint is required")
+}
+
+func (s *S) TestParseManifestV1DoesNotAcceptEndpoints(c *check.C) {
+	_, err := parseManifest([]byte("id: mysqlapi\nendpoints:\n  production: mysqlapi.com\n"))
+	c.Assert(err, check.ErrorMatches, `invalid manifest: line 2, column 1: unknown field "endpoints"`)
+}
+
+func (s *S) TestParseManifestUnknownField(c *check.C) {
+	data := "version: 2\nid: mysqlapi\nendpoints:\n  production: mysqlapi.com\n  # comment\nfoo: bar\n"
+	_, err := parseManifest([]byte(data))
+	c.Assert(err, check.ErrorMatches, `invalid manifest: line 6, column 1: unknown field "foo"`)
+}
+
+func (s *S) TestParseManifestUnsupportedVersion(c *check.C) {
+	_, err := parseManifest([]byte("id: mysqlapi\nversion: 3\n"))
+	c.Assert(err, check.ErrorMatches, "invalid manifest: line 2, column 1: unsupported manifest version 3")
+	_, err = parseManifest([]byte("id: mysqlapi\nversion: two\n"))
+	c.Assert(err, check.ErrorMatches, "invalid manifest: line 2, column 1: version must be an integer")
+}
+
+func (s *S) TestParseManifestInvalidTypes(c *check.C) {
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{
+			"version: 2\nid: mysqlapi\nendpoints:\n  production: [a, b]\n",
+			"line 4, column 3: endpoints.production must be a string",
+		},
+		{
+			"version: 2\nid: mysqlapi\nendpoints: mysqlapi.com\n",
+			"line 3, column 1: endpoints must be a mapping",
+		},
+		{
+			"version: 2\nid: mysqlapi\nteams:\n  - admin\n  - {name: ops}\n",
+			"line 5, column 3: teams.1 must be a string",
+		},
+		{
+			"version: 2\nid: mysqlapi\nplans:\n- name: small\n- description: big\n",
+			"line 5, column 1: the name of the plan is required",
+		},
+		{
+			"version: 2\nid: mysqlapi\nplans:\n  - name: small\n    size: 1GB\n",
+			`line 5, column 5: unknown field "size"`,
+		},
+		{
+			"version: 2\nid: mysqlapi\nplans:\n  - small\n",
+			"line 4, column 3: plans.0 must be a mapping",
+		},
+		{
+			"- mysqlapi\n",
+			"line 1, column 1: the manifest must be a mapping",
+		},
+	}
+	for _, t := range tests {
+		_, err := parseManifest([]byte(t.data))
+		c.Check(err, check.ErrorMatches, "invalid manifest: "+t.err, check.Commentf(t.data))
+	}
+}
+
+func (s *S) TestParseManifestSyntaxError(c *check.C) {
+	_, err := parseManifest([]byte("id: mysqlapi\nendpoint:\n  production: mysqlapi.com\n   staging: [\n"))
+	c.Assert(err, check.FitsTypeOf, &manifestError{})
+	manifestErr := err.(*manifestError)
+	c.Assert(manifestErr.Line, check.Equals, 4)
+	c.Assert(manifestErr.Column, check.Equals, 4)
+	c.Assert(manifestErr.Message, check.Equals, "mapping values are not allowed in this context")
+}
+
+func (s *S) TestYAMLPositions(c *check.C) {
+	data := `# comment
+id: mysqlapi
+endpoints:
+  production: https://mysqlapi.com
+teams:
+- admin
+- ops
+plans:
+  - name: small
+    description: "small: 1GB"
+  -
+    name: big
+doc: doc.txt
+`
+	positions := yamlPositions([]byte(data))
+	c.Assert(positions, check.DeepEquals, map[string]yamlPosition{
+		"id":                   {line: 2, column: 1},
+		"endpoints":            {line: 3, column: 1},
+		"endpoints.production": {line: 4, column: 3},
+		"teams":                {line: 5, column: 1},
+		"teams.0":              {line: 6, column: 1},
+		"teams.1":              {line: 7, column: 1},
+		"plans":                {line: 8, column: 1},
+		"plans.0":              {line: 9, column: 3},
+		"plans.0.name":         {line: 9, column: 5},
+		"plans.0.description":  {line: 10, column: 5},
+		"plans.1":              {line: 11, column: 3},
+		"plans.1.name":         {line: 12, column: 5},
+		"doc":                  {line: 13, column: 1},
+	})
+}
@@ -0,0 +1,509 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// servicesAPISpec is the OpenAPI description of the services API, which
+// service providers implement and tsuru calls.
+const servicesAPISpec = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "tsuru services API",
+    "description": "API implemented by service providers, which tsuru calls to manage service instances and bind them to apps. Every route requires the credentials of the service, with basic authentication: the username is the username in the manifest (or the id of the service) and the password is the password in the manifest.",
+    "version": "1.0"
+  },
+  "security": [{"basicAuth": []}],
+  "paths": {
+    "/resources/plans": {
+      "get": {
+        "operationId": "listPlans",
+        "summary": "Lists the plans of the service.",
+        "responses": {
+          "200": {
+            "description": "The plans of the service.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "array",
+                  "items": {
+                    "type": "object",
+                    "required": ["name"],
+                    "properties": {
+                      "name": {"type": "string"},
+                      "description": {"type": "string"}
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "401": {"description": "Invalid credentials."},
+          "500": {"description": "Failed to list the plans."}
+        }
+      }
+    },
+    "/resources": {
+      "post": {
+        "operationId": "createInstance",
+        "summary": "Creates a service instance.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "type": "object",
+                "required": ["name"],
+                "properties": {
+                  "name": {"type": "string", "description": "Name of the instance."},
+                  "plan": {"type": "string", "description": "Name of the plan of the instance."},
+                  "team": {"type": "string", "description": "Team that owns the instance."},
+                  "user": {"type": "string", "description": "User that created the instance."}
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": {"description": "The instance was created."},
+          "400": {"description": "Invalid parameters."},
+          "401": {"description": "Invalid credentials."},
+          "409": {"description": "The instance already exists."},
+          "500": {"description": "Failed to create the instance."}
+        }
+      }
+    },
+    "/resources/{name}": {
+      "delete": {
+        "operationId": "removeInstance",
+        "summary": "Removes a service instance. Removing an instance that doesn't exist must not fail with 500.",
+        "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "The instance was removed."},
+          "401": {"description": "Invalid credentials."},
+          "404": {"description": "The instance does not exist."},
+          "500": {"description": "Failed to remove the instance."}
+        }
+      }
+    },
+    "/resources/{name}/status": {
+      "get": {
+        "operationId": "instanceStatus",
+        "summary": "Checks the status of a service instance.",
+        "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "responses": {
+          "202": {"description": "The instance is pending."},
+          "204": {"description": "The instance is ready."},
+          "401": {"description": "Invalid credentials."},
+          "404": {"description": "The instance does not exist."},
+          "500": {"description": "The instance is down."}
+        }
+      }
+    },
+    "/resources/{name}/bind-app": {
+      "post": {
+        "operationId": "bindApp",
+        "summary": "Binds a service instance to an app.",
+        "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "type": "object",
+                "required": ["app-host"],
+                "properties": {
+                  "app-host": {"type": "string", "description": "Address of the app."},
+                  "app-name": {"type": "string", "description": "Name of the app."}
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "201": {
+            "description": "The instance was bound to the app. The response holds the environment variables to set in the app.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "additionalProperties": {"type": "string"}
+                }
+              }
+            }
+          },
+          "401": {"description": "Invalid credentials."},
+          "404": {"description": "The instance does not exist."},
+          "412": {"description": "The instance is not ready."},
+          "500": {"description": "Failed to bind the instance."}
+        }
+      },
+      "delete": {
+        "operationId": "unbindApp",
+        "summary": "Unbinds a service instance from an app.",
+        "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "type": "object",
+                "required": ["app-host"],
+                "properties": {
+                  "app-host": {"type": "string", "description": "Address of the app."},
+                  "app-name": {"type": "string", "description": "Name of the app."}
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {"description": "The instance was unbound from the app."},
+          "401": {"description": "Invalid credentials."},
+          "404": {"description": "The instance does not exist."},
+          "500": {"description": "Failed to unbind the instance."}
+        }
+      }
+    },
+    "/resources/{name}/bind": {
+      "post": {
+        "operationId": "bindUnit",
+        "summary": "Binds a service instance to a unit of an app.",
+        "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "type": "object",
+                "required": ["app-host", "unit-host"],
+                "properties": {
+                  "app-host": {"type": "string", "description": "Address of the app."},
+                  "unit-host": {"type": "string", "description": "Address of the unit."}
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {"description": "The instance was bound to the unit."},
+          "201": {"description": "The instance was bound to the unit."},
+          "401": {"description": "Invalid credentials."},
+          "404": {"description": "The instance does not exist."},
+          "412": {"description": "The instance is not ready."},
+          "500": {"description": "Failed to bind the instance."}
+        }
+      },
+      "delete": {
+        "operationId": "unbindUnit",
+        "summary": "Unbinds a service instance from a unit of an app.",
+        "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "type": "object",
+                "required": ["app-host", "unit-host"],
+                "properties": {
+                  "app-host": {"type": "string", "description": "Address of the app."},
+                  "unit-host": {"type": "string", "description": "Address of the unit."}
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {"description": "The instance was unbound from the unit."},
+          "401": {"description": "Invalid credentials."},
+          "404": {"description": "The instance does not exist."},
+          "500": {"description": "Failed to unbind the instance."}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "basicAuth": {"type": "http", "scheme": "basic"}
+    }
+  }
+}
+`
+
+// specDocument is the subset of an OpenAPI document used for validating
+// exchanges with a service API.
+type specDocument struct {
+	Paths map[string]map[string]*specOperation `json:"paths"`
+}
+
+type specOperation struct {
+	RequestBody *specBody                `json:"requestBody"`
+	Responses   map[string]*specResponse `json:"responses"`
+}
+
+type specBody struct {
+	Content map[string]*specMedia `json:"content"`
+}
+
+type specResponse struct {
+	Content map[string]*specMedia `json:"content"`
+}
+
+type specMedia struct {
+	Schema *specSchema `json:"schema"`
+}
+
+type specSchema struct {
+	Type                 string                 `json:"type"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*specSchema `json:"properties"`
+	Items                *specSchema            `json:"items"`
+	AdditionalProperties *specSchema            `json:"additionalProperties"`
+}
+
+// validate checks a decoded JSON value against the schema, returning the
+// problems found. The path locates the value in the document, like
+// "$[0].name".
+func (s *specSchema) validate(path string, v interface{}) []string {
+	if s == nil {
+		return nil
+	}
+	if got := jsonType(v); s.Type != "" && got != s.Type && !(s.Type == "number" && got == "integer") {
+		return []string{fmt.Sprintf("%s: expected %s, got %s", path, s.Type, got)}
+	}
+	var problems []string
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := value[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: the property %q is required", path, name))
+			}
+		}
+		var names []string
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			schema := s.Properties[name]
+			if schema == nil {
+				schema = s.AdditionalProperties
+			}
+			problems = append(problems, schema.validate(path+"."+name, value[name])...)
+		}
+	case []interface{}:
+		for i, item := range value {
+			problems = append(problems, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+		}
+	}
+	return problems
+}
+
+func jsonType(v interface{}) string {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == float64(int64(value)) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "null"
+}
+
+// specRoute is an operation of the spec, with its method and the segments of
+// its path.
+type specRoute struct {
+	method    string
+	template  string
+	segments  []string
+	operation *specOperation
+}
+
+func (r *specRoute) matches(method string, segments []string) bool {
+	if r.method != method || len(r.segments) != len(segments) {
+		return false
+	}
+	for i, s := range r.segments {
+		if !strings.HasPrefix(s, "{") && s != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// specValidator validates exchanges with a service API against an OpenAPI
+// document.
+type specValidator struct {
+	routes []specRoute
+}
+
+func newSpecValidator(spec string) (*specValidator, error) {
+	var doc specDocument
+	if err := json.Unmarshal([]byte(spec), &doc); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %s", err)
+	}
+	var v specValidator
+	for path, operations := range doc.Paths {
+		for method, op := range operations {
+			v.routes = append(v.routes, specRoute{
+				method:    strings.ToUpper(method),
+				template:  path,
+				segments:  strings.Split(strings.Trim(path, "/"), "/"),
+				operation: op,
+			})
+		}
+	}
+	return &v, nil
+}
+
+// servicesAPIValidator validates exchanges against the services API spec.
+var servicesAPIValidator = func() *specValidator {
+	v, err := newSpecValidator(servicesAPISpec)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}()
+
+// route returns the route of the spec matching the request, or nil.
+func (v *specValidator) route(method, path string) *specRoute {
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	var found *specRoute
+	for i := range v.routes {
+		r := &v.routes[i]
+		if !r.matches(method, segments) {
+			continue
+		}
+		// Literal segments win over parameters, so GET /resources/plans is
+		// not taken as an instance.
+		if found == nil || strings.Count(r.template, "{") < strings.Count(found.template, "{") {
+			found = r
+		}
+	}
+	return found
+}
+
+// validate checks a request sent to the service API and its response,
+// returning a *specError with the problems found, or nil if the exchange
+// conforms to the spec.
+func (v *specValidator) validate(method, path string, header http.Header, body []byte, status int, response []byte) *specError {
+	route := v.route(method, path)
+	if route == nil {
+		if i := strings.Index(path, "?"); i >= 0 {
+			path = path[:i]
+		}
+		return &specError{route: method + " " + path, problems: []string{"the route is not part of the services API"}}
+	}
+	var problems []string
+	if rb := route.operation.RequestBody; rb != nil {
+		if media := rb.Content["application/x-www-form-urlencoded"]; media != nil && media.Schema != nil {
+			if ct := header.Get("Content-Type"); !strings.HasPrefix(ct, "application/x-www-form-urlencoded") {
+				problems = append(problems, fmt.Sprintf("request: the content type must be application/x-www-form-urlencoded, got %q", ct))
+			}
+			form, err := url.ParseQuery(string(body))
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("request: invalid form: %s", err))
+			}
+			for _, name := range media.Schema.Required {
+				if form.Get(name) == "" {
+					problems = append(problems, fmt.Sprintf("request: the field %q is required", name))
+				}
+			}
+		}
+	}
+	if resp, ok := route.operation.Responses[strconv.Itoa(status)]; !ok {
+		var codes []string
+		for code := range route.operation.Responses {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		problems = append(problems, fmt.Sprintf("response: the status %d is not documented (documented: %s)", status, strings.Join(codes, ", ")))
+	} else if media := resp.Content["application/json"]; media != nil && media.Schema != nil {
+		var value interface{}
+		if err := json.Unmarshal(response, &value); err != nil {
+			problems = append(problems, fmt.Sprintf("response: invalid JSON: %s", err))
+		} else {
+			for _, p := range media.Schema.validate("$", value) {
+				problems = append(problems, "response: "+p)
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return &specError{route: route.method + " " + route.template, problems: problems}
+}
+
+// specError describes how an exchange with a service API doesn't conform to
+// the services API spec. The route is the one in the spec, like
+// "POST /resources/{name}/bind-app".
+type specError struct {
+	route    string
+	problems []string
+}
+
+func (e *specError) Error() string {
+	return fmt.Sprintf("%s doesn't conform to the services API: %s", e.route, strings.Join(e.problems, "; "))
+}
+
+type apiSpec struct {
+	fs     *gnuflag.FlagSet
+	output string
+}
+
+func (c *apiSpec) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "api-spec",
+		Usage: "api-spec [-o/--output <file>]",
+		Desc: `Displays the OpenAPI document of the services API.
+
+The services API is the API implemented by service providers, which tsuru calls
+to manage service instances and bind them to apps. Commands that talk to a
+service API, like "api-check", validate every request and response against this
+document when the --strict flag is given.`,
+		MinArgs: 0,
+		MaxArgs: 0,
+	}
+}
+
+func (c *apiSpec) Run(context *cmd.Context, client *cmd.Client) error {
+	if c.output != "" {
+		return ioutil.WriteFile(c.output, []byte(servicesAPISpec), 0644)
+	}
+	_, err := context.Stdout.Write([]byte(servicesAPISpec))
+	return err
+}
+
+func (c *apiSpec) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("api-spec", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.output, "output", "", "File to save the document to")
+		c.fs.StringVar(&c.output, "o", "", "File to save the document to")
+	}
+	return c.fs
+}
@@ -0,0 +1,187 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+var formHeader = http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+
+func (s *S) TestServicesAPISpec(c *check.C) {
+	var doc struct {
+		OpenAPI string                                       `json:"openapi"`
+		Paths   map[string]map[string]map[string]interface{} `json:"paths"`
+	}
+	err := json.Unmarshal([]byte(servicesAPISpec), &doc)
+	c.Assert(err, check.IsNil)
+	c.Assert(doc.OpenAPI, check.Equals, "3.0.0")
+	var routes []string
+	for _, route := range faultRoutes {
+		routes = append(routes, route)
+	}
+	c.Assert(routes, check.HasLen, 8)
+	for _, route := range routes {
+		parts := strings.SplitN(route, " ", 2)
+		_, ok := doc.Paths[parts[1]][strings.ToLower(parts[0])]
+		c.Check(ok, check.Equals, true, check.Commentf(route))
+	}
+	c.Assert(servicesAPIValidator.routes, check.HasLen, len(routes))
+}
+
+func (s *S) TestSpecValidatorRoute(c *check.C) {
+	v := servicesAPIValidator
+	c.Assert(v.route("GET", "/resources/plans").template, check.Equals, "/resources/plans")
+	c.Assert(v.route("GET", "/resources/mydb/status?x=1").template, check.Equals, "/resources/{name}/status")
+	c.Assert(v.route("DELETE", "/resources/mydb").template, check.Equals, "/resources/{name}")
+	c.Assert(v.route("POST", "/resources/mydb/bind").template, check.Equals, "/resources/{name}/bind")
+	c.Assert(v.route("PUT", "/resources/mydb"), check.IsNil)
+	c.Assert(v.route("GET", "/apps"), check.IsNil)
+}
+
+func (s *S) TestSpecValidatorValidate(c *check.C) {
+	v := servicesAPIValidator
+	var tests = []struct {
+		method   string
+		path     string
+		header   http.Header
+		body     string
+		status   int
+		response string
+		err      string
+	}{
+		{"GET", "/resources/plans", nil, "", 200, `[{"name": "small", "description": "1GB"}]`, ""},
+		{"GET", "/resources/plans", nil, "", 401, "unauthorized", ""},
+		{"GET", "/resources/plans", nil, "", 200, `{"name": "small"}`,
+			`GET /resources/plans doesn't conform to the services API: response: \$: expected array, got object`},
+		{"GET", "/resources/plans", nil, "", 200, `[{"name": "small"}, {"description": 1}]`,
+			`GET /resources/plans doesn't conform to the services API: response: \$\[1\]: the property "name" is required; response: \$\[1\].description: expected string, got integer`},
+		{"GET", "/resources/plans", nil, "", 200, `[{"name": "small"`,
+			"GET /resources/plans doesn't conform to the services API: response: invalid JSON: .*"},
+		{"POST", "/resources", formHeader, "name=mydb&plan=small", 201, "", ""},
+		{"POST", "/resources", formHeader, "plan=small", 201, "",
+			`POST /resources doesn't conform to the services API: request: the field "name" is required`},
+		{"POST", "/resources", nil, "name=mydb", 201, "",
+			`POST /resources doesn't conform to the services API: request: the content type must be application/x-www-form-urlencoded, got ""`},
+		{"POST", "/resources", formHeader, "name=mydb", 200, "",
+			`POST /resources doesn't conform to the services API: response: the status 200 is not documented \(documented: 201, 400, 401, 409, 500\)`},
+		{"POST", "/resources/mydb/bind-app", formHeader, "app-host=myapp.example.com", 201, `{"MYSQL_HOST": "10.0.0.2"}`, ""},
+		{"POST", "/resources/mydb/bind-app", formHeader, "app-host=myapp.example.com", 201, `{"MYSQL_HOST": "10.0.0.2", "MYSQL_PORT": 3306}`,
+			`POST /resources/{name}/bind-app doesn't conform to the services API: response: \$.MYSQL_PORT: expected string, got integer`},
+		{"POST", "/resources/mydb/bind-app", formHeader, "app-host=myapp.example.com", 412, "not ready", ""},
+		{"POST", "/resources/mydb/bind", formHeader, "app-host=myapp.example.com&unit-host=10.0.0.1", 200, "", ""},
+		{"DELETE", "/resources/mydb/bind", formHeader, "app-host=myapp.example.com", 200, "",
+			`DELETE /resources/{name}/bind doesn't conform to the services API: request: the field "unit-host" is required`},
+		{"GET", "/resources/mydb/status", nil, "", 204, "", ""},
+		{"GET", "/resources/mydb/status", nil, "", 200, "",
+			`GET /resources/{name}/status doesn't conform to the services API: response: the status 200 is not documented \(documented: 202, 204, 401, 404, 500\)`},
+		{"PUT", "/resources/mydb?x=1", nil, "", 200, "",
+			"PUT /resources/mydb doesn't conform to the services API: the route is not part of the services API"},
+	}
+	for i, t := range tests {
+		err := v.validate(t.method, t.path, t.header, []byte(t.body), t.status, []byte(t.response))
+		if t.err == "" {
+			c.Check(err, check.IsNil, check.Commentf("test #%d", i))
+		} else {
+			c.Check(err, check.ErrorMatches, t.err, check.Commentf("test #%d", i))
+		}
+	}
+}
+
+func (s *S) TestNewSpecValidatorInvalidDocument(c *check.C) {
+	_, err := newSpecValidator("{")
+	c.Assert(err, check.ErrorMatches, "invalid OpenAPI document: .*")
+}
+
+// newNonConformingServiceAPI returns a fake service API that returns a number
+// in the environment variables when binding an app.
+func newNonConformingServiceAPI() (*fakeServiceAPI, *httptest.Server) {
+	fake := newFakeServiceAPI()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/bind-app") {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"MYSQL_HOST": "10.0.0.2", "MYSQL_PORT": 3306}`))
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	return fake, server
+}
+
+func (s *S) TestServiceAPIStrict(c *check.C) {
+	fake, server := newNonConformingServiceAPI()
+	defer fake.stop()
+	defer server.Close()
+	api := newServiceAPI(server.URL, fake.manifest())
+	resp, err := api.createInstance("mydb", "small", "admin")
+	c.Assert(err, check.IsNil)
+	resp, err = api.bindApp("mydb", "myapp", "myapp.example.com")
+	c.Assert(err, check.IsNil)
+	api.validator = servicesAPIValidator
+	resp, err = api.createInstance("otherdb", "small", "admin")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.status, check.Equals, http.StatusCreated)
+	resp, err = api.bindApp("mydb", "myapp", "myapp.example.com")
+	c.Assert(err, check.FitsTypeOf, &specError{})
+	c.Assert(err, check.ErrorMatches, `POST /resources/{name}/bind-app doesn't conform to the services API: response: \$.MYSQL_PORT: expected string, got integer`)
+	c.Assert(resp.status, check.Equals, http.StatusCreated)
+}
+
+func (s *S) TestAPICheckRunStrict(c *check.C) {
+	fake, server := newNonConformingServiceAPI()
+	defer fake.stop()
+	defer server.Close()
+	path := filepath.Join(c.MkDir(), "manifest.yaml")
+	err := ioutil.WriteFile(path, []byte("id: mysqlapi\npassword: s3cr3t\nendpoint:\n  production: "+server.URL+"\n"), 0600)
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"production"}, Stdout: &stdout}
+	command := apiCheck{}
+	command.Flags().Parse(true, []string{"-m", path, "--strict"})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `1 check\(s\) failed`)
+	c.Assert(stdout.String(), check.Matches, `(?s).*\| bind app +\| failed +\| POST /resources/{name}/bind-app doesn't conform to the services API: response: \$.MYSQL_PORT: expected string, got integer +\|.*`)
+}
+
+func (s *S) TestAPICheckRunStrictConformingAPI(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	path := filepath.Join(c.MkDir(), "manifest.yaml")
+	err := ioutil.WriteFile(path, []byte("id: mysqlapi\npassword: s3cr3t\nendpoint:\n  production: "+fake.server.URL+"\n"), 0600)
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"production"}, Stdout: &stdout}
+	command := apiCheck{}
+	command.Flags().Parse(true, []string{"-m", path, "--strict"})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*11 passed, 0 failed, 0 skipped.\n$`)
+}
+
+func (s *S) TestAPISpecRun(c *check.C) {
+	var stdout bytes.Buffer
+	err := (&apiSpec{}).Run(&cmd.Context{Stdout: &stdout}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, servicesAPISpec)
+	path := filepath.Join(c.MkDir(), "openapi.json")
+	command := apiSpec{}
+	command.Flags().Parse(true, []string{"-o", path})
+	stdout.Reset()
+	err = command.Run(&cmd.Context{Stdout: &stdout}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "")
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, servicesAPISpec)
+}
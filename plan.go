@@ -0,0 +1,216 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+const planVersion = 1
+
+// changePlan is the set of changes needed to make a service on a target match
+// a manifest. It can be saved to a file, reviewed and executed later.
+type changePlan struct {
+	Version int    `json:"version"`
+	Target  string `json:"target"`
+	Service string `json:"service"`
+
+	// Create is true when the service does not exist in the target.
+	Create bool `json:"create"`
+
+	// Fingerprint identifies the state of the service in the target when
+	// the plan was made.
+	Fingerprint string `json:"fingerprint"`
+
+	Changes []change      `json:"changes"`
+	Desired *serviceState `json:"desired"`
+}
+
+// makePlan compares the manifest with the current state of the service in
+// the target, returning the plan for making them match.
+func makePlan(client *cmd.Client, m *manifest) (*changePlan, error) {
+	desired, err := manifestState(m)
+	if err != nil {
+		return nil, err
+	}
+	current, err := fetchServiceState(client, m.ID)
+	if err != nil {
+		return nil, err
+	}
+	target, err := cmd.GetTarget()
+	if err != nil {
+		return nil, err
+	}
+	p := changePlan{
+		Version:     planVersion,
+		Target:      target,
+		Service:     m.ID,
+		Fingerprint: current.fingerprint(),
+		Desired:     desired,
+	}
+	if current == nil {
+		p.Create = true
+	} else {
+		p.Changes = diffState(desired, current)
+	}
+	return &p, nil
+}
+
+// upToDate reports whether executing the plan would change nothing.
+func (p *changePlan) upToDate() bool {
+	if p.Create {
+		return false
+	}
+	for _, c := range p.Changes {
+		if !c.ReadOnly {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *changePlan) write(w io.Writer) {
+	if p.Create {
+		fmt.Fprintf(w, "Service %q will be created.\n", p.Service)
+		return
+	}
+	for _, c := range p.Changes {
+		fmt.Fprintln(w, c)
+	}
+	if p.upToDate() {
+		fmt.Fprintf(w, "Service %q is up to date.\n", p.Service)
+	}
+}
+
+// execute applies the plan to the target. It refuses to do anything if the
+// target or the state of the service changed since the plan was made. Plans
+// never include the password of the service: it's given when executing, and
+// an empty password keeps the current one.
+func (p *changePlan) execute(client *cmd.Client, password string) error {
+	target, err := cmd.GetTarget()
+	if err != nil {
+		return err
+	}
+	if target != p.Target {
+		return fmt.Errorf("the plan was made for the target %s, but the current target is %s", p.Target, target)
+	}
+	current, err := fetchServiceState(client, p.Service)
+	if err != nil {
+		return err
+	}
+	if current.fingerprint() != p.Fingerprint {
+		return fmt.Errorf("the service %q has changed since the plan was made, please make a new plan", p.Service)
+	}
+	if p.Create {
+		err = createService(client, p.Desired, password)
+		if err == nil && p.Desired.Doc != "" {
+			err = updateServiceDoc(client, p.Service, p.Desired.Doc)
+		}
+		return err
+	}
+	if password != "" || hasChanges(p.Changes, "username") || hasChanges(p.Changes, "description") ||
+		hasChanges(p.Changes, "endpoint") || hasChanges(p.Changes, "team") {
+		err = updateService(client, p.Desired, password)
+		if err != nil {
+			return err
+		}
+	}
+	if hasChanges(p.Changes, "doc") {
+		return updateServiceDoc(client, p.Service, p.Desired.Doc)
+	}
+	return nil
+}
+
+func readPlan(path string) (*changePlan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p changePlan
+	err = json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid plan file: %s", err)
+	}
+	if p.Version != planVersion {
+		return nil, fmt.Errorf("unsupported plan version: %d", p.Version)
+	}
+	if p.Service == "" || p.Desired == nil {
+		return nil, errors.New("invalid plan file: missing service definition")
+	}
+	return &p, nil
+}
+
+func writePlan(path string, p *changePlan) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0600)
+}
+
+type servicePlan struct {
+	fs     *gnuflag.FlagSet
+	output string
+	env    string
+}
+
+func (c *servicePlan) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "plan",
+		Usage: "plan <manifest-file.yaml> [-o/--output <plan-file.json>] [-e/--env <environment>]",
+		Desc: `Displays the changes needed to make a service match the given manifest file.
+
+The differences in endpoints, teams, documentation and plans between the
+manifest and the service in the target are displayed. Differences in plans are
+only reported, as plans are defined by the service API.
+
+When an output file is given, the plan is saved to it, and can be executed
+later with "apply <plan-file.json>".
+
+When an environment is given, the overlay file of the environment, like
+"manifest.prod.yml" for "manifest.yml" and the environment "prod", is merged
+over the manifest.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *servicePlan) Run(context *cmd.Context, client *cmd.Client) error {
+	m, err := loadManifest(context.Args[0], c.env, true)
+	if err != nil {
+		return err
+	}
+	p, err := makePlan(client, m)
+	if err != nil {
+		return err
+	}
+	p.write(context.Stdout)
+	if c.output != "" {
+		err = writePlan(c.output, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(context.Stdout, "Plan saved to %s.\n", c.output)
+	}
+	return nil
+}
+
+func (c *servicePlan) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("plan", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.output, "output", "", "File to save the plan to")
+		c.fs.StringVar(&c.output, "o", "", "File to save the plan to")
+		c.fs.StringVar(&c.env, "env", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.StringVar(&c.env, "e", "", "Environment whose overlay file is merged over the manifest")
+	}
+	return c.fs
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestServicePlanRun(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	target.services["mysqlapi"] = &service{
+		Name:       "mysqlapi",
+		Endpoint:   map[string]string{"production": "old.mysqlapi.com"},
+		OwnerTeams: []string{"ops"},
+	}
+	target.plans["mysqlapi"] = []plan{{Name: "small"}, {Name: "big"}}
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"testdata/manifest-full.yml"}, Stdout: &stdout}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	err := (&servicePlan{}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := `~ endpoint.production: old.mysqlapi.com => mysqlapi.com
+- team: ops
+\+ team: admin
+\+ doc: 11 lines, sha256 [0-9a-f]{12}
+- plan: big \(read-only, managed by the service API\)
+`
+	c.Assert(stdout.String(), check.Matches, expected)
+	for _, r := range target.requests {
+		c.Assert(r, check.Matches, "GET .*")
+	}
+}
+
+func (s *S) TestServicePlanRunSavesPlan(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	planFile := filepath.Join(c.MkDir(), "plan.json")
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"testdata/manifest.yml"}, Stdout: &stdout}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	command := servicePlan{}
+	err := command.Flags().Parse(true, []string{"-o", planFile})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Service \"mysqlapi\" will be created.\nPlan saved to "+planFile+".\n")
+	p, err := readPlan(planFile)
+	c.Assert(err, check.IsNil)
+	c.Assert(p.Create, check.Equals, true)
+	c.Assert(p.Service, check.Equals, "mysqlapi")
+	c.Assert(p.Target, check.Equals, target.server.URL)
+	c.Assert(p.Desired.Endpoint, check.DeepEquals, map[string]string{"production": "mysqlapi.com"})
+}
+
+func (s *S) TestServicePlanFlags(c *check.C) {
+	command := servicePlan{}
+	flagset := command.Flags()
+	flagset.Parse(true, []string{"--output", "plan.json"})
+	c.Assert(command.output, check.Equals, "plan.json")
+	c.Assert(flagset.Lookup("o"), check.NotNil)
+}
+
+func (s *S) TestChangePlanExecuteWrongTarget(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	p := &changePlan{Version: planVersion, Target: "http://tsuru.example.com", Service: "mysqlapi"}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	err := p.execute(client, "")
+	c.Assert(err, check.ErrorMatches, "the plan was made for the target http://tsuru.example.com, but the current target is .*")
+}
+
+func (s *S) TestReadPlanInvalid(c *check.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "plan.json")
+	err := ioutil.WriteFile(path, []byte("not json"), 0600)
+	c.Assert(err, check.IsNil)
+	_, err = readPlan(path)
+	c.Assert(err, check.ErrorMatches, "invalid plan file: .*")
+	err = ioutil.WriteFile(path, []byte(`{"version":42}`), 0600)
+	c.Assert(err, check.IsNil)
+	_, err = readPlan(path)
+	c.Assert(err, check.ErrorMatches, "unsupported plan version: 42")
+	_, err = readPlan(filepath.Join(dir, "unknown.json"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
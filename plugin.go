@@ -0,0 +1,191 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// pluginPrefix is the prefix of the names of the executables of plugins: the
+// plugin "foo" is the executable "crane-foo".
+const pluginPrefix = "crane-"
+
+// pluginsDir returns the directory of the plugins installed for the user.
+func pluginsDir() string {
+	return cmd.JoinWithUserDir(".crane", "plugins")
+}
+
+// pluginDirs returns the directories plugins are searched in, in order of
+// precedence: the plugins directory of the user and the directories in PATH.
+func pluginDirs() []string {
+	return append([]string{pluginsDir()}, filepath.SplitList(os.Getenv("PATH"))...)
+}
+
+// findPlugins returns the paths of the plugins in the directories, by their
+// names. When a plugin is in more than one directory, the first one wins.
+func findPlugins(dirs []string) map[string]string {
+	plugins := map[string]string{}
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			name := strings.TrimPrefix(f.Name(), pluginPrefix)
+			if name == f.Name() || name == "" {
+				continue
+			}
+			if _, ok := plugins[name]; ok {
+				continue
+			}
+			path := filepath.Join(dir, f.Name())
+			// The entry may be a symbolic link to the executable.
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+				continue
+			}
+			plugins[name] = path
+		}
+	}
+	return plugins
+}
+
+// pluginEnv returns the environment of plugins: the environment of crane,
+// with the target, the token and the verbosity of crane.
+func pluginEnv(name string, verbosity int) []string {
+	env := os.Environ()
+	if target, err := cmd.GetTarget(); err == nil {
+		env = append(env, "TSURU_TARGET="+target)
+	}
+	if token, err := cmd.ReadToken(); err == nil && token != "" {
+		env = append(env, "TSURU_TOKEN="+strings.TrimSpace(token))
+	}
+	return append(env, "CRANE_PLUGIN_NAME="+name, "CRANE_VERBOSITY="+strconv.Itoa(verbosity))
+}
+
+// globalVerbosity returns the verbosity given to crane in its global flags,
+// before the name of the command.
+func globalVerbosity(args []string) int {
+	var verbosity int
+	var ignored bool
+	fs := gnuflag.NewFlagSet("crane", gnuflag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.IntVar(&verbosity, "verbosity", 0, "")
+	fs.IntVar(&verbosity, "v", 0, "")
+	fs.BoolVar(&ignored, "help", false, "")
+	fs.BoolVar(&ignored, "h", false, "")
+	fs.BoolVar(&ignored, "version", false, "")
+	fs.Parse(false, args)
+	return verbosity
+}
+
+// pluginCommand is a command implemented by a plugin. Plugins are registered
+// as commands so they're listed by "crane help", but they're run by
+// commandLookup, which passes all the arguments through to the plugin.
+type pluginCommand struct {
+	name string
+	path string
+}
+
+func (c *pluginCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  c.name,
+		Usage: c.name + " [args...]",
+		Desc: fmt.Sprintf(`External plugin command, run from %s
+
+The arguments are passed through to the plugin. The target and the token of
+crane are passed through the TSURU_TARGET and TSURU_TOKEN environment
+variables, and the verbosity through CRANE_VERBOSITY.`, c.path),
+	}
+}
+
+func (c *pluginCommand) Run(context *cmd.Context, client *cmd.Client) error {
+	return runPlugin(context, c.name, c.path, client.Verbosity)
+}
+
+// runPlugin runs the plugin with the arguments in the context. Plugins report
+// their own errors, so their failures are not reported again.
+func runPlugin(context *cmd.Context, name, path string, verbosity int) error {
+	// Plugins may be interactive, so they don't write to the pager.
+	context.RawOutput()
+	command := exec.Command(path, context.Args...)
+	command.Stdin = context.Stdin
+	command.Stdout = context.Stdout
+	command.Stderr = context.Stderr
+	command.Env = pluginEnv(name, verbosity)
+	err := command.Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		return cmd.ErrAbortCommand
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run the plugin %q: %s", name, err)
+	}
+	return nil
+}
+
+// commandLookup is the lookup of the manager, called before the built-in
+// commands are looked up, which runs the aliases, the plugins and the hidden
+// __complete command of the completion scripts.
+type commandLookup struct {
+	manager *cmd.Manager
+
+	// args are the arguments of crane, including the global flags. They
+	// default to the arguments of the process.
+	args []string
+}
+
+func (l *commandLookup) lookup(context *cmd.Context) error {
+	if len(context.Args) == 0 {
+		return cmd.ErrLookup
+	}
+	args := l.args
+	if args == nil && len(os.Args) > 1 {
+		args = os.Args[1:]
+	}
+	var err error
+	if context.Args[0] == completeCommandName {
+		context.Args = context.Args[1:]
+		err = runComplete(l.manager, context, time.Now())
+	} else {
+		switch c := l.manager.Commands[context.Args[0]].(type) {
+		case *pluginCommand:
+			context.Args = context.Args[1:]
+			err = runPlugin(context, c.name, c.path, globalVerbosity(args))
+		case *aliasCommand:
+			err = l.runAlias(context, c, context.Args[1:], globalVerbosity(args), nil)
+		default:
+			return cmd.ErrLookup
+		}
+	}
+	if err != nil && err != cmd.ErrAbortCommand {
+		// The manager writes the errors of lookups as they are.
+		fmt.Fprintf(context.Stderr, "Error: %s\n", strings.TrimSuffix(err.Error(), "\n"))
+		return cmd.ErrAbortCommand
+	}
+	return err
+}
+
+// registerPlugins registers the plugins found in the directories as commands
+// of the manager. Built-in commands take precedence over plugins.
+func registerPlugins(m *cmd.Manager, dirs []string) {
+	for name, path := range findPlugins(dirs) {
+		if _, ok := m.Commands[name]; !ok {
+			m.Register(&pluginCommand{name: name, path: path})
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+const pluginScript = `#!/bin/sh
+echo "args: $*"
+echo "name: $CRANE_PLUGIN_NAME"
+echo "target: $TSURU_TARGET"
+echo "token: $TSURU_TOKEN"
+echo "verbosity: $CRANE_VERBOSITY"
+`
+
+func writePlugin(c *check.C, dir, name, script string, mode os.FileMode) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(script), mode)
+	c.Assert(err, check.IsNil)
+	return path
+}
+
+func (s *S) TestFindPlugins(c *check.C) {
+	first, second := c.MkDir(), c.MkDir()
+	deploy := writePlugin(c, first, "crane-deploy", pluginScript, 0755)
+	writePlugin(c, second, "crane-deploy", pluginScript, 0755)
+	backup := writePlugin(c, second, "crane-backup", pluginScript, 0755)
+	writePlugin(c, second, "crane-notes", "notes", 0644)
+	writePlugin(c, second, "tsuru-deploy", pluginScript, 0755)
+	writePlugin(c, second, "crane-", pluginScript, 0755)
+	err := os.Mkdir(filepath.Join(second, "crane-dir"), 0755)
+	c.Assert(err, check.IsNil)
+	err = os.Symlink(backup, filepath.Join(first, "crane-restore"))
+	c.Assert(err, check.IsNil)
+	plugins := findPlugins([]string{"", filepath.Join(first, "missing"), first, second})
+	c.Assert(plugins, check.DeepEquals, map[string]string{
+		"deploy":  deploy,
+		"backup":  backup,
+		"restore": filepath.Join(first, "crane-restore"),
+	})
+}
+
+func (s *S) TestPluginDirs(c *check.C) {
+	home, path := os.Getenv("HOME"), os.Getenv("PATH")
+	defer os.Setenv("HOME", home)
+	defer os.Setenv("PATH", path)
+	os.Setenv("HOME", "/home/gopher")
+	os.Setenv("PATH", "/usr/local/bin"+string(filepath.ListSeparator)+"/usr/bin")
+	c.Assert(pluginDirs(), check.DeepEquals, []string{"/home/gopher/.crane/plugins", "/usr/local/bin", "/usr/bin"})
+}
+
+func (s *S) TestGlobalVerbosity(c *check.C) {
+	c.Assert(globalVerbosity([]string{"deploy", "-v", "2"}), check.Equals, 0)
+	c.Assert(globalVerbosity([]string{"-v", "2", "deploy"}), check.Equals, 2)
+	c.Assert(globalVerbosity([]string{"--verbosity", "1", "deploy", "--force"}), check.Equals, 1)
+	c.Assert(globalVerbosity([]string{"--unknown", "deploy"}), check.Equals, 0)
+}
+
+func (s *S) TestRegisterPlugins(c *check.C) {
+	dir := c.MkDir()
+	deploy := writePlugin(c, dir, "crane-deploy", pluginScript, 0755)
+	writePlugin(c, dir, "crane-instance-list", pluginScript, 0755)
+	writePlugin(c, dir, "crane-create", pluginScript, 0755)
+	m := buildManager("crane", "", []string{dir})
+	c.Assert(m.Commands["deploy"], check.DeepEquals, &pluginCommand{name: "deploy", path: deploy})
+	c.Assert(m.Commands["instance-list"], check.FitsTypeOf, &instanceList{})
+	c.Assert(m.Commands["create"], check.FitsTypeOf, &cmd.RemovedCommand{})
+}
+
+func (s *S) TestPluginsAreListedInHelp(c *check.C) {
+	dir := c.MkDir()
+	writePlugin(c, dir, "crane-deploy", pluginScript, 0755)
+	m := cmd.NewManager("crane", version, header, ioutil.Discard, ioutil.Discard, os.Stdin, nil)
+	m.Register(&instanceList{})
+	registerPlugins(m, []string{dir})
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	err := m.Commands["help"].Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*  deploy +External plugin command, run from `+dir+`/crane-deploy\n.*`)
+	c.Assert(stdout.String(), check.Matches, `(?s).*  instance-list +Lists the service instances you can read, one per line, with their plans, teams\n.*`)
+}
+
+func (s *S) TestPluginLookup(c *check.C) {
+	os.Setenv("TSURU_TOKEN", "secret")
+	defer os.Unsetenv("TSURU_TOKEN")
+	dir := c.MkDir()
+	writePlugin(c, dir, "crane-deploy", pluginScript, 0755)
+	var stdout, stderr bytes.Buffer
+	plugins := &commandLookup{args: []string{"-v", "1", "deploy", "--force", "myapp"}}
+	m := cmd.NewManager("crane", version, header, &stdout, &stderr, os.Stdin, plugins.lookup)
+	plugins.manager = m
+	registerPlugins(m, []string{dir})
+	m.Run(plugins.args)
+	c.Assert(stderr.String(), check.Equals, "")
+	c.Assert(stdout.String(), check.Equals, `args: --force myapp
+name: deploy
+target: http://localhost:8080
+token: secret
+verbosity: 1
+`)
+}
+
+func (s *S) TestPluginLookupBuiltinCommand(c *check.C) {
+	m := buildManager("crane", "", nil)
+	plugins := &commandLookup{manager: m}
+	context := cmd.Context{Args: []string{"instance-list"}}
+	c.Assert(plugins.lookup(&context), check.Equals, cmd.ErrLookup)
+	context = cmd.Context{Args: []string{"not-a-command"}}
+	c.Assert(plugins.lookup(&context), check.Equals, cmd.ErrLookup)
+	context = cmd.Context{}
+	c.Assert(plugins.lookup(&context), check.Equals, cmd.ErrLookup)
+}
+
+func (s *S) TestPluginLookupFailure(c *check.C) {
+	dir := c.MkDir()
+	writePlugin(c, dir, "crane-fail", "#!/bin/sh\necho failed >&2\nexit 3\n", 0755)
+	m := cmd.NewManager("crane", version, header, ioutil.Discard, ioutil.Discard, os.Stdin, nil)
+	registerPlugins(m, []string{dir})
+	plugins := &commandLookup{manager: m, args: []string{"fail"}}
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{Args: []string{"fail"}, Stdout: &stdout, Stderr: &stderr}
+	err := plugins.lookup(&context)
+	c.Assert(err, check.Equals, cmd.ErrAbortCommand)
+	c.Assert(stderr.String(), check.Equals, "failed\n")
+}
+
+func (s *S) TestPluginLookupCantStart(c *check.C) {
+	dir := c.MkDir()
+	path := writePlugin(c, dir, "crane-broken", pluginScript, 0755)
+	m := cmd.NewManager("crane", version, header, ioutil.Discard, ioutil.Discard, os.Stdin, nil)
+	registerPlugins(m, []string{dir})
+	err := os.Remove(path)
+	c.Assert(err, check.IsNil)
+	plugins := &commandLookup{manager: m, args: []string{"broken"}}
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"broken"}, Stdout: &stdout, Stderr: &stdout}
+	err = plugins.lookup(&context)
+	c.Assert(err, check.Equals, cmd.ErrAbortCommand)
+	c.Assert(stdout.String(), check.Matches, `Error: failed to run the plugin "broken": [^\n]+\n`)
+}
+
+func (s *S) TestPluginCommandRun(c *check.C) {
+	dir := c.MkDir()
+	path := writePlugin(c, dir, "crane-deploy", pluginScript, 0755)
+	command := pluginCommand{name: "deploy", path: path}
+	c.Assert(command.Info().Name, check.Equals, "deploy")
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"myapp"}, Stdout: &stdout, Stderr: &stdout}
+	client := cmd.NewClient(nil, nil, manager)
+	client.Verbosity = 2
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s)args: myapp\nname: deploy\n.*verbosity: 2\n`)
+}
@@ -0,0 +1,528 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+var pluginNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9-]{0,39}$`)
+
+func validatePluginName(name string) error {
+	if !pluginNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid plugin name %q, it must start with a letter and contain only lower case letters, numbers and dashes", name)
+	}
+	return nil
+}
+
+// lockedPlugin is a plugin pinned in the lock file: where it's installed
+// from, and the checksum of what was installed.
+type lockedPlugin struct {
+	Source string `json:"source"`
+	SHA256 string `json:"sha256"`
+}
+
+// pluginLockFile is the lock file of the plugins installed by plugin-install.
+// It may be shared, so every member of a team installs the same plugins.
+type pluginLockFile struct {
+	Plugins map[string]lockedPlugin `json:"plugins"`
+}
+
+// pluginLockPath returns the default path of the lock file.
+func pluginLockPath() string {
+	return filepath.Join(pluginsDir(), "plugins.lock")
+}
+
+// readPluginLock reads the lock file. A missing lock file has no plugins.
+func readPluginLock(path string) (*pluginLockFile, error) {
+	lock := pluginLockFile{Plugins: map[string]lockedPlugin{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("invalid lock file %s: %s", path, err)
+	}
+	if lock.Plugins == nil {
+		lock.Plugins = map[string]lockedPlugin{}
+	}
+	return &lock, nil
+}
+
+func (l *pluginLockFile) write(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// pluginVersionPath returns the path of the executable of a version of the
+// plugin, relative to the plugins directory. Versions are identified by the
+// checksum of what was installed.
+func pluginVersionPath(name, sum string) string {
+	return filepath.Join("versions", name, sum, pluginPrefix+name)
+}
+
+// installedPluginVersion returns the checksum of the version of the plugin
+// installed in the directory, or an empty string when the plugin isn't
+// installed by plugin-install.
+func installedPluginVersion(dir, name string) string {
+	target, err := os.Readlink(filepath.Join(dir, pluginPrefix+name))
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(filepath.ToSlash(target), "/")
+	if len(parts) != 4 || parts[0] != "versions" || parts[1] != name {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join(dir, target)); err != nil {
+		return ""
+	}
+	return parts[2]
+}
+
+func isRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// lockSource returns how a source is pinned in the lock file at lockPath. A
+// local path is made relative to the directory of the lock file, so a lock file
+// shared along with the plugins next to it works wherever it's checked out.
+func lockSource(lockPath, source string) (string, error) {
+	if isRemoteSource(source) {
+		return source, nil
+	}
+	path, err := filepath.Abs(source)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.Abs(filepath.Dir(lockPath))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return path, nil
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// resolveSource returns where to install a plugin pinned to source in the lock
+// file at lockPath from, resolving a relative path against the directory of
+// the lock file.
+func resolveSource(lockPath, source string) string {
+	if isRemoteSource(source) || filepath.IsAbs(source) {
+		return source
+	}
+	path := filepath.Join(filepath.Dir(lockPath), filepath.FromSlash(source))
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// readPluginSource reads a plugin from a URL or from a local file.
+func readPluginSource(source string) ([]byte, error) {
+	if !isRemoteSource(source) {
+		return ioutil.ReadFile(source)
+	}
+	client := http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", source, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// extractPlugin returns the executable of the plugin in what was read from its
+// source: either the executable itself or a tarball, optionally gzipped, with
+// the crane-<name> executable, or with a single file.
+func extractPlugin(name string, data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzipped plugin: %s", err)
+		}
+		defer gz.Close()
+		if data, err = ioutil.ReadAll(gz); err != nil {
+			return nil, fmt.Errorf("invalid gzipped plugin: %s", err)
+		}
+	}
+	if len(data) < 262 || string(data[257:262]) != "ustar" {
+		return data, nil
+	}
+	var files []string
+	contents := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid tarball: %s", err)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tarball: %s", err)
+		}
+		if path.Base(header.Name) == pluginPrefix+name {
+			return content, nil
+		}
+		files = append(files, header.Name)
+		contents[header.Name] = content
+	}
+	if len(files) == 1 {
+		return contents[files[0]], nil
+	}
+	return nil, fmt.Errorf("the tarball has no %s executable", pluginPrefix+name)
+}
+
+// installPlugin installs the plugin from its source in the plugins directory,
+// and returns the checksum of the source. When sum is not empty, the checksum
+// of the source must match it.
+func installPlugin(dir, name, source, sum string) (string, error) {
+	data, err := readPluginSource(source)
+	if err != nil {
+		return "", err
+	}
+	checksum := sha256.Sum256(data)
+	actual := hex.EncodeToString(checksum[:])
+	if sum != "" && !strings.EqualFold(sum, actual) {
+		return "", fmt.Errorf("checksum mismatch for %s: expected sha256 %s, got %s", source, strings.ToLower(sum), actual)
+	}
+	executable, err := extractPlugin(name, data)
+	if err != nil {
+		return "", err
+	}
+	link := filepath.Join(dir, pluginPrefix+name)
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return "", fmt.Errorf("%s was not installed by plugin-install, remove it first", link)
+	}
+	version := pluginVersionPath(name, actual)
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, version)), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, version), executable, 0755); err != nil {
+		return "", err
+	}
+	os.Remove(link)
+	if err := os.Symlink(version, link); err != nil {
+		return "", err
+	}
+	removePluginVersions(dir, name, actual)
+	return actual, nil
+}
+
+// removePluginVersions removes the versions of the plugin, except the given
+// one.
+func removePluginVersions(dir, name, keep string) error {
+	versions := filepath.Join(dir, "versions", name)
+	files, err := ioutil.ReadDir(versions)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range files {
+		if f.Name() != keep {
+			if err := os.RemoveAll(filepath.Join(versions, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if keep == "" {
+		return os.RemoveAll(versions)
+	}
+	return nil
+}
+
+type pluginInstall struct {
+	fs       *gnuflag.FlagSet
+	sum      string
+	lockPath string
+}
+
+func (c *pluginInstall) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "plugin-install",
+		Usage: "plugin-install [<name> [<url-or-path>]] [--sha256 <checksum>] [-l/--lock <file>]",
+		Desc: `Installs a plugin in the plugins directory, ~/.crane/plugins, from a URL or
+from a local file. The plugin is either an executable or a tarball, optionally
+gzipped, with the crane-<name> executable.
+
+The SHA-256 checksum of what was installed is pinned in a lock file, so
+installing the plugin again from the same source fails if it has changed. Give
+--sha256 to check the checksum of a new plugin. Installing from another source
+pins the new checksum. Local sources are pinned relative to the directory of
+the lock file.
+
+Without the source, the plugin is installed from the source pinned in the lock
+file, and without the name, every plugin in the lock file is installed, so
+sharing a lock file with --lock makes every member of a team run the same
+plugins.`,
+		MinArgs: 0,
+		MaxArgs: 2,
+	}
+}
+
+func (c *pluginInstall) Run(context *cmd.Context, client *cmd.Client) error {
+	lockPath := c.lockPath
+	if lockPath == "" {
+		lockPath = pluginLockPath()
+	}
+	lock, err := readPluginLock(lockPath)
+	if err != nil {
+		return err
+	}
+	dir := pluginsDir()
+	if len(context.Args) == 0 {
+		if c.sum != "" {
+			return errors.New("the checksum can only be given with the name of the plugin")
+		}
+		if len(lock.Plugins) == 0 {
+			fmt.Fprintf(context.Stdout, "No plugins pinned in %s.\n", lockPath)
+			return nil
+		}
+		names := make([]string, 0, len(lock.Plugins))
+		for name := range lock.Plugins {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var failed int
+		for _, name := range names {
+			pinned := lock.Plugins[name]
+			if installedPluginVersion(dir, name) == pinned.SHA256 {
+				fmt.Fprintf(context.Stdout, "Plugin %q is up to date.\n", name)
+				continue
+			}
+			source := resolveSource(lockPath, pinned.Source)
+			if _, err := installPlugin(dir, name, source, pinned.SHA256); err != nil {
+				fmt.Fprintf(context.Stdout, "Failed to install the plugin %q: %s\n", name, err)
+				failed++
+				continue
+			}
+			fmt.Fprintf(context.Stdout, "Plugin %q installed from %s.\n", name, source)
+		}
+		if failed > 0 {
+			return fmt.Errorf("failed to install %d of %d plugins", failed, len(names))
+		}
+		return nil
+	}
+	name := context.Args[0]
+	if err := validatePluginName(name); err != nil {
+		return err
+	}
+	pinned, locked := lock.Plugins[name]
+	pinnedSource := pinned.Source
+	if len(context.Args) > 1 {
+		if pinnedSource, err = lockSource(lockPath, context.Args[1]); err != nil {
+			return err
+		}
+	} else if !locked {
+		return fmt.Errorf("the plugin %q is not pinned in %s, give the source of the plugin", name, lockPath)
+	}
+	source := resolveSource(lockPath, pinnedSource)
+	sum := c.sum
+	if locked && source == resolveSource(lockPath, pinned.Source) {
+		if sum != "" && !strings.EqualFold(sum, pinned.SHA256) {
+			return fmt.Errorf("the plugin %q is pinned to sha256 %s in %s", name, pinned.SHA256, lockPath)
+		}
+		sum = pinned.SHA256
+	}
+	actual, err := installPlugin(dir, name, source, sum)
+	if err != nil {
+		return err
+	}
+	lock.Plugins[name] = lockedPlugin{Source: pinnedSource, SHA256: actual}
+	if err := lock.write(lockPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Plugin %q installed from %s (sha256 %s).\n", name, source, actual)
+	return nil
+}
+
+func (c *pluginInstall) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("plugin-install", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.sum, "sha256", "", "Expected SHA-256 checksum of the plugin")
+		c.fs.StringVar(&c.lockPath, "lock", "", "Lock file of the plugins (default: ~/.crane/plugins/plugins.lock)")
+		c.fs.StringVar(&c.lockPath, "l", "", "Lock file of the plugins (default: ~/.crane/plugins/plugins.lock)")
+	}
+	return c.fs
+}
+
+type pluginList struct {
+	fs       *gnuflag.FlagSet
+	lockPath string
+}
+
+func (c *pluginList) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "plugin-list",
+		Usage: "plugin-list [-l/--lock <file>]",
+		Desc: `Lists the plugins pinned in the lock file, with their sources and checksums,
+and whether they're installed, and the other plugins found on PATH.`,
+		MinArgs: 0,
+		MaxArgs: 0,
+	}
+}
+
+func (c *pluginList) Run(context *cmd.Context, client *cmd.Client) error {
+	lockPath := c.lockPath
+	if lockPath == "" {
+		lockPath = pluginLockPath()
+	}
+	lock, err := readPluginLock(lockPath)
+	if err != nil {
+		return err
+	}
+	dir := pluginsDir()
+	found := findPlugins(pluginDirs())
+	names := make([]string, 0, len(found)+len(lock.Plugins))
+	for name := range lock.Plugins {
+		names = append(names, name)
+	}
+	for name := range found {
+		if _, ok := lock.Plugins[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(context.Stdout, "No plugins installed.")
+		return nil
+	}
+	sort.Strings(names)
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"Plugin", "Source", "SHA-256", "Status"}
+	for _, name := range names {
+		pinned, ok := lock.Plugins[name]
+		if !ok {
+			table.AddRow(cmd.Row{name, found[name], "-", "not pinned"})
+			continue
+		}
+		status := "installed"
+		switch installed := installedPluginVersion(dir, name); {
+		case installed == "":
+			status = "not installed"
+		case installed != pinned.SHA256:
+			status = "outdated"
+		}
+		sum := pinned.SHA256
+		if len(sum) > 12 {
+			sum = sum[:12]
+		}
+		table.AddRow(cmd.Row{name, resolveSource(lockPath, pinned.Source), sum, status})
+	}
+	context.Stdout.Write(table.Bytes())
+	return nil
+}
+
+func (c *pluginList) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("plugin-list", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.lockPath, "lock", "", "Lock file of the plugins (default: ~/.crane/plugins/plugins.lock)")
+		c.fs.StringVar(&c.lockPath, "l", "", "Lock file of the plugins (default: ~/.crane/plugins/plugins.lock)")
+	}
+	return c.fs
+}
+
+type pluginRemove struct {
+	cmd.ConfirmationCommand
+	fs       *gnuflag.FlagSet
+	lockPath string
+}
+
+func (c *pluginRemove) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "plugin-remove",
+		Usage: "plugin-remove <name> [-l/--lock <file>] [-y/--assume-yes]",
+		Desc: `Removes a plugin installed by plugin-install, and its pin in the lock file.
+Plugins found on PATH are not removed.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *pluginRemove) Run(context *cmd.Context, client *cmd.Client) error {
+	name := context.Args[0]
+	if err := validatePluginName(name); err != nil {
+		return err
+	}
+	lockPath := c.lockPath
+	if lockPath == "" {
+		lockPath = pluginLockPath()
+	}
+	lock, err := readPluginLock(lockPath)
+	if err != nil {
+		return err
+	}
+	dir := pluginsDir()
+	_, locked := lock.Plugins[name]
+	installed := installedPluginVersion(dir, name) != ""
+	if !locked && !installed {
+		return fmt.Errorf("the plugin %q was not installed by plugin-install", name)
+	}
+	if !c.Confirm(context, fmt.Sprintf("Are you sure you want to remove the plugin %q?", name)) {
+		return nil
+	}
+	if installed {
+		if err := os.Remove(filepath.Join(dir, pluginPrefix+name)); err != nil {
+			return err
+		}
+	}
+	if err := removePluginVersions(dir, name, ""); err != nil {
+		return err
+	}
+	if locked {
+		delete(lock.Plugins, name)
+		if err := lock.write(lockPath); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(context.Stdout, "Plugin %q successfully removed.\n", name)
+	return nil
+}
+
+func (c *pluginRemove) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = c.ConfirmationCommand.Flags()
+		c.fs.StringVar(&c.lockPath, "lock", "", "Lock file of the plugins (default: ~/.crane/plugins/plugins.lock)")
+		c.fs.StringVar(&c.lockPath, "l", "", "Lock file of the plugins (default: ~/.crane/plugins/plugins.lock)")
+	}
+	return c.fs
+}
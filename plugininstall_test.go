@@ -0,0 +1,351 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+// setPluginHome sets HOME to a new directory, returning a function that
+// restores it.
+func setPluginHome(c *check.C) func() {
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", c.MkDir())
+	return func() { os.Setenv("HOME", home) }
+}
+
+func pluginTarball(c *check.C, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		c.Assert(err, check.IsNil)
+		_, err = tw.Write([]byte(content))
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(tw.Close(), check.IsNil)
+	c.Assert(gz.Close(), check.IsNil)
+	return buf.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *S) TestExtractPlugin(c *check.C) {
+	data, err := extractPlugin("deploy", []byte(pluginScript))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, pluginScript)
+	tarball := pluginTarball(c, map[string]string{"README": "docs", "bin/crane-deploy": pluginScript})
+	data, err = extractPlugin("deploy", tarball)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, pluginScript)
+	data, err = extractPlugin("deploy", pluginTarball(c, map[string]string{"deploy": pluginScript}))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, pluginScript)
+	_, err = extractPlugin("backup", tarball)
+	c.Assert(err, check.ErrorMatches, "the tarball has no crane-backup executable")
+	_, err = extractPlugin("deploy", []byte{0x1f, 0x8b, 0})
+	c.Assert(err, check.ErrorMatches, "invalid gzipped plugin: .*")
+}
+
+func (s *S) TestReadPluginLockMissing(c *check.C) {
+	lock, err := readPluginLock(filepath.Join(c.MkDir(), "plugins.lock"))
+	c.Assert(err, check.IsNil)
+	c.Assert(lock.Plugins, check.DeepEquals, map[string]lockedPlugin{})
+}
+
+func (s *S) TestReadPluginLockInvalid(c *check.C) {
+	path := filepath.Join(c.MkDir(), "plugins.lock")
+	err := ioutil.WriteFile(path, []byte("plugins"), 0644)
+	c.Assert(err, check.IsNil)
+	_, err = readPluginLock(path)
+	c.Assert(err, check.ErrorMatches, "invalid lock file .*")
+}
+
+func (s *S) TestPluginInstallFromTarball(c *check.C) {
+	defer setPluginHome(c)()
+	tarball := pluginTarball(c, map[string]string{"crane-deploy": pluginScript})
+	source := filepath.Join(c.MkDir(), "deploy.tar.gz")
+	err := ioutil.WriteFile(source, tarball, 0644)
+	c.Assert(err, check.IsNil)
+	sum := sha256Hex(tarball)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"deploy", source}, Stdout: &stdout}
+	command := pluginInstall{}
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Plugin "deploy" installed from `+source+" (sha256 "+sum+").\n")
+	dir := pluginsDir()
+	c.Assert(installedPluginVersion(dir, "deploy"), check.Equals, sum)
+	c.Assert(findPlugins([]string{dir}), check.DeepEquals, map[string]string{"deploy": filepath.Join(dir, "crane-deploy")})
+	data, err := ioutil.ReadFile(filepath.Join(dir, "crane-deploy"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, pluginScript)
+	lock, err := readPluginLock(pluginLockPath())
+	c.Assert(err, check.IsNil)
+	c.Assert(lock.Plugins, check.HasLen, 1)
+	c.Assert(lock.Plugins["deploy"].SHA256, check.Equals, sum)
+	c.Assert(filepath.IsAbs(lock.Plugins["deploy"].Source), check.Equals, false)
+	c.Assert(resolveSource(pluginLockPath(), lock.Plugins["deploy"].Source), check.Equals, source)
+}
+
+func (s *S) TestPluginInstallFromURL(c *check.C) {
+	defer setPluginHome(c)()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/crane-deploy" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(pluginScript))
+	}))
+	defer server.Close()
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"deploy", server.URL + "/crane-deploy"}, Stdout: &stdout}
+	command := pluginInstall{}
+	command.Flags().Parse(true, []string{"--sha256", strings.ToUpper(sha256Hex([]byte(pluginScript)))})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(installedPluginVersion(pluginsDir(), "deploy"), check.Equals, sha256Hex([]byte(pluginScript)))
+	context.Args = []string{"backup", server.URL + "/crane-backup"}
+	command = pluginInstall{}
+	err = command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "failed to download .*/crane-backup: 404 Not Found")
+}
+
+func (s *S) TestPluginInstallChecksumMismatch(c *check.C) {
+	defer setPluginHome(c)()
+	source := writePlugin(c, c.MkDir(), "crane-deploy", pluginScript, 0755)
+	context := cmd.Context{Args: []string{"deploy", source}, Stdout: ioutil.Discard}
+	command := pluginInstall{}
+	command.Flags().Parse(true, []string{"--sha256", "abc123"})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "checksum mismatch for .*: expected sha256 abc123, got "+sha256Hex([]byte(pluginScript)))
+	c.Assert(installedPluginVersion(pluginsDir(), "deploy"), check.Equals, "")
+}
+
+func (s *S) TestPluginInstallPinned(c *check.C) {
+	defer setPluginHome(c)()
+	source := writePlugin(c, c.MkDir(), "crane-deploy", pluginScript, 0755)
+	context := cmd.Context{Args: []string{"deploy", source}, Stdout: ioutil.Discard}
+	command := pluginInstall{}
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(source, []byte("#!/bin/sh\necho changed\n"), 0755)
+	c.Assert(err, check.IsNil)
+	context.Args = []string{"deploy"}
+	err = command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "checksum mismatch for .*: expected sha256 "+sha256Hex([]byte(pluginScript))+", got .*")
+	c.Assert(installedPluginVersion(pluginsDir(), "deploy"), check.Equals, sha256Hex([]byte(pluginScript)))
+}
+
+func (s *S) TestPluginInstallNewSourceRepins(c *check.C) {
+	defer setPluginHome(c)()
+	dir := c.MkDir()
+	first := writePlugin(c, dir, "crane-deploy-1", pluginScript, 0755)
+	second := writePlugin(c, dir, "crane-deploy-2", "#!/bin/sh\necho 2\n", 0755)
+	context := cmd.Context{Args: []string{"deploy", first}, Stdout: ioutil.Discard}
+	command := pluginInstall{}
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	context.Args = []string{"deploy", second}
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	sum := sha256Hex([]byte("#!/bin/sh\necho 2\n"))
+	c.Assert(installedPluginVersion(pluginsDir(), "deploy"), check.Equals, sum)
+	versions, err := ioutil.ReadDir(filepath.Join(pluginsDir(), "versions", "deploy"))
+	c.Assert(err, check.IsNil)
+	c.Assert(versions, check.HasLen, 1)
+	lock, err := readPluginLock(pluginLockPath())
+	c.Assert(err, check.IsNil)
+	c.Assert(lock.Plugins["deploy"].SHA256, check.Equals, sum)
+	c.Assert(resolveSource(pluginLockPath(), lock.Plugins["deploy"].Source), check.Equals, second)
+}
+
+func (s *S) TestPluginInstallSourceRelativeToLockFile(c *check.C) {
+	defer setPluginHome(c)()
+	wd, err := os.Getwd()
+	c.Assert(err, check.IsNil)
+	defer os.Chdir(wd)
+	repo := c.MkDir()
+	err = os.Mkdir(filepath.Join(repo, "plugins"), 0755)
+	c.Assert(err, check.IsNil)
+	writePlugin(c, filepath.Join(repo, "plugins"), "crane-deploy", pluginScript, 0755)
+	err = os.Chdir(repo)
+	c.Assert(err, check.IsNil)
+	lockPath := filepath.Join(repo, "team.lock")
+	context := cmd.Context{Args: []string{"deploy", filepath.Join("plugins", "crane-deploy")}, Stdout: ioutil.Discard}
+	command := pluginInstall{}
+	command.Flags().Parse(true, []string{"--lock", lockPath})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	lock, err := readPluginLock(lockPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(lock.Plugins["deploy"].Source, check.Equals, "plugins/crane-deploy")
+	moved := filepath.Join(c.MkDir(), "checkout")
+	err = os.Rename(repo, moved)
+	c.Assert(err, check.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, check.IsNil)
+	err = os.RemoveAll(filepath.Join(pluginsDir(), "versions"))
+	c.Assert(err, check.IsNil)
+	err = os.Remove(filepath.Join(pluginsDir(), "crane-deploy"))
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context = cmd.Context{Stdout: &stdout}
+	command = pluginInstall{}
+	command.Flags().Parse(true, []string{"--lock", filepath.Join(moved, "team.lock")})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Plugin "deploy" installed from `+filepath.Join(moved, "plugins", "crane-deploy")+".\n")
+	c.Assert(installedPluginVersion(pluginsDir(), "deploy"), check.Equals, sha256Hex([]byte(pluginScript)))
+}
+
+func (s *S) TestPluginInstallFromLockFile(c *check.C) {
+	defer setPluginHome(c)()
+	dir := c.MkDir()
+	deploy := writePlugin(c, dir, "crane-deploy", pluginScript, 0755)
+	backup := writePlugin(c, dir, "crane-backup", "#!/bin/sh\n", 0755)
+	lockPath := filepath.Join(dir, "team.lock")
+	lock := pluginLockFile{Plugins: map[string]lockedPlugin{
+		"deploy": {Source: deploy, SHA256: sha256Hex([]byte(pluginScript))},
+		"backup": {Source: backup, SHA256: "0000"},
+	}}
+	err := lock.write(lockPath)
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	command := pluginInstall{}
+	command.Flags().Parse(true, []string{"--lock", lockPath})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "failed to install 1 of 2 plugins")
+	c.Assert(stdout.String(), check.Matches, `Failed to install the plugin "backup": checksum mismatch for .*
+Plugin "deploy" installed from .*crane-deploy.
+`)
+	stdout.Reset()
+	delete(lock.Plugins, "backup")
+	err = lock.write(lockPath)
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Plugin \"deploy\" is up to date.\n")
+}
+
+func (s *S) TestPluginInstallNotPinned(c *check.C) {
+	defer setPluginHome(c)()
+	context := cmd.Context{Args: []string{"deploy"}, Stdout: ioutil.Discard}
+	command := pluginInstall{}
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `the plugin "deploy" is not pinned in .*plugins.lock, give the source of the plugin`)
+	context.Args = []string{"Deploy", "crane-deploy"}
+	err = command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `invalid plugin name "Deploy", .*`)
+}
+
+func (s *S) TestPluginInstallUnmanagedPlugin(c *check.C) {
+	defer setPluginHome(c)()
+	err := os.MkdirAll(pluginsDir(), 0755)
+	c.Assert(err, check.IsNil)
+	writePlugin(c, pluginsDir(), "crane-deploy", pluginScript, 0755)
+	source := writePlugin(c, c.MkDir(), "crane-deploy", pluginScript, 0755)
+	context := cmd.Context{Args: []string{"deploy", source}, Stdout: ioutil.Discard}
+	command := pluginInstall{}
+	err = command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, ".*crane-deploy was not installed by plugin-install, remove it first")
+}
+
+func (s *S) TestPluginList(c *check.C) {
+	defer setPluginHome(c)()
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	bin := c.MkDir()
+	os.Setenv("PATH", bin)
+	backup := writePlugin(c, bin, "crane-backup", pluginScript, 0755)
+	source := writePlugin(c, c.MkDir(), "crane-deploy", pluginScript, 0755)
+	context := cmd.Context{Args: []string{"deploy", source}, Stdout: ioutil.Discard}
+	err := (&pluginInstall{}).Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	lock, err := readPluginLock(pluginLockPath())
+	c.Assert(err, check.IsNil)
+	lock.Plugins["restore"] = lockedPlugin{Source: "https://example.com/crane-restore", SHA256: "0123456789abcdef"}
+	err = lock.write(pluginLockPath())
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context = cmd.Context{Stdout: &stdout}
+	err = (&pluginList{}).Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"Plugin", "Source", "SHA-256", "Status"}
+	table.AddRow(cmd.Row{"backup", backup, "-", "not pinned"})
+	table.AddRow(cmd.Row{"deploy", source, sha256Hex([]byte(pluginScript))[:12], "installed"})
+	table.AddRow(cmd.Row{"restore", "https://example.com/crane-restore", "0123456789ab", "not installed"})
+	c.Assert(stdout.String(), check.Equals, table.String())
+}
+
+func (s *S) TestPluginListEmpty(c *check.C) {
+	defer setPluginHome(c)()
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", c.MkDir())
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	err := (&pluginList{}).Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "No plugins installed.\n")
+}
+
+func (s *S) TestPluginRemove(c *check.C) {
+	defer setPluginHome(c)()
+	source := writePlugin(c, c.MkDir(), "crane-deploy", pluginScript, 0755)
+	context := cmd.Context{Args: []string{"deploy", source}, Stdout: ioutil.Discard}
+	err := (&pluginInstall{}).Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context = cmd.Context{Args: []string{"deploy"}, Stdout: &stdout, Stdin: strings.NewReader("y\n")}
+	err = (&pluginRemove{}).Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Are you sure you want to remove the plugin "deploy"? (y/n) Plugin "deploy" successfully removed.`+"\n")
+	_, err = os.Lstat(filepath.Join(pluginsDir(), "crane-deploy"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	_, err = os.Stat(filepath.Join(pluginsDir(), "versions", "deploy"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	lock, err := readPluginLock(pluginLockPath())
+	c.Assert(err, check.IsNil)
+	c.Assert(lock.Plugins, check.DeepEquals, map[string]lockedPlugin{})
+}
+
+func (s *S) TestPluginRemoveCanceled(c *check.C) {
+	defer setPluginHome(c)()
+	source := writePlugin(c, c.MkDir(), "crane-deploy", pluginScript, 0755)
+	context := cmd.Context{Args: []string{"deploy", source}, Stdout: ioutil.Discard}
+	err := (&pluginInstall{}).Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	context = cmd.Context{Args: []string{"deploy"}, Stdout: ioutil.Discard, Stdin: strings.NewReader("n\n")}
+	err = (&pluginRemove{}).Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(installedPluginVersion(pluginsDir(), "deploy"), check.Equals, sha256Hex([]byte(pluginScript)))
+}
+
+func (s *S) TestPluginRemoveNotInstalled(c *check.C) {
+	defer setPluginHome(c)()
+	context := cmd.Context{Args: []string{"deploy"}, Stdout: ioutil.Discard}
+	err := (&pluginRemove{}).Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `the plugin "deploy" was not installed by plugin-install`)
+}
@@ -0,0 +1,429 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+const redacted = "REDACTED"
+
+// exchange is a request sent to the service API and its response, as
+// recorded in session files, one JSON object per line. The secret in the
+// Authorization header is never recorded.
+type exchange struct {
+	Time     time.Time   `json:"time"`
+	Method   string      `json:"method"`
+	Path     string      `json:"path"`
+	Username string      `json:"username,omitempty"`
+	Header   http.Header `json:"header,omitempty"`
+	Body     string      `json:"body,omitempty"`
+	Status   int         `json:"status"`
+	Response string      `json:"response,omitempty"`
+	Duration float64     `json:"duration_ms"`
+	Error    string      `json:"error,omitempty"`
+	Fault    string      `json:"fault,omitempty"`
+
+	// Violations are the ways the exchange doesn't conform to the services
+	// API, when the proxy validates the exchanges.
+	Violations []string `json:"violations,omitempty"`
+}
+
+// hopHeaders are not forwarded by the proxy, nor recorded.
+var hopHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// serviceProxy is a reverse proxy to a service API, logging and recording
+// every exchange. Faults may be injected in the exchanges.
+type serviceProxy struct {
+	upstream string
+	client   *http.Client
+	log      io.Writer
+	faults   *faultSet
+
+	// validator, when set, validates the exchanges with the service API,
+	// logging and recording the violations.
+	validator *specValidator
+
+	mu        sync.Mutex
+	session   io.Writer
+	exchanges int
+}
+
+func newServiceProxy(upstream string, log, session io.Writer) *serviceProxy {
+	if !strings.Contains(upstream, "://") {
+		upstream = "http://" + upstream
+	}
+	return &serviceProxy{
+		upstream: strings.TrimRight(upstream, "/"),
+		client:   &http.Client{Timeout: time.Minute},
+		log:      log,
+		session:  session,
+	}
+}
+
+func (p *serviceProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ex := exchange{
+		Time:   time.Now().UTC(),
+		Method: r.Method,
+		Path:   r.URL.RequestURI(),
+		Header: recordedHeader(r.Header),
+		Body:   string(body),
+	}
+	ex.Username, _, _ = r.BasicAuth()
+	start := time.Now()
+	fault := p.faults.pick(r.Method, r.URL.Path)
+	if fault != nil {
+		ex.Fault = fault.Name
+		time.Sleep(fault.latency)
+		if fault.Drop {
+			ex.Duration = milliseconds(time.Since(start))
+			ex.Error = "connection dropped"
+			p.record(&ex)
+			dropConnection(w)
+			return
+		}
+		if fault.Status != 0 {
+			ex.Duration = milliseconds(time.Since(start))
+			ex.Status = fault.Status
+			ex.Response = fmt.Sprintf("fault %q injected by crane\n", fault.Name)
+			p.record(&ex)
+			http.Error(w, strings.TrimSuffix(ex.Response, "\n"), fault.Status)
+			return
+		}
+	}
+	resp, err := p.forward(r, body)
+	if err != nil {
+		ex.Duration = milliseconds(time.Since(start))
+		ex.Status = http.StatusBadGateway
+		ex.Error = err.Error()
+		p.record(&ex)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if fault != nil && fault.MalformedJSON {
+		data = malformJSON(data)
+	}
+	ex.Duration = milliseconds(time.Since(start))
+	ex.Status = resp.StatusCode
+	ex.Response = string(data)
+	if err != nil {
+		ex.Error = err.Error()
+	}
+	if p.validator != nil {
+		if serr := p.validator.validate(r.Method, ex.Path, r.Header, body, resp.StatusCode, data); serr != nil {
+			ex.Violations = serr.problems
+		}
+	}
+	p.record(&ex)
+	for name, values := range resp.Header {
+		if !isHopHeader(name) {
+			w.Header()[name] = values
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(data)
+}
+
+// dropConnection closes the connection of the request without responding.
+func dropConnection(w http.ResponseWriter) {
+	if hijacker, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	http.Error(w, "connection dropped", http.StatusBadGateway)
+}
+
+func (p *serviceProxy) forward(r *http.Request, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(r.Method, p.upstream+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range r.Header {
+		if !isHopHeader(name) {
+			req.Header[name] = values
+		}
+	}
+	return p.client.Do(req)
+}
+
+// record logs the exchange and appends it to the session.
+func (p *serviceProxy) record(ex *exchange) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.exchanges++
+	fmt.Fprintf(p.log, "%s %s: ", ex.Method, ex.Path)
+	if ex.Error != "" && ex.Response == "" {
+		fmt.Fprintf(p.log, "failed after %.1fms: %s", ex.Duration, ex.Error)
+	} else {
+		fmt.Fprintf(p.log, "%d %s in %.1fms", ex.Status, http.StatusText(ex.Status), ex.Duration)
+	}
+	if ex.Fault != "" {
+		fmt.Fprintf(p.log, " (fault %q)", ex.Fault)
+	}
+	fmt.Fprintln(p.log)
+	if auth := ex.Header.Get("Authorization"); auth != "" {
+		fmt.Fprintf(p.log, "  Authorization: %s\n", auth)
+	}
+	if ex.Body != "" {
+		fmt.Fprintf(p.log, "  > %s\n", ex.Body)
+	}
+	if body := strings.TrimSpace(ex.Response); body != "" {
+		fmt.Fprintf(p.log, "  < %s\n", body)
+	}
+	for _, v := range ex.Violations {
+		fmt.Fprintf(p.log, "  ! %s\n", v)
+	}
+	if p.session != nil {
+		json.NewEncoder(p.session).Encode(ex)
+	}
+}
+
+// recordedHeader returns a copy of the header that is safe to record, without
+// the secret of the basic authentication.
+func recordedHeader(header http.Header) http.Header {
+	h := http.Header{}
+	for name, values := range header {
+		if !isHopHeader(name) {
+			h[name] = append([]string(nil), values...)
+		}
+	}
+	if auth := h.Get("Authorization"); auth != "" {
+		scheme := strings.SplitN(auth, " ", 2)[0]
+		h.Set("Authorization", scheme+" "+redacted)
+		if username, _, ok := (&http.Request{Header: header}).BasicAuth(); ok {
+			h.Set("Authorization", scheme+" "+username+":"+redacted)
+		}
+	}
+	return h
+}
+
+func isHopHeader(name string) bool {
+	for _, h := range hopHeaders {
+		if strings.EqualFold(name, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// readSession reads the exchanges recorded in a session file.
+func readSession(path string) ([]exchange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var exchanges []exchange
+	decoder := json.NewDecoder(f)
+	for {
+		var ex exchange
+		err := decoder.Decode(&ex)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid session file %s: %s", path, err)
+		}
+		exchanges = append(exchanges, ex)
+	}
+	return exchanges, nil
+}
+
+type apiProxy struct {
+	fs       *gnuflag.FlagSet
+	listen   string
+	upstream string
+	output   string
+	faults   string
+	control  string
+	strict   bool
+
+	// stop is notified when the proxy must stop. It's notified by SIGINT and
+	// SIGTERM when not set.
+	stop chan os.Signal
+}
+
+func (c *apiProxy) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "api-proxy",
+		Usage: "api-proxy --upstream <endpoint> [-l/--listen <address>] [-o/--output <session-file>] [--faults <rules-file.yaml>] [--control <address>] [--strict]",
+		Desc: `Starts a proxy to a service API, logging every exchange between tsuru and the
+service.
+
+Point the endpoint of the service in tsuru to the proxy, and every request
+tsuru sends to the service API, along with the response, is displayed. The
+secret in the basic authentication is always redacted.
+
+The exchanges are also recorded to a session file, which defaults to a new
+session-<timestamp>.jsonl file in the current directory. The session may be
+sent again to the service API with "api-replay".
+
+Faults may be injected in the exchanges, following the rules in the file given
+with --faults, like:
+
+    rules:
+      - name: flaky-binds
+        route: bind-app
+        probability: 0.3
+        status: 503
+      - route: POST /resources
+        latency: 2s
+
+A rule applies to a route, given by its method and path, like
+"POST /resources/{name}/bind-app", or by its name: plans, create, status,
+bind-app, unbind-app, bind-unit, unbind-unit or remove. It fires with the given
+probability, which defaults to 1, and may add latency, respond with a status
+instead of calling the service API, drop the connection ("drop: true") or make
+the response invalid JSON ("malformed-json: true").
+
+With --control, a control API is started in the given address, for changing
+the rules at runtime: GET /faults lists the rules, PUT /faults replaces them
+with the ones in the body, DELETE /faults removes them, and POST
+/faults/<name>/enable and /faults/<name>/disable switch a rule on and off. The
+control API is not authenticated, so it only listens on loopback addresses,
+like "127.0.0.1:8889", and on 127.0.0.1 when only the port is given.
+
+With the --strict flag, the exchanges are validated against the OpenAPI
+document of the services API (see "api-spec"). Violations are logged, prefixed
+by "!", and recorded in the session, but responses are forwarded unchanged.
+
+The proxy listens on ":8888" by default, and runs until interrupted.`,
+		MinArgs: 0,
+		MaxArgs: 0,
+	}
+}
+
+// loopbackAddress returns the address an unauthenticated server, named in the
+// errors, listens on. Only loopback addresses are allowed, and 127.0.0.1 is
+// used when only the port is given.
+func loopbackAddress(server, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s address %q: %s", server, address, err)
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("the %s must listen on a loopback address, like 127.0.0.1:%s, not %q", server, port, address)
+	}
+	return address, nil
+}
+
+func (c *apiProxy) Run(context *cmd.Context, client *cmd.Client) error {
+	if c.upstream == "" {
+		return errors.New("the upstream endpoint is required, use --upstream to define it")
+	}
+	var controlAddr string
+	if c.control != "" {
+		var err error
+		if controlAddr, err = loopbackAddress("control API", c.control); err != nil {
+			return err
+		}
+	}
+	output := c.output
+	if output == "" {
+		output = "session-" + time.Now().Format("20060102-150405") + ".jsonl"
+	}
+	faults := newFaultSet(nil)
+	if c.faults != "" {
+		rules, err := readFaultRules(c.faults)
+		if err != nil {
+			return err
+		}
+		faults.set(rules)
+	}
+	listen := c.listen
+	if listen == "" {
+		listen = ":8888"
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	proxy := newServiceProxy(c.upstream, context.Stdout, f)
+	proxy.faults = faults
+	if c.strict {
+		proxy.validator = servicesAPIValidator
+	}
+	stop := c.stop
+	if stop == nil {
+		stop = make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(stop)
+	}
+	fmt.Fprintf(context.Stdout, "Proxying %s at %s, recording the session to %s.\n", proxy.upstream, listener.Addr(), output)
+	go http.Serve(listener, proxy)
+	if c.control != "" {
+		control, err := net.Listen("tcp", controlAddr)
+		if err != nil {
+			return err
+		}
+		defer control.Close()
+		fmt.Fprintf(context.Stdout, "Control API listening at %s.\n", control.Addr())
+		go http.Serve(control, faults)
+	}
+	<-stop
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	fmt.Fprintf(context.Stdout, "Recorded %d exchange(s) to %s.\n", proxy.exchanges, output)
+	return nil
+}
+
+func (c *apiProxy) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("api-proxy", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.upstream, "upstream", "", "Endpoint of the service API")
+		c.fs.StringVar(&c.listen, "listen", ":8888", "Address the proxy listens on")
+		c.fs.StringVar(&c.listen, "l", ":8888", "Address the proxy listens on")
+		c.fs.StringVar(&c.output, "output", "", "Session file (default: session-<timestamp>.jsonl)")
+		c.fs.StringVar(&c.output, "o", "", "Session file (default: session-<timestamp>.jsonl)")
+		c.fs.StringVar(&c.faults, "faults", "", "YAML file with the rules for injecting faults")
+		c.fs.StringVar(&c.control, "control", "", "Address of the control API of the fault rules")
+		c.fs.BoolVar(&c.strict, "strict", false, "Validate the exchanges against the OpenAPI document of the services API")
+	}
+	return c.fs
+}
@@ -0,0 +1,231 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+// recordSession sends a lifecycle of an instance through a proxy to the fake
+// service API, returning the log and the recorded session.
+func recordSession(c *check.C, fake *fakeServiceAPI) (string, string) {
+	var log, session bytes.Buffer
+	proxy := newServiceProxy(fake.server.URL, &log, &session)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	api := newServiceAPI(server.URL, fake.manifest())
+	resp, err := api.createInstance("mydb", "small", "admin")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.status, check.Equals, http.StatusCreated)
+	resp, err = api.bindApp("mydb", "myapp", "myapp.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.status, check.Equals, http.StatusCreated)
+	resp, err = api.unbindApp("mydb", "myapp", "myapp.example.com")
+	c.Assert(err, check.IsNil)
+	resp, err = api.removeInstance("mydb")
+	c.Assert(err, check.IsNil)
+	c.Assert(proxy.exchanges, check.Equals, 4)
+	return log.String(), session.String()
+}
+
+func (s *S) TestServiceProxy(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	log, session := recordSession(c, fake)
+	c.Assert(fake.requests, check.DeepEquals, []string{
+		"POST /resources",
+		"POST /resources/mydb/bind-app",
+		"DELETE /resources/mydb/bind-app",
+		"DELETE /resources/mydb",
+	})
+	c.Assert(fake.instances, check.HasLen, 0)
+	c.Assert(log, check.Matches, `POST /resources: 201 Created in .*ms
+  Authorization: Basic mysqlapi:REDACTED
+  > name=mydb&plan=small&team=admin
+POST /resources/mydb/bind-app: 201 Created in .*ms
+  Authorization: Basic mysqlapi:REDACTED
+  > app-host=myapp.example.com&app-name=myapp
+  < {"MYSQL_HOST":"10.0.0.2","MYSQL_USER":"root"}
+DELETE /resources/mydb/bind-app: 200 OK in .*ms
+(?s).*`)
+	c.Assert(strings.Contains(log, "s3cr3t"), check.Equals, false)
+	c.Assert(strings.Contains(session, "s3cr3t"), check.Equals, false)
+	lines := strings.Split(strings.TrimSpace(session), "\n")
+	c.Assert(lines, check.HasLen, 4)
+	var ex exchange
+	err := json.Unmarshal([]byte(lines[1]), &ex)
+	c.Assert(err, check.IsNil)
+	c.Assert(ex.Method, check.Equals, "POST")
+	c.Assert(ex.Path, check.Equals, "/resources/mydb/bind-app")
+	c.Assert(ex.Username, check.Equals, "mysqlapi")
+	c.Assert(ex.Header.Get("Authorization"), check.Equals, "Basic mysqlapi:REDACTED")
+	c.Assert(ex.Header.Get("Content-Type"), check.Equals, "application/x-www-form-urlencoded")
+	c.Assert(ex.Body, check.Equals, "app-host=myapp.example.com&app-name=myapp")
+	c.Assert(ex.Status, check.Equals, http.StatusCreated)
+	c.Assert(ex.Response, check.Equals, `{"MYSQL_HOST":"10.0.0.2","MYSQL_USER":"root"}`+"\n")
+}
+
+func (s *S) TestServiceProxyStrict(c *check.C) {
+	fake, upstream := newNonConformingServiceAPI()
+	defer fake.stop()
+	defer upstream.Close()
+	var log, session bytes.Buffer
+	proxy := newServiceProxy(upstream.URL, &log, &session)
+	proxy.validator = servicesAPIValidator
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	api := newServiceAPI(server.URL, fake.manifest())
+	_, err := api.createInstance("mydb", "small", "admin")
+	c.Assert(err, check.IsNil)
+	resp, err := api.bindApp("mydb", "myapp", "myapp.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(resp.body), check.Equals, `{"MYSQL_HOST": "10.0.0.2", "MYSQL_PORT": 3306}`)
+	c.Assert(log.String(), check.Matches, `(?s)POST /resources: 201 Created in .*
+POST /resources/mydb/bind-app: 201 Created in .*
+  ! response: \$.MYSQL_PORT: expected string, got integer
+$`)
+	lines := strings.Split(strings.TrimSpace(session.String()), "\n")
+	c.Assert(lines, check.HasLen, 2)
+	var ex exchange
+	err = json.Unmarshal([]byte(lines[0]), &ex)
+	c.Assert(err, check.IsNil)
+	c.Assert(ex.Violations, check.IsNil)
+	err = json.Unmarshal([]byte(lines[1]), &ex)
+	c.Assert(err, check.IsNil)
+	c.Assert(ex.Violations, check.DeepEquals, []string{"response: $.MYSQL_PORT: expected string, got integer"})
+}
+
+func (s *S) TestServiceProxyUpstreamDown(c *check.C) {
+	fake := newFakeServiceAPI()
+	fake.stop()
+	var log, session bytes.Buffer
+	server := httptest.NewServer(newServiceProxy(fake.server.URL, &log, &session))
+	defer server.Close()
+	resp, err := newServiceAPI(server.URL, fake.manifest()).plans()
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.status, check.Equals, http.StatusBadGateway)
+	c.Assert(log.String(), check.Matches, "GET /resources/plans: failed after .*ms: .*\n  Authorization: Basic mysqlapi:REDACTED\n")
+	var ex exchange
+	err = json.Unmarshal(session.Bytes(), &ex)
+	c.Assert(err, check.IsNil)
+	c.Assert(ex.Status, check.Equals, http.StatusBadGateway)
+	c.Assert(ex.Error, check.Not(check.Equals), "")
+}
+
+func (s *S) TestRecordedHeader(c *check.C) {
+	header := http.Header{"Connection": {"close"}, "Accept": {"application/json"}}
+	c.Assert(recordedHeader(header), check.DeepEquals, http.Header{"Accept": {"application/json"}})
+	header.Set("Authorization", "Bearer abc123")
+	c.Assert(recordedHeader(header).Get("Authorization"), check.Equals, "Bearer REDACTED")
+	c.Assert(header.Get("Authorization"), check.Equals, "Bearer abc123")
+}
+
+func (s *S) TestReadSession(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	_, session := recordSession(c, fake)
+	path := filepath.Join(c.MkDir(), "session.jsonl")
+	err := ioutil.WriteFile(path, []byte(session), 0600)
+	c.Assert(err, check.IsNil)
+	exchanges, err := readSession(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(exchanges, check.HasLen, 4)
+	c.Assert(exchanges[3].Method+" "+exchanges[3].Path, check.Equals, "DELETE /resources/mydb")
+	err = ioutil.WriteFile(path, []byte("{\"method\": \"GET\"}\nnot json\n"), 0600)
+	c.Assert(err, check.IsNil)
+	_, err = readSession(path)
+	c.Assert(err, check.ErrorMatches, "invalid session file .*session.jsonl: .*")
+}
+
+func (s *S) TestAPIProxyRun(c *check.C) {
+	output := filepath.Join(c.MkDir(), "session.jsonl")
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	command := apiProxy{stop: make(chan os.Signal, 1)}
+	command.Flags().Parse(true, []string{"--upstream", "localhost:8000", "-l", "127.0.0.1:0", "-o", output})
+	command.stop <- os.Interrupt
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `Proxying http://localhost:8000 at 127.0.0.1:\d+, recording the session to .*session.jsonl.
+Recorded 0 exchange\(s\) to .*session.jsonl.
+`)
+	_, err = os.Stat(output)
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, nil)
+	c.Assert(err, check.NotNil)
+	c.Assert(os.IsExist(err), check.Equals, true)
+}
+
+func (s *S) TestAPIProxyRequiresUpstream(c *check.C) {
+	err := (&apiProxy{}).Run(&cmd.Context{}, nil)
+	c.Assert(err, check.ErrorMatches, "the upstream endpoint is required, use --upstream to define it")
+}
+
+func (s *S) TestAPIProxyInvalidFaults(c *check.C) {
+	path := filepath.Join(c.MkDir(), "faults.yaml")
+	err := ioutil.WriteFile(path, []byte("rules: [{route: create}]"), 0600)
+	c.Assert(err, check.IsNil)
+	command := apiProxy{}
+	command.Flags().Parse(true, []string{"--upstream", "localhost:8000", "--faults", path})
+	err = command.Run(&cmd.Context{}, nil)
+	c.Assert(err, check.ErrorMatches, "invalid fault rule #1: one of latency, status, drop or malformed-json is required")
+}
+
+func (s *S) TestLoopbackAddress(c *check.C) {
+	tests := []struct {
+		address string
+		want    string
+		err     string
+	}{
+		{":8889", "127.0.0.1:8889", ""},
+		{"127.0.0.1:8889", "127.0.0.1:8889", ""},
+		{"localhost:8889", "localhost:8889", ""},
+		{"[::1]:8889", "[::1]:8889", ""},
+		{"0.0.0.0:8889", "", `the control API must listen on a loopback address, like 127.0.0.1:8889, not "0.0.0.0:8889"`},
+		{"10.0.0.4:8889", "", `the control API must listen on a loopback address, like 127.0.0.1:8889, not "10.0.0.4:8889"`},
+		{"example.com:8889", "", `the control API must listen on a loopback address, .*`},
+		{"8889", "", `invalid control API address "8889": .*`},
+	}
+	for _, t := range tests {
+		address, err := loopbackAddress("control API", t.address)
+		if t.err != "" {
+			c.Check(err, check.ErrorMatches, t.err, check.Commentf(t.address))
+			continue
+		}
+		c.Check(err, check.IsNil, check.Commentf(t.address))
+		c.Check(address, check.Equals, t.want, check.Commentf(t.address))
+	}
+}
+
+func (s *S) TestAPIProxyRunControlNotLoopback(c *check.C) {
+	output := filepath.Join(c.MkDir(), "session.jsonl")
+	command := apiProxy{stop: make(chan os.Signal, 1)}
+	command.Flags().Parse(true, []string{"--upstream", "localhost:8000", "-l", "127.0.0.1:0", "-o", output, "--control", "0.0.0.0:0"})
+	err := command.Run(&cmd.Context{Stdout: ioutil.Discard}, nil)
+	c.Assert(err, check.ErrorMatches, `the control API must listen on a loopback address, .*`)
+	_, err = os.Stat(output)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestAPIProxyRunControlPortOnly(c *check.C) {
+	output := filepath.Join(c.MkDir(), "session.jsonl")
+	var stdout bytes.Buffer
+	command := apiProxy{stop: make(chan os.Signal, 1)}
+	command.Flags().Parse(true, []string{"--upstream", "localhost:8000", "-l", "127.0.0.1:0", "-o", output, "--control", ":0"})
+	command.stop <- os.Interrupt
+	err := command.Run(&cmd.Context{Stdout: &stdout}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*Control API listening at 127\.0\.0\.1:\d+\..*`)
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// replayResult is the result of sending a recorded exchange again.
+type replayResult struct {
+	exchange exchange
+	status   int
+	err      error
+
+	// skipped tells the exchange wasn't sent again, as a fault was
+	// injected in it.
+	skipped bool
+}
+
+func (r *replayResult) matches() bool {
+	return r.err == nil && r.status == r.exchange.Status
+}
+
+// replay sends the recorded requests to the service API, in order.
+func replay(api *serviceAPI, exchanges []exchange) []replayResult {
+	results := make([]replayResult, len(exchanges))
+	for i, ex := range exchanges {
+		header := http.Header{}
+		for name, values := range ex.Header {
+			if http.CanonicalHeaderKey(name) != "Authorization" {
+				header[name] = values
+			}
+		}
+		results[i].exchange = ex
+		// The recorded response was made up or altered by the proxy, so
+		// the service API can't be expected to respond like it.
+		if ex.Fault != "" {
+			results[i].skipped = true
+			continue
+		}
+		resp, err := api.send(ex.Method, ex.Path, header, []byte(ex.Body))
+		if err != nil {
+			results[i].err = err
+			continue
+		}
+		results[i].status = resp.status
+	}
+	return results
+}
+
+type apiReplay struct {
+	fs       *gnuflag.FlagSet
+	manifest string
+	env      string
+	strict   bool
+}
+
+func (c *apiReplay) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "api-replay",
+		Usage: "api-replay <session-file> <endpoint> [-m/--manifest <manifest-file.yaml>] [-e/--env <environment>] [--strict]",
+		Desc: `Sends the requests recorded by "api-proxy" to a service API again.
+
+The requests in the session file are sent in order to the given endpoint, and
+the status of each response is compared with the recorded one. As the secret
+of the service is never recorded, the credentials are taken from the manifest,
+which defaults to "manifest.yaml".
+
+The endpoint may be a URL or the name of an endpoint in the manifest, like
+"production". Exchanges recorded while a fault was injected are skipped. The
+command fails if any response differs from the recorded one. With the --strict
+flag, the replayed requests and responses are also
+validated against the OpenAPI document of the services API (see "api-spec"),
+and exchanges that don't conform to it differ.`,
+		MinArgs: 2,
+		MaxArgs: 2,
+	}
+}
+
+func (c *apiReplay) Run(context *cmd.Context, client *cmd.Client) error {
+	exchanges, err := readSession(context.Args[0])
+	if err != nil {
+		return err
+	}
+	path := c.manifest
+	if path == "" {
+		path = "manifest.yaml"
+	}
+	m, err := loadManifest(path, c.env, true)
+	if err != nil {
+		return err
+	}
+	api := newServiceAPI(resolveEndpoint(m, context.Args[1]), m)
+	if c.strict {
+		api.validator = servicesAPIValidator
+	}
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"#", "Request", "Recorded", "Replayed", "Result"}
+	var differed, skipped int
+	for i, r := range replay(api, exchanges) {
+		replayed := strconv.Itoa(r.status)
+		result := "ok"
+		if r.err != nil {
+			replayed = r.err.Error()
+		}
+		if r.skipped {
+			replayed = "-"
+			result = fmt.Sprintf("skipped (fault %q)", r.exchange.Fault)
+			skipped++
+		} else if !r.matches() {
+			result = "differs"
+			differed++
+		}
+		table.AddRow(cmd.Row{
+			strconv.Itoa(i + 1),
+			r.exchange.Method + " " + r.exchange.Path,
+			strconv.Itoa(r.exchange.Status),
+			replayed,
+			result,
+		})
+	}
+	context.Stdout.Write(table.Bytes())
+	fmt.Fprintf(context.Stdout, "%d matched, %d differed", len(exchanges)-differed-skipped, differed)
+	if skipped > 0 {
+		fmt.Fprintf(context.Stdout, ", %d skipped", skipped)
+	}
+	fmt.Fprintln(context.Stdout, ".")
+	if differed > 0 {
+		return fmt.Errorf("%d response(s) differed from the session", differed)
+	}
+	return nil
+}
+
+func (c *apiReplay) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("api-replay", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.manifest, "manifest", "", "Manifest file with the credentials of the service (default: manifest.yaml)")
+		c.fs.StringVar(&c.manifest, "m", "", "Manifest file with the credentials of the service (default: manifest.yaml)")
+		c.fs.StringVar(&c.env, "env", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.StringVar(&c.env, "e", "", "Environment whose overlay file is merged over the manifest")
+		c.fs.BoolVar(&c.strict, "strict", false, "Validate requests and responses against the OpenAPI document of the services API")
+	}
+	return c.fs
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestReplay(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	exchanges := []exchange{
+		{Method: "POST", Path: "/resources", Header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}, "Authorization": {"Basic mysqlapi:REDACTED"}}, Body: "name=mydb&plan=small", Status: 201},
+		{Method: "GET", Path: "/resources/mydb/status", Status: 204},
+		{Method: "DELETE", Path: "/resources/other", Status: 200},
+	}
+	results := replay(newServiceAPI(fake.server.URL, fake.manifest()), exchanges)
+	c.Assert(results, check.HasLen, 3)
+	c.Assert(results[0].status, check.Equals, http.StatusCreated)
+	c.Assert(results[0].matches(), check.Equals, true)
+	c.Assert(results[1].matches(), check.Equals, true)
+	c.Assert(results[2].status, check.Equals, http.StatusNotFound)
+	c.Assert(results[2].matches(), check.Equals, false)
+	c.Assert(fake.instances["mydb"], check.NotNil)
+}
+
+func (s *S) TestAPIReplayRun(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	_, session := recordSession(c, fake)
+	dir := c.MkDir()
+	sessionPath := filepath.Join(dir, "session.jsonl")
+	err := ioutil.WriteFile(sessionPath, []byte(session), 0600)
+	c.Assert(err, check.IsNil)
+	manifestPath := filepath.Join(dir, "manifest.yaml")
+	data := "id: mysqlapi\npassword: s3cr3t\nendpoint:\n  production: " + fake.server.URL + "\n"
+	err = ioutil.WriteFile(manifestPath, []byte(data), 0600)
+	c.Assert(err, check.IsNil)
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{sessionPath, "production"}, Stdout: &stdout}
+	command := apiReplay{}
+	command.Flags().Parse(true, []string{"-m", manifestPath})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*\| 2 +\| POST /resources/mydb/bind-app +\| 201 +\| 201 +\| ok +\|.*4 matched, 0 differed.\n$`)
+	fake.overrides["POST /resources/{name}/bind-app"] = http.StatusInternalServerError
+	stdout.Reset()
+	err = command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `1 response\(s\) differed from the session`)
+	c.Assert(stdout.String(), check.Matches, `(?s).*\| 2 +\| POST /resources/mydb/bind-app +\| 201 +\| 500 +\| differs +\|.*3 matched, 1 differed.\n$`)
+}
+
+func (s *S) TestAPIReplaySkipsFaults(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	rules, err := parseFaultRules([]byte("rules: [{name: broken-binds, route: bind-app, status: 503}, {route: status, drop: true}]"))
+	c.Assert(err, check.IsNil)
+	var session bytes.Buffer
+	proxy := newServiceProxy(fake.server.URL, ioutil.Discard, &session)
+	proxy.faults = newFaultSet(rules)
+	server := httptest.NewServer(proxy)
+	api := newServiceAPI(server.URL, fake.manifest())
+	_, err = api.createInstance("mydb", "small", "admin")
+	c.Assert(err, check.IsNil)
+	resp, err := api.bindApp("mydb", "myapp", "myapp.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.status, check.Equals, http.StatusServiceUnavailable)
+	_, err = api.instanceStatus("mydb")
+	c.Assert(err, check.NotNil)
+	_, err = api.removeInstance("mydb")
+	c.Assert(err, check.IsNil)
+	server.Close()
+	dir := c.MkDir()
+	sessionPath := filepath.Join(dir, "session.jsonl")
+	err = ioutil.WriteFile(sessionPath, session.Bytes(), 0600)
+	c.Assert(err, check.IsNil)
+	manifestPath := filepath.Join(dir, "manifest.yaml")
+	err = ioutil.WriteFile(manifestPath, []byte("id: mysqlapi\npassword: s3cr3t\nendpoint:\n  production: "+fake.server.URL+"\n"), 0600)
+	c.Assert(err, check.IsNil)
+	fake.requests = nil
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{sessionPath, "production"}, Stdout: &stdout}
+	command := apiReplay{}
+	command.Flags().Parse(true, []string{"-m", manifestPath})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	// The dropped status request is retried by the client, so it's recorded
+	// twice.
+	c.Assert(stdout.String(), check.Matches, `(?s).*\| 2 +\| POST /resources/mydb/bind-app +\| 503 +\| - +\| skipped \(fault "broken-binds"\) +\|
+\| 3 +\| GET /resources/mydb/status +\| 0 +\| - +\| skipped \(fault "rule-2"\) +\|
+.*2 matched, 0 differed, 3 skipped.\n$`)
+	c.Assert(fake.requests, check.DeepEquals, []string{"POST /resources", "DELETE /resources/mydb"})
+}
+
+func (s *S) TestAPIReplaySessionNotFound(c *check.C) {
+	context := cmd.Context{Args: []string{"testdata/not-found.jsonl", "production"}}
+	err := (&apiReplay{}).Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "open testdata/not-found.jsonl: no such file or directory")
+}
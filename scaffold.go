@@ -0,0 +1,193 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// scaffoldData is the data available to the templates of a new service API
+// project.
+type scaffoldData struct {
+	ID          string
+	EnvPrefix   string
+	PasswordVar string
+}
+
+func newScaffoldData(id string) scaffoldData {
+	prefix := strings.ToUpper(strings.Replace(id, "-", "_", -1))
+	return scaffoldData{ID: id, EnvPrefix: prefix, PasswordVar: prefix + "_PASSWORD"}
+}
+
+// userTemplatesDir returns the directory with the templates that override the
+// built-in ones, with one directory per language.
+func userTemplatesDir() string {
+	return cmd.JoinWithUserDir(".crane", "templates")
+}
+
+// scaffoldTemplates returns the templates of the files of a project in the
+// given language, by their paths. The built-in templates are overridden by the
+// files in the directory of the language in dir, which may also define new
+// languages.
+func scaffoldTemplates(lang, dir string) (map[string]string, error) {
+	templates := map[string]string{}
+	for path, content := range builtinScaffolds[lang] {
+		templates[path] = content
+	}
+	langDir := filepath.Join(dir, lang)
+	err := filepath.Walk(langDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == langDir {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(langDir, path)
+		if err != nil {
+			return err
+		}
+		templates[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(templates) == 0 {
+		var langs []string
+		for l := range builtinScaffolds {
+			langs = append(langs, l)
+		}
+		sort.Strings(langs)
+		return nil, fmt.Errorf("unknown language %q, the available languages are: %s", lang, strings.Join(langs, ", "))
+	}
+	return templates, nil
+}
+
+// renderScaffold renders the templates, returning the content of each file by
+// its path.
+func renderScaffold(templates map[string]string, data scaffoldData) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	for path, content := range templates {
+		tmpl, err := template.New(path).Parse(content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %s: %s", path, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("invalid template %s: %s", path, err)
+		}
+		files[path] = buf.Bytes()
+	}
+	return files, nil
+}
+
+type serviceInit struct {
+	fs     *gnuflag.FlagSet
+	lang   string
+	output string
+	force  bool
+}
+
+func (c *serviceInit) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "init",
+		Usage: "init <service-id> [-l/--lang go|python] [-o/--output <directory>] [-f/--force]",
+		Desc: `Generates a new service API project.
+
+The project includes a skeleton of the service API, implementing every route of
+the tsuru services API, a manifest file, a documentation file and a test suite
+that checks the service API with "api-check". The project is generated in a
+directory named after the service, unless another directory is given.
+
+The templates of the project are built into crane, for the languages go (the
+default) and python. Files in ~/.crane/templates/<language> override the
+built-in templates with the same path, and new languages may be added by
+creating their directories. Templates use the syntax of Go's text/template
+package, with the fields .ID, .EnvPrefix and .PasswordVar.
+
+Existing files are not overwritten, unless the --force flag is given.`,
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *serviceInit) Run(context *cmd.Context, client *cmd.Client) error {
+	id := context.Args[0]
+	if err := validateServiceID(id); err != nil {
+		return err
+	}
+	lang := c.lang
+	if lang == "" {
+		lang = "go"
+	}
+	templates, err := scaffoldTemplates(lang, userTemplatesDir())
+	if err != nil {
+		return err
+	}
+	files, err := renderScaffold(templates, newScaffoldData(id))
+	if err != nil {
+		return err
+	}
+	dir := c.output
+	if dir == "" {
+		dir = id
+	}
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	if !c.force {
+		for _, path := range paths {
+			if _, err := os.Stat(filepath.Join(dir, path)); err == nil {
+				return fmt.Errorf("the file %q already exists, use --force to overwrite it", filepath.Join(dir, path))
+			}
+		}
+	}
+	for _, path := range paths {
+		target := filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(target, files[path], 0644); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(context.Stdout, "Service API project for %q created in %s:\n\n", id, dir)
+	for _, path := range paths {
+		fmt.Fprintf(context.Stdout, "  %s\n", path)
+	}
+	return nil
+}
+
+func (c *serviceInit) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("init", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.lang, "lang", "go", "Language of the service API")
+		c.fs.StringVar(&c.lang, "l", "go", "Language of the service API")
+		c.fs.StringVar(&c.output, "output", "", "Directory of the project (default: the service id)")
+		c.fs.StringVar(&c.output, "o", "", "Directory of the project (default: the service id)")
+		c.fs.BoolVar(&c.force, "force", false, "Overwrite existing files")
+		c.fs.BoolVar(&c.force, "f", false, "Overwrite existing files")
+	}
+	return c.fs
+}
@@ -0,0 +1,423 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// builtinScaffolds are the built-in templates of new service API projects, by
+// language and path.
+var builtinScaffolds = map[string]map[string]string{
+	"go": {
+		"main.go":       goServiceTemplate,
+		"main_test.go":  goServiceTestTemplate,
+		"manifest.yaml": scaffoldManifestTemplate,
+		"doc.md":        scaffoldDocTemplate,
+		"README.md":     goReadmeTemplate,
+	},
+	"python": {
+		"app.py":        pythonServiceTemplate,
+		"test_app.py":   pythonServiceTestTemplate,
+		"manifest.yaml": scaffoldManifestTemplate,
+		"doc.md":        scaffoldDocTemplate,
+		"README.md":     pythonReadmeTemplate,
+	},
+}
+
+const scaffoldManifestTemplate = `version: 2
+id: {{.ID}}
+description: {{.ID}} service for tsuru apps
+username: {{.ID}}
+password: ${{"{"}}{{.PasswordVar}}}
+doc: doc.md
+endpoints:
+  production: https://{{.ID}}.example.com
+plans:
+  - name: small
+    description: Small instance
+`
+
+const scaffoldDocTemplate = `{{.ID}} service
+
+Binding an instance of {{.ID}} to an app sets the following environment
+variables in the app:
+
+  {{.EnvPrefix}}_HOST: address of the instance
+  {{.EnvPrefix}}_INSTANCE: name of the instance
+`
+
+const goReadmeTemplate = `# {{.ID}}
+
+Service API of the {{.ID}} service, implementing the tsuru services API.
+
+Run it with:
+
+    $ export {{.PasswordVar}}=<password>
+    $ go run main.go
+
+Check it against the tsuru services API with:
+
+    $ crane api-check http://localhost:8888
+
+The tests run the same check, when crane is installed:
+
+    $ go test
+`
+
+const pythonReadmeTemplate = `# {{.ID}}
+
+Service API of the {{.ID}} service, implementing the tsuru services API.
+
+Run it with:
+
+    $ export {{.PasswordVar}}=<password>
+    $ python3 app.py
+
+Check it against the tsuru services API with:
+
+    $ crane api-check http://localhost:8888
+
+The tests run the same check, when crane is installed:
+
+    $ python3 -m unittest test_app
+`
+
+const goServiceTemplate = `// Service API of the {{.ID}} service, implementing the tsuru services API.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+var plans = []map[string]string{
+	{"name": "small", "description": "Small instance"},
+}
+
+type instance struct {
+	plan  string
+	team  string
+	apps  map[string]bool
+	units map[string]bool
+}
+
+type server struct {
+	username string
+	password string
+
+	mu        sync.Mutex
+	instances map[string]*instance
+}
+
+func newServer(username, password string) *server {
+	return &server{username: username, password: password, instances: map[string]*instance{}}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if username, password, ok := r.BasicAuth(); !ok || username != s.username || password != s.password {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// tsuru sends forms in the body of DELETE requests too, which aren't
+	// parsed by ParseForm.
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "resources" {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(parts) == 2 && parts[1] == "plans" && r.Method == "GET" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plans)
+		return
+	}
+	if len(parts) == 1 && r.Method == "POST" {
+		s.createInstance(w, form)
+		return
+	}
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	inst, ok := s.instances[parts[1]]
+	if !ok {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+	route := r.Method + " " + strings.Join(parts[2:], "/")
+	switch route {
+	case "DELETE ":
+		delete(s.instances, parts[1])
+	case "GET status":
+		w.WriteHeader(http.StatusNoContent)
+	case "POST bind-app":
+		inst.apps[form.Get("app-host")] = true
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{
+			"{{.EnvPrefix}}_HOST":     "localhost",
+			"{{.EnvPrefix}}_INSTANCE": parts[1],
+		})
+	case "DELETE bind-app":
+		delete(inst.apps, form.Get("app-host"))
+	case "POST bind":
+		inst.units[form.Get("unit-host")] = true
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE bind":
+		delete(inst.units, form.Get("unit-host"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *server) createInstance(w http.ResponseWriter, form url.Values) {
+	name := form.Get("name")
+	if name == "" {
+		http.Error(w, "the name of the instance is required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := s.instances[name]; ok {
+		http.Error(w, "the instance already exists", http.StatusConflict)
+		return
+	}
+	s.instances[name] = &instance{
+		plan:  form.Get("plan"),
+		team:  form.Get("team"),
+		apps:  map[string]bool{},
+		units: map[string]bool{},
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func main() {
+	password := os.Getenv("{{.PasswordVar}}")
+	if password == "" {
+		log.Fatal("the {{.PasswordVar}} environment variable is required")
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8888"
+	}
+	log.Fatal(http.ListenAndServe(":"+port, newServer("{{.ID}}", password)))
+}
+`
+
+const goServiceTestTemplate = `package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestUnauthorized(t *testing.T) {
+	server := httptest.NewServer(newServer("{{.ID}}", "secret"))
+	defer server.Close()
+	req, err := http.NewRequest("GET", server.URL+"/resources/plans", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("{{.ID}}", "wrong")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", resp.StatusCode)
+	}
+}
+
+// TestConformance checks the service API against the tsuru services API,
+// with crane api-check.
+func TestConformance(t *testing.T) {
+	crane, err := exec.LookPath("crane")
+	if err != nil {
+		t.Skip("crane is not installed")
+	}
+	server := httptest.NewServer(newServer("{{.ID}}", "secret"))
+	defer server.Close()
+	cmd := exec.Command(crane, "api-check", server.URL, "-m", "manifest.yaml")
+	cmd.Env = append(os.Environ(), "{{.PasswordVar}}=secret")
+	out, err := cmd.CombinedOutput()
+	t.Logf("%s", out)
+	if err != nil {
+		t.Fatalf("the service API doesn't conform to the tsuru services API: %s", err)
+	}
+}
+`
+
+const pythonServiceTemplate = `"""Service API of the {{.ID}} service, implementing the tsuru services API."""
+
+import base64
+import json
+import os
+import threading
+from http.server import BaseHTTPRequestHandler, HTTPServer
+from socketserver import ThreadingMixIn
+from urllib.parse import parse_qs
+
+PLANS = [
+    {"name": "small", "description": "Small instance"},
+]
+
+
+class Store(object):
+    def __init__(self):
+        self.lock = threading.Lock()
+        self.instances = {}
+
+
+def make_handler(username, password, store):
+    expected = "Basic " + base64.b64encode(
+        (username + ":" + password).encode()).decode()
+
+    class Handler(BaseHTTPRequestHandler):
+        def do_GET(self):
+            self.route("GET")
+
+        def do_POST(self):
+            self.route("POST")
+
+        def do_DELETE(self):
+            self.route("DELETE")
+
+        def respond(self, status, body=None):
+            data = b""
+            if body is not None:
+                data = json.dumps(body).encode()
+            self.send_response(status)
+            if body is not None:
+                self.send_header("Content-Type", "application/json")
+            self.send_header("Content-Length", str(len(data)))
+            self.end_headers()
+            self.wfile.write(data)
+
+        def route(self, method):
+            if self.headers.get("Authorization") != expected:
+                return self.respond(401, "unauthorized")
+            length = int(self.headers.get("Content-Length") or 0)
+            query = parse_qs(self.rfile.read(length).decode())
+            form = dict((k, v[0]) for k, v in query.items())
+            parts = self.path.split("?")[0].strip("/").split("/")
+            if parts[0] != "resources":
+                return self.respond(404, "not found")
+            with store.lock:
+                if parts[1:] == ["plans"] and method == "GET":
+                    return self.respond(200, PLANS)
+                if len(parts) == 1 and method == "POST":
+                    return self.create_instance(form)
+                if len(parts) < 2 or parts[1] not in store.instances:
+                    return self.respond(404, "instance not found")
+                name, instance = parts[1], store.instances[parts[1]]
+                route = (method, "/".join(parts[2:]))
+                if route == ("DELETE", ""):
+                    del store.instances[name]
+                    return self.respond(200)
+                if route == ("GET", "status"):
+                    return self.respond(204)
+                if route == ("POST", "bind-app"):
+                    instance["apps"].add(form.get("app-host"))
+                    return self.respond(201, {
+                        "{{.EnvPrefix}}_HOST": "localhost",
+                        "{{.EnvPrefix}}_INSTANCE": name,
+                    })
+                if route == ("DELETE", "bind-app"):
+                    instance["apps"].discard(form.get("app-host"))
+                    return self.respond(200)
+                if route == ("POST", "bind"):
+                    instance["units"].add(form.get("unit-host"))
+                    return self.respond(201)
+                if route == ("DELETE", "bind"):
+                    instance["units"].discard(form.get("unit-host"))
+                    return self.respond(200)
+                return self.respond(404, "not found")
+
+        def create_instance(self, form):
+            name = form.get("name")
+            if not name:
+                return self.respond(400, "the name of the instance is required")
+            if name in store.instances:
+                return self.respond(409, "the instance already exists")
+            store.instances[name] = {
+                "plan": form.get("plan"),
+                "team": form.get("team"),
+                "apps": set(),
+                "units": set(),
+            }
+            return self.respond(201)
+
+    return Handler
+
+
+class Server(ThreadingMixIn, HTTPServer):
+    daemon_threads = True
+
+
+def new_server(address, username, password):
+    return Server(address, make_handler(username, password, Store()))
+
+
+if __name__ == "__main__":
+    password = os.environ.get("{{.PasswordVar}}")
+    if not password:
+        raise SystemExit("the {{.PasswordVar}} environment variable is required")
+    port = int(os.environ.get("PORT", "8888"))
+    new_server(("", port), "{{.ID}}", password).serve_forever()
+`
+
+const pythonServiceTestTemplate = `import os
+import shutil
+import subprocess
+import threading
+import unittest
+
+from app import new_server
+
+
+class ConformanceTest(unittest.TestCase):
+    """Checks the service API against the tsuru services API, with crane
+    api-check."""
+
+    def setUp(self):
+        self.server = new_server(("127.0.0.1", 0), "{{.ID}}", "secret")
+        thread = threading.Thread(target=self.server.serve_forever)
+        thread.daemon = True
+        thread.start()
+
+    def tearDown(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+    @unittest.skipIf(shutil.which("crane") is None, "crane is not installed")
+    def test_conformance(self):
+        url = "http://127.0.0.1:%d" % self.server.server_address[1]
+        env = dict(os.environ, {{.PasswordVar}}="secret")
+        result = subprocess.run(
+            ["crane", "api-check", url, "-m", "manifest.yaml"],
+            env=env, stdout=subprocess.PIPE, stderr=subprocess.STDOUT)
+        print(result.stdout.decode())
+        self.assertEqual(result.returncode, 0)
+
+
+if __name__ == "__main__":
+    unittest.main()
+`
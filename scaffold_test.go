@@ -0,0 +1,137 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestNewScaffoldData(c *check.C) {
+	data := newScaffoldData("mysql-api")
+	c.Assert(data, check.DeepEquals, scaffoldData{ID: "mysql-api", EnvPrefix: "MYSQL_API", PasswordVar: "MYSQL_API_PASSWORD"})
+}
+
+func (s *S) TestScaffoldTemplatesBuiltin(c *check.C) {
+	templates, err := scaffoldTemplates("go", c.MkDir())
+	c.Assert(err, check.IsNil)
+	c.Assert(templates, check.DeepEquals, builtinScaffolds["go"])
+	_, err = scaffoldTemplates("ruby", c.MkDir())
+	c.Assert(err, check.ErrorMatches, `unknown language "ruby", the available languages are: go, python`)
+}
+
+func (s *S) TestScaffoldTemplatesOverride(c *check.C) {
+	dir := c.MkDir()
+	err := os.MkdirAll(filepath.Join(dir, "go", "scripts"), 0755)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "go", "README.md"), []byte("# {{.ID}} at ACME\n"), 0644)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "go", "scripts", "deploy.sh"), []byte("deploy {{.ID}}\n"), 0644)
+	c.Assert(err, check.IsNil)
+	templates, err := scaffoldTemplates("go", dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(templates, check.HasLen, len(builtinScaffolds["go"])+1)
+	c.Assert(templates["README.md"], check.Equals, "# {{.ID}} at ACME\n")
+	c.Assert(templates["scripts/deploy.sh"], check.Equals, "deploy {{.ID}}\n")
+	c.Assert(templates["main.go"], check.Equals, goServiceTemplate)
+}
+
+func (s *S) TestScaffoldTemplatesNewLanguage(c *check.C) {
+	dir := c.MkDir()
+	err := os.MkdirAll(filepath.Join(dir, "ruby"), 0755)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "ruby", "app.rb"), []byte("# {{.ID}}\n"), 0644)
+	c.Assert(err, check.IsNil)
+	templates, err := scaffoldTemplates("ruby", dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(templates, check.DeepEquals, map[string]string{"app.rb": "# {{.ID}}\n"})
+}
+
+func (s *S) TestRenderScaffold(c *check.C) {
+	for lang, templates := range builtinScaffolds {
+		files, err := renderScaffold(templates, newScaffoldData("mysqlapi"))
+		c.Assert(err, check.IsNil, check.Commentf(lang))
+		c.Assert(files, check.HasLen, len(templates))
+		m, err := parseManifest(files["manifest.yaml"])
+		c.Assert(err, check.IsNil, check.Commentf(lang))
+		c.Check(m.ID, check.Equals, "mysqlapi")
+		c.Check(m.Password, check.Equals, "${MYSQLAPI_PASSWORD}")
+		c.Check(m.Doc, check.Equals, "doc.md")
+	}
+	files, err := renderScaffold(builtinScaffolds["go"], newScaffoldData("mysqlapi"))
+	c.Assert(err, check.IsNil)
+	for _, path := range []string{"main.go", "main_test.go"} {
+		formatted, err := format.Source(files[path])
+		c.Assert(err, check.IsNil, check.Commentf(path))
+		c.Check(string(formatted), check.Equals, string(files[path]), check.Commentf(path))
+	}
+	c.Assert(bytes.Contains(files["main.go"], []byte(`"MYSQLAPI_HOST":     "localhost"`)), check.Equals, true)
+	_, err = renderScaffold(map[string]string{"broken": "{{.ID"}, newScaffoldData("mysqlapi"))
+	c.Assert(err, check.ErrorMatches, "invalid template broken: .*")
+	_, err = renderScaffold(map[string]string{"broken": "{{.Name}}"}, newScaffoldData("mysqlapi"))
+	c.Assert(err, check.ErrorMatches, "invalid template broken: .*")
+}
+
+func (s *S) TestInitRun(c *check.C) {
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", c.MkDir())
+	dir := filepath.Join(c.MkDir(), "mysqlapi")
+	var stdout bytes.Buffer
+	context := cmd.Context{Args: []string{"mysqlapi"}, Stdout: &stdout}
+	command := serviceInit{}
+	command.Flags().Parse(true, []string{"-l", "python", "-o", dir})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Service API project for "mysqlapi" created in `+dir+`:
+
+  README.md
+  app.py
+  doc.md
+  manifest.yaml
+  test_app.py
+`)
+	m, err := loadManifest(filepath.Join(dir, "manifest.yaml"), "", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.ID, check.Equals, "mysqlapi")
+	err = command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `the file ".*/mysqlapi/README.md" already exists, use --force to overwrite it`)
+	command.Flags().Parse(true, []string{"--force"})
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestInitRunUserTemplates(c *check.C) {
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", c.MkDir())
+	langDir := filepath.Join(os.Getenv("HOME"), ".crane", "templates", "go")
+	err := os.MkdirAll(langDir, 0755)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(langDir, "doc.md"), []byte("Docs of {{.ID}}.\n"), 0644)
+	c.Assert(err, check.IsNil)
+	dir := filepath.Join(c.MkDir(), "redisapi")
+	context := cmd.Context{Args: []string{"redisapi"}, Stdout: ioutil.Discard}
+	command := serviceInit{output: dir}
+	err = command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "doc.md"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "Docs of redisapi.\n")
+	_, err = os.Stat(filepath.Join(dir, "main.go"))
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestInitRunInvalidID(c *check.C) {
+	context := cmd.Context{Args: []string{"MySQL API"}}
+	err := (&serviceInit{}).Run(&context, nil)
+	c.Assert(err, check.NotNil)
+}
@@ -0,0 +1,365 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/errors"
+)
+
+// service is the definition of a service, as stored in the tsuru server.
+type service struct {
+	Name        string
+	Username    string
+	Description string
+	Endpoint    map[string]string
+	OwnerTeams  []string
+}
+
+// plan is a plan offered by the service API of a service.
+type plan struct {
+	Name        string
+	Description string
+}
+
+// serviceState is everything crane manages about a service: its definition,
+// its documentation and the plans offered by its API.
+//
+// The password of the service is not part of its state: it can't be read from
+// the target, so it's never compared nor saved.
+type serviceState struct {
+	Name        string            `json:"name"`
+	Username    string            `json:"username,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Endpoint    map[string]string `json:"endpoint"`
+	Teams       []string          `json:"teams,omitempty"`
+	Doc         string            `json:"doc,omitempty"`
+	Plans       []string          `json:"plans,omitempty"`
+}
+
+// getService retrieves the definition of the given service from the target.
+// It returns nil, without an error, when the service does not exist.
+func getService(client *cmd.Client, id string) (*service, error) {
+	var s service
+	err := getJSON(client, "/services/"+id, &s)
+	if err != nil {
+		if httpErr, ok := err.(*errors.HTTP); ok && httpErr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &s, nil
+}
+
+func getServiceDoc(client *cmd.Client, id string) (string, error) {
+	u, err := cmd.GetURL("/services/" + id + "/doc")
+	if err != nil {
+		return "", err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	doc, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(doc), nil
+}
+
+func getServicePlans(client *cmd.Client, id string) ([]plan, error) {
+	var plans []plan
+	err := getJSON(client, "/services/"+id+"/plans", &plans)
+	if err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+// fetchServiceState retrieves the current state of the given service from the
+// target. It returns nil, without an error, when the service does not exist.
+func fetchServiceState(client *cmd.Client, id string) (*serviceState, error) {
+	s, err := getService(client, id)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	doc, err := getServiceDoc(client, id)
+	if err != nil {
+		return nil, err
+	}
+	plans, err := getServicePlans(client, id)
+	if err != nil {
+		return nil, err
+	}
+	state := serviceState{
+		Name:        s.Name,
+		Username:    s.Username,
+		Description: s.Description,
+		Endpoint:    s.Endpoint,
+		Teams:       sortedCopy(s.OwnerTeams),
+		Doc:         doc,
+	}
+	for _, p := range plans {
+		state.Plans = append(state.Plans, p.Name)
+	}
+	sort.Strings(state.Plans)
+	return &state, nil
+}
+
+// manifestState returns the state described by the manifest, loading the doc
+// file if the manifest references one.
+func manifestState(m *manifest) (*serviceState, error) {
+	state := serviceState{
+		Name:        m.ID,
+		Username:    m.Username,
+		Description: m.Description,
+		Endpoint:    m.Endpoints,
+		Teams:       sortedCopy(m.Teams),
+		Plans:       m.planNames(),
+	}
+	if m.Doc != "" {
+		doc, err := ioutil.ReadFile(m.path(m.Doc))
+		if err != nil {
+			return nil, err
+		}
+		state.Doc = string(doc)
+	}
+	return &state, nil
+}
+
+// fingerprint returns a hash of the state, used to detect whether the state
+// changed between two points in time. A nil state has a fingerprint too.
+func (s *serviceState) fingerprint() string {
+	data, _ := json.Marshal(s)
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func createService(client *cmd.Client, desired *serviceState, password string) error {
+	u, err := cmd.GetURL("/services")
+	if err != nil {
+		return err
+	}
+	values := stateValues(desired, password)
+	values.Set("id", desired.Name)
+	return sendForm(client, "POST", u, values)
+}
+
+func updateService(client *cmd.Client, desired *serviceState, password string) error {
+	u, err := cmd.GetURL("/services/" + desired.Name)
+	if err != nil {
+		return err
+	}
+	return sendForm(client, "PUT", u, stateValues(desired, password))
+}
+
+func updateServiceDoc(client *cmd.Client, id, doc string) error {
+	u, err := cmd.GetURL("/services/" + id + "/doc")
+	if err != nil {
+		return err
+	}
+	return sendForm(client, "PUT", u, url.Values{"doc": []string{doc}})
+}
+
+// stateValues encodes the service definition as form values. The production
+// endpoint is sent as "endpoint", other endpoints are sent as
+// "endpoint.<name>". An empty password is not sent, keeping the current one.
+func stateValues(s *serviceState, password string) url.Values {
+	values := url.Values{}
+	if s.Username != "" {
+		values.Set("username", s.Username)
+	}
+	if password != "" {
+		values.Set("password", password)
+	}
+	if s.Description != "" {
+		values.Set("description", s.Description)
+	}
+	for name, endpoint := range s.Endpoint {
+		if name == "production" {
+			values.Set("endpoint", endpoint)
+		} else {
+			values.Set("endpoint."+name, endpoint)
+		}
+	}
+	for _, team := range s.Teams {
+		values.Add("team", team)
+	}
+	return values
+}
+
+func getJSON(client *cmd.Client, path string, v interface{}) error {
+	u, err := cmd.GetURL(path)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+func sendForm(client *cmd.Client, method, u string, values url.Values) error {
+	request, err := http.NewRequest(method, u, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// change is a difference between the desired and the current value of a
+// field in a service. An empty Old value means the field will be added, an
+// empty New value means it will be removed.
+//
+// Read-only changes are differences crane can report but not fix, like plans,
+// which are defined by the service API.
+type change struct {
+	Field    string `json:"field"`
+	Old      string `json:"old,omitempty"`
+	New      string `json:"new,omitempty"`
+	ReadOnly bool   `json:"readonly,omitempty"`
+}
+
+func (c change) String() string {
+	var s string
+	switch {
+	case c.Old == "":
+		s = fmt.Sprintf("+ %s: %s", c.Field, c.New)
+	case c.New == "":
+		s = fmt.Sprintf("- %s: %s", c.Field, c.Old)
+	default:
+		s = fmt.Sprintf("~ %s: %s => %s", c.Field, c.Old, c.New)
+	}
+	if c.ReadOnly {
+		s += " (read-only, managed by the service API)"
+	}
+	return s
+}
+
+// diffState computes the changes needed to make the current state match the
+// desired state. Optional fields, like teams, doc and plans, are only compared
+// when the desired state defines them.
+func diffState(desired, current *serviceState) []change {
+	var changes []change
+	if desired.Username != "" && desired.Username != current.Username {
+		changes = append(changes, change{Field: "username", Old: current.Username, New: desired.Username})
+	}
+	if desired.Description != "" && desired.Description != current.Description {
+		changes = append(changes, change{Field: "description", Old: current.Description, New: desired.Description})
+	}
+	changes = append(changes, diffMap("endpoint", current.Endpoint, desired.Endpoint)...)
+	if len(desired.Teams) > 0 {
+		changes = append(changes, diffSet("team", current.Teams, desired.Teams)...)
+	}
+	if desired.Doc != "" && desired.Doc != current.Doc {
+		changes = append(changes, change{Field: "doc", Old: docSummary(current.Doc), New: docSummary(desired.Doc)})
+	}
+	if len(desired.Plans) > 0 {
+		planChanges := diffSet("plan", current.Plans, desired.Plans)
+		for i := range planChanges {
+			planChanges[i].ReadOnly = true
+		}
+		changes = append(changes, planChanges...)
+	}
+	return changes
+}
+
+// hasChanges reports whether any of the changes touches the given field, or
+// any of its keys.
+func hasChanges(changes []change, field string) bool {
+	for _, c := range changes {
+		if c.Field == field || strings.HasPrefix(c.Field, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func diffMap(field string, current, desired map[string]string) []change {
+	var keys []string
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	for key := range current {
+		if _, ok := desired[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var changes []change
+	for _, key := range keys {
+		if current[key] != desired[key] {
+			changes = append(changes, change{Field: field + "." + key, Old: current[key], New: desired[key]})
+		}
+	}
+	return changes
+}
+
+func diffSet(field string, current, desired []string) []change {
+	in := func(s string, set []string) bool {
+		for _, item := range set {
+			if item == s {
+				return true
+			}
+		}
+		return false
+	}
+	var changes []change
+	for _, item := range current {
+		if !in(item, desired) {
+			changes = append(changes, change{Field: field, Old: item})
+		}
+	}
+	for _, item := range desired {
+		if !in(item, current) {
+			changes = append(changes, change{Field: field, New: item})
+		}
+	}
+	return changes
+}
+
+func docSummary(doc string) string {
+	if doc == "" {
+		return ""
+	}
+	lines := strings.Count(strings.TrimRight(doc, "\n"), "\n") + 1
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(doc)))
+	return fmt.Sprintf("%d lines, sha256 %s", lines, sum[:12])
+}
+
+func sortedCopy(items []string) []string {
+	if len(items) == 0 {
+		return nil
+	}
+	result := make([]string, len(items))
+	copy(result, items)
+	sort.Strings(result)
+	return result
+}
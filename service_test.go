@@ -0,0 +1,281 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/cmd/cmdtest"
+	"gopkg.in/check.v1"
+)
+
+// fakeTarget is a minimal tsuru server, keeping service definitions in
+// memory. It becomes the target while it's running.
+type fakeTarget struct {
+	server   *httptest.Server
+	services map[string]*service
+	docs     map[string]string
+	plans    map[string][]plan
+	requests []string
+}
+
+func newFakeTarget() *fakeTarget {
+	t := &fakeTarget{
+		services: map[string]*service{},
+		docs:     map[string]string{},
+		plans:    map[string][]plan{},
+	}
+	t.server = httptest.NewServer(t)
+	os.Setenv("TSURU_TARGET", t.server.URL)
+	return t
+}
+
+func (t *fakeTarget) stop() {
+	t.server.Close()
+	os.Setenv("TSURU_TARGET", "http://localhost:8080")
+}
+
+func (t *fakeTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.requests = append(t.requests, r.Method+" "+r.URL.Path)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/1.0/services"), "/")
+	if r.Method == "POST" && r.URL.Path == "/1.0/services" {
+		t.services[r.FormValue("id")] = serviceFromForm(r)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id := parts[1]
+	s, ok := t.services[id]
+	if !ok {
+		http.Error(w, "service not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == "GET" && len(parts) == 2:
+		json.NewEncoder(w).Encode(s)
+	case r.Method == "PUT" && len(parts) == 2:
+		s = serviceFromForm(r)
+		s.Name = id
+		t.services[id] = s
+	case r.Method == "GET" && parts[2] == "doc":
+		w.Write([]byte(t.docs[id]))
+	case r.Method == "PUT" && parts[2] == "doc":
+		t.docs[id] = r.FormValue("doc")
+	case r.Method == "GET" && parts[2] == "plans":
+		json.NewEncoder(w).Encode(t.plans[id])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func serviceFromForm(r *http.Request) *service {
+	r.ParseForm()
+	s := service{
+		Name:        r.FormValue("id"),
+		Username:    r.FormValue("username"),
+		Description: r.FormValue("description"),
+		Endpoint:    map[string]string{},
+	}
+	for key, values := range r.Form {
+		if key == "endpoint" {
+			s.Endpoint["production"] = values[0]
+		} else if strings.HasPrefix(key, "endpoint.") {
+			s.Endpoint[strings.TrimPrefix(key, "endpoint.")] = values[0]
+		}
+	}
+	s.OwnerTeams = r.Form["team"]
+	return &s
+}
+
+func (s *S) TestGetService(c *check.C) {
+	trans := &cmdtest.ConditionalTransport{
+		Transport: cmdtest.Transport{
+			Message: `{"Name":"mysqlapi","Username":"mysqlapi","Endpoint":{"production":"mysqlapi.com"}}`,
+			Status:  http.StatusOK,
+		},
+		CondFunc: func(req *http.Request) bool {
+			return req.Method == "GET" && req.URL.Path == "/1.0/services/mysqlapi"
+		},
+	}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, manager)
+	svc, err := getService(client, "mysqlapi")
+	c.Assert(err, check.IsNil)
+	c.Assert(svc, check.DeepEquals, &service{
+		Name:     "mysqlapi",
+		Username: "mysqlapi",
+		Endpoint: map[string]string{"production": "mysqlapi.com"},
+	})
+}
+
+func (s *S) TestGetServiceNotFound(c *check.C) {
+	trans := &cmdtest.Transport{Message: "service not found", Status: http.StatusNotFound}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, manager)
+	svc, err := getService(client, "mysqlapi")
+	c.Assert(err, check.IsNil)
+	c.Assert(svc, check.IsNil)
+}
+
+func (s *S) TestGetServiceFailure(c *check.C) {
+	trans := &cmdtest.Transport{Message: "something went wrong", Status: http.StatusInternalServerError}
+	client := cmd.NewClient(&http.Client{Transport: trans}, nil, manager)
+	_, err := getService(client, "mysqlapi")
+	c.Assert(err, check.ErrorMatches, "something went wrong")
+}
+
+func (s *S) TestFetchServiceState(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	target.services["mysqlapi"] = &service{
+		Name:       "mysqlapi",
+		Endpoint:   map[string]string{"production": "mysqlapi.com"},
+		OwnerTeams: []string{"ops", "admin"},
+	}
+	target.docs["mysqlapi"] = "mysqlapi docs"
+	target.plans["mysqlapi"] = []plan{{Name: "small"}, {Name: "big"}}
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	state, err := fetchServiceState(client, "mysqlapi")
+	c.Assert(err, check.IsNil)
+	c.Assert(state, check.DeepEquals, &serviceState{
+		Name:     "mysqlapi",
+		Endpoint: map[string]string{"production": "mysqlapi.com"},
+		Teams:    []string{"admin", "ops"},
+		Doc:      "mysqlapi docs",
+		Plans:    []string{"big", "small"},
+	})
+}
+
+func (s *S) TestFetchServiceStateNotFound(c *check.C) {
+	target := newFakeTarget()
+	defer target.stop()
+	client := cmd.NewClient(http.DefaultClient, nil, manager)
+	state, err := fetchServiceState(client, "mysqlapi")
+	c.Assert(err, check.IsNil)
+	c.Assert(state, check.IsNil)
+}
+
+func (s *S) TestManifestState(c *check.C) {
+	m := &manifest{
+		ID:          "mysqlapi",
+		Username:    "mysql",
+		Description: "MySQL databases",
+		Endpoints:   map[string]string{"production": "mysqlapi.com"},
+		Teams:       []string{"ops", "admin"},
+		Doc:         "doc.txt",
+		Plans:       []manifestPlan{{Name: "small"}, {Name: "big"}},
+		dir:         "testdata",
+	}
+	state, err := manifestState(m)
+	c.Assert(err, check.IsNil)
+	c.Assert(state.Username, check.Equals, "mysql")
+	c.Assert(state.Description, check.Equals, "MySQL databases")
+	c.Assert(state.Teams, check.DeepEquals, []string{"admin", "ops"})
+	c.Assert(state.Plans, check.DeepEquals, []string{"big", "small"})
+	c.Assert(state.Doc, check.Matches, "(?s)mysqlapi\n.*MYSQL_HOST.*")
+}
+
+func (s *S) TestManifestStateDocNotFound(c *check.C) {
+	m := &manifest{ID: "mysqlapi", Doc: "unknown.txt", dir: "testdata"}
+	_, err := manifestState(m)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestFingerprint(c *check.C) {
+	var nilState *serviceState
+	state := &serviceState{Name: "mysqlapi", Endpoint: map[string]string{"production": "mysqlapi.com"}}
+	c.Assert(nilState.fingerprint(), check.HasLen, 64)
+	c.Assert(state.fingerprint(), check.Not(check.Equals), nilState.fingerprint())
+	state.Doc = "docs"
+	other := *state
+	c.Assert(state.fingerprint(), check.Equals, other.fingerprint())
+}
+
+func (s *S) TestDiffState(c *check.C) {
+	desired := &serviceState{
+		Name:     "mysqlapi",
+		Endpoint: map[string]string{"production": "mysqlapi.com", "staging": "staging.mysqlapi.com"},
+		Teams:    []string{"admin"},
+		Doc:      "new docs\n",
+		Plans:    []string{"small"},
+	}
+	current := &serviceState{
+		Name:     "mysqlapi",
+		Endpoint: map[string]string{"production": "old.mysqlapi.com", "dev": "dev.mysqlapi.com"},
+		Teams:    []string{"ops"},
+		Plans:    []string{"big", "small"},
+	}
+	changes := diffState(desired, current)
+	c.Assert(changes, check.DeepEquals, []change{
+		{Field: "endpoint.dev", Old: "dev.mysqlapi.com"},
+		{Field: "endpoint.production", Old: "old.mysqlapi.com", New: "mysqlapi.com"},
+		{Field: "endpoint.staging", New: "staging.mysqlapi.com"},
+		{Field: "team", Old: "ops"},
+		{Field: "team", New: "admin"},
+		{Field: "doc", New: "1 lines, sha256 28134158a6f3"},
+		{Field: "plan", Old: "big", ReadOnly: true},
+	})
+	c.Assert(changes[0].String(), check.Equals, "- endpoint.dev: dev.mysqlapi.com")
+	c.Assert(changes[1].String(), check.Equals, "~ endpoint.production: old.mysqlapi.com => mysqlapi.com")
+	c.Assert(changes[2].String(), check.Equals, "+ endpoint.staging: staging.mysqlapi.com")
+	c.Assert(changes[6].String(), check.Equals, "- plan: big (read-only, managed by the service API)")
+}
+
+func (s *S) TestDiffStateUsernameAndDescription(c *check.C) {
+	desired := &serviceState{Name: "mysqlapi", Username: "mysql", Description: "MySQL databases"}
+	current := &serviceState{Name: "mysqlapi", Username: "mysqlapi"}
+	c.Assert(diffState(desired, current), check.DeepEquals, []change{
+		{Field: "username", Old: "mysqlapi", New: "mysql"},
+		{Field: "description", New: "MySQL databases"},
+	})
+}
+
+func (s *S) TestStateValues(c *check.C) {
+	state := &serviceState{
+		Name:        "mysqlapi",
+		Username:    "mysql",
+		Description: "MySQL databases",
+		Endpoint:    map[string]string{"production": "mysqlapi.com", "staging": "staging.mysqlapi.com"},
+		Teams:       []string{"admin", "ops"},
+	}
+	values := stateValues(state, "s3cr3t")
+	c.Assert(values, check.DeepEquals, url.Values{
+		"username":         {"mysql"},
+		"password":         {"s3cr3t"},
+		"description":      {"MySQL databases"},
+		"endpoint":         {"mysqlapi.com"},
+		"endpoint.staging": {"staging.mysqlapi.com"},
+		"team":             {"admin", "ops"},
+	})
+	values = stateValues(state, "")
+	_, ok := values["password"]
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *S) TestDiffStateOnlyComparesDefinedFields(c *check.C) {
+	desired := &serviceState{Name: "mysqlapi", Endpoint: map[string]string{"production": "mysqlapi.com"}}
+	current := &serviceState{
+		Name:     "mysqlapi",
+		Endpoint: map[string]string{"production": "mysqlapi.com"},
+		Teams:    []string{"ops"},
+		Doc:      "docs",
+		Plans:    []string{"small"},
+	}
+	c.Assert(diffState(desired, current), check.HasLen, 0)
+}
+
+func (s *S) TestHasChanges(c *check.C) {
+	changes := []change{{Field: "endpoint.production"}, {Field: "doc"}}
+	c.Assert(hasChanges(changes, "endpoint"), check.Equals, true)
+	c.Assert(hasChanges(changes, "doc"), check.Equals, true)
+	c.Assert(hasChanges(changes, "team"), check.Equals, false)
+}
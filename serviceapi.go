@@ -0,0 +1,142 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// serviceAPI is a client of the API implemented by service providers, which
+// tsuru calls to manage service instances and bind them to apps.
+type serviceAPI struct {
+	endpoint string
+	username string
+	password string
+	client   *http.Client
+
+	// validator, when set, validates every exchange with the service API,
+	// making the calls fail with a *specError on violations.
+	validator *specValidator
+}
+
+// newServiceAPI returns a client of the service API in the given endpoint,
+// authenticating with the credentials in the manifest.
+func newServiceAPI(endpoint string, m *manifest) *serviceAPI {
+	username := m.Username
+	if username == "" {
+		username = m.ID
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	return &serviceAPI{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		username: username,
+		password: m.Password,
+		client:   &http.Client{Timeout: time.Minute},
+	}
+}
+
+// resolveEndpoint returns the URL of the endpoint, which may be a URL or the
+// name of an endpoint in the manifest.
+func resolveEndpoint(m *manifest, endpoint string) string {
+	if !strings.Contains(endpoint, "://") {
+		if e, ok := m.Endpoints[endpoint]; ok {
+			return e
+		}
+	}
+	return endpoint
+}
+
+// apiResponse is the response of the service API to a call.
+type apiResponse struct {
+	status   int
+	body     []byte
+	duration time.Duration
+}
+
+// call sends a request to the service API. Responses with error status are not
+// errors, only failures to talk to the API are.
+func (a *serviceAPI) call(method, path string, params url.Values) (*apiResponse, error) {
+	header := http.Header{}
+	var body string
+	if params != nil {
+		header.Set("Content-Type", "application/x-www-form-urlencoded")
+		body = params.Encode()
+	}
+	return a.send(method, path, header, []byte(body))
+}
+
+// send sends a request to the service API with the given headers and body,
+// authenticating with the credentials of the service. When the exchange is
+// validated and doesn't conform to the services API, the response is returned
+// along with a *specError.
+func (a *serviceAPI) send(method, path string, header http.Header, body []byte) (*apiResponse, error) {
+	req, err := http.NewRequest(method, a.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.SetBasicAuth(a.username, a.password)
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json")
+	}
+	start := time.Now()
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	result := &apiResponse{status: resp.StatusCode, body: data, duration: time.Since(start)}
+	if a.validator != nil {
+		if err := a.validator.validate(method, path, req.Header, body, resp.StatusCode, data); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (a *serviceAPI) plans() (*apiResponse, error) {
+	return a.call("GET", "/resources/plans", nil)
+}
+
+func (a *serviceAPI) createInstance(name, plan, team string) (*apiResponse, error) {
+	return a.call("POST", "/resources", url.Values{"name": {name}, "plan": {plan}, "team": {team}})
+}
+
+func (a *serviceAPI) instanceStatus(name string) (*apiResponse, error) {
+	return a.call("GET", "/resources/"+name+"/status", nil)
+}
+
+func (a *serviceAPI) bindApp(name, appName, appHost string) (*apiResponse, error) {
+	return a.call("POST", "/resources/"+name+"/bind-app", url.Values{"app-name": {appName}, "app-host": {appHost}})
+}
+
+func (a *serviceAPI) unbindApp(name, appName, appHost string) (*apiResponse, error) {
+	return a.call("DELETE", "/resources/"+name+"/bind-app", url.Values{"app-name": {appName}, "app-host": {appHost}})
+}
+
+func (a *serviceAPI) bindUnit(name, appHost, unitHost string) (*apiResponse, error) {
+	return a.call("POST", "/resources/"+name+"/bind", url.Values{"app-host": {appHost}, "unit-host": {unitHost}})
+}
+
+func (a *serviceAPI) unbindUnit(name, appHost, unitHost string) (*apiResponse, error) {
+	return a.call("DELETE", "/resources/"+name+"/bind", url.Values{"app-host": {appHost}, "unit-host": {unitHost}})
+}
+
+func (a *serviceAPI) removeInstance(name string) (*apiResponse, error) {
+	return a.call("DELETE", "/resources/"+name, nil)
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"gopkg.in/check.v1"
+)
+
+// fakeServiceAPI is a service API that follows the contract of the tsuru
+// services API, keeping instances in memory. Its behavior can be broken on
+// purpose, by overriding the status code of a route, like
+// "DELETE /resources/{name}", regardless of the credentials in the request.
+type fakeServiceAPI struct {
+	server    *httptest.Server
+	username  string
+	password  string
+	envs      map[string]string
+	overrides map[string]int
+
+	mu        sync.Mutex
+	instances map[string]map[string]bool
+	requests  []string
+}
+
+func newFakeServiceAPI() *fakeServiceAPI {
+	api := &fakeServiceAPI{
+		username:  "mysqlapi",
+		password:  "s3cr3t",
+		envs:      map[string]string{"MYSQL_HOST": "10.0.0.2", "MYSQL_USER": "root"},
+		overrides: map[string]int{},
+		instances: map[string]map[string]bool{},
+	}
+	api.server = httptest.NewServer(api)
+	return api
+}
+
+func (a *fakeServiceAPI) stop() {
+	a.server.Close()
+}
+
+func (a *fakeServiceAPI) manifest() *manifest {
+	return &manifest{ID: a.username, Password: a.password, Endpoints: map[string]string{"production": a.server.URL}}
+}
+
+func (a *fakeServiceAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	parseForm(r)
+	route := r.Method + " " + r.URL.Path
+	a.requests = append(a.requests, route)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) > 1 && r.URL.Path != "/resources/plans" {
+		parts[1] = "{name}"
+	}
+	if status, ok := a.overrides[r.Method+" /"+strings.Join(parts, "/")]; ok {
+		w.WriteHeader(status)
+		return
+	}
+	if username, password, ok := r.BasicAuth(); !ok || username != a.username || password != a.password {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if route == "GET /resources/plans" {
+		json.NewEncoder(w).Encode([]map[string]string{{"name": "small", "description": "1GB"}, {"name": "big", "description": "100GB"}})
+		return
+	}
+	if route == "POST /resources" {
+		a.instances[r.FormValue("name")] = map[string]bool{}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/resources/")
+	if i := strings.Index(name, "/"); i >= 0 {
+		name = name[:i]
+	}
+	binds, ok := a.instances[name]
+	if !ok {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/status"):
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/bind-app"):
+		binds[r.FormValue("app-host")] = true
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a.envs)
+	case r.Method == "DELETE" && strings.HasSuffix(r.URL.Path, "/bind-app"):
+		delete(binds, r.FormValue("app-host"))
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/bind"):
+		binds[r.FormValue("unit-host")] = true
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "DELETE" && strings.HasSuffix(r.URL.Path, "/bind"):
+		delete(binds, r.FormValue("unit-host"))
+	case r.Method == "DELETE" && r.URL.Path == "/resources/"+name:
+		delete(a.instances, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *S) TestNewServiceAPI(c *check.C) {
+	api := newServiceAPI("mysqlapi.com/", &manifest{ID: "mysqlapi", Password: "s3cr3t"})
+	c.Assert(api.endpoint, check.Equals, "http://mysqlapi.com")
+	c.Assert(api.username, check.Equals, "mysqlapi")
+	c.Assert(api.password, check.Equals, "s3cr3t")
+	api = newServiceAPI("https://mysqlapi.com", &manifest{ID: "mysqlapi", Username: "mysql"})
+	c.Assert(api.endpoint, check.Equals, "https://mysqlapi.com")
+	c.Assert(api.username, check.Equals, "mysql")
+}
+
+func (s *S) TestServiceAPILifecycle(c *check.C) {
+	fake := newFakeServiceAPI()
+	defer fake.stop()
+	api := newServiceAPI(fake.server.URL, fake.manifest())
+	resp, err := api.createInstance("mydb", "small", "admin")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.status, check.Equals, http.StatusCreated)
+	c.Assert(fake.instances["mydb"], check.NotNil)
+	resp, err = api.bindApp("mydb", "myapp", "myapp.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.status, check.Equals, http.StatusCreated)
+	var envs map[string]string
+	c.Assert(json.Unmarshal(resp.body, &envs), check.IsNil)
+	c.Assert(envs, check.DeepEquals, fake.envs)
+	resp, err = api.unbindApp("mydb", "myapp", "myapp.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.status, check.Equals, http.StatusOK)
+	c.Assert(fake.instances["mydb"], check.HasLen, 0)
+	resp, err = api.removeInstance("mydb")
+	c.Assert(err, check.IsNil)
+	c.Assert(resp.status, check.Equals, http.StatusOK)
+	c.Assert(fake.instances, check.HasLen, 0)
+	c.Assert(fake.requests, check.DeepEquals, []string{
+		"POST /resources",
+		"POST /resources/mydb/bind-app",
+		"DELETE /resources/mydb/bind-app",
+		"DELETE /resources/mydb",
+	})
+}
+
+func (s *S) TestServiceAPIConnectionError(c *check.C) {
+	fake := newFakeServiceAPI()
+	fake.stop()
+	api := newServiceAPI(fake.server.URL, fake.manifest())
+	_, err := api.plans()
+	c.Assert(err, check.NotNil)
+}
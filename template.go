@@ -0,0 +1,337 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/tsuru/gnuflag"
+	"github.com/tsuru/tsuru/cmd"
+	"github.com/tsuru/tsuru/validation"
+	"gopkg.in/yaml.v1"
+)
+
+var (
+	endpointNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+	teamNameRegexp     = regexp.MustCompile(`^[a-zA-Z][-@_.+\w]*$`)
+)
+
+type serviceTemplate struct {
+	fs             *gnuflag.FlagSet
+	output         string
+	force          bool
+	nonInteractive bool
+	id             string
+	description    string
+	username       string
+	password       string
+	doc            string
+	endpoints      cmd.StringSliceFlag
+	teams          cmd.StringSliceFlag
+}
+
+func (c *serviceTemplate) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "template",
+		Usage: "template [-o/--output <manifest-file.yaml>] [-f/--force] [-n/--non-interactive] [--id <id>] [--endpoint <name>=<url>]... [--team <team>]... [--username <username>] [--password <password>] [--description <description>] [--doc <doc-file>]",
+		Desc: `Generates a manifest file for a new service.
+
+The id of the service, its endpoints, teams and credentials are asked
+interactively, and each answer is validated before moving on. Answers may also
+be given with flags, and are not asked again. In non-interactive mode, nothing
+is asked: the id and the production endpoint must be given with flags.
+
+The password defaults to a reference to an environment variable, like
+${MYSQLAPI_PASSWORD}, so it's not stored in the manifest.
+
+The manifest is saved to "manifest.yaml", unless another file is given. Existing
+files are not overwritten, unless the --force flag is given.`,
+		MinArgs: 0,
+		MaxArgs: 0,
+	}
+}
+
+func (c *serviceTemplate) Run(context *cmd.Context, client *cmd.Client) error {
+	output := c.output
+	if output == "" {
+		output = "manifest.yaml"
+	}
+	if _, err := os.Stat(output); err == nil && !c.force {
+		return fmt.Errorf("the file %q already exists, use --force to overwrite it", output)
+	}
+	m, err := c.flagsManifest()
+	if err != nil {
+		return err
+	}
+	if c.nonInteractive {
+		if m.ID == "" {
+			return errors.New("the service id is required, use --id to define it")
+		}
+		if m.Endpoints["production"] == "" {
+			return errors.New("the production endpoint is required, use --endpoint production=<url> to define it")
+		}
+	} else {
+		p := prompter{in: bufio.NewReader(context.Stdin), out: context.Stdout}
+		err = p.fill(m, c.username == "", c.password == "")
+		if err != nil {
+			return err
+		}
+	}
+	if m.Username == "" {
+		m.Username = m.ID
+	}
+	if m.Password == "" {
+		m.Password = passwordReference(m.ID)
+	}
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(output, data, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Manifest saved to %s.\n", output)
+	return nil
+}
+
+// flagsManifest builds a manifest from the values given in the flags,
+// validating them.
+func (c *serviceTemplate) flagsManifest() (*manifest, error) {
+	m := manifest{
+		Version:     manifestVersion,
+		ID:          c.id,
+		Description: c.description,
+		Username:    c.username,
+		Password:    c.password,
+		Doc:         c.doc,
+		Endpoints:   map[string]string{},
+	}
+	checks := []struct {
+		value string
+		check func(string) error
+	}{
+		{c.id, validateServiceID},
+		{c.username, validateUsername},
+		{c.password, validatePassword},
+	}
+	for _, ch := range checks {
+		if ch.value == "" {
+			continue
+		}
+		if err := ch.check(ch.value); err != nil {
+			return nil, err
+		}
+	}
+	for _, value := range c.endpoints {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid endpoint %q, must be in the form <name>=<url>", value)
+		}
+		if err := validateEndpoint(parts[0], parts[1]); err != nil {
+			return nil, err
+		}
+		m.Endpoints[parts[0]] = parts[1]
+	}
+	for _, team := range c.teams {
+		if err := validateTeam(team); err != nil {
+			return nil, err
+		}
+		m.Teams = append(m.Teams, team)
+	}
+	return &m, nil
+}
+
+func (c *serviceTemplate) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("template", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.output, "output", "", "File to save the manifest to (default: manifest.yaml)")
+		c.fs.StringVar(&c.output, "o", "", "File to save the manifest to (default: manifest.yaml)")
+		c.fs.BoolVar(&c.force, "force", false, "Overwrite the manifest file if it exists")
+		c.fs.BoolVar(&c.force, "f", false, "Overwrite the manifest file if it exists")
+		c.fs.BoolVar(&c.nonInteractive, "non-interactive", false, "Don't ask anything, use only the values in the flags")
+		c.fs.BoolVar(&c.nonInteractive, "n", false, "Don't ask anything, use only the values in the flags")
+		c.fs.StringVar(&c.id, "id", "", "Id of the service")
+		c.fs.StringVar(&c.description, "description", "", "Description of the service")
+		c.fs.StringVar(&c.username, "username", "", "Username used by tsuru to authenticate in the service API (default: the id)")
+		c.fs.StringVar(&c.password, "password", "", "Password used by tsuru to authenticate in the service API (default: a reference to an environment variable)")
+		c.fs.StringVar(&c.doc, "doc", "", "Documentation file of the service")
+		c.fs.Var(&c.endpoints, "endpoint", "Endpoint of the service API, in the form <name>=<url> (may be repeated)")
+		c.fs.Var(&c.teams, "team", "Team that owns the service (may be repeated)")
+	}
+	return c.fs
+}
+
+// prompter asks questions to the user, validating the answers.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// fill asks for the fields of the manifest that are not defined yet.
+func (p *prompter) fill(m *manifest, askUsername, askPassword bool) error {
+	var err error
+	askEndpoints := len(m.Endpoints) == 0
+	if m.ID == "" {
+		if m.ID, err = p.ask("Service id", "", validateServiceID); err != nil {
+			return err
+		}
+	}
+	if m.Description == "" {
+		if m.Description, err = p.ask("Description (optional)", "", nil); err != nil {
+			return err
+		}
+	}
+	if m.Endpoints["production"] == "" {
+		validate := func(value string) error {
+			return validateEndpoint("production", value)
+		}
+		if m.Endpoints["production"], err = p.ask("Production endpoint", "", validate); err != nil {
+			return err
+		}
+	}
+	for askEndpoints {
+		value, err := p.ask("Other endpoint, in the form <name>=<url> (empty to finish)", "", func(value string) error {
+			if value == "" {
+				return nil
+			}
+			parts := strings.SplitN(value, "=", 2)
+			if len(parts) != 2 {
+				return errors.New("the endpoint must be in the form <name>=<url>")
+			}
+			return validateEndpoint(parts[0], parts[1])
+		})
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			break
+		}
+		parts := strings.SplitN(value, "=", 2)
+		m.Endpoints[parts[0]] = parts[1]
+	}
+	if len(m.Teams) == 0 {
+		for {
+			team, err := p.ask("Team that owns the service (empty to finish)", "", func(value string) error {
+				if value == "" {
+					return nil
+				}
+				return validateTeam(value)
+			})
+			if err != nil {
+				return err
+			}
+			if team == "" {
+				break
+			}
+			m.Teams = append(m.Teams, team)
+		}
+	}
+	if askUsername {
+		if m.Username, err = p.ask("Username", m.ID, validateUsername); err != nil {
+			return err
+		}
+	}
+	if askPassword {
+		if m.Password, err = p.ask("Password", passwordReference(m.ID), validatePassword); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ask asks a question until the answer is valid. Empty answers are replaced by
+// the default value.
+func (p *prompter) ask(question, defaultValue string, validate func(string) error) (string, error) {
+	for {
+		if defaultValue != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, defaultValue)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+		line, err := p.in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err == io.EOF {
+				return "", errors.New("unexpected end of input")
+			}
+			return "", err
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = defaultValue
+		}
+		if validate == nil {
+			return answer, nil
+		}
+		if err := validate(answer); err != nil {
+			fmt.Fprintf(p.out, "Invalid value: %s.\n", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+// passwordReference returns the reference to the environment variable that
+// holds the password of the service, like "${MYSQLAPI_PASSWORD}".
+func passwordReference(id string) string {
+	name := strings.ToUpper(strings.Replace(id, "-", "_", -1))
+	return "${" + name + "_PASSWORD}"
+}
+
+func validateServiceID(id string) error {
+	if !validation.ValidateLength(id, 1, 40) {
+		return errors.New("the id must have between 1 and 40 characters")
+	}
+	if !serviceNameRegexp.MatchString(id) {
+		return errors.New("the id must start with a letter and contain only lower case letters, numbers and dashes")
+	}
+	return nil
+}
+
+func validateEndpoint(name, value string) error {
+	if !endpointNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid endpoint name %q, it must start with a letter and contain only lower case letters, numbers and dashes", name)
+	}
+	if isReference(value) {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL %q for the endpoint %q, it must be an http or https URL", value, name)
+	}
+	return nil
+}
+
+func validateTeam(team string) error {
+	if !validation.ValidateLength(team, 1, 63) || !teamNameRegexp.MatchString(team) {
+		return fmt.Errorf("invalid team name %q", team)
+	}
+	return nil
+}
+
+func validateUsername(username string) error {
+	if !validation.ValidateLength(username, 1, 64) {
+		return errors.New("the username must have between 1 and 64 characters")
+	}
+	return nil
+}
+
+func validatePassword(password string) error {
+	if isReference(password) {
+		return nil
+	}
+	if !validation.ValidateLength(password, 8, 0) {
+		return errors.New("the password must have at least 8 characters, or be a reference like ${PASSWORD}")
+	}
+	return nil
+}
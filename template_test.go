@@ -0,0 +1,161 @@
+// Copyright 2017 crane authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestServiceTemplateInteractive(c *check.C) {
+	output := filepath.Join(c.MkDir(), "manifest.yaml")
+	input := strings.Join([]string{
+		"MySQL",
+		"mysqlapi",
+		"MySQL databases",
+		"mysqlapi.com",
+		"https://mysqlapi.com",
+		"staging",
+		"staging=https://staging.mysqlapi.com",
+		"",
+		"admin",
+		"",
+		"",
+		"short",
+		"",
+	}, "\n") + "\n"
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdin: strings.NewReader(input), Stdout: &stdout}
+	command := serviceTemplate{}
+	command.Flags().Parse(true, []string{"-o", output})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s)Service id: Invalid value: the id must start with a letter.*`+
+		`Production endpoint: Invalid value: invalid URL "mysqlapi.com".*`+
+		`Username \[mysqlapi\]: Password \[\$\{MYSQLAPI_PASSWORD\}\]: Invalid value: the password must have at least 8 characters.*`+
+		`Manifest saved to .*manifest.yaml.\n$`)
+	m, err := loadManifest(output, "", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Password, check.Equals, "${MYSQLAPI_PASSWORD}")
+	c.Assert(m.ID, check.Equals, "mysqlapi")
+	c.Assert(m.Description, check.Equals, "MySQL databases")
+	c.Assert(m.Username, check.Equals, "mysqlapi")
+	c.Assert(m.Teams, check.DeepEquals, []string{"admin"})
+	c.Assert(m.Endpoints, check.DeepEquals, map[string]string{
+		"production": "https://mysqlapi.com",
+		"staging":    "https://staging.mysqlapi.com",
+	})
+}
+
+func (s *S) TestServiceTemplateInteractiveSkipsFlags(c *check.C) {
+	output := filepath.Join(c.MkDir(), "manifest.yaml")
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdin: strings.NewReader("\n\n"), Stdout: &stdout}
+	command := serviceTemplate{}
+	command.Flags().Parse(true, []string{
+		"-o", output, "--id", "mysqlapi", "--endpoint", "production=https://mysqlapi.com",
+		"--username", "mysql", "--password", "s3cr3t-password",
+	})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Description (optional): Team that owns the service (empty to finish): Manifest saved to "+output+".\n")
+}
+
+func (s *S) TestServiceTemplateUnexpectedEndOfInput(c *check.C) {
+	output := filepath.Join(c.MkDir(), "manifest.yaml")
+	context := cmd.Context{Stdin: strings.NewReader("mysqlapi\n"), Stdout: ioutil.Discard}
+	command := serviceTemplate{}
+	command.Flags().Parse(true, []string{"-o", output})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, "unexpected end of input")
+}
+
+func (s *S) TestServiceTemplateNonInteractive(c *check.C) {
+	output := filepath.Join(c.MkDir(), "manifest.yaml")
+	var stdout bytes.Buffer
+	context := cmd.Context{Stdout: &stdout}
+	command := serviceTemplate{}
+	command.Flags().Parse(true, []string{
+		"-n", "-o", output, "--id", "mysqlapi",
+		"--endpoint", "production=https://mysqlapi.com", "--endpoint", "staging=https://staging.mysqlapi.com",
+		"--team", "admin", "--team", "ops", "--description", "MySQL databases", "--doc", "doc.md",
+	})
+	err := command.Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Manifest saved to "+output+".\n")
+	data, err := ioutil.ReadFile(output)
+	c.Assert(err, check.IsNil)
+	expected := `version: 2
+id: mysqlapi
+description: MySQL databases
+username: mysqlapi
+password: ${MYSQLAPI_PASSWORD}
+teams:
+- admin
+- ops
+doc: doc.md
+endpoints:
+  production: https://mysqlapi.com
+  staging: https://staging.mysqlapi.com
+`
+	c.Assert(string(data), check.Equals, expected)
+}
+
+func (s *S) TestServiceTemplateNonInteractiveMissingFields(c *check.C) {
+	output := filepath.Join(c.MkDir(), "manifest.yaml")
+	command := serviceTemplate{}
+	command.Flags().Parse(true, []string{"-n", "-o", output})
+	err := command.Run(&cmd.Context{}, nil)
+	c.Assert(err, check.ErrorMatches, "the service id is required, use --id to define it")
+	command = serviceTemplate{}
+	command.Flags().Parse(true, []string{"-n", "-o", output, "--id", "mysqlapi"})
+	err = command.Run(&cmd.Context{}, nil)
+	c.Assert(err, check.ErrorMatches, `the production endpoint is required, use --endpoint production=<url> to define it`)
+}
+
+func (s *S) TestServiceTemplateInvalidFlags(c *check.C) {
+	output := filepath.Join(c.MkDir(), "manifest.yaml")
+	var tests = []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--id", "My Service"}, "the id must start with a letter.*"},
+		{[]string{"--endpoint", "production"}, `invalid endpoint "production", must be in the form <name>=<url>`},
+		{[]string{"--endpoint", "production=ftp://mysqlapi.com"}, `invalid URL "ftp://mysqlapi.com" for the endpoint "production".*`},
+		{[]string{"--team", "-admin"}, `invalid team name "-admin"`},
+		{[]string{"--password", "short"}, "the password must have at least 8 characters.*"},
+	}
+	for _, t := range tests {
+		command := serviceTemplate{}
+		command.Flags().Parse(true, append([]string{"-n", "-o", output}, t.args...))
+		err := command.Run(&cmd.Context{}, nil)
+		c.Check(err, check.ErrorMatches, t.err)
+	}
+}
+
+func (s *S) TestServiceTemplateDoesNotOverwrite(c *check.C) {
+	output := filepath.Join(c.MkDir(), "manifest.yaml")
+	err := ioutil.WriteFile(output, []byte("id: mysqlapi\n"), 0644)
+	c.Assert(err, check.IsNil)
+	args := []string{"-n", "-o", output, "--id", "mysqlapi", "--endpoint", "production=https://mysqlapi.com"}
+	command := serviceTemplate{}
+	command.Flags().Parse(true, args)
+	err = command.Run(&cmd.Context{Stdout: ioutil.Discard}, nil)
+	c.Assert(err, check.ErrorMatches, `the file ".*manifest.yaml" already exists, use --force to overwrite it`)
+	command = serviceTemplate{}
+	command.Flags().Parse(true, append(args, "--force"))
+	err = command.Run(&cmd.Context{Stdout: ioutil.Discard}, nil)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestPasswordReference(c *check.C) {
+	c.Assert(passwordReference("mysqlapi"), check.Equals, "${MYSQLAPI_PASSWORD}")
+	c.Assert(passwordReference("my-sql"), check.Equals, "${MY_SQL_PASSWORD}")
+}